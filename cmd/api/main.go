@@ -23,16 +23,20 @@ import (
 )
 
 type Config struct {
-	Host             string           `yaml:"host"`
-	Port             int              `yaml:"port"`
-	DBPath           string           `yaml:"db_path"`
-	TelegramBotToken string           `yaml:"telegram_bot_token"`
-	GeminiAPIKey     string           `yaml:"gemini_api_key"`
-	GrokAPIKey       string           `yaml:"grok_api_key"`
-	ExternalURL      string           `yaml:"external_url"`
-	JWTSecretKey     string           `yaml:"jwt_secret_key"`
-	S3Storage        storage.S3Config `yaml:"s3_storage"`
-	TelegramWebApp   string           `yaml:"telegram_webapp_url"`
+	Host             string                  `yaml:"host"`
+	Port             int                     `yaml:"port"`
+	DBPath           string                  `yaml:"db_path"`
+	TelegramBotToken string                  `yaml:"telegram_bot_token"`
+	GeminiAPIKey     string                  `yaml:"gemini_api_key"`
+	GrokAPIKey       string                  `yaml:"grok_api_key"`
+	ExternalURL      string                  `yaml:"external_url"`
+	JWTSecretKey     string                  `yaml:"jwt_secret_key"`
+	S3Storage        storage.S3Config        `yaml:"s3_storage"`
+	TelegramWebApp   string                  `yaml:"telegram_webapp_url"`
+	AI               ai.Config               `yaml:"ai"`
+	TaskGenerator    job.TaskGeneratorConfig `yaml:"task_generator"`
+	AdminTelegramIDs []int64                 `yaml:"admin_telegram_ids"`
+	WebhookSecret    string                  `yaml:"telegram_webhook_secret"`
 }
 
 func ReadConfig(filePath string) (*Config, error) {
@@ -100,23 +104,48 @@ func main() {
 		storageProvider = nil
 	}
 
-	aiClient, err := ai.NewGeminiClient(cfg.GeminiAPIKey)
+	geminiClient, err := ai.NewGeminiClient(cfg.GeminiAPIKey)
 	if err != nil {
 		log.Fatalf("Failed to create OpenAI client: %v", err)
 	}
 
-	h := handler.New(
-		bot,
-		dbStorage,
-		cfg.JWTSecretKey,
-		cfg.TelegramBotToken,
-		cfg.TelegramWebApp,
-		storageProvider,
-		aiClient,
-	)
+	// every AI call from handlers, the bot and background jobs shares one concurrency limit
+	aiClient := ai.NewLimitedClient(geminiClient, cfg.AI.MaxConcurrency)
+
+	var moderator ai.Moderator
+	if !cfg.AI.DisableSafetyFilter {
+		moderator = ai.NewKeywordModerator(nil)
+	}
+
+	// Start task generation job
+	taskGenerator := job.NewTaskGenerator(dbStorage, aiClient, storageProvider, moderator, cfg.TaskGenerator)
+	// go taskGenerator.Start()
+	log.Println("Task generation job started")
+
+	h := handler.New(handler.Config{
+		Bot:                  bot,
+		DB:                   dbStorage,
+		JWTSecret:            cfg.JWTSecretKey,
+		BotToken:             cfg.TelegramBotToken,
+		WebAppURL:            cfg.TelegramWebApp,
+		StorageProvider:      storageProvider,
+		AIClient:             aiClient,
+		Moderator:            moderator,
+		AITimeout:            cfg.AI.RequestTimeout,
+		TaskGenerator:        taskGenerator,
+		MaxGenerationRetries: cfg.AI.MaxGenerationRetries,
+		MaxBotGenerations:    cfg.AI.MaxBotGenerations,
+		BotAutoRetries:       cfg.AI.BotAutoRetries,
+		BotRetryDelay:        cfg.AI.BotRetryDelay,
+		LogGenerations:       cfg.AI.LogGenerations,
+		AdminTelegramIDs:     cfg.AdminTelegramIDs,
+		WebhookSecret:        cfg.WebhookSecret,
+	})
 
 	log.Printf("Authorized on account %d", bot.ID())
 
+	h.ReportInterruptedImports()
+
 	e := echo.New()
 
 	logr := slog.New(slog.NewTextHandler(os.Stdout, nil))
@@ -125,21 +154,21 @@ func main() {
 
 	e.Validator = &CustomValidator{validator: validator.New()}
 
+	if cfg.WebhookSecret == "" {
+		log.Println("Warning: telegram_webhook_secret is not set, webhook updates are not verified")
+	}
+
 	webhookURL := fmt.Sprintf("%s/webhook", cfg.ExternalURL)
 	if ok, err := bot.SetWebhook(context.Background(), &telegram.SetWebhookParams{
 		DropPendingUpdates: true,
 		URL:                webhookURL,
+		SecretToken:        cfg.WebhookSecret,
 	}); err != nil {
 		log.Fatalf("Failed to set webhook: %v", err)
 	} else if !ok {
 		log.Fatalf("Failed to set webhook: %v", err)
 	}
 
-	// Start task generation job
-	taskGenerator := job.NewTaskGenerator(dbStorage, aiClient, storageProvider)
-	// go taskGenerator.Start()
-	log.Println("Task generation job started")
-
 	h.RegisterRoutes(e)
 
 	// Set up graceful shutdown
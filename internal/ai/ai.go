@@ -4,14 +4,60 @@ import (
 	"atamagaii/internal/contract"
 	"atamagaii/internal/db"
 	"context"
+	"errors"
+	"time"
 )
 
+var (
+	// ErrQuotaExceeded means the AI provider rejected the request because of rate limits or exhausted quota
+	ErrQuotaExceeded = errors.New("AI provider quota exceeded")
+	// ErrInvalidResponse means the model output could not be parsed into the expected structure
+	ErrInvalidResponse = errors.New("AI response could not be parsed")
+	// ErrEmptyResponse means the model returned no text, e.g. under load or because the provider's safety filter blocked it
+	ErrEmptyResponse = errors.New("AI returned an empty response")
+	// ErrUnsupportedLanguage means content can't be generated for the requested language
+	ErrUnsupportedLanguage = errors.New("language is not supported for generation")
+)
+
+type Config struct {
+	// DisableSafetyFilter turns off moderation of generated example sentences
+	DisableSafetyFilter bool `yaml:"disable_safety_filter"`
+	// RequestTimeout bounds how long an API request may wait on the AI provider, e.g. "45s"
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	// MaxGenerationRetries is how many times a user may retry a failed card generation from Telegram
+	MaxGenerationRetries int `yaml:"max_generation_retries"`
+	// MaxConcurrency bounds how many AI requests may run at once across the process, 0 means DefaultMaxConcurrency
+	MaxConcurrency int `yaml:"max_concurrency"`
+	// MaxBotGenerations bounds how many card generations started from Telegram messages run at once, 0 means the handler default
+	MaxBotGenerations int `yaml:"max_bot_generations"`
+	// BotAutoRetries is how many times a failed generation from Telegram is retried on its own, 0 means the handler default
+	// and a negative value turns automatic retries off
+	BotAutoRetries int `yaml:"bot_auto_retries"`
+	// BotRetryDelay is the wait before each automatic retry, e.g. "5s", 0 means the handler default
+	BotRetryDelay time.Duration `yaml:"bot_retry_delay"`
+	// LogGenerations stores the prompt and raw response of every card generation for admins to inspect
+	LogGenerations bool `yaml:"log_generations"`
+}
+
+// CardGenerationOptions tweaks how card content is generated
+type CardGenerationOptions struct {
+	// Strict asks the model to keep examples neutral; used when a previous attempt was flagged
+	Strict bool
+	// MeaningLanguages limits meanings and example translations to these languages (en, ru); empty means both
+	MeaningLanguages []string
+	// KnownWords are terms the learner already studied, the example should prefer them over unfamiliar vocabulary
+	KnownWords []string
+	// ExampleCount is how many example sentences to write, more than one fills CardFields.Examples
+	ExampleCount int
+}
+
 type AIClient interface {
-	GenerateCardContent(ctx context.Context, term string, language string) (*contract.CardFields, error)
+	GenerateCardContent(ctx context.Context, term string, language string, opts CardGenerationOptions) (*contract.CardFields, error)
 	GenerateTask(ctx context.Context, language, templateName string, taskType db.TaskType) (*string, error)
 	GenerateAudio(ctx context.Context, text string, language string) (string, error)
 	CheckSentenceTranslation(ctx context.Context, sentenceRu, correctAnswer, userAnswer string, languageCode string) (*TranslationCheckResult, error)
 	ParseCSVFields(ctx context.Context, line string) (CSVToJSONFields, error)
 	CheckQuestionAnswer(ctx context.Context, question, answer, languageCode string) (*QuestionCheckResult, error)
 	CheckStoryQuestionAnswer(ctx context.Context, story, question, userAnswer string, languageCode string) (*StoryQuestionCheckResult, error)
+	GenerateTranscription(ctx context.Context, term, example, transcriptionType string) (*TranscriptionResult, error)
 }
@@ -8,9 +8,15 @@ import (
 	"cloud.google.com/go/texttospeech/apiv1/texttospeechpb"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"google.golang.org/genai"
+	"log"
+	"math"
+	"net/http"
 	"os"
+	"slices"
+	"strings"
 )
 
 const (
@@ -44,13 +50,104 @@ func NewGeminiClient(apiKey string) (*GeminiClient, error) {
 	}, nil
 }
 
+// jsonOnlyReminder is appended to the prompt when the first response could not be parsed
+const jsonOnlyReminder = "\n\nReturn only the JSON object, without markdown code fences or any explanation."
+
+type generateFunc func(ctx context.Context, prompt string) (string, error)
+
 func parseResponse[T any](text string) (T, error) {
 	var result T
+	if strings.TrimSpace(text) == "" {
+		return result, ErrEmptyResponse
+	}
+
 	err := json.Unmarshal([]byte(text), &result)
+	if err == nil {
+		return result, nil
+	}
+
+	// the model occasionally wraps the object in a code fence or adds prose around it
+	if cleaned := extractJSON(text); cleaned != text {
+		var repaired T
+		if json.Unmarshal([]byte(cleaned), &repaired) == nil {
+			return repaired, nil
+		}
+	}
+
+	return result, fmt.Errorf("%w: %w", ErrInvalidResponse, err)
+}
+
+// extractJSON isolates the first JSON object in text, skipping anything before
+// its opening brace and after the matching closing brace
+func extractJSON(text string) string {
+	start := strings.IndexByte(text, '{')
+	if start < 0 {
+		return strings.TrimSpace(text)
+	}
+
+	depth := 0
+	inString, escaped := false, false
+	for i := start; i < len(text); i++ {
+		ch := text[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+			case ch == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch ch {
+		case '"':
+			inString = true
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return text[start : i+1]
+			}
+		}
+	}
+
+	return strings.TrimSpace(text[start:])
+}
+
+// generateJSON runs the prompt and parses the response into T, retrying once
+// with an explicit JSON-only reminder when the first response cannot be parsed
+func generateJSON[T any](ctx context.Context, generate generateFunc, prompt string) (T, error) {
+	var result T
+
+	text, err := generate(ctx, prompt)
+	if err != nil {
+		return result, err
+	}
+	RecordGeneration(ctx, prompt, text)
+
+	result, err = parseResponse[T](text)
+	if err == nil {
+		return result, nil
+	}
+
+	log.Printf("AI response is not valid JSON, retrying: %v", err)
+
+	text, err = generate(ctx, prompt+jsonOnlyReminder)
 	if err != nil {
-		return result, fmt.Errorf("error parsing response: %w", err)
+		return result, err
+	}
+	RecordGeneration(ctx, prompt+jsonOnlyReminder, text)
+
+	return parseResponse[T](text)
+}
+
+func (c *GeminiClient) generator(temperature float32, schema *genai.Schema) generateFunc {
+	return func(ctx context.Context, prompt string) (string, error) {
+		return c.generateContent(ctx, prompt, temperature, schema)
 	}
-	return result, nil
 }
 
 func (c *GeminiClient) generateContent(
@@ -72,13 +169,82 @@ func (c *GeminiClient) generateContent(
 
 	result, err := c.client.Models.GenerateContent(ctx, c.model, genai.Text(prompt), config)
 	if err != nil {
+		var apiErr genai.APIError
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusTooManyRequests {
+			return "", fmt.Errorf("%w: %w", ErrQuotaExceeded, err)
+		}
 		return "", fmt.Errorf("failed to generate content: %w", err)
 	}
 
-	return result.Text(), nil
+	return responseText(result)
+}
+
+// responseText returns the text of the first candidate, or ErrEmptyResponse with the reason
+// when the prompt was blocked or the model stopped without producing any text
+func responseText(result *genai.GenerateContentResponse) (string, error) {
+	if result.PromptFeedback != nil && result.PromptFeedback.BlockReason != "" {
+		return "", fmt.Errorf("%w: prompt blocked (%s)", ErrEmptyResponse, result.PromptFeedback.BlockReason)
+	}
+
+	if len(result.Candidates) == 0 {
+		return "", fmt.Errorf("%w: no candidates", ErrEmptyResponse)
+	}
+
+	text := result.Text()
+	if strings.TrimSpace(text) == "" {
+		if reason := result.Candidates[0].FinishReason; reason != "" && reason != genai.FinishReasonStop {
+			return "", fmt.Errorf("%w: finish reason %s", ErrEmptyResponse, reason)
+		}
+		return "", ErrEmptyResponse
+	}
+
+	return text, nil
+}
+
+func (c *GeminiClient) GenerateCardContent(ctx context.Context, term string, language string, opts CardGenerationOptions) (*contract.CardFields, error) {
+	prompt, responseSchema := cardContentRequest(term, opts)
+	vocabCard, err := generateJSON[contract.CardFields](ctx, c.generator(1.4, responseSchema), prompt)
+	if err != nil {
+		return nil, fmt.Errorf("error generating card content: %w", err)
+	}
+
+	// ensure no furigana in term field
+	if vocabCard.Term != "" {
+		vocabCard.Term = utils.RemoveFurigana(vocabCard.Term)
+	}
+
+	// ensure no furigana in examples
+	for i := range vocabCard.Examples {
+		vocabCard.Examples[i].Native = utils.RemoveFurigana(vocabCard.Examples[i].Native)
+	}
+	if len(vocabCard.Examples) > 0 {
+		// the single example fields keep showing the first example to clients that don't know the list
+		first := vocabCard.Examples[0]
+		vocabCard.ExampleNative = first.Native
+		vocabCard.ExampleWithTranscription = first.WithTranscription
+		vocabCard.ExampleEn = first.En
+		vocabCard.ExampleRu = first.Ru
+	}
+	if vocabCard.ExampleNative != "" {
+		vocabCard.ExampleNative = utils.RemoveFurigana(vocabCard.ExampleNative)
+	}
+
+	return &vocabCard, nil
+}
+
+func strictExampleRules(strict bool) string {
+	if !strict {
+		return ""
+	}
+	return `- Пример должен быть нейтральным и уместным для учебника: без ругательств, грубости, насилия, сексуального контекста и оскорблений.
+- Если слово само по себе грубое, покажи его употребление в максимально нейтральной ситуации.
+`
 }
 
-func (c *GeminiClient) GenerateCardContent(ctx context.Context, term string, language string) (*contract.CardFields, error) {
+// cardContentRequest builds the prompt and response schema for a card, only asking for meanings
+// in the requested languages so no tokens are spent on the ones the learner doesn't read. When more
+// than one example is wanted, the examples are requested as a list instead of the single example fields.
+func cardContentRequest(term string, opts CardGenerationOptions) (string, *genai.Schema) {
 	responseSchema := &genai.Schema{
 		Type: genai.TypeObject,
 		Properties: map[string]*genai.Schema{
@@ -91,26 +257,26 @@ func (c *GeminiClient) GenerateCardContent(ctx context.Context, term string, lan
 			"term_with_transcription": {
 				Type: genai.TypeString,
 			},
-			"meaning_en": {
-				Type: genai.TypeString,
-			},
-			"meaning_ru": {
-				Type: genai.TypeString,
-			},
 			"example_native": {
 				Type: genai.TypeString,
 			},
-			"example_en": {
-				Type: genai.TypeString,
-			},
-			"example_ru": {
-				Type: genai.TypeString,
-			},
 			"example_with_transcription": {
 				Type: genai.TypeString,
 			},
 		},
-		Required: []string{"term", "meaning_en", "meaning_ru", "example_native", "example_en", "example_ru", "example_with_transcription"},
+		Required: []string{"term", "example_native", "example_with_transcription"},
+	}
+
+	languages := meaningLanguages(opts.MeaningLanguages)
+	for _, lang := range languages {
+		for _, field := range []string{"meaning_" + lang, "example_" + lang} {
+			responseSchema.Properties[field] = &genai.Schema{Type: genai.TypeString}
+			responseSchema.Required = append(responseSchema.Required, field)
+		}
+	}
+
+	if opts.ExampleCount > 1 {
+		useExampleList(responseSchema, languages, opts.ExampleCount)
 	}
 
 	prompt := fmt.Sprintf(`
@@ -130,31 +296,91 @@ func (c *GeminiClient) GenerateCardContent(ctx context.Context, term string, lan
 Требования к примеру:
 - Пример должен быть простым, понятными и близкими к повседневным ситуациям, чтобы ясно показывать значение и типичное употребление слова.
 - Предложение должно быть коротким (10-12 слов).
----
+%s%s%s%s---
 Слово: %s
-`, term)
-	responseText, err := c.generateContent(ctx, prompt, 1.4, responseSchema)
-	if err != nil {
-		return nil, err
+`, strictExampleRules(opts.Strict), knownWordsRules(opts.KnownWords), meaningLanguageRules(languages), exampleCountRules(opts.ExampleCount, languages), term)
+
+	return prompt, responseSchema
+}
+
+// useExampleList replaces the single example fields of a card schema with an examples list of count entries
+func useExampleList(schema *genai.Schema, languages []string, count int) {
+	item := &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"native":             {Type: genai.TypeString},
+			"with_transcription": {Type: genai.TypeString},
+		},
+		Required: []string{"native", "with_transcription"},
+	}
+	for _, lang := range languages {
+		item.Properties[lang] = &genai.Schema{Type: genai.TypeString}
+		item.Required = append(item.Required, lang)
 	}
 
-	var vocabCard contract.CardFields
-	vocabCard, err = parseResponse[contract.CardFields](responseText)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing card content: %w", err)
+	schema.Required = slices.DeleteFunc(schema.Required, func(field string) bool {
+		return strings.HasPrefix(field, "example_")
+	})
+	for field := range schema.Properties {
+		if strings.HasPrefix(field, "example_") {
+			delete(schema.Properties, field)
+		}
 	}
 
-	// ensure no furigana in term field
-	if vocabCard.Term != "" {
-		vocabCard.Term = utils.RemoveFurigana(vocabCard.Term)
+	schema.Properties["examples"] = &genai.Schema{
+		Type:     genai.TypeArray,
+		Items:    item,
+		MinItems: genai.Ptr(int64(count)),
+		MaxItems: genai.Ptr(int64(count)),
+	}
+	schema.Required = append(schema.Required, "examples")
+}
+
+func exampleCountRules(count int, languages []string) string {
+	if count <= 1 {
+		return ""
 	}
 
-	// ensure no furigana in examples
-	if vocabCard.ExampleNative != "" {
-		vocabCard.ExampleNative = utils.RemoveFurigana(vocabCard.ExampleNative)
+	return fmt.Sprintf("- Составь %d разных примера в списке examples: native — пример, with_transcription — пример с транскрипцией, "+
+		"%s — перевод примера. Примеры должны показывать разные ситуации употребления слова.\n", count, strings.Join(languages, " и "))
+}
+
+// meaningLanguages keeps the supported languages from requested, in a stable order; none means all of them
+func meaningLanguages(requested []string) []string {
+	if len(requested) == 0 {
+		return db.SupportedMeaningLanguages
 	}
 
-	return &vocabCard, nil
+	var languages []string
+	for _, lang := range db.SupportedMeaningLanguages {
+		if slices.Contains(requested, lang) {
+			languages = append(languages, lang)
+		}
+	}
+
+	if len(languages) == 0 {
+		return db.SupportedMeaningLanguages
+	}
+
+	return languages
+}
+
+func knownWordsRules(knownWords []string) string {
+	if len(knownWords) == 0 {
+		return ""
+	}
+
+	return "- Студент уже знает эти слова: " + strings.Join(knownWords, ", ") +
+		". Составь пример по возможности из них, избегая незнакомой и более сложной лексики.\n"
+}
+
+func meaningLanguageRules(languages []string) string {
+	if len(languages) != 1 {
+		return ""
+	}
+
+	fields := fmt.Sprintf("meaning_%[1]s и example_%[1]s", languages[0])
+	return "- Значение и перевод примера нужны только в полях " + fields + ", другие языки не заполняй.\n"
 }
 
 func (c *GeminiClient) GenerateTask(ctx context.Context, language, knownWords string, taskType db.TaskType) (*string, error) {
@@ -247,14 +473,25 @@ The word to use is %s
 		}
 	}
 
-	responseText, err := c.generateContent(ctx, prompt, 1.4, schema)
+	content, err := generateJSON[json.RawMessage](ctx, c.generator(1.4, schema), prompt)
 	if err != nil {
 		return nil, fmt.Errorf("error generating task content: %w", err)
 	}
 
+	responseText := string(content)
 	return &responseText, nil
 }
 
+// WithSpeakingRate wraps SSML text so it is read at rate times the normal speed, e.g. 0.8 for 20% slower.
+// Card audio is read at the normal rate, so a rate of 1 or less than 0 leaves the text as it is.
+func WithSpeakingRate(text string, rate float64) string {
+	if rate <= 0 || rate == 1 {
+		return text
+	}
+
+	return fmt.Sprintf(`<prosody rate="%d%%">%s</prosody>`, int(math.Round(rate*100)), text)
+}
+
 func (c *GeminiClient) GenerateAudio(ctx context.Context, text string, language string) (string, error) {
 	voice := getGoogleTTSVoice(language)
 
@@ -332,17 +569,11 @@ func (c *GeminiClient) CheckSentenceTranslation(ctx context.Context, sentenceRu,
 		Required: []string{"score"},
 	}
 
-	responseText, err := c.generateContent(ctx, prompt, 0.3, responseSchema)
+	result, err := generateJSON[TranslationCheckResult](ctx, c.generator(0.3, responseSchema), prompt)
 	if err != nil {
 		return nil, fmt.Errorf("error generating translation check: %w", err)
 	}
 
-	var result TranslationCheckResult
-	result, err = parseResponse[TranslationCheckResult](responseText)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing translation check response: %w", err)
-	}
-
 	return &result, nil
 }
 
@@ -370,17 +601,11 @@ func (c *GeminiClient) CheckQuestionAnswer(ctx context.Context, question, userAn
 		Required: []string{"score"},
 	}
 
-	responseText, err := c.generateContent(ctx, prompt, 0.3, responseSchema)
+	result, err := generateJSON[QuestionCheckResult](ctx, c.generator(0.3, responseSchema), prompt)
 	if err != nil {
 		return nil, fmt.Errorf("error generating translation check: %w", err)
 	}
 
-	var result QuestionCheckResult
-	result, err = parseResponse[QuestionCheckResult](responseText)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing translation check response: %w", err)
-	}
-
 	return &result, nil
 }
 
@@ -406,15 +631,54 @@ func (c *GeminiClient) CheckStoryQuestionAnswer(ctx context.Context, story, ques
 		},
 	}
 
-	responseText, err := c.generateContent(ctx, prompt, 0.3, responseSchema)
+	result, err := generateJSON[StoryQuestionCheckResult](ctx, c.generator(0.3, responseSchema), prompt)
 	if err != nil {
 		return nil, fmt.Errorf("error generating story question check: %w", err)
 	}
 
-	var result StoryQuestionCheckResult
-	result, err = parseResponse[StoryQuestionCheckResult](responseText)
+	return &result, nil
+}
+
+type TranscriptionResult struct {
+	TermWithTranscription    string `json:"term_with_transcription"`
+	ExampleWithTranscription string `json:"example_with_transcription"`
+}
+
+// transcriptionFormats describes for each supported transcription type how readings are embedded
+var transcriptionFormats = map[string]string{
+	"furigana": "Фуригану указывай только для иероглифов (漢字) в формате 漢字[かな], например: とても寂[さび]しいです。 Не добавляй чтение к хирагане, катакане и частицам.",
+	"pinyin":   "Пиньинь с тонами указывай после каждого слова из иероглифов в формате 汉字[hàn zì], например: 我[wǒ]喜欢[xǐ huān]猫[māo]。",
+}
+
+// GenerateTranscription adds reading aids to a term and its example sentence
+func (c *GeminiClient) GenerateTranscription(ctx context.Context, term, example, transcriptionType string) (*TranscriptionResult, error) {
+	format, ok := transcriptionFormats[transcriptionType]
+	if !ok {
+		return nil, fmt.Errorf("%w: transcription type %s", ErrUnsupportedLanguage, transcriptionType)
+	}
+
+	prompt := fmt.Sprintf(`Добавь чтение к слову и примеру, не меняя сам текст.
+%s
+Используй только квадратные скобки, без HTML и круглых скобок. Если пример пустой, верни пустую строку.
+
+Слово: %s
+Пример: %s`, format, term, example)
+	responseSchema := &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"term_with_transcription": {
+				Type: genai.TypeString,
+			},
+			"example_with_transcription": {
+				Type: genai.TypeString,
+			},
+		},
+		Required: []string{"term_with_transcription", "example_with_transcription"},
+	}
+
+	result, err := generateJSON[TranscriptionResult](ctx, c.generator(0, responseSchema), prompt)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing story question check response: %w", err)
+		return nil, fmt.Errorf("error generating transcription: %w", err)
 	}
 
 	return &result, nil
@@ -631,16 +895,10 @@ func (c *GeminiClient) ParseCSVFields(ctx context.Context, text string) (CSVToJS
 		},
 	}
 
-	responseText, err := c.generateContent(ctx, prompt, 0, responseSchema)
+	fields, err := generateJSON[CSVToJSONFields](ctx, c.generator(0, responseSchema), prompt)
 	if err != nil {
 		return CSVToJSONFields{}, fmt.Errorf("error generating gemini mapping: %w", err)
 	}
-	//
-	var fields CSVToJSONFields
-	fields, err = parseResponse[CSVToJSONFields](responseText)
-	if err != nil {
-		return CSVToJSONFields{}, fmt.Errorf("error parsing gemini mapping response: %w", err)
-	}
 
 	return fields, nil
 }
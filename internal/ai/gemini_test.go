@@ -0,0 +1,220 @@
+package ai
+
+import (
+	"atamagaii/internal/contract"
+	"context"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genai"
+	"strings"
+	"testing"
+)
+
+func TestParseResponse_RepairsWrappedJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{name: "plain", text: `{"score": 90, "feedback": "ok"}`},
+		{name: "code fence", text: "```json\n{\"score\": 90, \"feedback\": \"ok\"}\n```"},
+		{name: "trailing fence", text: "{\"score\": 90, \"feedback\": \"ok\"}\n```"},
+		{name: "prose prefix", text: "Here is the result:\n{\"score\": 90, \"feedback\": \"ok\"}"},
+		{name: "prose suffix", text: "{\"score\": 90, \"feedback\": \"ok\"}\nLet me know if you need anything else."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseResponse[TranslationCheckResult](tt.text)
+			require.NoError(t, err)
+			require.Equal(t, 90, result.Score)
+			require.NotNil(t, result.Feedback)
+			require.Equal(t, "ok", *result.Feedback)
+		})
+	}
+}
+
+func TestParseResponse_BracesInsideStrings(t *testing.T) {
+	text := "```json\n{\"term\": \"猫\", \"example_en\": \"A cat said \\\"}{\\\" once.\"}\n```"
+
+	fields, err := parseResponse[contract.CardFields](text)
+	require.NoError(t, err)
+	require.Equal(t, "猫", fields.Term)
+	require.Equal(t, `A cat said "}{" once.`, fields.ExampleEn)
+}
+
+func TestParseResponse_InvalidJSON(t *testing.T) {
+	_, err := parseResponse[TranslationCheckResult]("I could not produce a result.")
+	require.ErrorIs(t, err, ErrInvalidResponse)
+}
+
+func TestGenerateJSON_RetriesOnceWithReminder(t *testing.T) {
+	var prompts []string
+	generate := func(_ context.Context, prompt string) (string, error) {
+		prompts = append(prompts, prompt)
+		if len(prompts) == 1 {
+			return "Sorry, I can't format that.", nil
+		}
+		return `{"score": 75}`, nil
+	}
+
+	result, err := generateJSON[TranslationCheckResult](context.Background(), generate, "check this")
+	require.NoError(t, err)
+	require.Equal(t, 75, result.Score)
+	require.Len(t, prompts, 2)
+	require.Equal(t, "check this", prompts[0])
+	require.True(t, strings.HasSuffix(prompts[1], jsonOnlyReminder), "Retry should ask for JSON only")
+}
+
+func TestGenerateJSON_NoRetryWhenRepairable(t *testing.T) {
+	calls := 0
+	generate := func(_ context.Context, _ string) (string, error) {
+		calls++
+		return "```json\n{\"score\": 100}\n```", nil
+	}
+
+	result, err := generateJSON[TranslationCheckResult](context.Background(), generate, "check this")
+	require.NoError(t, err)
+	require.Equal(t, 100, result.Score)
+	require.Equal(t, 1, calls)
+}
+
+func TestGenerateJSON_FailsAfterRetry(t *testing.T) {
+	calls := 0
+	generate := func(_ context.Context, _ string) (string, error) {
+		calls++
+		return "not json", nil
+	}
+
+	_, err := generateJSON[TranslationCheckResult](context.Background(), generate, "check this")
+	require.Error(t, err)
+	require.Equal(t, 2, calls)
+}
+
+func TestGenerateJSON_RecordsGeneration(t *testing.T) {
+	calls := 0
+	generate := func(_ context.Context, _ string) (string, error) {
+		calls++
+		if calls == 1 {
+			return "Sorry, I can't format that.", nil
+		}
+		return `{"score": 75}`, nil
+	}
+
+	var record GenerationRecord
+	ctx := WithGenerationRecord(context.Background(), &record)
+
+	_, err := generateJSON[TranslationCheckResult](ctx, generate, "check this")
+	require.NoError(t, err)
+	require.Equal(t, "check this"+jsonOnlyReminder, record.Prompt, "The retried prompt should be recorded")
+	require.Equal(t, `{"score": 75}`, record.Response)
+
+	// Without a record in the context nothing is captured and nothing breaks
+	_, err = generateJSON[TranslationCheckResult](context.Background(), generate, "check this")
+	require.NoError(t, err)
+}
+
+func TestCardContentRequest_MeaningLanguages(t *testing.T) {
+	prompt, schema := cardContentRequest("猫", CardGenerationOptions{})
+	for _, field := range []string{"meaning_en", "example_en", "meaning_ru", "example_ru"} {
+		require.Contains(t, schema.Properties, field)
+		require.Contains(t, schema.Required, field)
+	}
+	require.NotContains(t, prompt, "другие языки не заполняй")
+
+	prompt, schema = cardContentRequest("猫", CardGenerationOptions{MeaningLanguages: []string{"ru"}})
+	for _, field := range []string{"meaning_ru", "example_ru"} {
+		require.Contains(t, schema.Properties, field)
+		require.Contains(t, schema.Required, field)
+	}
+	for _, field := range []string{"meaning_en", "example_en"} {
+		require.NotContains(t, schema.Properties, field, "English fields should not be requested")
+		require.NotContains(t, schema.Required, field)
+	}
+	require.Contains(t, prompt, "meaning_ru и example_ru")
+	require.NotContains(t, prompt, "meaning_en")
+}
+
+func TestCardContentRequest_KnownWords(t *testing.T) {
+	prompt, _ := cardContentRequest("猫", CardGenerationOptions{})
+	require.NotContains(t, prompt, "Студент уже знает")
+
+	prompt, _ = cardContentRequest("猫", CardGenerationOptions{KnownWords: []string{"犬", "食べる"}})
+	require.Contains(t, prompt, "Студент уже знает эти слова: 犬, 食べる")
+}
+
+func TestCardContentRequest_ExampleCount(t *testing.T) {
+	prompt, schema := cardContentRequest("猫", CardGenerationOptions{ExampleCount: 1})
+	require.Contains(t, schema.Properties, "example_native")
+	require.NotContains(t, schema.Properties, "examples")
+	require.NotContains(t, prompt, "examples")
+
+	prompt, schema = cardContentRequest("猫", CardGenerationOptions{ExampleCount: 2, MeaningLanguages: []string{"en"}})
+	require.NotContains(t, schema.Properties, "example_native")
+	require.NotContains(t, schema.Required, "example_en")
+	require.Contains(t, schema.Required, "examples")
+
+	examples := schema.Properties["examples"]
+	require.NotNil(t, examples)
+	require.Equal(t, int64(2), *examples.MinItems)
+	require.Equal(t, int64(2), *examples.MaxItems)
+	require.Contains(t, examples.Items.Properties, "en")
+	require.NotContains(t, examples.Items.Properties, "ru")
+	require.Contains(t, prompt, "Составь 2 разных примера")
+}
+
+func TestParseResponse_EmptyResponse(t *testing.T) {
+	for _, text := range []string{"", "  \n\t"} {
+		_, err := parseResponse[TranslationCheckResult](text)
+		require.ErrorIs(t, err, ErrEmptyResponse)
+		require.NotErrorIs(t, err, ErrInvalidResponse)
+	}
+}
+
+func TestResponseText_EmptyOrBlocked(t *testing.T) {
+	tests := []struct {
+		name     string
+		response *genai.GenerateContentResponse
+		reason   string
+	}{
+		{
+			name:     "no candidates",
+			response: &genai.GenerateContentResponse{},
+			reason:   "no candidates",
+		},
+		{
+			name: "whitespace only",
+			response: &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{
+				Content:      genai.NewContentFromText("  ", genai.RoleModel),
+				FinishReason: genai.FinishReasonStop,
+			}}},
+		},
+		{
+			name: "candidate blocked by safety",
+			response: &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{
+				FinishReason: genai.FinishReasonSafety,
+			}}},
+			reason: "SAFETY",
+		},
+		{
+			name: "prompt blocked",
+			response: &genai.GenerateContentResponse{PromptFeedback: &genai.GenerateContentResponsePromptFeedback{
+				BlockReason: genai.BlockedReasonProhibitedContent,
+			}},
+			reason: "PROHIBITED_CONTENT",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := responseText(tt.response)
+			require.ErrorIs(t, err, ErrEmptyResponse)
+			require.Contains(t, err.Error(), tt.reason)
+		})
+	}
+
+	text, err := responseText(&genai.GenerateContentResponse{Candidates: []*genai.Candidate{{
+		Content:      genai.NewContentFromText(`{"score": 90}`, genai.RoleModel),
+		FinishReason: genai.FinishReasonStop,
+	}}})
+	require.NoError(t, err)
+	require.Equal(t, `{"score": 90}`, text)
+}
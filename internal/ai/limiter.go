@@ -0,0 +1,113 @@
+package ai
+
+import (
+	"atamagaii/internal/contract"
+	"atamagaii/internal/db"
+	"context"
+)
+
+// DefaultMaxConcurrency bounds concurrent AI requests when ai.max_concurrency is not set
+const DefaultMaxConcurrency = 8
+
+// LimitedClient wraps an AIClient so that at most a fixed number of AI requests run at once
+// across the whole process; callers beyond the limit wait for a free slot or for their context to end
+type LimitedClient struct {
+	client AIClient
+	slots  chan struct{}
+}
+
+func NewLimitedClient(client AIClient, maxConcurrency int) *LimitedClient {
+	if maxConcurrency <= 0 {
+		maxConcurrency = DefaultMaxConcurrency
+	}
+
+	return &LimitedClient{
+		client: client,
+		slots:  make(chan struct{}, maxConcurrency),
+	}
+}
+
+func (l *LimitedClient) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *LimitedClient) release() {
+	<-l.slots
+}
+
+func (l *LimitedClient) GenerateCardContent(ctx context.Context, term string, language string, opts CardGenerationOptions) (*contract.CardFields, error) {
+	if err := l.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer l.release()
+
+	return l.client.GenerateCardContent(ctx, term, language, opts)
+}
+
+func (l *LimitedClient) GenerateTask(ctx context.Context, language, templateName string, taskType db.TaskType) (*string, error) {
+	if err := l.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer l.release()
+
+	return l.client.GenerateTask(ctx, language, templateName, taskType)
+}
+
+func (l *LimitedClient) GenerateAudio(ctx context.Context, text string, language string) (string, error) {
+	if err := l.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer l.release()
+
+	return l.client.GenerateAudio(ctx, text, language)
+}
+
+func (l *LimitedClient) CheckSentenceTranslation(ctx context.Context, sentenceRu, correctAnswer, userAnswer string, languageCode string) (*TranslationCheckResult, error) {
+	if err := l.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer l.release()
+
+	return l.client.CheckSentenceTranslation(ctx, sentenceRu, correctAnswer, userAnswer, languageCode)
+}
+
+func (l *LimitedClient) ParseCSVFields(ctx context.Context, line string) (CSVToJSONFields, error) {
+	if err := l.acquire(ctx); err != nil {
+		return CSVToJSONFields{}, err
+	}
+	defer l.release()
+
+	return l.client.ParseCSVFields(ctx, line)
+}
+
+func (l *LimitedClient) CheckQuestionAnswer(ctx context.Context, question, answer, languageCode string) (*QuestionCheckResult, error) {
+	if err := l.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer l.release()
+
+	return l.client.CheckQuestionAnswer(ctx, question, answer, languageCode)
+}
+
+func (l *LimitedClient) CheckStoryQuestionAnswer(ctx context.Context, story, question, userAnswer string, languageCode string) (*StoryQuestionCheckResult, error) {
+	if err := l.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer l.release()
+
+	return l.client.CheckStoryQuestionAnswer(ctx, story, question, userAnswer, languageCode)
+}
+
+func (l *LimitedClient) GenerateTranscription(ctx context.Context, term, example, transcriptionType string) (*TranscriptionResult, error) {
+	if err := l.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer l.release()
+
+	return l.client.GenerateTranscription(ctx, term, example, transcriptionType)
+}
@@ -0,0 +1,97 @@
+package ai
+
+import (
+	"atamagaii/internal/db"
+	"context"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingClient counts how many GenerateTask calls run at once and holds each until released
+type blockingClient struct {
+	AIClient
+	running atomic.Int32
+	peak    atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingClient) GenerateTask(_ context.Context, _, _ string, _ db.TaskType) (*string, error) {
+	n := b.running.Add(1)
+	for {
+		peak := b.peak.Load()
+		if n <= peak || b.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	b.started <- struct{}{}
+
+	<-b.release
+	b.running.Add(-1)
+
+	result := "{}"
+	return &result, nil
+}
+
+func TestLimitedClient_QueuesCallsBeyondLimit(t *testing.T) {
+	const limit, calls = 2, 6
+
+	upstream := &blockingClient{
+		started: make(chan struct{}, calls),
+		release: make(chan struct{}),
+	}
+	client := NewLimitedClient(upstream, limit)
+
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.GenerateTask(context.Background(), "jp", "", db.TaskTypeVocabRecall); err != nil {
+				t.Errorf("GenerateTask failed: %v", err)
+			}
+		}()
+	}
+
+	for i := 0; i < limit; i++ {
+		<-upstream.started
+	}
+
+	// the remaining calls must be waiting for a slot instead of reaching the provider
+	select {
+	case <-upstream.started:
+		t.Fatal("call started beyond the concurrency limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < calls; i++ {
+		upstream.release <- struct{}{}
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(limit), upstream.peak.Load())
+}
+
+func TestLimitedClient_WaitRespectsContext(t *testing.T) {
+	upstream := &blockingClient{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	client := NewLimitedClient(upstream, 1)
+
+	go func() {
+		_, _ = client.GenerateTask(context.Background(), "jp", "", db.TaskTypeVocabRecall)
+	}()
+	<-upstream.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err := client.GenerateTask(ctx, "jp", "", db.TaskTypeVocabRecall)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	upstream.release <- struct{}{}
+}
@@ -0,0 +1,83 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"unicode"
+)
+
+var ErrContentFlagged = errors.New("generated content was flagged by the safety filter")
+
+// Moderator decides whether AI generated text is appropriate for a learning context
+type Moderator interface {
+	IsFlagged(ctx context.Context, text string) (bool, error)
+}
+
+// defaultBlockedKeywords is intentionally short and only holds slurs and sexual stems. Words a learner meets
+// in ordinary sentences, like 殺す or クソ, stay out of it: flagging them would reject legitimate cards.
+// The stems still occur inside innocent words (колебаться, застрахуй), so they are only matched at the
+// start of a word, see IsFlagged.
+var defaultBlockedKeywords = []string{
+	// English
+	"nigger", "faggot",
+	// Russian
+	"хуй", "пизд", "ебат", "ёбан", "пидор",
+	// Japanese
+	"ちんこ", "まんこ",
+}
+
+// KeywordModerator flags text that contains any of the blocked keywords (case-insensitive).
+// Keywords in scripts written with spaces must match a whole word or its beginning; Japanese and
+// Chinese keywords are matched anywhere, since those scripts have no word boundaries to split on.
+type KeywordModerator struct {
+	keywords []string
+}
+
+func NewKeywordModerator(keywords []string) *KeywordModerator {
+	if len(keywords) == 0 {
+		keywords = defaultBlockedKeywords
+	}
+
+	normalized := make([]string, 0, len(keywords))
+	for _, k := range keywords {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if k != "" {
+			normalized = append(normalized, k)
+		}
+	}
+
+	return &KeywordModerator{keywords: normalized}
+}
+
+func (m *KeywordModerator) IsFlagged(_ context.Context, text string) (bool, error) {
+	lower := strings.ToLower(text)
+	words := strings.FieldsFunc(lower, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsMark(r)
+	})
+
+	for _, k := range m.keywords {
+		if isUnspacedScript(k) {
+			if strings.Contains(lower, k) {
+				return true, nil
+			}
+			continue
+		}
+		for _, w := range words {
+			if strings.HasPrefix(w, k) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// isUnspacedScript reports whether the keyword is written in a script that doesn't separate words with spaces
+func isUnspacedScript(keyword string) bool {
+	for _, r := range keyword {
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package ai
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestKeywordModerator_DefaultKeywords(t *testing.T) {
+	moderator := NewKeywordModerator(nil)
+
+	tests := []struct {
+		text    string
+		flagged bool
+	}{
+		{"犯人は人を殺すつもりはなかった。", false},
+		{"クソ暑い日が続いている。", false},
+		{"Сука лает во дворе.", false},
+		{"He called him a FAGGOT.", true},
+		{"Он долго колебался, но всё же решил колебаться дальше.", false},
+		{"Собака начала хлебать воду из миски.", false},
+		{"Застрахуй машину до поездки.", false},
+		{"Ну и хуйня получилась.", true},
+		{"Пошёл на хуй!", true},
+		{"あいつはちんこの話ばかりする。", true},
+	}
+
+	for _, tt := range tests {
+		flagged, err := moderator.IsFlagged(context.Background(), tt.text)
+		require.NoError(t, err)
+		require.Equal(t, tt.flagged, flagged, tt.text)
+	}
+}
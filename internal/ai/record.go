@@ -0,0 +1,25 @@
+package ai
+
+import "context"
+
+// GenerationRecord captures the prompt sent to the model and the raw text it returned, for debugging generations
+type GenerationRecord struct {
+	Prompt   string
+	Response string
+}
+
+type generationRecordKey struct{}
+
+// WithGenerationRecord returns a context whose generations are captured into record
+func WithGenerationRecord(ctx context.Context, record *GenerationRecord) context.Context {
+	return context.WithValue(ctx, generationRecordKey{}, record)
+}
+
+// RecordGeneration stores a prompt and the model's response in the context's record, if it has one.
+// A generation that is retried is recorded again, so the record holds the attempt whose result was used.
+func RecordGeneration(ctx context.Context, prompt, response string) {
+	if record, ok := ctx.Value(generationRecordKey{}).(*GenerationRecord); ok && record != nil {
+		record.Prompt = prompt
+		record.Response = response
+	}
+}
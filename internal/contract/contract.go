@@ -11,6 +11,8 @@ type JWTClaims struct {
 	jwt.RegisteredClaims
 	UID    string `json:"uid,omitempty"`
 	ChatID int64  `json:"chat_id,omitempty"`
+	// IsAdmin unlocks the /v1/admin routes, copied from the user at login
+	IsAdmin bool `json:"is_admin,omitempty"`
 }
 
 type AuthTelegramRequest struct {
@@ -30,7 +32,8 @@ func (a AuthTelegramRequest) Validate() error {
 }
 
 type ErrorResponse struct {
-	Error string `json:"error"`
+	Error string    `json:"error"`
+	Code  ErrorCode `json:"code"`
 }
 
 type CardFields struct {
@@ -48,7 +51,39 @@ type CardFields struct {
 	AudioExample             string `json:"audio_example"`
 	ImageURL                 string `json:"image_url,omitempty"`
 	LanguageCode             string `json:"language_code"`
+	UserNote                 string `json:"user_note,omitempty" validate:"max=2000"` // Learner's own mnemonic, never produced by generation
+
+	// Examples holds every example sentence on decks that ask for more than one, the Example fields repeat the first
+	Examples []CardExample `json:"examples,omitempty"`
+}
+
+// CardExample is one of a card's example sentences
+type CardExample struct {
+	Native            string `json:"native"`
+	WithTranscription string `json:"with_transcription,omitempty"`
+	En                string `json:"en,omitempty"`
+	Ru                string `json:"ru,omitempty"`
+}
+
+// Translations returns the meaning and example translation in language, "en" or "ru",
+// each falling back to the other language when the card has none in language
+func (f CardFields) Translations(language string) (meaning string, example string) {
+	meaning, example = f.MeaningEn, f.ExampleEn
+	fallbackMeaning, fallbackExample := f.MeaningRu, f.ExampleRu
+	if language == "ru" {
+		meaning, example, fallbackMeaning, fallbackExample = fallbackMeaning, fallbackExample, meaning, example
+	}
+
+	if meaning == "" {
+		meaning = fallbackMeaning
+	}
+	if example == "" {
+		example = fallbackExample
+	}
+
+	return meaning, example
 }
+
 type CardResponse struct {
 	ID              string                       `json:"id"`
 	DeckID          string                       `json:"deck_id"`
@@ -65,7 +100,52 @@ type CardResponse struct {
 	FirstReviewedAt *time.Time                   `json:"first_reviewed_at,omitempty"`
 	State           string                       `json:"state,omitempty"`
 	LearningStep    int                          `json:"learning_step,omitempty"`
+	Priority        int                          `json:"priority,omitempty"`
 	NextIntervals   PotentialIntervalsForDisplay `json:"next_intervals,omitempty"`
+	IntervalDisplay string                       `json:"interval_display,omitempty"` // Current interval in human terms, e.g. "3d"
+	DueInDisplay    string                       `json:"due_in_display,omitempty"`   // Time until next review, "now" when already due
+
+	// Meaning and ExampleTranslation are the card's translations in the user's display language
+	Meaning            string `json:"meaning,omitempty"`
+	ExampleTranslation string `json:"example_translation,omitempty"`
+
+	// HasAudio and HasImage tell whether the card has media without reading the fields
+	HasAudio bool `json:"has_audio"`
+	HasImage bool `json:"has_image"`
+
+	// ReviewMode is the deck's review mode for cards served for study: "audio_front" asks the client to play
+	// the audio first and show the term as the answer
+	ReviewMode string `json:"review_mode,omitempty"`
+
+	// StudyAgain marks a card failed earlier in the session that is shown again before the session ends
+	StudyAgain bool `json:"study_again,omitempty"`
+
+	// Suspended marks a card kept out of study until it is unsuspended
+	Suspended bool `json:"suspended,omitempty"`
+
+	// Tags label the card, a card tagged "leech" lapsed too often in a deck that tags leeches
+	Tags []string `json:"tags,omitempty"`
+
+	// Back holds what is only revealed with the answer, set for cards of decks that keep examples off the front
+	Back *CardBack `json:"back,omitempty"`
+}
+
+// CardBack is the part of a card served for review that belongs on its back. The fields it carries are
+// left empty in the card's Fields.
+type CardBack struct {
+	ExampleNative            string        `json:"example_native,omitempty"`
+	ExampleWithTranscription string        `json:"example_with_transcription,omitempty"`
+	ExampleEn                string        `json:"example_en,omitempty"`
+	ExampleRu                string        `json:"example_ru,omitempty"`
+	ExampleTranslation       string        `json:"example_translation,omitempty"`
+	AudioExample             string        `json:"audio_example,omitempty"`
+	Examples                 []CardExample `json:"examples,omitempty"`
+}
+
+// RecentCardResponse is a card in the cross-deck list of recently created cards
+type RecentCardResponse struct {
+	CardResponse
+	DeckName string `json:"deck_name"`
 }
 
 type ReviewCardResponse struct {
@@ -73,9 +153,18 @@ type ReviewCardResponse struct {
 	NextCards []CardResponse     `json:"next_cards"`
 }
 
+// PotentialIntervalsForDisplay previews the interval each rating would give, Hard and Easy only for decks with
+// four rating buttons
 type PotentialIntervalsForDisplay struct {
 	Again string `json:"again"`
 	Good  string `json:"good"`
+	Hard  string `json:"hard,omitempty"`
+	Easy  string `json:"easy,omitempty"`
+}
+
+// TaskCountResponse is the number of incomplete tasks the user can work on
+type TaskCountResponse struct {
+	Count int `json:"count"`
 }
 
 // TaskResponse represents a task with its card data for the API
@@ -86,8 +175,65 @@ type TaskResponse struct {
 	CompletedAt  *time.Time    `json:"completed_at,omitempty"`
 	UserResponse *string       `json:"user_response,omitempty"`
 	IsCorrect    *bool         `json:"is_correct,omitempty"`
+	TimeSpentMs  *int          `json:"time_spent_ms,omitempty"`
+	Answer       *string       `json:"answer,omitempty"`
 	CreatedAt    time.Time     `json:"created_at"`
 	Card         *CardResponse `json:"card,omitempty"`
+	LanguageCode string        `json:"language_code,omitempty"` // Language of the task's deck, for picking fonts, input and speech
+}
+
+// ResetDailyResponse reports how many of the user's cards no longer count against today's new-card budget
+type ResetDailyResponse struct {
+	UserID     string `json:"user_id"`
+	CardsReset int    `json:"cards_reset"`
+}
+
+// GenerateTranscriptionsResponse reports the outcome of filling in missing readings for a deck
+type GenerateTranscriptionsResponse struct {
+	Updated   int `json:"updated"`   // Cards that got readings in this request
+	Remaining int `json:"remaining"` // Cards still missing readings, call again to continue
+}
+
+// CardGenerationResult is the outcome of generating one card's content in a batch
+type CardGenerationResult struct {
+	CardID string `json:"card_id"`
+	Term   string `json:"term"`
+	Status string `json:"status"`          // "generated" or "failed"
+	Error  string `json:"error,omitempty"` // Why generation failed
+}
+
+// GenerateMissingResponse reports which cards of a deck got generated content and which failed
+type GenerateMissingResponse struct {
+	Generated int                    `json:"generated"`
+	Failed    int                    `json:"failed"`
+	Remaining int                    `json:"remaining"` // Cards still missing content that this request didn't get to
+	Results   []CardGenerationResult `json:"results"`
+}
+
+// TTSPreviewResponse points to synthesized preview audio
+type TTSPreviewResponse struct {
+	URL    string `json:"url"`
+	Cached bool   `json:"cached"` // The same text was synthesized before and no new audio was generated
+}
+
+// ImportJobResponse describes a file import that is still running
+type ImportJobResponse struct {
+	ID        string    `json:"id"`
+	FileName  string    `json:"file_name"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// SessionItem is a single step of a study session, either a card to review or a task to solve
+type SessionItem struct {
+	Type string        `json:"type"` // "card" or "task"
+	Card *CardResponse `json:"card,omitempty"`
+	Task *TaskResponse `json:"task,omitempty"`
+}
+
+// StudySessionResponse is an ordered study plan for a deck mixing card reviews and tasks
+type StudySessionResponse struct {
+	DeckID string        `json:"deck_id"`
+	Items  []SessionItem `json:"items"`
 }
 
 // TaskContent is an interface that can be one of multiple task content types
@@ -103,6 +249,8 @@ type TaskVocabRecallContent struct {
 		D string `json:"d"`
 	} `json:"options"`
 	Question string `json:"question"`
+	// FreeText tasks have no options, the term has to be typed for the meaning in the question
+	FreeText bool `json:"free_text,omitempty"`
 }
 
 // TaskSentenceTranslationContent represents the content for sentence translation tasks
@@ -125,8 +273,9 @@ type TaskAudioContent struct {
 
 // SubmitTaskRequest represents the request to submit a task answer
 type SubmitTaskRequest struct {
-	TaskID   string `json:"task_id" validate:"required"`
-	Response string `json:"response" validate:"required"`
+	TaskID      string `json:"task_id" validate:"required"`
+	Response    string `json:"response" validate:"required"`
+	TimeSpentMs *int   `json:"time_spent_ms,omitempty" validate:"omitempty,min=0"` // How long the user took to answer
 }
 
 // SubmitTaskResponse represents the response for submitting a task answer
@@ -134,4 +283,5 @@ type SubmitTaskResponse struct {
 	Task      TaskResponse `json:"task"`
 	IsCorrect bool         `json:"is_correct"`
 	FeedBack  *string      `json:"feedback"`
+	Score     *int         `json:"score,omitempty"` // Check score of AI graded answers, whether they passed or not
 }
@@ -0,0 +1,55 @@
+package contract
+
+import "net/http"
+
+// ErrorCode is a machine-readable error kind sent alongside the human message, so clients can branch on it
+type ErrorCode string
+
+const (
+	ErrorCodeValidation    ErrorCode = "VALIDATION"
+	ErrorCodeUnauthorized  ErrorCode = "UNAUTHORIZED"
+	ErrorCodeForbidden     ErrorCode = "FORBIDDEN"
+	ErrorCodeNotFound      ErrorCode = "NOT_FOUND"
+	ErrorCodeUnprocessable ErrorCode = "UNPROCESSABLE"
+	ErrorCodeRateLimited   ErrorCode = "RATE_LIMITED"
+	ErrorCodeUnavailable   ErrorCode = "UNAVAILABLE"
+	ErrorCodeNotSupported  ErrorCode = "NOT_SUPPORTED"
+	ErrorCodeTimeout       ErrorCode = "TIMEOUT"
+	ErrorCodeInternal      ErrorCode = "INTERNAL"
+
+	ErrorCodeDeckNotFound   ErrorCode = "DECK_NOT_FOUND"
+	ErrorCodeCardNotFound   ErrorCode = "CARD_NOT_FOUND"
+	ErrorCodeUserNotFound   ErrorCode = "USER_NOT_FOUND"
+	ErrorCodeImportNotFound ErrorCode = "IMPORT_NOT_FOUND"
+	ErrorCodeDailyLimit     ErrorCode = "DAILY_LIMIT_REACHED"
+	ErrorCodeAIUnavailable  ErrorCode = "AI_UNAVAILABLE"
+	ErrorCodeAITimeout      ErrorCode = "AI_TIMEOUT"
+
+	ErrorCodeNoReviewToUndo      ErrorCode = "NO_REVIEW_TO_UNDO"
+	ErrorCodeReviewNotReversible ErrorCode = "REVIEW_NOT_REVERSIBLE"
+)
+
+// ErrorCodeForStatus is the code used for errors that don't name a more specific one
+func ErrorCodeForStatus(status int) ErrorCode {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrorCodeValidation
+	case http.StatusUnauthorized:
+		return ErrorCodeUnauthorized
+	case http.StatusForbidden:
+		return ErrorCodeForbidden
+	case http.StatusNotFound:
+		return ErrorCodeNotFound
+	case http.StatusUnprocessableEntity:
+		return ErrorCodeUnprocessable
+	case http.StatusTooManyRequests:
+		return ErrorCodeRateLimited
+	case http.StatusServiceUnavailable:
+		return ErrorCodeUnavailable
+	case http.StatusNotImplemented:
+		return ErrorCodeNotSupported
+	case http.StatusGatewayTimeout:
+		return ErrorCodeTimeout
+	}
+	return ErrorCodeInternal
+}
@@ -8,13 +8,106 @@ type UpdateUserSettingsRequest struct {
 }
 
 type UserSettingsResponse struct {
-	MaxTasksPerDay int      `json:"max_tasks_per_day"`
-	TaskTypes      []string `json:"task_types"`
+	MaxTasksPerDay   int      `json:"max_tasks_per_day"`
+	TaskTypes        []string `json:"task_types"`
+	NewCardsPaused   bool     `json:"new_cards_paused"`
+	StudyOrder       string   `json:"study_order"`
+	MeaningLanguages []string `json:"meaning_languages"`
+	// DefaultNewCardsPerDay is the new card limit given to decks the user creates
+	DefaultNewCardsPerDay int `json:"default_new_cards_per_day"`
+	// TranslationPassScore is the check score a translation task needs to count as correct
+	TranslationPassScore int `json:"translation_pass_score"`
+	// KnownWordExamples makes generated card examples prefer words the user already studied
+	KnownWordExamples bool `json:"known_word_examples"`
+	// TaskAudioRate is the speaking rate of listening task audio, 1 being the rate of card audio
+	TaskAudioRate float64 `json:"task_audio_rate"`
+	// FreeTextVocabRecall makes vocab recall tasks ask for the term to be typed
+	FreeTextVocabRecall bool `json:"free_text_vocab_recall"`
+	// Timezone is the IANA time zone the user's study days follow
+	Timezone string `json:"timezone"`
+	// DisplayLanguage is the language card meanings and example translations are shown in
+	DisplayLanguage string `json:"display_language"`
+}
+
+// NewUserSettingsResponse fills in the effective value of every setting the user left unset,
+// languageCode is the user's own language that some defaults follow
+func NewUserSettingsResponse(settings *db.UserSettings, languageCode string) UserSettingsResponse {
+	if settings == nil {
+		settings = db.DefaultUserSettings()
+	}
+
+	taskTypes := make([]string, len(settings.TaskTypes))
+	for i, taskType := range settings.TaskTypes {
+		taskTypes[i] = string(taskType)
+	}
+
+	studyOrder := settings.StudyOrder
+	if !db.IsValidStudyOrder(studyOrder) {
+		studyOrder = db.StudyOrderReviewsFirst
+	}
+
+	meaningLanguages := settings.MeaningLanguages
+	if len(meaningLanguages) == 0 {
+		meaningLanguages = db.SupportedMeaningLanguages
+	}
+
+	newCardsPerDay := settings.DefaultNewCardsPerDay
+	if !db.IsValidNewCardsPerDay(newCardsPerDay) {
+		newCardsPerDay = db.DefaultNewCardsPerDay
+	}
+
+	passScore := settings.TranslationPassScore
+	if !db.IsValidTranslationPassScore(passScore) {
+		passScore = db.DefaultTranslationPassScore
+	}
+
+	taskAudioRate := settings.TaskAudioRate
+	if !db.IsValidTaskAudioRate(taskAudioRate) {
+		taskAudioRate = db.DefaultTaskAudioRate
+	}
+
+	timezone := settings.Timezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+
+	return UserSettingsResponse{
+		MaxTasksPerDay:        settings.MaxTasksPerDay,
+		TaskTypes:             taskTypes,
+		NewCardsPaused:        settings.NewCardsPaused,
+		StudyOrder:            studyOrder,
+		MeaningLanguages:      meaningLanguages,
+		DefaultNewCardsPerDay: newCardsPerDay,
+		TranslationPassScore:  passScore,
+		KnownWordExamples:     settings.KnownWordExamples,
+		TaskAudioRate:         taskAudioRate,
+		FreeTextVocabRecall:   settings.FreeTextVocabRecall,
+		Timezone:              timezone,
+		DisplayLanguage:       db.ResolveDisplayLanguage(settings, languageCode),
+	}
 }
 
 type UpdateUserSettings struct {
 	MaxTasksPerDay *int     `json:"max_tasks_per_day,omitempty"`
 	TaskTypes      []string `json:"task_types,omitempty"`
+	NewCardsPaused *bool    `json:"new_cards_paused,omitempty"`
+	StudyOrder     *string  `json:"study_order,omitempty"`
+	// MeaningLanguages sets which meaning languages the AI generates, e.g. ["ru"]
+	MeaningLanguages []string `json:"meaning_languages,omitempty"`
+	// DefaultNewCardsPerDay sets the new card limit of decks created from now on
+	DefaultNewCardsPerDay *int `json:"default_new_cards_per_day,omitempty"`
+	// TranslationPassScore sets the check score translation tasks need to pass, between 50 and 100
+	TranslationPassScore *int `json:"translation_pass_score,omitempty"`
+	// KnownWordExamples turns on examples built from the user's known words
+	KnownWordExamples *bool `json:"known_word_examples,omitempty"`
+	// TaskAudioRate sets how fast listening task audio is read, between 0.5 and 1
+	TaskAudioRate *float64 `json:"task_audio_rate,omitempty"`
+	// FreeTextVocabRecall switches vocab recall tasks between typing the term and multiple choice
+	FreeTextVocabRecall *bool `json:"free_text_vocab_recall,omitempty"`
+	// Timezone sets the IANA time zone, e.g. "Asia/Tokyo", the user's study days follow
+	Timezone *string `json:"timezone,omitempty"`
+	// DisplayLanguage sets the language card translations are shown in, "en" or "ru"
+	DisplayLanguage *string `json:"display_language,omitempty"`
 }
 
 type UpdateUserRequest struct {
@@ -1,13 +1,18 @@
 package db
 
 import (
+	"atamagaii/internal/utils"
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	nanoid "github.com/matoous/go-nanoid/v2"
 	"math"
 	"sort"
+	"strings"
 	"time"
+	"unicode"
 )
 
 type Card struct {
@@ -24,10 +29,57 @@ type Card struct {
 	FirstReviewedAt *time.Time    `db:"first_reviewed_at" json:"first_reviewed_at,omitempty"`
 	State           string        `db:"state" json:"state"`
 	LearningStep    int           `db:"learning_step" json:"learning_step"`
+	Priority        int           `db:"priority" json:"priority"` // New cards of higher priority are studied first
 	CreatedAt       time.Time     `db:"created_at" json:"created_at"`
 	UpdatedAt       time.Time     `db:"updated_at" json:"updated_at"`
 	DeletedAt       *time.Time    `db:"deleted_at" json:"deleted_at,omitempty"`
+	// SuspendedAt is set while the card is kept out of study, the review queries never return suspended cards
+	SuspendedAt *time.Time `db:"suspended_at" json:"suspended_at,omitempty"`
+	// Tags label the card, like LeechTag, they are stored separated by spaces
+	Tags []string `db:"tags" json:"tags,omitempty"`
 }
+
+// cardColumns lists the cards columns in the order scanCard reads them, queries alias cards as c
+const cardColumns = `c.id, c.deck_id, c.fields, c.user_id, c.next_review, c.interval, c.ease,
+	c.review_count, c.laps_count, c.last_reviewed_at, c.first_reviewed_at, c.state,
+	c.learning_step, c.priority, c.created_at, c.updated_at, c.deleted_at, c.suspended_at, c.tags`
+
+// scanCard reads a row selected with cardColumns, columns selected after them are scanned into extra
+func scanCard(row rowScanner, extra ...any) (Card, error) {
+	var card Card
+	var intervalNs int64
+	var tags string
+
+	dest := []any{
+		&card.ID,
+		&card.DeckID,
+		&card.Fields,
+		&card.UserID,
+		&card.NextReview,
+		&intervalNs,
+		&card.Ease,
+		&card.ReviewCount,
+		&card.LapsCount,
+		&card.LastReviewedAt,
+		&card.FirstReviewedAt,
+		&card.State,
+		&card.LearningStep,
+		&card.Priority,
+		&card.CreatedAt,
+		&card.UpdatedAt,
+		&card.DeletedAt,
+		&card.SuspendedAt,
+		&tags,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return Card{}, err
+	}
+
+	card.Interval = time.Duration(intervalNs)
+	card.Tags = strings.Fields(tags)
+	return card, nil
+}
+
 type VocabularyItem struct {
 	Term                  string `json:"term"`                    // Primary term in native script
 	Transcription         string `json:"transcription,omitempty"` // Reading aid (pinyin, romaji, etc.)
@@ -52,6 +104,18 @@ type VocabularyItem struct {
 	AudioWord    string `json:"audio_word,omitempty"`    // Audio for term pronunciation
 	AudioExample string `json:"audio_example,omitempty"` // Audio for example sentence
 	ImageURL     string `json:"image_url,omitempty"`     // Illustration image
+
+	// Review state of a card exported from Anki, only kept when the import asks to preserve scheduling
+	Scheduling *ImportedScheduling `json:"scheduling,omitempty"`
+}
+
+// IsValid reports whether the item has a term and at least one meaning, the minimum for a usable card
+func (v VocabularyItem) IsValid() bool {
+	if strings.TrimSpace(v.Term) == "" {
+		return false
+	}
+
+	return strings.TrimSpace(v.MeaningEn) != "" || strings.TrimSpace(v.MeaningRu) != ""
 }
 
 func (s *Storage) AddCard(userID, deckID, fields string) (*Card, error) {
@@ -99,10 +163,42 @@ func (s *Storage) AddCard(userID, deckID, fields string) (*Card, error) {
 	}, nil
 }
 
-func (s *Storage) AddCardsInBatch(userID, deckID string, fieldsArray []string) error {
-	tx, err := s.db.Begin()
+const (
+	// DefaultCardBatchSize is how many cards a single INSERT statement carries during imports
+	DefaultCardBatchSize = 100
+
+	// cardInsertParams is the number of bound parameters per inserted card row
+	cardInsertParams = 7
+	// maxCardBatchSize keeps a single statement within SQLite's default 999 variable limit
+	maxCardBatchSize = 999 / cardInsertParams
+)
+
+// AddCardsInBatch inserts new cards in one transaction using multi-row
+// INSERT statements of up to chunkSize rows each
+func (s *Storage) AddCardsInBatch(userID, deckID string, fieldsArray []string, chunkSize int) error {
+	_, _, err := s.addCards(context.Background(), userID, deckID, fieldsArray, chunkSize)
+	return err
+}
+
+// AddCardsInBatchContext is AddCardsInBatch that rolls the whole batch back if ctx is canceled before it commits.
+// It returns the IDs of the new cards in the order of fieldsArray.
+func (s *Storage) AddCardsInBatchContext(ctx context.Context, userID, deckID string, fieldsArray []string, chunkSize int) ([]string, error) {
+	ids, _, err := s.addCards(ctx, userID, deckID, fieldsArray, chunkSize)
+	return ids, err
+}
+
+// addCards does the work for AddCardsInBatch, returning the new card IDs and how many statements it executed
+func (s *Storage) addCards(ctx context.Context, userID, deckID string, fieldsArray []string, chunkSize int) ([]string, int, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultCardBatchSize
+	}
+	if chunkSize > maxCardBatchSize {
+		chunkSize = maxCardBatchSize
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("error starting transaction: %w", err)
+		return nil, 0, fmt.Errorf("error starting transaction: %w", err)
 	}
 	defer func() {
 		if err != nil {
@@ -110,50 +206,138 @@ func (s *Storage) AddCardsInBatch(userID, deckID string, fieldsArray []string) e
 		}
 	}()
 
-	stmt, err := tx.Prepare(`
-		INSERT INTO cards (
-			id, deck_id, fields, user_id, ease, review_count, laps_count,
-			learning_step, state, created_at, updated_at
-		)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`)
-	if err != nil {
-		return fmt.Errorf("error preparing statement: %w", err)
-	}
-	defer stmt.Close()
+	// statements for full chunks are prepared once; only the final partial chunk needs its own
+	var fullStmt *sql.Stmt
+	defer func() {
+		if fullStmt != nil {
+			_ = fullStmt.Close()
+		}
+	}()
 
+	ids := make([]string, 0, len(fieldsArray))
+	statements := 0
 	now := time.Now()
-	for i, fields := range fieldsArray {
-		cardID := nanoid.Must()
-		_, err = stmt.Exec(
-			cardID,
-			deckID,
-			fields,
-			userID,
-			DefaultEase,
-			0,     // review_count
-			0,     // laps_count
-			0,     // learning_step
-			"new", // state
-			now,
-			now,
-		)
+	for offset := 0; offset < len(fieldsArray); offset += chunkSize {
+		chunk := fieldsArray[offset:min(offset+chunkSize, len(fieldsArray))]
+
+		args := make([]interface{}, 0, len(chunk)*cardInsertParams)
+		for _, fields := range chunk {
+			id := nanoid.Must()
+			ids = append(ids, id)
+			args = append(args, id, deckID, fields, userID, DefaultEase, now, now)
+		}
+
+		if len(chunk) == chunkSize {
+			if fullStmt == nil {
+				fullStmt, err = tx.PrepareContext(ctx, cardInsertQuery(chunkSize))
+				if err != nil {
+					return nil, statements, fmt.Errorf("error preparing statement: %w", err)
+				}
+			}
+			_, err = fullStmt.ExecContext(ctx, args...)
+		} else {
+			_, err = tx.ExecContext(ctx, cardInsertQuery(len(chunk)), args...)
+		}
 		if err != nil {
-			return fmt.Errorf("error inserting card %d: %w", i, err)
+			return nil, statements, fmt.Errorf("error inserting cards %d-%d: %w", offset, offset+len(chunk)-1, err)
 		}
+		statements++
 	}
 
 	if err = tx.Commit(); err != nil {
-		return fmt.Errorf("error committing transaction: %w", err)
+		return nil, statements, fmt.Errorf("error committing transaction: %w", err)
 	}
 
-	return nil
+	return ids, statements, nil
 }
 
-func (s *Storage) GetNewCards(userID string, deckID string, limit, limitPerDay int) ([]Card, error) {
-	today := time.Now().Truncate(24 * time.Hour)
+// cardInsertQuery builds a multi-row INSERT for rows new cards
+func cardInsertQuery(rows int) string {
+	var b strings.Builder
+	b.WriteString(`
+		INSERT INTO cards (
+			id, deck_id, fields, user_id, ease, created_at, updated_at,
+			review_count, laps_count, learning_step, state
+		)
+		VALUES `)
+
+	for i := 0; i < rows; i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("(?, ?, ?, ?, ?, ?, ?, 0, 0, 0, 'new')")
+	}
+
+	return b.String()
+}
+
+// queueSettings is what the study queues and new card budgets of a request need from the user,
+// loaded once and shared by all the decks involved
+type queueSettings struct {
+	newCardsPaused bool
+	location       *time.Location // time zone of the user's study days, see ResolveLocation
+	studyOrder     string
+	missedDays     int            // see missedStudyDays
+	forgiven       map[string]int // new cards started today per deck that a reset took off the budget
+}
+
+// loadQueueSettings builds the queueSettings of the user's settings
+func (s *Storage) loadQueueSettings(userID string, settings *UserSettings) (queueSettings, error) {
+	missed, err := s.missedStudyDays(userID)
+	if err != nil {
+		return queueSettings{}, fmt.Errorf("error counting missed study days: %w", err)
+	}
+
+	var forgiven map[string]int
+	if settings != nil && settings.NewCardReset != nil && settings.NewCardReset.Day == studyDay(time.Now()) {
+		forgiven = settings.NewCardReset.Decks
+	}
+
+	return queueSettings{
+		newCardsPaused: settings != nil && settings.NewCardsPaused,
+		location:       ResolveLocation(settings),
+		studyOrder:     ResolveStudyOrder(settings),
+		missedDays:     missed,
+		forgiven:       forgiven,
+	}, nil
+}
 
-	countNewStartedTodayQuery := `
+// newCardBoost returns the extra new cards the deck allows today to catch up on missed study days:
+// a day's worth of its new cards per missed day, capped by the deck's new_card_boost
+func (q queueSettings) newCardBoost(deck *Deck) int {
+	if deck.NewCardBoost <= 0 || deck.NewCardsPerDay <= 0 {
+		return 0
+	}
+
+	return min(q.missedDays*deck.NewCardsPerDay, deck.NewCardBoost)
+}
+
+// newCardAllowance returns how many more new cards the deck introduces today after startedToday: none while
+// new cards are paused or on a weekday off the deck's schedule in the user's time zone, otherwise what is left
+// of its daily limit plus boost. Cards forgiven by a reset today don't count. The study queue, the deck
+// statistics and the due count all budget with it.
+func (q queueSettings) newCardAllowance(deck *Deck, startedToday int) int {
+	if q.newCardsPaused || !NewCardsScheduledOn(deck.NewCardDays, time.Now().In(q.location).Weekday()) {
+		return 0
+	}
+
+	counted := max(startedToday-q.forgiven[deck.ID], 0)
+	return max(deck.NewCardsPerDay+q.newCardBoost(deck)-counted, 0)
+}
+
+// studyDayStart returns when the day the new card budget of t counts against began, a UTC midnight
+func studyDayStart(t time.Time) time.Time {
+	return t.Truncate(24 * time.Hour)
+}
+
+// studyDay names the day the new card budget of t counts against
+func studyDay(t time.Time) string {
+	return studyDayStart(t).UTC().Format(time.DateOnly)
+}
+
+// newCardsStartedToday counts the deck's cards first reviewed today
+func (s *Storage) newCardsStartedToday(userID, deckID string) (int, error) {
+	query := `
 		SELECT COUNT(*)
 		FROM cards c
 		WHERE c.user_id = ?
@@ -162,35 +346,74 @@ func (s *Storage) GetNewCards(userID string, deckID string, limit, limitPerDay i
 		AND c.first_reviewed_at >= ?
 	`
 
-	var newCardsStartedToday int
-	err := s.db.QueryRow(countNewStartedTodayQuery, userID, deckID, today).Scan(&newCardsStartedToday)
+	var count int
+	if err := s.db.QueryRow(query, userID, deckID, studyDayStart(time.Now())).Scan(&count); err != nil {
+		return 0, fmt.Errorf("error counting new cards started today: %w", err)
+	}
+
+	return count, nil
+}
+
+// missedStudyDays counts the days without reviews between the user's last study day and today.
+// A user who has never studied hasn't missed anything.
+func (s *Storage) missedStudyDays(userID string) (int, error) {
+	today := time.Now().Truncate(24 * time.Hour)
+
+	var lastReviewedAt time.Time
+	err := s.db.QueryRow(`
+		SELECT reviewed_at
+		FROM reviews
+		WHERE user_id = ? AND reviewed_at < ?
+		ORDER BY reviewed_at DESC
+		LIMIT 1
+	`, userID, today).Scan(&lastReviewedAt)
 	if err != nil {
-		return nil, fmt.Errorf("error counting new cards started today: %w", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
 	}
 
-	if newCardsStartedToday >= limitPerDay {
-		return nil, nil
+	return int(today.Sub(lastReviewedAt.Truncate(24*time.Hour))/(24*time.Hour)) - 1, nil
+}
+
+// GetNewCards returns up to limit of the deck's new cards left in today's budget, the deck's daily limit
+// plus its boost, highest priority first
+func (s *Storage) GetNewCards(userID string, settings *UserSettings, deck *Deck, limit int) ([]Card, error) {
+	study, err := s.loadQueueSettings(userID, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.getNewCards(userID, deck, study, limit)
+}
+
+// getNewCards is GetNewCards with the queueSettings already loaded
+func (s *Storage) getNewCards(userID string, deck *Deck, study queueSettings, limit int) ([]Card, error) {
+	startedToday, err := s.newCardsStartedToday(userID, deck.ID)
+	if err != nil {
+		return nil, err
 	}
 
-	remainingNewCards := limitPerDay - newCardsStartedToday
-	if remainingNewCards > limit {
-		remainingNewCards = limit
+	remainingNewCards := min(study.newCardAllowance(deck, startedToday), limit)
+	if remainingNewCards <= 0 {
+		return nil, nil
 	}
 
 	query := `
-		SELECT id, deck_id, fields, user_id, next_review, interval, ease,
-		       review_count, laps_count, last_reviewed_at, first_reviewed_at, state,
-		       learning_step, created_at, updated_at, deleted_at
+		SELECT ` + cardColumns + `
 		FROM cards c
 		WHERE c.user_id = ?
 		AND c.deck_id = ?
 		AND c.deleted_at IS NULL
+		AND c.suspended_at IS NULL
+		AND (c.buried_until IS NULL OR c.buried_until <= ?)
 		AND c.state = 'new'
-		ORDER BY c.created_at ASC
+		ORDER BY c.priority DESC, c.created_at ASC
 		LIMIT ?
 	`
 
-	rows, err := s.db.Query(query, userID, deckID, remainingNewCards)
+	rows, err := s.db.Query(query, userID, deck.ID, time.Now(), remainingNewCards)
 	if err != nil {
 		return nil, fmt.Errorf("error getting new cards: %w", err)
 	}
@@ -198,31 +421,10 @@ func (s *Storage) GetNewCards(userID string, deckID string, limit, limitPerDay i
 
 	var cards []Card
 	for rows.Next() {
-		var card Card
-		var intervalNs int64
-
-		if err := rows.Scan(
-			&card.ID,
-			&card.DeckID,
-			&card.Fields,
-			&card.UserID,
-			&card.NextReview,
-			&intervalNs,
-			&card.Ease,
-			&card.ReviewCount,
-			&card.LapsCount,
-			&card.LastReviewedAt,
-			&card.FirstReviewedAt,
-			&card.State,
-			&card.LearningStep,
-			&card.CreatedAt,
-			&card.UpdatedAt,
-			&card.DeletedAt,
-		); err != nil {
+		card, err := scanCard(rows)
+		if err != nil {
 			return nil, fmt.Errorf("error scanning new card: %w", err)
 		}
-
-		card.Interval = time.Duration(intervalNs)
 		cards = append(cards, card)
 	}
 
@@ -233,40 +435,74 @@ func (s *Storage) GetNewCards(userID string, deckID string, limit, limitPerDay i
 	return cards, nil
 }
 
-func (s *Storage) GetDueCardCount(userID string) (int, error) {
-	todayEnd := time.Now().Truncate(24 * time.Hour).Add(24*time.Hour - time.Nanosecond)
-	today := time.Now().Truncate(24 * time.Hour)
+// GetDueCardCount counts the learning and review cards due today across the user's decks plus the new cards
+// each deck's budget lets in today
+func (s *Storage) GetDueCardCount(userID string, settings *UserSettings) (int, error) {
+	now := time.Now()
+	todayEnd := now.Truncate(24 * time.Hour).Add(24*time.Hour - time.Nanosecond)
+	today := now.Truncate(24 * time.Hour)
 
-	// Query to count learning, review, and new cards available for study today
-	query := `
+	dueQuery := `
 		SELECT
 			COALESCE(SUM(CASE WHEN (state = 'learning' OR state = 'relearning') AND next_review <= ? THEN 1 ELSE 0 END), 0) +
-			COALESCE(SUM(CASE WHEN state = 'review' AND next_review <= ? THEN 1 ELSE 0 END), 0) +
-			COALESCE((
-				SELECT COUNT(*) FROM (
-					SELECT id FROM cards
-					WHERE user_id = ? AND deleted_at IS NULL
-					AND state = 'new'
-					AND (first_reviewed_at IS NULL OR first_reviewed_at < ?)
-					LIMIT (
-						SELECT SUM(new_cards_per_day) - (
-							SELECT COUNT(*) FROM cards
-							WHERE user_id = ? AND deleted_at IS NULL
-							AND first_reviewed_at >= ?
-						) FROM decks WHERE user_id = ? AND deleted_at IS NULL
-					)
-				) as new_count
-			), 0) as total_due_count
+			COALESCE(SUM(CASE WHEN state = 'review' AND next_review <= ? THEN 1 ELSE 0 END), 0)
 		FROM cards
-		WHERE user_id = ? AND deleted_at IS NULL
+		WHERE user_id = ? AND deleted_at IS NULL AND suspended_at IS NULL
+		AND (buried_until IS NULL OR buried_until <= ?)
 	`
 
 	var count int
-	err := s.db.QueryRow(query, todayEnd, todayEnd, userID, today, userID, today, userID, userID).Scan(&count)
-	if err != nil {
+	if err := s.db.QueryRow(dueQuery, todayEnd, todayEnd, userID, now).Scan(&count); err != nil {
 		return 0, fmt.Errorf("error getting due card count: %w", err)
 	}
 
+	decks, err := s.listDecks(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	study, err := s.loadQueueSettings(userID, settings)
+	if err != nil {
+		return 0, err
+	}
+
+	// New cards each deck has available and has started today, in one pass over the user's cards
+	newQuery := `
+		SELECT
+			deck_id,
+			COALESCE(SUM(CASE WHEN state = 'new' AND suspended_at IS NULL AND (buried_until IS NULL OR buried_until <= ?) THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN first_reviewed_at >= ? THEN 1 ELSE 0 END), 0)
+		FROM cards
+		WHERE user_id = ? AND deleted_at IS NULL
+		GROUP BY deck_id
+	`
+
+	rows, err := s.db.Query(newQuery, now, today, userID)
+	if err != nil {
+		return 0, fmt.Errorf("error counting new cards per deck: %w", err)
+	}
+	defer rows.Close()
+
+	type newCardCounts struct{ available, startedToday int }
+	countsByDeck := make(map[string]newCardCounts)
+	for rows.Next() {
+		var deckID string
+		var counts newCardCounts
+		if err := rows.Scan(&deckID, &counts.available, &counts.startedToday); err != nil {
+			return 0, fmt.Errorf("error scanning new card counts: %w", err)
+		}
+		countsByDeck[deckID] = counts
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating new card counts: %w", err)
+	}
+
+	for i := range decks {
+		counts := countsByDeck[decks[i].ID]
+		count += min(study.newCardAllowance(&decks[i], counts.startedToday), counts.available)
+	}
+
 	return count, nil
 }
 
@@ -275,20 +511,20 @@ func (s *Storage) GetDueCards(userID string, deckID string, limit int) ([]Card,
 	// todayEnd := time.Now()
 
 	query := `
-		SELECT id, deck_id, fields, user_id, next_review, interval, ease,
-		       review_count, laps_count, last_reviewed_at, first_reviewed_at, state,
-		       learning_step, created_at, updated_at, deleted_at
+		SELECT ` + cardColumns + `
 		FROM cards c
 		WHERE c.user_id = ?
 		AND c.deck_id = ?
 		AND c.deleted_at IS NULL
+		AND c.suspended_at IS NULL
+		AND (c.buried_until IS NULL OR c.buried_until <= ?)
 		AND c.next_review IS NOT NULL
 		AND c.next_review <= ?
 		ORDER BY c.next_review ASC
 		LIMIT ?
 	`
 
-	rows, err := s.db.Query(query, userID, deckID, todayEnd, limit)
+	rows, err := s.db.Query(query, userID, deckID, time.Now(), todayEnd, limit)
 	if err != nil {
 		return nil, fmt.Errorf("error getting due cards: %w", err)
 	}
@@ -296,31 +532,10 @@ func (s *Storage) GetDueCards(userID string, deckID string, limit int) ([]Card,
 
 	var cards []Card
 	for rows.Next() {
-		var card Card
-		var intervalNs int64
-
-		if err := rows.Scan(
-			&card.ID,
-			&card.DeckID,
-			&card.Fields,
-			&card.UserID,
-			&card.NextReview,
-			&intervalNs,
-			&card.Ease,
-			&card.ReviewCount,
-			&card.LapsCount,
-			&card.LastReviewedAt,
-			&card.FirstReviewedAt,
-			&card.State,
-			&card.LearningStep,
-			&card.CreatedAt,
-			&card.UpdatedAt,
-			&card.DeletedAt,
-		); err != nil {
+		card, err := scanCard(rows)
+		if err != nil {
 			return nil, fmt.Errorf("error scanning due card: %w", err)
 		}
-
-		card.Interval = time.Duration(intervalNs)
 		cards = append(cards, card)
 	}
 
@@ -331,13 +546,56 @@ func (s *Storage) GetDueCards(userID string, deckID string, limit int) ([]Card,
 	return cards, nil
 }
 
-func CalculatePreviewInterval(card Card, rating int) time.Duration {
+// GetCardsFailedSince returns cards whose latest review since the given time was rated Again, in the order
+// they were failed, whatever their next review. An empty deckID covers all of the user's decks.
+func (s *Storage) GetCardsFailedSince(userID string, deckID string, since time.Time, limit int) ([]Card, error) {
+	query := `
+		SELECT ` + cardColumns + `
+		FROM cards c
+		JOIN reviews r ON r.card_id = c.id AND r.user_id = c.user_id AND r.reviewed_at = (
+			SELECT MAX(reviewed_at) FROM reviews WHERE card_id = c.id AND user_id = c.user_id AND reviewed_at >= ?
+		)
+		WHERE c.user_id = ?
+		AND (? = '' OR c.deck_id = ?)
+		AND c.deleted_at IS NULL
+		AND c.suspended_at IS NULL
+		AND (c.buried_until IS NULL OR c.buried_until <= ?)
+		AND r.rating = ?
+		ORDER BY r.reviewed_at ASC
+		LIMIT ?
+	`
+
+	// reviewed_at is stored as text in server local time, since has to be in the same zone to compare
+	rows, err := s.db.Query(query, since.Local(), userID, deckID, deckID, time.Now(), RatingAgain, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error getting failed cards: %w", err)
+	}
+	defer rows.Close()
+
+	var cards []Card
+	for rows.Next() {
+		card, err := scanCard(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning failed card: %w", err)
+		}
+		cards = append(cards, card)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating failed card rows: %w", err)
+	}
+
+	return cards, nil
+}
+
+func CalculatePreviewInterval(card Card, rating int, easeSettings EaseSettings) time.Duration {
 	params, err := calculateNextReviewParameters(
 		CardState(card.State),
 		card.LearningStep,
 		card.Interval, // Card's current interval
 		card.Ease,     // Card's current ease
 		rating,
+		easeSettings,
 	)
 	if err != nil {
 		fmt.Printf("Warning: calculatePreviewInterval failed for card ID %s (state: %s, rating: %d): %v. Returning default.\n", card.ID, card.State, rating, err)
@@ -346,27 +604,105 @@ func CalculatePreviewInterval(card Card, rating int) time.Duration {
 	return params.Interval
 }
 
+// NoSessionNewLimit disables the per-fetch cap on new cards in GetCardsForReview
+const NoSessionNewLimit = -1
+
+// MatureInterval is the review interval from which a card counts as mature rather than young
+const MatureInterval = 21 * 24 * time.Hour
+
+// DeckBreakdown counts every card of a deck by state, regardless of what is due today
+type DeckBreakdown struct {
+	Total      int `json:"total"`
+	New        int `json:"new"`
+	Learning   int `json:"learning"`
+	Review     int `json:"review"`
+	Relearning int `json:"relearning"`
+	Young      int `json:"young"`  // Review cards with an interval below MatureInterval
+	Mature     int `json:"mature"` // Review cards with an interval of at least MatureInterval
+}
+
+// GetDeckBreakdown counts the deck's cards per state in a single grouped query
+func (s *Storage) GetDeckBreakdown(userID, deckID string) (*DeckBreakdown, error) {
+	query := `
+		SELECT COALESCE(state, ?), COUNT(*),
+		       COALESCE(SUM(CASE WHEN interval >= ? THEN 1 ELSE 0 END), 0)
+		FROM cards
+		WHERE user_id = ? AND deck_id = ? AND deleted_at IS NULL
+		GROUP BY COALESCE(state, ?)
+	`
+
+	rows, err := s.db.Query(query, StateNew, MatureInterval.Nanoseconds(), userID, deckID, StateNew)
+	if err != nil {
+		return nil, fmt.Errorf("error counting cards by state: %w", err)
+	}
+	defer rows.Close()
+
+	breakdown := &DeckBreakdown{}
+	for rows.Next() {
+		var state CardState
+		var count, mature int
+		if err := rows.Scan(&state, &count, &mature); err != nil {
+			return nil, fmt.Errorf("error scanning card state count: %w", err)
+		}
+
+		breakdown.Total += count
+		switch state {
+		case StateNew:
+			breakdown.New += count
+		case StateLearning:
+			breakdown.Learning += count
+		case StateReview:
+			breakdown.Review += count
+			breakdown.Mature += mature
+			breakdown.Young += count - mature
+		case StateRelearning:
+			breakdown.Relearning += count
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating card state counts: %w", err)
+	}
+
+	return breakdown, nil
+}
+
+// GetCardsForReview returns due and new cards of the deck for a study session. sessionNewLimit caps how many
+// new cards a single fetch may return on top of the daily budget, NoSessionNewLimit turns it off.
+// Due reviews are only bounded by limit, a deck taking no new cards a day still gets its reviews.
 func (s *Storage) GetCardsForReview(
 	userID string,
-	deckID string,
+	settings *UserSettings,
+	deck *Deck,
 	limit int,
-	newCardsLimitForDay int,
+	sessionNewLimit int,
 ) ([]Card, error) {
-	// reviewLimit := newCardsLimitForDay * 10
+	study, err := s.loadQueueSettings(userID, settings)
+	if err != nil {
+		return nil, err
+	}
 
-	reviewCards, err := s.GetDueCards(userID, deckID, limit)
+	reviewCards, err := s.GetDueCards(userID, deck.ID, limit)
 	if err != nil {
 		return nil, fmt.Errorf("error getting review cards: %w", err)
 	}
 
-	newCards, err := s.GetNewCards(userID, deckID, limit, newCardsLimitForDay)
-	if err != nil {
-		return nil, fmt.Errorf("error getting new cards: %w", err)
+	newLimit := limit
+	if sessionNewLimit != NoSessionNewLimit && sessionNewLimit < newLimit {
+		newLimit = sessionNewLimit
+	}
+
+	var newCards []Card
+	if newLimit > 0 && deck.NewCardsPerDay > 0 {
+		newCards, err = s.getNewCards(userID, deck, study, newLimit)
+		if err != nil {
+			return nil, fmt.Errorf("error getting new cards: %w", err)
+		}
 	}
 
 	combinedCards := append(reviewCards, newCards...)
 
-	SortCardsForReview(combinedCards, time.Now())
+	SortCardsForReview(combinedCards, time.Now(), study.studyOrder)
 
 	if len(combinedCards) > limit {
 		combinedCards = combinedCards[:limit]
@@ -375,6 +711,92 @@ func (s *Storage) GetCardsForReview(
 	return combinedCards, nil
 }
 
+// StreamDeckCardFields calls fn with the raw fields JSON of each of the deck's cards in creation order,
+// without loading the whole deck into memory
+func (s *Storage) StreamDeckCardFields(userID, deckID string, fn func(fields string) error) error {
+	query := `
+		SELECT fields
+		FROM cards
+		WHERE user_id = ? AND deck_id = ? AND deleted_at IS NULL
+		ORDER BY created_at ASC, rowid ASC
+	`
+
+	rows, err := s.db.Query(query, userID, deckID)
+	if err != nil {
+		return fmt.Errorf("error querying deck cards: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var fields string
+		if err := rows.Scan(&fields); err != nil {
+			return fmt.Errorf("error scanning deck card: %w", err)
+		}
+
+		if err := fn(fields); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating deck cards: %w", err)
+	}
+
+	return nil
+}
+
+// GetCardsForReviewAcrossDecks builds one study queue from the user's decks, as returned by GetDecks. Each deck
+// contributes its due reviews and new cards within its own daily budget, and sessionNewLimit caps
+// the new cards of the combined queue rather than each deck's share.
+func (s *Storage) GetCardsForReviewAcrossDecks(userID string, settings *UserSettings, decks []Deck, limit int, sessionNewLimit int) ([]Card, error) {
+	study, err := s.loadQueueSettings(userID, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	newLimit := limit
+	if sessionNewLimit != NoSessionNewLimit && sessionNewLimit < newLimit {
+		newLimit = sessionNewLimit
+	}
+
+	var combinedCards []Card
+	for i := range decks {
+		deck := &decks[i]
+		reviewCards, err := s.GetDueCards(userID, deck.ID, limit)
+		if err != nil {
+			return nil, fmt.Errorf("error getting review cards for deck %s: %w", deck.ID, err)
+		}
+		combinedCards = append(combinedCards, reviewCards...)
+
+		if newLimit > 0 && deck.NewCardsPerDay > 0 {
+			newCards, err := s.getNewCards(userID, deck, study, newLimit)
+			if err != nil {
+				return nil, fmt.Errorf("error getting new cards for deck %s: %w", deck.ID, err)
+			}
+			combinedCards = append(combinedCards, newCards...)
+		}
+	}
+
+	SortCardsForReview(combinedCards, time.Now(), study.studyOrder)
+
+	queue := make([]Card, 0, min(limit, len(combinedCards)))
+	newCount := 0
+	for _, card := range combinedCards {
+		if len(queue) == limit {
+			break
+		}
+		if card.State == string(StateNew) {
+			if newCount == newLimit {
+				continue
+			}
+			newCount++
+		}
+		queue = append(queue, card)
+	}
+
+	return queue, nil
+}
+
 func FormatSimpleDuration(d time.Duration) string {
 	if d <= 0 {
 		// For display, a 0 or negative interval after calculation (before fallback) might appear as a very short step.
@@ -433,8 +855,14 @@ func roundSeconds(f float64) float64 {
 // 2. Then review cards
 // 3. Then new cards
 // 4. Finally, learning/relearning cards with next_review_time < referenceTime
+// With StudyOrderNewFirst steps 2 and 3 are swapped.
 // Within each category, cards are sorted by next review time or creation date
-func SortCardsForReview(cards []Card, referenceTime time.Time) {
+func SortCardsForReview(cards []Card, referenceTime time.Time, order string) {
+	reviewCategory, newCategory := 1, 2
+	if order == StudyOrderNewFirst {
+		reviewCategory, newCategory = 2, 1
+	}
+
 	// Define sorting priority
 	sort.SliceStable(cards, func(i, j int) bool {
 		a, b := cards[i], cards[j]
@@ -447,9 +875,9 @@ func SortCardsForReview(cards []Card, referenceTime time.Time) {
 				}
 				return 3 // Learning/relearning, but in the future
 			case StateReview:
-				return 1
+				return reviewCategory
 			case StateNew:
-				return 2
+				return newCategory
 			default:
 				return 4 // Fallback for unknown states
 			}
@@ -476,7 +904,7 @@ func SortCardsForReview(cards []Card, referenceTime time.Time) {
 			}
 			return a.LastReviewedAt.Before(*b.LastReviewedAt) // Earlier reviewed first
 
-		case 1: // Review cards
+		case reviewCategory: // Review cards
 			// For review cards, sort by next_review time
 			if a.NextReview == nil && b.NextReview == nil {
 				return a.CreatedAt.Before(b.CreatedAt) // Fallback to creation time
@@ -489,8 +917,11 @@ func SortCardsForReview(cards []Card, referenceTime time.Time) {
 			}
 			return a.NextReview.Before(*b.NextReview) // Earlier due date first
 
-		case 2: // New cards
-			// Sort by created_at
+		case newCategory: // New cards
+			// Higher priority first, then by created_at
+			if a.Priority != b.Priority {
+				return a.Priority > b.Priority
+			}
 			return a.CreatedAt.Before(b.CreatedAt) // Older cards first
 
 		default:
@@ -501,77 +932,30 @@ func SortCardsForReview(cards []Card, referenceTime time.Time) {
 
 func (s *Storage) GetCard(cardID string, userID string) (*Card, error) {
 	query := `
-		SELECT id, deck_id, fields, user_id, next_review, interval, ease,
-		       review_count, laps_count, last_reviewed_at, first_reviewed_at, state,
-		       learning_step, created_at, updated_at, deleted_at
-		FROM cards
+		SELECT ` + cardColumns + `
+		FROM cards c
 		WHERE id = ? AND user_id = ? AND deleted_at IS NULL
 	`
 
-	var card Card
-	var intervalNs int64
+	card, err := scanCard(s.db.QueryRow(query, cardID, userID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("error getting card: %w", err)
+	}
 
-	err := s.db.QueryRow(query, cardID, userID).Scan(
-		&card.ID,
-		&card.DeckID,
-		&card.Fields,
-		&card.UserID,
-		&card.NextReview,
-		&intervalNs,
-		&card.Ease,
-		&card.ReviewCount,
-		&card.LapsCount,
-		&card.LastReviewedAt,
-		&card.FirstReviewedAt,
-		&card.State,
-		&card.LearningStep,
-		&card.CreatedAt,
-		&card.UpdatedAt,
-		&card.DeletedAt,
-	)
-
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, ErrNotFound
-		}
-		return nil, fmt.Errorf("error getting card: %w", err)
-	}
-
-	card.Interval = time.Duration(intervalNs)
 	return &card, nil
 }
 
 func (s *Storage) GetCardByID(cardID string) (*Card, error) {
 	query := `
-		SELECT id, deck_id, fields, user_id, next_review, interval, ease,
-		       review_count, laps_count, last_reviewed_at, first_reviewed_at, state,
-		       learning_step, created_at, updated_at, deleted_at
-		FROM cards
+		SELECT ` + cardColumns + `
+		FROM cards c
 		WHERE id = ? AND deleted_at IS NULL
 	`
 
-	var card Card
-	var intervalNs int64
-
-	err := s.db.QueryRow(query, cardID).Scan(
-		&card.ID,
-		&card.DeckID,
-		&card.Fields,
-		&card.UserID,
-		&card.NextReview,
-		&intervalNs,
-		&card.Ease,
-		&card.ReviewCount,
-		&card.LapsCount,
-		&card.LastReviewedAt,
-		&card.FirstReviewedAt,
-		&card.State,
-		&card.LearningStep,
-		&card.CreatedAt,
-		&card.UpdatedAt,
-		&card.DeletedAt,
-	)
-
+	card, err := scanCard(s.db.QueryRow(query, cardID))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNotFound
@@ -579,7 +963,6 @@ func (s *Storage) GetCardByID(cardID string) (*Card, error) {
 		return nil, fmt.Errorf("error getting card by ID: %w", err)
 	}
 
-	card.Interval = time.Duration(intervalNs)
 	return &card, nil
 }
 
@@ -607,3 +990,612 @@ func (s *Storage) UpdateCardFields(cardID string, fields string) error {
 
 	return nil
 }
+
+// Outcomes of generating a card's content, recorded in cards.generation_status. Cards never generated in bulk have none.
+const (
+	GenerationStatusGenerated = "generated"
+	GenerationStatusFailed    = "failed"
+)
+
+// SetCardGenerationStatus records the outcome of generating the card's content together with the reason
+// it failed, empty when it didn't
+func (s *Storage) SetCardGenerationStatus(cardID, status, generationError string) error {
+	query := `
+		UPDATE cards
+		SET generation_status = ?, generation_error = ?
+		WHERE id = ? AND deleted_at IS NULL
+	`
+
+	result, err := s.db.Exec(query, status, generationError, cardID)
+	if err != nil {
+		return fmt.Errorf("error updating card generation status: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking updated rows: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// GetFailedGenerations returns the reasons generation last failed for the deck's cards, keyed by card ID
+func (s *Storage) GetFailedGenerations(userID, deckID string) (map[string]string, error) {
+	query := `
+		SELECT id, generation_error
+		FROM cards
+		WHERE user_id = ? AND deck_id = ? AND generation_status = ? AND deleted_at IS NULL
+	`
+
+	rows, err := s.db.Query(query, userID, deckID, GenerationStatusFailed)
+	if err != nil {
+		return nil, fmt.Errorf("error querying failed generations: %w", err)
+	}
+	defer rows.Close()
+
+	failures := make(map[string]string)
+	for rows.Next() {
+		var cardID, generationError string
+		if err := rows.Scan(&cardID, &generationError); err != nil {
+			return nil, fmt.Errorf("error scanning failed generation: %w", err)
+		}
+		failures[cardID] = generationError
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating failed generation rows: %w", err)
+	}
+
+	return failures, nil
+}
+
+// GetStuckCards returns the deck's cards that reached the deck's stuck review limit without graduating,
+// longest stuck first. Such cards usually have unclear content worth editing.
+func (s *Storage) GetStuckCards(userID string, deckID string) ([]Card, error) {
+	query := `
+		SELECT ` + cardColumns + `
+		FROM cards c
+		WHERE user_id = ? AND deck_id = ? AND deleted_at IS NULL AND stuck_at IS NOT NULL
+		ORDER BY stuck_at ASC
+	`
+
+	rows, err := s.db.Query(query, userID, deckID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting stuck cards: %w", err)
+	}
+	defer rows.Close()
+
+	cards := make([]Card, 0)
+	for rows.Next() {
+		card, err := scanCard(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning stuck card: %w", err)
+		}
+		cards = append(cards, card)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating stuck cards: %w", err)
+	}
+
+	return cards, nil
+}
+
+// searchableFields are the card fields SearchCards matches against
+var searchableFields = []string{"term", "meaning_en", "meaning_ru", "example_native"}
+
+// normalizeSearchText lowercases text and drops furigana readings, so "天気[てんき]" is searched as "天気"
+func normalizeSearchText(text string) string {
+	return strings.ToLower(utils.RemoveFurigana(text))
+}
+
+// searchMatch reports whether text contains needle, a query run through normalizeSearchText, ignoring case
+// and furigana. It is registered as the search_match SQL function, LIKE only ignores case for ASCII.
+func searchMatch(text, needle string) bool {
+	return strings.Contains(normalizeSearchText(text), needle) || strings.Contains(strings.ToLower(text), needle)
+}
+
+// searchGlob returns a GLOB pattern matching every text searchMatch matches needle in: the needle's runes in
+// order, each in any of its cases, with anything in between since dropped furigana may separate them
+func searchGlob(needle string) string {
+	var pattern strings.Builder
+	pattern.WriteByte('*')
+	for _, r := range needle {
+		switch {
+		case r == '*' || r == '?' || r == '[':
+			pattern.WriteString("[" + string(r) + "]")
+		case unicode.SimpleFold(r) != r:
+			pattern.WriteByte('[')
+			for f := r; ; {
+				pattern.WriteRune(f)
+				if f = unicode.SimpleFold(f); f == r {
+					break
+				}
+			}
+			pattern.WriteByte(']')
+		default:
+			pattern.WriteRune(r)
+		}
+		pattern.WriteByte('*')
+	}
+	return pattern.String()
+}
+
+// SearchCards returns the user's cards whose term, meanings or example contain query, newest first.
+// Fields are read with json_extract, so keys and other fields of the JSON don't match. Matching ignores case,
+// Russian meanings included, and furigana: "天気" finds "天気[てんき]" and so does "てんき". The searchGlob
+// pattern narrows the cards down in SQL, search_match only checks the fields it lets through.
+func (s *Storage) SearchCards(userID, query string, limit, offset int) ([]Card, error) {
+	needle := normalizeSearchText(strings.TrimSpace(query))
+	if needle == "" || limit <= 0 {
+		return []Card{}, nil
+	}
+
+	glob := searchGlob(needle)
+	args := []any{userID}
+	matches := make([]string, len(searchableFields))
+	for i, field := range searchableFields {
+		value := fmt.Sprintf("CAST(COALESCE(json_extract(c.fields, '$.%s'), '') AS TEXT)", field)
+		matches[i] = fmt.Sprintf("(%s GLOB ? AND search_match(%s, ?))", value, value)
+		args = append(args, glob, needle)
+	}
+	args = append(args, limit, offset)
+
+	sqlQuery := `
+		SELECT ` + cardColumns + `
+		FROM cards c
+		WHERE c.user_id = ? AND c.deleted_at IS NULL AND json_valid(c.fields)
+		  AND c.deck_id IN (SELECT id FROM decks WHERE deleted_at IS NULL)
+		  AND (` + strings.Join(matches, " OR ") + `)
+		ORDER BY c.created_at DESC, c.id
+		LIMIT ? OFFSET ?
+	`
+
+	rows, err := s.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error searching cards: %w", err)
+	}
+	defer rows.Close()
+
+	cards := make([]Card, 0)
+	for rows.Next() {
+		card, err := scanCard(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning searched card: %w", err)
+		}
+		cards = append(cards, card)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating searched cards: %w", err)
+	}
+
+	return cards, nil
+}
+
+// RecentCard is a card listed across decks, together with the name of its deck
+type RecentCard struct {
+	Card
+	DeckName string `json:"deck_name"`
+}
+
+// GetRecentCards returns the user's most recently created cards across all decks, newest first
+func (s *Storage) GetRecentCards(userID string, limit int) ([]RecentCard, error) {
+	query := `
+		SELECT ` + cardColumns + `, d.name
+		FROM cards c
+		JOIN decks d ON d.id = c.deck_id AND d.deleted_at IS NULL
+		WHERE c.user_id = ? AND c.deleted_at IS NULL
+		ORDER BY c.created_at DESC, c.rowid DESC
+		LIMIT ?
+	`
+
+	rows, err := s.db.Query(query, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error getting recent cards: %w", err)
+	}
+	defer rows.Close()
+
+	cards := make([]RecentCard, 0)
+	for rows.Next() {
+		var card RecentCard
+		var err error
+		card.Card, err = scanCard(rows, &card.DeckName)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning recent card: %w", err)
+		}
+		cards = append(cards, card)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating recent cards: %w", err)
+	}
+
+	return cards, nil
+}
+
+// Bounds of Card.Priority, 0 being the priority of every card nobody prioritized
+const (
+	MinCardPriority = -100
+	MaxCardPriority = 100
+)
+
+// IsValidCardPriority reports whether priority is an allowed card priority
+func IsValidCardPriority(priority int) bool {
+	return priority >= MinCardPriority && priority <= MaxCardPriority
+}
+
+// UpdateCardPriority sets the priority deciding which new cards of a deck are studied first
+func (s *Storage) UpdateCardPriority(cardID, userID string, priority int) error {
+	result, err := s.db.Exec(`UPDATE cards SET priority = ?, updated_at = ? WHERE id = ? AND user_id = ? AND deleted_at IS NULL`,
+		priority, time.Now(), cardID, userID)
+	if err != nil {
+		return fmt.Errorf("error updating card priority: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking updated rows: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// DeleteCard soft-deletes a card together with its tasks
+func (s *Storage) DeleteCard(cardID, userID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	now := time.Now()
+
+	cardQuery := `
+		UPDATE cards
+		SET deleted_at = ?, updated_at = ?
+		WHERE id = ? AND user_id = ? AND deleted_at IS NULL
+	`
+	result, err := tx.Exec(cardQuery, now, now, cardID, userID)
+	if err != nil {
+		return fmt.Errorf("error marking card as deleted: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		err = ErrNotFound
+		return err
+	}
+
+	tasksQuery := `
+		UPDATE tasks
+		SET deleted_at = ?, updated_at = ?
+		WHERE card_id = ? AND user_id = ? AND deleted_at IS NULL
+	`
+	_, err = tx.Exec(tasksQuery, now, now, cardID, userID)
+	if err != nil {
+		return fmt.Errorf("error marking card tasks as deleted: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+// RestoreCard undoes DeleteCard. Only tasks deleted together with the card are restored,
+// and cards whose deck has been deleted stay deleted.
+func (s *Storage) RestoreCard(cardID, userID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var deletedAt time.Time
+	err = tx.QueryRow(`
+		SELECT c.deleted_at
+		FROM cards c
+		JOIN decks d ON d.id = c.deck_id
+		WHERE c.id = ? AND c.user_id = ? AND c.deleted_at IS NOT NULL AND d.deleted_at IS NULL
+	`, cardID, userID).Scan(&deletedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+			return err
+		}
+		return fmt.Errorf("error fetching deleted card: %w", err)
+	}
+
+	now := time.Now()
+
+	_, err = tx.Exec(`
+		UPDATE cards
+		SET deleted_at = NULL, updated_at = ?
+		WHERE id = ? AND user_id = ?
+	`, now, cardID, userID)
+	if err != nil {
+		return fmt.Errorf("error restoring card: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE tasks
+		SET deleted_at = NULL, updated_at = ?
+		WHERE card_id = ? AND user_id = ? AND deleted_at >= ?
+	`, now, cardID, userID, deletedAt)
+	if err != nil {
+		return fmt.Errorf("error restoring card tasks: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+// ResetDailyNewCards gives the user back today's new-card budget and returns how many started cards it
+// forgave. The counts are kept in the user's settings as a NewCardReset for today, the cards' review
+// history is left as it is. Only the new_card_reset key of the settings is written, so settings saved at
+// the same time aren't overwritten.
+func (s *Storage) ResetDailyNewCards(userID string) (total int, err error) {
+	now := time.Now()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	query := `
+		SELECT deck_id, COUNT(*)
+		FROM cards
+		WHERE user_id = ?
+		AND deleted_at IS NULL
+		AND first_reviewed_at >= ?
+		GROUP BY deck_id
+	`
+
+	rows, err := tx.Query(query, userID, studyDayStart(now))
+	if err != nil {
+		return 0, fmt.Errorf("error counting new cards started today: %w", err)
+	}
+	defer rows.Close()
+
+	reset := &NewCardReset{Day: studyDay(now), Decks: make(map[string]int)}
+	for rows.Next() {
+		var deckID string
+		var count int
+		if err = rows.Scan(&deckID, &count); err != nil {
+			return 0, fmt.Errorf("error scanning started card count: %w", err)
+		}
+		reset.Decks[deckID] = count
+		total += count
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating started card counts: %w", err)
+	}
+	rows.Close()
+
+	resetJSON, err := json.Marshal(reset)
+	if err != nil {
+		return 0, fmt.Errorf("error serializing new card reset: %w", err)
+	}
+
+	// A user who never saved settings gets the defaults, as GetUserByID would have returned them
+	defaultsJSON, err := json.Marshal(DefaultUserSettings())
+	if err != nil {
+		return 0, fmt.Errorf("error serializing default settings: %w", err)
+	}
+
+	result, err := tx.Exec(`
+		UPDATE users
+		SET settings = json_set(COALESCE(NULLIF(settings, ''), ?), '$.new_card_reset', json(?)), updated_at = ?
+		WHERE id = ?
+	`, string(defaultsJSON), string(resetJSON), now, userID)
+	if err != nil {
+		return 0, fmt.Errorf("error saving new card reset: %w", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error checking rows affected: %w", err)
+	}
+	if updated == 0 {
+		err = ErrNotFound
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return total, nil
+}
+
+// CardFilter selects cards for bulk operations; empty fields match every card
+type CardFilter struct {
+	DeckID  string
+	Tag     string
+	IsLeech *bool
+	State   string
+}
+
+// IsValidTag reports whether tag can be stored in a card's space separated tags
+func IsValidTag(tag string) bool {
+	return tag != "" && !strings.ContainsFunc(tag, unicode.IsSpace)
+}
+
+// IsValidCardState reports whether state is one of the card states
+func IsValidCardState(state string) bool {
+	switch CardState(state) {
+	case StateNew, StateLearning, StateReview, StateRelearning:
+		return true
+	}
+	return false
+}
+
+// SuspendCard takes the card out of study or brings it back, keeping its scheduling state either way.
+// Suspending an already suspended card keeps the time it was first suspended.
+func (s *Storage) SuspendCard(cardID, userID string, suspended bool) error {
+	now := time.Now()
+	query := `
+		UPDATE cards
+		SET suspended_at = CASE WHEN ? THEN COALESCE(suspended_at, ?) ELSE NULL END, updated_at = ?
+		WHERE id = ? AND user_id = ? AND deleted_at IS NULL
+	`
+
+	result, err := s.db.Exec(query, suspended, now, now, cardID, userID)
+	if err != nil {
+		return fmt.Errorf("error updating card suspension: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking updated rows: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// BuryCard keeps the card out of study until the start of tomorrow in the user's time zone and returns that
+// time. Unlike suspension nothing has to undo it, the queues pick the card up again once the time has passed.
+func (s *Storage) BuryCard(cardID, userID string) (time.Time, error) {
+	settings, err := s.GetUserSettings(userID)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error getting user settings: %w", err)
+	}
+
+	location := ResolveLocation(settings)
+	now := time.Now()
+	local := now.In(location)
+	// Stored in server local time like the times buried_until is compared with, comparisons are textual
+	tomorrow := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, location).Local()
+
+	query := `
+		UPDATE cards
+		SET buried_until = ?, updated_at = ?
+		WHERE id = ? AND user_id = ? AND deleted_at IS NULL
+	`
+
+	result, err := s.db.Exec(query, tomorrow, now, cardID, userID)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error burying card: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error checking updated rows: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return time.Time{}, ErrNotFound
+	}
+
+	return tomorrow, nil
+}
+
+// SetCardsSuspended suspends or unsuspends every card of the user matching filter and returns how many
+// cards changed. Cards already in the requested state are left alone, so they aren't counted.
+func (s *Storage) SetCardsSuspended(userID string, filter CardFilter, suspended bool) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	now := time.Now()
+
+	query := `UPDATE cards SET suspended_at = ?, updated_at = ? WHERE user_id = ? AND deleted_at IS NULL`
+	args := []interface{}{nil, now, userID}
+	if suspended {
+		args[0] = now
+		query += ` AND suspended_at IS NULL`
+	} else {
+		query += ` AND suspended_at IS NOT NULL`
+	}
+
+	if filter.DeckID != "" {
+		var exists bool
+		err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM decks WHERE id = ? AND user_id = ? AND deleted_at IS NULL)`,
+			filter.DeckID, userID).Scan(&exists)
+		if err != nil {
+			return 0, fmt.Errorf("error checking deck: %w", err)
+		}
+		if !exists {
+			err = ErrNotFound
+			return 0, err
+		}
+
+		query += ` AND deck_id = ?`
+		args = append(args, filter.DeckID)
+	}
+
+	if filter.Tag != "" {
+		query += ` AND instr(' ' || tags || ' ', ' ' || ? || ' ') > 0`
+		args = append(args, filter.Tag)
+	}
+
+	if filter.IsLeech != nil {
+		if *filter.IsLeech {
+			query += ` AND leech_at IS NOT NULL`
+		} else {
+			query += ` AND leech_at IS NULL`
+		}
+	}
+
+	if filter.State != "" {
+		query += ` AND state = ?`
+		args = append(args, filter.State)
+	}
+
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("error updating suspended cards: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error getting suspended card count: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return int(affected), nil
+}
@@ -0,0 +1,948 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	nanoid "github.com/matoous/go-nanoid/v2"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestStorage(tb testing.TB) *Storage {
+	tb.Helper()
+
+	storage, err := ConnectDB(filepath.Join(tb.TempDir(), "test.db"))
+	if err != nil {
+		tb.Fatalf("failed to connect to test database: %v", err)
+	}
+	tb.Cleanup(func() { _ = storage.Close() })
+
+	return storage
+}
+
+func newTestDeck(tb testing.TB, storage *Storage) (string, *Deck) {
+	tb.Helper()
+
+	userID := nanoid.Must()
+	if err := storage.SaveUser(&User{ID: userID, TelegramID: 1, LanguageCode: "en"}); err != nil {
+		tb.Fatalf("failed to save user: %v", err)
+	}
+
+	deck, err := storage.CreateDeck(userID, CreateDeckParams{Name: "Batch Deck", Level: "mixed", LanguageCode: "jp", TranscriptionType: "furigana"})
+	if err != nil {
+		tb.Fatalf("failed to create deck: %v", err)
+	}
+
+	return userID, deck
+}
+
+func cardFields(n int) []string {
+	fields := make([]string, n)
+	for i := range fields {
+		fields[i] = fmt.Sprintf(`{"term":"word-%d"}`, i)
+	}
+	return fields
+}
+
+func TestAddCards_Chunked(t *testing.T) {
+	tests := []struct {
+		name               string
+		cards              int
+		chunkSize          int
+		expectedStatements int
+	}{
+		{name: "Single row statements", cards: 250, chunkSize: 1, expectedStatements: 250},
+		{name: "Default chunk", cards: 5000, chunkSize: DefaultCardBatchSize, expectedStatements: 50},
+		{name: "Partial last chunk", cards: 250, chunkSize: 100, expectedStatements: 3},
+		{name: "Chunk capped by variable limit", cards: 500, chunkSize: 1000, expectedStatements: 4},
+		{name: "Non-positive chunk uses default", cards: 150, chunkSize: 0, expectedStatements: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newTestStorage(t)
+			userID, deck := newTestDeck(t, storage)
+			fields := cardFields(tt.cards)
+
+			newIDs, statements, err := storage.addCards(context.Background(), userID, deck.ID, fields, tt.chunkSize)
+			if err != nil {
+				t.Fatalf("addCards failed: %v", err)
+			}
+			if statements != tt.expectedStatements {
+				t.Errorf("expected %d statements, got %d", tt.expectedStatements, statements)
+			}
+
+			cards, err := storage.GetCardsByDeckID(deck.ID, userID)
+			if err != nil {
+				t.Fatalf("failed to load cards: %v", err)
+			}
+			if len(cards) != tt.cards {
+				t.Fatalf("expected %d cards, got %d", tt.cards, len(cards))
+			}
+
+			ids := make(map[string]bool, len(cards))
+			terms := make(map[string]bool, len(cards))
+			for _, card := range cards {
+				ids[card.ID] = true
+				terms[card.Fields] = true
+				if card.State != "new" || card.Ease != DefaultEase || card.ReviewCount != 0 {
+					t.Fatalf("card %s was not inserted as a fresh card: %+v", card.ID, card)
+				}
+			}
+			if len(ids) != tt.cards {
+				t.Errorf("expected %d unique card ids, got %d", tt.cards, len(ids))
+			}
+			if len(newIDs) != tt.cards {
+				t.Errorf("expected %d returned card ids, got %d", tt.cards, len(newIDs))
+			}
+			for _, id := range newIDs {
+				if !ids[id] {
+					t.Errorf("returned id %s is not a stored card", id)
+				}
+			}
+			for _, f := range fields {
+				if !terms[f] {
+					t.Errorf("missing card with fields %s", f)
+				}
+			}
+		})
+	}
+}
+
+func TestGetCardsForReview_StudyOrder(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	if err := storage.AddCardsInBatch(userID, deck.ID, cardFields(4), DefaultCardBatchSize); err != nil {
+		t.Fatalf("failed to add cards: %v", err)
+	}
+
+	cards, err := storage.GetCardsByDeckID(deck.ID, userID)
+	if err != nil {
+		t.Fatalf("failed to load cards: %v", err)
+	}
+
+	// two cards graduated earlier and are due again, the other two were never studied
+	yesterday := time.Now().Add(-24 * time.Hour)
+	reviewIDs := map[string]bool{cards[0].ID: true, cards[1].ID: true}
+	for id := range reviewIDs {
+		_, err := storage.db.Exec(`UPDATE cards SET state = ?, interval = ?, next_review = ?, first_reviewed_at = ? WHERE id = ?`,
+			StateReview, (3 * 24 * time.Hour).Nanoseconds(), yesterday, yesterday.Add(-72*time.Hour), id)
+		if err != nil {
+			t.Fatalf("failed to move card to review: %v", err)
+		}
+	}
+
+	assertOrder := func(settings *UserSettings, wantReviewFirst bool) {
+		t.Helper()
+
+		queue, err := storage.GetCardsForReview(userID, settings, deck, 10, NoSessionNewLimit)
+		if err != nil {
+			t.Fatalf("GetCardsForReview failed: %v", err)
+		}
+		if len(queue) != 4 {
+			t.Fatalf("expected 4 cards in the queue, got %d", len(queue))
+		}
+
+		for i, card := range queue {
+			wantReview := (i < 2) == wantReviewFirst
+			if reviewIDs[card.ID] != wantReview {
+				t.Fatalf("unexpected card at position %d: state %s", i, card.State)
+			}
+		}
+	}
+
+	settings := DefaultUserSettings()
+	assertOrder(settings, true)
+
+	settings.StudyOrder = StudyOrderNewFirst
+	assertOrder(settings, false)
+}
+
+func BenchmarkAddCardsInBatch(b *testing.B) {
+	fields := cardFields(5000)
+
+	for _, chunkSize := range []int{1, DefaultCardBatchSize} {
+		b.Run(fmt.Sprintf("chunk=%d", chunkSize), func(b *testing.B) {
+			storage := newTestStorage(b)
+			userID, deck := newTestDeck(b, storage)
+
+			statements := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, n, err := storage.addCards(context.Background(), userID, deck.ID, fields, chunkSize)
+				if err != nil {
+					b.Fatalf("addCards failed: %v", err)
+				}
+				statements += n
+			}
+			b.ReportMetric(float64(statements)/float64(b.N), "statements/op")
+		})
+	}
+}
+
+func TestGetCardsForReview_NoNewCardsPerDay(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	if err := storage.AddCardsInBatch(userID, deck.ID, cardFields(3), DefaultCardBatchSize); err != nil {
+		t.Fatalf("failed to add cards: %v", err)
+	}
+
+	cards, err := storage.GetCardsByDeckID(deck.ID, userID)
+	if err != nil {
+		t.Fatalf("failed to load cards: %v", err)
+	}
+
+	yesterday := time.Now().Add(-24 * time.Hour)
+	dueID := cards[0].ID
+	_, err = storage.db.Exec(`UPDATE cards SET state = ?, interval = ?, next_review = ?, first_reviewed_at = ? WHERE id = ?`,
+		StateReview, (3 * 24 * time.Hour).Nanoseconds(), yesterday, yesterday.Add(-72*time.Hour), dueID)
+	if err != nil {
+		t.Fatalf("failed to move card to review: %v", err)
+	}
+
+	deck.NewCardsPerDay = 0
+	queue, err := storage.GetCardsForReview(userID, DefaultUserSettings(), deck, 10, NoSessionNewLimit)
+	if err != nil {
+		t.Fatalf("GetCardsForReview failed: %v", err)
+	}
+	if len(queue) != 1 || queue[0].ID != dueID {
+		t.Fatalf("expected only the due review card, got %d cards", len(queue))
+	}
+}
+
+func TestGetNewCards_NewCardDays(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	if err := storage.AddCardsInBatch(userID, deck.ID, cardFields(3), DefaultCardBatchSize); err != nil {
+		t.Fatalf("failed to add cards: %v", err)
+	}
+
+	// Far from UTC so the weekday differs from the server's for part of every day
+	settings := DefaultUserSettings()
+	settings.Timezone = "Pacific/Kiritimati"
+
+	location, err := time.LoadLocation("Pacific/Kiritimati")
+	if err != nil {
+		t.Fatalf("failed to load location: %v", err)
+	}
+	today := 1 << uint(time.Now().In(location).Weekday())
+
+	tests := []struct {
+		name     string
+		days     int
+		expected int
+	}{
+		{"excluded weekday", AllNewCardDays &^ today, 0},
+		{"included weekday", today, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deck.NewCardDays = tt.days
+			if err := storage.UpdateDeckSettings(deck.ID, deck); err != nil {
+				t.Fatalf("failed to update deck: %v", err)
+			}
+
+			cards, err := storage.GetNewCards(userID, settings, deck, 10)
+			if err != nil {
+				t.Fatalf("GetNewCards failed: %v", err)
+			}
+			if len(cards) != tt.expected {
+				t.Fatalf("expected %d new cards, got %d", tt.expected, len(cards))
+			}
+
+			// The deck statistics and the due count budget new cards like the queue does
+			stats, err := storage.GetDeckStatistics(userID, settings, deck)
+			if err != nil {
+				t.Fatalf("GetDeckStatistics failed: %v", err)
+			}
+			if stats.NewCards != tt.expected {
+				t.Fatalf("expected statistics to show %d new cards, got %d", tt.expected, stats.NewCards)
+			}
+
+			count, err := storage.GetDueCardCount(userID, settings)
+			if err != nil {
+				t.Fatalf("GetDueCardCount failed: %v", err)
+			}
+			if count != tt.expected {
+				t.Fatalf("expected a due count of %d, got %d", tt.expected, count)
+			}
+		})
+	}
+}
+
+func TestGetDueCardCount_PerDeckBudget(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, small := newTestDeck(t, storage)
+
+	large, err := storage.CreateDeck(userID, CreateDeckParams{Name: "Second Deck", Level: "mixed", LanguageCode: "jp", TranscriptionType: "furigana"})
+	if err != nil {
+		t.Fatalf("failed to create deck: %v", err)
+	}
+
+	// A generous budget on a deck with few cards must not let another deck go over its own limit
+	small.NewCardsPerDay = 10
+	large.NewCardsPerDay = 2
+	for _, deck := range []*Deck{small, large} {
+		if err := storage.UpdateDeckSettings(deck.ID, deck); err != nil {
+			t.Fatalf("failed to update deck: %v", err)
+		}
+	}
+
+	if err := storage.AddCardsInBatch(userID, small.ID, cardFields(1), DefaultCardBatchSize); err != nil {
+		t.Fatalf("failed to add cards: %v", err)
+	}
+	if err := storage.AddCardsInBatch(userID, large.ID, cardFields(8), DefaultCardBatchSize); err != nil {
+		t.Fatalf("failed to add cards: %v", err)
+	}
+
+	count, err := storage.GetDueCardCount(userID, DefaultUserSettings())
+	if err != nil {
+		t.Fatalf("GetDueCardCount failed: %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("expected a due count of 3, got %d", count)
+	}
+}
+
+func TestGetNewCards_MissedDayBoost(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	if err := storage.AddCardsInBatch(userID, deck.ID, cardFields(10), DefaultCardBatchSize); err != nil {
+		t.Fatalf("failed to add cards: %v", err)
+	}
+
+	newCardCount := func(newCardsPerDay, boost int) int {
+		t.Helper()
+		deck.NewCardsPerDay = newCardsPerDay
+		deck.NewCardBoost = boost
+		if err := storage.UpdateDeckSettings(deck.ID, deck); err != nil {
+			t.Fatalf("failed to update deck: %v", err)
+		}
+
+		cards, err := storage.GetNewCards(userID, DefaultUserSettings(), deck, 100)
+		if err != nil {
+			t.Fatalf("GetNewCards failed: %v", err)
+		}
+		return len(cards)
+	}
+
+	// Without any study history nothing has been missed
+	if got := newCardCount(2, 3); got != 2 {
+		t.Fatalf("expected 2 new cards for a user who never studied, got %d", got)
+	}
+
+	// Study in another deck three days ago, so the two days since were missed
+	otherDeck, err := storage.CreateDeck(userID, CreateDeckParams{Name: "Other Deck", Level: "mixed", LanguageCode: "jp", TranscriptionType: "furigana"})
+	if err != nil {
+		t.Fatalf("failed to create deck: %v", err)
+	}
+	studied, err := storage.AddCard(userID, otherDeck.ID, `{"term":"word"}`)
+	if err != nil {
+		t.Fatalf("failed to add card: %v", err)
+	}
+	if err := storage.ReviewCard(studied, otherDeck, RatingGood, 3000); err != nil {
+		t.Fatalf("ReviewCard failed: %v", err)
+	}
+	if _, err := storage.db.Exec(`UPDATE reviews SET reviewed_at = ? WHERE card_id = ?`, time.Now().Add(-72*time.Hour), studied.ID); err != nil {
+		t.Fatalf("failed to backdate review: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		boost    int
+		expected int
+	}{
+		{"boost off", 0, 2},
+		{"capped by the deck", 3, 5},
+		{"a day's worth per missed day", 10, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newCardCount(2, tt.boost); got != tt.expected {
+				t.Fatalf("expected %d new cards, got %d", tt.expected, got)
+			}
+		})
+	}
+
+	stats, err := storage.GetDeckStatistics(userID, DefaultUserSettings(), deck)
+	if err != nil {
+		t.Fatalf("GetDeckStatistics failed: %v", err)
+	}
+	if stats.NewCards != 6 {
+		t.Fatalf("expected the boost in the deck statistics, got %d new cards", stats.NewCards)
+	}
+}
+
+func TestGetNewCards_Priority(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	if err := storage.AddCardsInBatch(userID, deck.ID, cardFields(5), DefaultCardBatchSize); err != nil {
+		t.Fatalf("failed to add cards: %v", err)
+	}
+
+	cards, err := storage.GetNewCards(userID, DefaultUserSettings(), deck, 10)
+	if err != nil {
+		t.Fatalf("GetNewCards failed: %v", err)
+	}
+
+	// The last two cards in line are exam words
+	examHigh, examLow := cards[4].ID, cards[3].ID
+	if err := storage.UpdateCardPriority(examHigh, userID, 10); err != nil {
+		t.Fatalf("failed to update priority: %v", err)
+	}
+	if err := storage.UpdateCardPriority(examLow, userID, 5); err != nil {
+		t.Fatalf("failed to update priority: %v", err)
+	}
+	if err := storage.UpdateCardPriority(examLow, "someone-else", MaxCardPriority); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound updating another user's card priority, got %v", err)
+	}
+
+	cards, err = storage.GetNewCards(userID, DefaultUserSettings(), deck, 10)
+	if err != nil {
+		t.Fatalf("GetNewCards failed: %v", err)
+	}
+	if len(cards) != 5 || cards[0].ID != examHigh || cards[1].ID != examLow {
+		t.Fatalf("expected prioritized cards first, got %d cards starting with %s", len(cards), cards[0].ID)
+	}
+
+	// Shuffle and let the review sort put them back
+	cards[0], cards[4] = cards[4], cards[0]
+	SortCardsForReview(cards, time.Now(), StudyOrderReviewsFirst)
+	if cards[0].ID != examHigh || cards[1].ID != examLow {
+		t.Fatalf("expected SortCardsForReview to order new cards by priority")
+	}
+}
+
+func TestGetCardsForReviewAcrossDecks(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, small := newTestDeck(t, storage)
+
+	other, err := storage.CreateDeck(userID, CreateDeckParams{Name: "Second Deck", Level: "mixed", LanguageCode: "jp", TranscriptionType: "furigana"})
+	if err != nil {
+		t.Fatalf("failed to create deck: %v", err)
+	}
+
+	budgets := map[string]int{small.ID: 2, other.ID: 3}
+	for _, deck := range []*Deck{small, other} {
+		deck.NewCardsPerDay = budgets[deck.ID]
+		if err := storage.UpdateDeckSettings(deck.ID, deck); err != nil {
+			t.Fatalf("failed to update deck settings: %v", err)
+		}
+		if err := storage.AddCardsInBatch(userID, deck.ID, cardFields(5), DefaultCardBatchSize); err != nil {
+			t.Fatalf("failed to add cards: %v", err)
+		}
+	}
+
+	perDeck := func(cards []Card) map[string]int {
+		counts := make(map[string]int)
+		for _, card := range cards {
+			counts[card.DeckID]++
+		}
+		return counts
+	}
+
+	decks, err := storage.GetDecks(userID, DefaultUserSettings())
+	if err != nil {
+		t.Fatalf("GetDecks failed: %v", err)
+	}
+
+	cards, err := storage.GetCardsForReviewAcrossDecks(userID, DefaultUserSettings(), decks, 20, NoSessionNewLimit)
+	if err != nil {
+		t.Fatalf("GetCardsForReviewAcrossDecks failed: %v", err)
+	}
+
+	counts := perDeck(cards)
+	for deckID, budget := range budgets {
+		if counts[deckID] != budget {
+			t.Errorf("expected %d new cards from deck %s, got %d", budget, deckID, counts[deckID])
+		}
+	}
+
+	// The session cap applies to the combined queue
+	cards, err = storage.GetCardsForReviewAcrossDecks(userID, DefaultUserSettings(), decks, 20, 4)
+	if err != nil {
+		t.Fatalf("GetCardsForReviewAcrossDecks failed: %v", err)
+	}
+	if len(cards) != 4 {
+		t.Fatalf("expected the session cap of 4 new cards, got %d", len(cards))
+	}
+
+	counts = perDeck(cards)
+	for deckID, budget := range budgets {
+		if counts[deckID] == 0 || counts[deckID] > budget {
+			t.Errorf("expected between 1 and %d cards from deck %s, got %d", budget, deckID, counts[deckID])
+		}
+	}
+}
+
+func TestReviewCard_FlagsStuckCards(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+	deck.StuckReviewLimit = 5
+
+	if err := storage.AddCardsInBatch(userID, deck.ID, cardFields(1), DefaultCardBatchSize); err != nil {
+		t.Fatalf("failed to add cards: %v", err)
+	}
+
+	cards, err := storage.GetCardsByDeckID(deck.ID, userID)
+	if err != nil {
+		t.Fatalf("failed to load cards: %v", err)
+	}
+	card := cards[0]
+
+	stuckCount := func() int {
+		t.Helper()
+		stuck, err := storage.GetStuckCards(userID, deck.ID)
+		if err != nil {
+			t.Fatalf("GetStuckCards failed: %v", err)
+		}
+		return len(stuck)
+	}
+
+	for i := 1; i <= deck.StuckReviewLimit; i++ {
+		if got := stuckCount(); got != 0 {
+			t.Fatalf("card flagged after %d reviews, before reaching the limit", i-1)
+		}
+		if err := storage.ReviewCard(&card, deck, RatingAgain, 1000); err != nil {
+			t.Fatalf("failed to review card: %v", err)
+		}
+	}
+
+	if got := stuckCount(); got != 1 {
+		t.Fatalf("expected the card to be flagged after %d Again reviews, got %d stuck cards", deck.StuckReviewLimit, got)
+	}
+
+	// Graduating clears the flag
+	for card.State != string(StateReview) {
+		if err := storage.ReviewCard(&card, deck, RatingGood, 1000); err != nil {
+			t.Fatalf("failed to review card: %v", err)
+		}
+	}
+	if got := stuckCount(); got != 0 {
+		t.Fatalf("expected a graduated card to no longer be stuck, got %d stuck cards", got)
+	}
+}
+
+func TestGetCardsFailedSince(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	addReviewCard := func() *Card {
+		t.Helper()
+		card, err := storage.AddCard(userID, deck.ID, `{"term":"word"}`)
+		if err != nil {
+			t.Fatalf("failed to add card: %v", err)
+		}
+		card.State = string(StateReview)
+		card.Interval = 3 * 24 * time.Hour
+		card.Ease = DefaultEase
+		return card
+	}
+
+	earlier := addReviewCard()
+	if err := storage.ReviewCard(earlier, deck, RatingAgain, 3000); err != nil {
+		t.Fatalf("ReviewCard failed: %v", err)
+	}
+
+	sessionStart := time.Now()
+
+	failed := addReviewCard()
+	if err := storage.ReviewCard(failed, deck, RatingAgain, 3000); err != nil {
+		t.Fatalf("ReviewCard failed: %v", err)
+	}
+
+	resolved := addReviewCard()
+	if err := storage.ReviewCard(resolved, deck, RatingAgain, 3000); err != nil {
+		t.Fatalf("ReviewCard failed: %v", err)
+	}
+	if err := storage.ReviewCard(resolved, deck, RatingGood, 3000); err != nil {
+		t.Fatalf("ReviewCard failed: %v", err)
+	}
+
+	// The failed card isn't due again before tomorrow, it still has to come back in this session
+	tomorrow := time.Now().Add(48 * time.Hour)
+	if _, err := storage.db.Exec(`UPDATE cards SET next_review = ? WHERE id = ?`, tomorrow, failed.ID); err != nil {
+		t.Fatalf("failed to move next review: %v", err)
+	}
+
+	cards, err := storage.GetCardsFailedSince(userID, deck.ID, sessionStart, 10)
+	if err != nil {
+		t.Fatalf("GetCardsFailedSince failed: %v", err)
+	}
+	if len(cards) != 1 || cards[0].ID != failed.ID {
+		t.Fatalf("expected only the card failed in the session, got %d cards", len(cards))
+	}
+
+	cards, err = storage.GetCardsFailedSince(userID, "", sessionStart, 10)
+	if err != nil {
+		t.Fatalf("GetCardsFailedSince across decks failed: %v", err)
+	}
+	if len(cards) != 1 || cards[0].ID != failed.ID {
+		t.Fatalf("expected the failed card across decks, got %d cards", len(cards))
+	}
+}
+
+func TestSetCardsSuspended_Leeches(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	otherDeck, err := storage.CreateDeck(userID, CreateDeckParams{Name: "Other Deck", Level: "mixed", LanguageCode: "jp", TranscriptionType: "furigana"})
+	if err != nil {
+		t.Fatalf("failed to create deck: %v", err)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	addDueCard := func(deckID string, leech bool) *Card {
+		t.Helper()
+		card, err := storage.AddCard(userID, deckID, `{"term":"word"}`)
+		if err != nil {
+			t.Fatalf("failed to add card: %v", err)
+		}
+		var leechAt *time.Time
+		if leech {
+			leechAt = &past
+		}
+		_, err = storage.db.Exec(`UPDATE cards SET state = ?, next_review = ?, leech_at = ? WHERE id = ?`,
+			StateReview, past, leechAt, card.ID)
+		if err != nil {
+			t.Fatalf("failed to make card due: %v", err)
+		}
+		return card
+	}
+
+	leeches := []*Card{addDueCard(deck.ID, true), addDueCard(deck.ID, true)}
+	healthy := addDueCard(deck.ID, false)
+	otherLeech := addDueCard(otherDeck.ID, true)
+
+	isLeech := true
+	filter := CardFilter{DeckID: deck.ID, IsLeech: &isLeech}
+
+	count, err := storage.SetCardsSuspended(userID, filter, true)
+	if err != nil {
+		t.Fatalf("SetCardsSuspended failed: %v", err)
+	}
+	if count != len(leeches) {
+		t.Fatalf("expected %d suspended cards, got %d", len(leeches), count)
+	}
+
+	dueIDs := func(deckID string) map[string]bool {
+		t.Helper()
+		cards, err := storage.GetDueCards(userID, deckID, 10)
+		if err != nil {
+			t.Fatalf("GetDueCards failed: %v", err)
+		}
+		ids := make(map[string]bool, len(cards))
+		for _, card := range cards {
+			ids[card.ID] = true
+		}
+		return ids
+	}
+
+	due := dueIDs(deck.ID)
+	for _, card := range leeches {
+		if due[card.ID] {
+			t.Fatalf("suspended leech %s is still due", card.ID)
+		}
+	}
+	if !due[healthy.ID] {
+		t.Fatalf("expected the card that isn't a leech to stay due")
+	}
+	if !dueIDs(otherDeck.ID)[otherLeech.ID] {
+		t.Fatalf("expected the leech of another deck to stay due")
+	}
+
+	// Suspending again matches nothing new
+	if count, err = storage.SetCardsSuspended(userID, filter, true); err != nil || count != 0 {
+		t.Fatalf("expected no further cards suspended, got %d (err %v)", count, err)
+	}
+
+	if _, err := storage.SetCardsSuspended(nanoid.Must(), filter, true); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a deck of another user, got %v", err)
+	}
+
+	count, err = storage.SetCardsSuspended(userID, filter, false)
+	if err != nil {
+		t.Fatalf("SetCardsSuspended failed to unsuspend: %v", err)
+	}
+	if count != len(leeches) {
+		t.Fatalf("expected %d unsuspended cards, got %d", len(leeches), count)
+	}
+	if due := dueIDs(deck.ID); !due[leeches[0].ID] || !due[leeches[1].ID] {
+		t.Fatalf("expected unsuspended leeches to be due again")
+	}
+}
+
+func TestSetCardsSuspended_Tag(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	if err := storage.AddCardsInBatch(userID, deck.ID, cardFields(3), DefaultCardBatchSize); err != nil {
+		t.Fatalf("failed to add cards: %v", err)
+	}
+	cards, err := storage.GetCardsByDeckID(deck.ID, userID)
+	if err != nil {
+		t.Fatalf("failed to load cards: %v", err)
+	}
+
+	for i, tags := range []string{"leech", "verb leech", "leeches"} {
+		if _, err := storage.db.Exec(`UPDATE cards SET tags = ? WHERE id = ?`, tags, cards[i].ID); err != nil {
+			t.Fatalf("failed to tag card: %v", err)
+		}
+	}
+
+	count, err := storage.SetCardsSuspended(userID, CardFilter{Tag: LeechTag}, true)
+	if err != nil {
+		t.Fatalf("SetCardsSuspended failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expected the 2 cards tagged %q to be suspended, got %d", LeechTag, count)
+	}
+
+	card, err := storage.GetCard(cards[1].ID, userID)
+	if err != nil {
+		t.Fatalf("failed to load card: %v", err)
+	}
+	if !slices.Equal(card.Tags, []string{"verb", "leech"}) {
+		t.Errorf("expected tags [verb leech], got %v", card.Tags)
+	}
+}
+
+func TestBuryCard(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	past := time.Now().Add(-time.Hour)
+	review, err := storage.AddCard(userID, deck.ID, `{"term":"review"}`)
+	if err != nil {
+		t.Fatalf("failed to add card: %v", err)
+	}
+	if _, err := storage.db.Exec(`UPDATE cards SET state = ?, next_review = ? WHERE id = ?`, StateReview, past, review.ID); err != nil {
+		t.Fatalf("failed to make card due: %v", err)
+	}
+
+	newCard, err := storage.AddCard(userID, deck.ID, `{"term":"new"}`)
+	if err != nil {
+		t.Fatalf("failed to add card: %v", err)
+	}
+
+	queued := func() map[string]bool {
+		t.Helper()
+		cards, err := storage.GetCardsForReview(userID, DefaultUserSettings(), deck, 10, NoSessionNewLimit)
+		if err != nil {
+			t.Fatalf("GetCardsForReview failed: %v", err)
+		}
+		ids := make(map[string]bool, len(cards))
+		for _, card := range cards {
+			ids[card.ID] = true
+		}
+		return ids
+	}
+
+	for _, card := range []*Card{review, newCard} {
+		until, err := storage.BuryCard(card.ID, userID)
+		if err != nil {
+			t.Fatalf("BuryCard failed: %v", err)
+		}
+		if want := time.Now().Truncate(24 * time.Hour).Add(24 * time.Hour); !until.Equal(want) {
+			t.Errorf("expected card buried until %v, got %v", want, until)
+		}
+	}
+
+	if ids := queued(); ids[review.ID] || ids[newCard.ID] {
+		t.Fatalf("expected buried cards to be left out of review, got %v", ids)
+	}
+
+	count, err := storage.GetDueCardCount(userID, DefaultUserSettings())
+	if err != nil {
+		t.Fatalf("GetDueCardCount failed: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("expected buried cards not to be counted as due, got %d", count)
+	}
+
+	// The next day the cards are back without anyone unburying them
+	if _, err := storage.db.Exec(`UPDATE cards SET buried_until = ? WHERE user_id = ?`, past, userID); err != nil {
+		t.Fatalf("failed to move the burial into the past: %v", err)
+	}
+	if ids := queued(); !ids[review.ID] || !ids[newCard.ID] {
+		t.Fatalf("expected cards to come back once their burial passed, got %v", ids)
+	}
+
+	if _, err := storage.BuryCard(review.ID, "someone-else"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound burying another user's card, got %v", err)
+	}
+}
+
+func TestBuryCard_UserTimezone(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	user, err := storage.GetUserByID(userID)
+	if err != nil {
+		t.Fatalf("failed to load user: %v", err)
+	}
+	user.Settings = DefaultUserSettings()
+	user.Settings.Timezone = "Asia/Tokyo"
+	if err := storage.UpdateUser(user); err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatalf("failed to load location: %v", err)
+	}
+
+	card, err := storage.AddCard(userID, deck.ID, `{"term":"new"}`)
+	if err != nil {
+		t.Fatalf("failed to add card: %v", err)
+	}
+
+	until, err := storage.BuryCard(card.ID, userID)
+	if err != nil {
+		t.Fatalf("BuryCard failed: %v", err)
+	}
+
+	local := time.Now().In(tokyo)
+	if want := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, tokyo); !until.Equal(want) {
+		t.Errorf("expected card buried until %v, got %v", want, until.In(tokyo))
+	}
+
+	cards, err := storage.GetCardsForReview(userID, user.Settings, deck, 10, NoSessionNewLimit)
+	if err != nil {
+		t.Fatalf("GetCardsForReview failed: %v", err)
+	}
+	if len(cards) != 0 {
+		t.Errorf("expected the buried card to be left out, got %d cards", len(cards))
+	}
+}
+
+func TestSearchCards(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	weather, err := storage.AddCard(userID, deck.ID, `{"term":"天気[てんき]","meaning_en":"Weather","meaning_ru":"Погода","example_native":"いい天気[てんき]ですね"}`)
+	if err != nil {
+		t.Fatalf("failed to add card: %v", err)
+	}
+	if _, err := storage.AddCard(userID, deck.ID, `{"term":"雨","meaning_en":"rain","meaning_ru":"дождь","audio_word":"weather.mp3"}`); err != nil {
+		t.Fatalf("failed to add card: %v", err)
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"天気", 1},
+		{"てんき", 1},
+		{"天気[てんき]", 1},
+		{"WEATHER", 1},
+		{"погода", 1},
+		{"ですね", 1},
+		{"天気です", 1}, // furigana between the words is skipped
+		{"気[て", 1},  // GLOB metacharacters are matched literally
+		{"*", 0},
+		{"meaning_en", 0}, // keys aren't searched
+		{"snow", 0},
+	}
+	for _, tt := range tests {
+		cards, err := storage.SearchCards(userID, tt.query, 10, 0)
+		if err != nil {
+			t.Fatalf("SearchCards(%q) failed: %v", tt.query, err)
+		}
+		if len(cards) != tt.want {
+			t.Fatalf("SearchCards(%q) returned %d cards, want %d", tt.query, len(cards), tt.want)
+		}
+		if tt.want == 1 && cards[0].ID != weather.ID {
+			t.Fatalf("SearchCards(%q) returned card %s, want %s", tt.query, cards[0].ID, weather.ID)
+		}
+	}
+
+	if cards, err := storage.SearchCards(userID, "天気", 10, 1); err != nil || len(cards) != 0 {
+		t.Fatalf("SearchCards with offset past the matches returned %d cards, err %v", len(cards), err)
+	}
+
+	// "a" is in both cards' English meanings
+	first, err := storage.SearchCards(userID, "A", 1, 0)
+	if err != nil || len(first) != 1 {
+		t.Fatalf("SearchCards first page returned %d cards, err %v", len(first), err)
+	}
+	second, err := storage.SearchCards(userID, "A", 1, 1)
+	if err != nil || len(second) != 1 || second[0].ID == first[0].ID {
+		t.Fatalf("SearchCards second page returned %v, err %v, first page %s", second, err, first[0].ID)
+	}
+
+	if err := storage.SuspendCard(weather.ID, userID, true); err != nil {
+		t.Fatalf("failed to suspend card: %v", err)
+	}
+	if cards, err := storage.SearchCards(userID, "天気", 10, 0); err != nil || len(cards) != 1 || cards[0].SuspendedAt == nil {
+		t.Fatalf("SearchCards should return suspended cards marked as such, got %v, err %v", cards, err)
+	}
+
+	if err := storage.DeleteCard(weather.ID, userID); err != nil {
+		t.Fatalf("failed to delete card: %v", err)
+	}
+	if cards, err := storage.SearchCards(userID, "天気", 10, 0); err != nil || len(cards) != 0 {
+		t.Fatalf("SearchCards returned %d deleted cards, err %v", len(cards), err)
+	}
+}
+
+func TestResetDailyNewCards(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	if err := storage.AddCardsInBatch(userID, deck.ID, cardFields(3), DefaultCardBatchSize); err != nil {
+		t.Fatalf("failed to add cards: %v", err)
+	}
+	cards, err := storage.GetCardsByDeckID(deck.ID, userID)
+	if err != nil {
+		t.Fatalf("failed to load cards: %v", err)
+	}
+	for _, card := range cards[:2] {
+		if err := storage.ReviewCard(&card, deck, RatingGood, 1000); err != nil {
+			t.Fatalf("failed to review card: %v", err)
+		}
+	}
+
+	// A settings change saved by another request must survive the reset
+	user, err := storage.GetUserByID(userID)
+	if err != nil {
+		t.Fatalf("failed to load user: %v", err)
+	}
+	user.Settings.MaxTasksPerDay = 3
+	if err := storage.UpdateUser(user); err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+
+	forgiven, err := storage.ResetDailyNewCards(userID)
+	if err != nil {
+		t.Fatalf("ResetDailyNewCards failed: %v", err)
+	}
+	if forgiven != 2 {
+		t.Errorf("expected 2 started cards to be forgiven, got %d", forgiven)
+	}
+
+	settings, err := storage.GetUserSettings(userID)
+	if err != nil {
+		t.Fatalf("failed to load settings: %v", err)
+	}
+	if settings.MaxTasksPerDay != 3 {
+		t.Errorf("the reset overwrote max_tasks_per_day, got %d", settings.MaxTasksPerDay)
+	}
+	if settings.NewCardReset == nil || settings.NewCardReset.Day != studyDay(time.Now()) || settings.NewCardReset.Decks[deck.ID] != 2 {
+		t.Errorf("expected today's reset forgiving 2 cards of the deck, got %+v", settings.NewCardReset)
+	}
+
+	if _, err := storage.ResetDailyNewCards("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for an unknown user, got %v", err)
+	}
+}
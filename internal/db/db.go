@@ -78,6 +78,10 @@ func init() {
 	sql.Register("sql",
 		&sqlite3.SQLiteDriver{
 			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				if err := conn.RegisterFunc("search_match", searchMatch, true); err != nil {
+					return err
+				}
+
 				_, err := conn.Exec(`
 					PRAGMA busy_timeout       = 10000;
 					PRAGMA journal_mode       = WAL;
@@ -6,73 +6,343 @@ import (
 	"errors"
 	"fmt"
 	nanoid "github.com/matoous/go-nanoid/v2"
+	"strings"
 	"time"
 )
 
 type Deck struct {
-	ID                string          `db:"id" json:"id"`
-	Name              string          `db:"name" json:"name"`
-	Level             string          `db:"level" json:"level"`
-	LanguageCode      string          `db:"language_code" json:"language_code"`           // ISO 639-1 language code (e.g., "ja", "en", "th")
-	TranscriptionType string          `db:"transcription_type" json:"transcription_type"` // Type of transcription/reading aids
-	NewCardsPerDay    int             `db:"new_cards_per_day" json:"new_cards_per_day"`
-	UserID            string          `db:"user_id" json:"user_id"`
-	CreatedAt         time.Time       `db:"created_at" json:"created_at"`
-	UpdatedAt         time.Time       `db:"updated_at" json:"updated_at"`
-	DeletedAt         *time.Time      `db:"deleted_at" json:"deleted_at,omitempty"`
-	Stats             *DeckStatistics `json:"stats,omitempty"`
+	ID                   string          `db:"id" json:"id"`
+	Name                 string          `db:"name" json:"name"`
+	Description          string          `db:"description" json:"description"`
+	Level                string          `db:"level" json:"level"`
+	IsGenerated          bool            `db:"is_generated" json:"is_generated"`             // The per-language deck collecting generated cards, see Source for imports
+	LanguageCode         string          `db:"language_code" json:"language_code"`           // ISO 639-1 language code (e.g., "ja", "en", "th")
+	TranscriptionType    string          `db:"transcription_type" json:"transcription_type"` // Type of transcription/reading aids
+	NewCardsPerDay       int             `db:"new_cards_per_day" json:"new_cards_per_day"`
+	MinEase              float64         `db:"min_ease" json:"min_ease"`
+	EaseGoodBonus        float64         `db:"ease_good_bonus" json:"ease_good_bonus"`
+	EaseLapsePenalty     float64         `db:"ease_lapse_penalty" json:"ease_lapse_penalty"`
+	GenerateAudio        bool            `db:"generate_audio" json:"generate_audio"`               // Record example audio for generated cards
+	GenerateImages       bool            `db:"generate_images" json:"generate_images"`             // Illustrate generated cards
+	AudioContent         string          `db:"audio_content" json:"audio_content"`                 // What generated audio reads out, one of the AudioContent constants
+	NewCardDays          int             `db:"new_card_days" json:"new_card_days"`                 // Weekdays new cards are introduced on, bit i set for time.Weekday(i)
+	StuckReviewLimit     int             `db:"stuck_review_limit" json:"stuck_review_limit"`       // Learning reviews after which a card is flagged as stuck, 0 turns flagging off
+	ConfidenceScheduling bool            `db:"confidence_scheduling" json:"confidence_scheduling"` // Scale review intervals by answer time, see applyConfidence
+	LeechAction          string          `db:"leech_action" json:"leech_action"`                   // What happens to a card flagged as a leech, one of the LeechAction constants
+	ExampleCount         int             `db:"example_count" json:"example_count"`                 // Example sentences generated per card
+	NewCardBoost         int             `db:"new_card_boost" json:"new_card_boost"`               // Most extra new cards allowed after missed study days, 0 turns the boost off
+	ReviewMode           string          `db:"review_mode" json:"review_mode"`                     // How cards are presented for review, one of the ReviewMode constants
+	IntervalModifier     float64         `db:"interval_modifier" json:"interval_modifier"`         // Multiplies every review interval, 1 keeps them as scheduled
+	ExampleOnBack        bool            `db:"example_on_back" json:"example_on_back"`             // Reveal example sentences with the answer instead of on the card front
+	RatingButtons        int             `db:"rating_buttons" json:"rating_buttons"`               // Rating buttons offered on review, 2 (Again, Good) or 4 (adding Hard and Easy)
+	UserID               string          `db:"user_id" json:"user_id"`
+	CreatedAt            time.Time       `db:"created_at" json:"created_at"`
+	UpdatedAt            time.Time       `db:"updated_at" json:"updated_at"`
+	DeletedAt            *time.Time      `db:"deleted_at" json:"deleted_at,omitempty"`
+	Stats                *DeckStatistics `json:"stats,omitempty"`
+	Source               *DeckSource     `json:"source,omitempty"` // Only filled in when a single deck is requested
 }
 
-func (s *Storage) CreateDeck(userID, name, level string, languageCode string, transcriptionType string) (*Deck, error) {
+// DeckSource records where an imported deck's cards came from
+type DeckSource struct {
+	Type         string     `json:"type"`                    // One of the DeckSource constants
+	FileName     string     `json:"file_name,omitempty"`     // Bundled deck file or the uploaded file's original name
+	LanguageCode string     `json:"language_code,omitempty"` // Language the import detected or was given
+	ImportedAt   *time.Time `json:"imported_at,omitempty"`
+}
+
+// Deck source types, there is one per import path
+const (
+	DeckSourceBundled = "bundled" // a deck file shipped with the app
+	DeckSourceCSV     = "csv"     // a CSV or TXT file sent to the bot
+	DeckSourceJSON    = "json"    // vocabulary posted to the JSON import
+)
+
+// Audio content options decide what a deck's generated card audio reads out
+const (
+	AudioContentCombined    = "combined"     // the term followed by the example sentence
+	AudioContentExampleOnly = "example_only" // just the example sentence
+	AudioContentTermOnly    = "term_only"    // just the term
+)
+
+// IsValidAudioContent reports whether content is one of the audio content options
+func IsValidAudioContent(content string) bool {
+	switch content {
+	case AudioContentCombined, AudioContentExampleOnly, AudioContentTermOnly:
+		return true
+	default:
+		return false
+	}
+}
+
+// Review modes decide how a deck's cards are presented for review
+const (
+	ReviewModeText       = "text"        // the term on the front
+	ReviewModeAudioFront = "audio_front" // the card's audio on the front, recalling the term is the answer
+)
+
+// IsValidReviewMode reports whether mode is one of the review modes
+func IsValidReviewMode(mode string) bool {
+	return mode == ReviewModeText || mode == ReviewModeAudioFront
+}
+
+// AllNewCardDays is the new card schedule introducing new cards every day of the week
+const AllNewCardDays = 1<<7 - 1
+
+// IsValidNewCardDays reports whether days is a weekday mask with at least one day set
+func IsValidNewCardDays(days int) bool {
+	return days >= 1 && days <= AllNewCardDays
+}
+
+// NewCardsScheduledOn reports whether the weekday mask days introduces new cards on day
+func NewCardsScheduledOn(days int, day time.Weekday) bool {
+	return days&(1<<uint(day)) != 0
+}
+
+// Leech actions decide what happens to a card once it lapses LeechLapseThreshold times; the card is
+// flagged as a leech either way
+const (
+	LeechActionSuspend = "suspend" // take the card out of study until it is unsuspended
+	LeechActionTag     = "tag"     // add LeechTag and keep the card in study
+	LeechActionNone    = "none"    // only flag the card
+)
+
+// LeechTag is the tag LeechActionTag adds to a card
+const LeechTag = "leech"
+
+// IsValidLeechAction reports whether action is one of the leech actions
+func IsValidLeechAction(action string) bool {
+	return action == LeechActionSuspend || action == LeechActionTag || action == LeechActionNone
+}
+
+// Bounds and default of how many example sentences a deck's cards are generated with
+const (
+	DefaultExampleCount = 1
+	MaxExampleCount     = 3
+)
+
+// Bounds and default of a deck's stuck review limit
+const (
+	DefaultStuckReviewLimit = 15
+	MaxStuckReviewLimit     = 100
+)
+
+// Bounds and default of a deck's daily new card limit
+const (
+	DefaultNewCardsPerDay = 20
+	MaxNewCardsPerDay     = 500
+)
+
+// IsValidNewCardsPerDay reports whether n is an allowed daily new card limit
+func IsValidNewCardsPerDay(n int) bool {
+	return n >= 1 && n <= MaxNewCardsPerDay
+}
+
+// deckColumns lists the decks columns in the order scanDeck reads them
+const deckColumns = `id, name, description, level, is_generated, language_code, transcription_type, new_cards_per_day,
+	min_ease, ease_good_bonus, ease_lapse_penalty, generate_audio, generate_images, audio_content, new_card_days,
+	stuck_review_limit, confidence_scheduling, leech_action, example_count, new_card_boost, review_mode,
+	interval_modifier, example_on_back, rating_buttons, user_id, created_at, updated_at, deleted_at`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanDeck reads a row selected with deckColumns, Stats and Source are left for the caller
+func scanDeck(row rowScanner) (Deck, error) {
+	var deck Deck
+	err := row.Scan(
+		&deck.ID,
+		&deck.Name,
+		&deck.Description,
+		&deck.Level,
+		&deck.IsGenerated,
+		&deck.LanguageCode,
+		&deck.TranscriptionType,
+		&deck.NewCardsPerDay,
+		&deck.MinEase,
+		&deck.EaseGoodBonus,
+		&deck.EaseLapsePenalty,
+		&deck.GenerateAudio,
+		&deck.GenerateImages,
+		&deck.AudioContent,
+		&deck.NewCardDays,
+		&deck.StuckReviewLimit,
+		&deck.ConfidenceScheduling,
+		&deck.LeechAction,
+		&deck.ExampleCount,
+		&deck.NewCardBoost,
+		&deck.ReviewMode,
+		&deck.IntervalModifier,
+		&deck.ExampleOnBack,
+		&deck.RatingButtons,
+		&deck.UserID,
+		&deck.CreatedAt,
+		&deck.UpdatedAt,
+		&deck.DeletedAt,
+	)
+	return deck, err
+}
+
+// CreateDeckParams describes a deck to create
+type CreateDeckParams struct {
+	Name              string
+	Description       string
+	Level             string
+	IsGenerated       bool   // The per-language deck collecting generated cards, see GetOrCreateGeneratedDeck
+	LanguageCode      string // Empty means Japanese
+	TranscriptionType string // Empty means the language's default
+	// Source is the import the deck is created for, recorded with the deck like SetDeckSource does
+	Source *DeckSource
+}
+
+// CreateDeck creates a deck that starts with the user's default daily new card limit
+func (s *Storage) CreateDeck(userID string, params CreateDeckParams) (*Deck, error) {
+	deck, _, err := s.createDeck(userID, params, false)
+	return deck, err
+}
+
+// CreateBundledDeck creates a deck for a bundled deck file unless the user already has a live deck imported
+// from it, in which case that deck is returned with created set to false. The check and the insert are one
+// statement, so two imports of the same file racing each other still create a single deck.
+func (s *Storage) CreateBundledDeck(userID string, params CreateDeckParams) (deck *Deck, created bool, err error) {
+	if params.Source == nil || params.Source.Type != DeckSourceBundled {
+		return nil, false, fmt.Errorf("bundled deck source is required")
+	}
+
+	deck, created, err = s.createDeck(userID, params, true)
+	if err != nil || created {
+		return deck, created, err
+	}
+
+	deck, err = s.GetDeckBySourceFile(userID, params.Source.FileName)
+	return deck, false, err
+}
+
+// createDeck inserts the deck, when onlyNewSource is set the insert is skipped and created is false
+// if the user already has a live deck imported from the same source file
+func (s *Storage) createDeck(userID string, params CreateDeckParams, onlyNewSource bool) (*Deck, bool, error) {
 	deckID := nanoid.Must()
 	now := time.Now()
-	defaultNewCardsPerDay := 20
+
+	settings, err := s.GetUserSettings(userID)
+	if err != nil {
+		return nil, false, fmt.Errorf("error getting user settings: %w", err)
+	}
+	newCardsPerDay := ResolveNewCardsPerDay(settings)
 
 	// Default to Japanese if no language code specified
-	if languageCode == "" {
-		languageCode = "jp"
-	}
-
-	// Default transcription type based on language
-	if transcriptionType == "" {
-		switch languageCode {
-		case "jp":
-			transcriptionType = "furigana"
-		case "th":
-			transcriptionType = "thai_romanization"
-		case "ge":
-			transcriptionType = "mkhedruli"
-		default:
-			transcriptionType = "none"
+	if params.LanguageCode == "" {
+		params.LanguageCode = "jp"
+	}
+
+	if params.TranscriptionType == "" {
+		params.TranscriptionType = utils.GetDefaultTranscriptionType(params.LanguageCode)
+	}
+
+	var source DeckSource
+	if params.Source != nil {
+		source = *params.Source
+		if source.ImportedAt == nil {
+			source.ImportedAt = &now
 		}
+		params.Source = &source
 	}
 
 	query := `
-		INSERT INTO decks (id, name, level, language_code, transcription_type, new_cards_per_day, user_id, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO decks (
+			id, name, description, level, is_generated, language_code, transcription_type, new_cards_per_day,
+			import_type, import_file_name, import_language, imported_at,
+			user_id, created_at, updated_at
+		)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
 	`
+	args := []any{
+		deckID, params.Name, params.Description, params.Level, params.IsGenerated, params.LanguageCode, params.TranscriptionType, newCardsPerDay,
+		source.Type, source.FileName, source.LanguageCode, source.ImportedAt,
+		userID, now, now,
+	}
+
+	if onlyNewSource {
+		query += `
+		WHERE NOT EXISTS (
+			SELECT 1 FROM decks
+			WHERE user_id = ? AND import_type = ? AND import_file_name = ? AND deleted_at IS NULL
+		)
+		`
+		args = append(args, userID, source.Type, source.FileName)
+	}
 
-	_, err := s.db.Exec(query, deckID, name, level, languageCode, transcriptionType, defaultNewCardsPerDay, userID, now, now)
+	result, err := s.db.Exec(query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("error creating deck: %w", err)
+		return nil, false, fmt.Errorf("error creating deck: %w", err)
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return nil, false, fmt.Errorf("error checking rows affected: %w", err)
+	}
+	if inserted == 0 {
+		return nil, false, nil
 	}
 
 	return &Deck{
 		ID:                deckID,
-		Name:              name,
-		Level:             level,
-		LanguageCode:      languageCode,
-		TranscriptionType: transcriptionType,
-		NewCardsPerDay:    defaultNewCardsPerDay,
+		Name:              params.Name,
+		Description:       params.Description,
+		Level:             params.Level,
+		IsGenerated:       params.IsGenerated,
+		LanguageCode:      params.LanguageCode,
+		TranscriptionType: params.TranscriptionType,
+		NewCardsPerDay:    newCardsPerDay,
+		MinEase:           MinEaseFactor,
+		EaseGoodBonus:     DefaultEaseGoodBonus,
+		EaseLapsePenalty:  DefaultEaseLapsePenalty,
+		GenerateAudio:     true,
+		AudioContent:      AudioContentCombined,
+		NewCardDays:       AllNewCardDays,
+		StuckReviewLimit:  DefaultStuckReviewLimit,
+		LeechAction:       LeechActionSuspend,
+		ReviewMode:        ReviewModeText,
+		IntervalModifier:  DefaultIntervalModifier,
+		RatingButtons:     DefaultRatingButtons,
+		ExampleCount:      DefaultExampleCount,
 		UserID:            userID,
 		CreatedAt:         now,
 		UpdatedAt:         now,
-	}, nil
+		Source:            params.Source,
+	}, true, nil
+}
+
+func (s *Storage) GetDecks(userID string, settings *UserSettings) ([]Deck, error) {
+	decks, err := s.listDecks(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	study, err := s.loadQueueSettings(userID, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	// Statistics are queried only once listDecks has closed the deck rows, a query nested in the iteration needs
+	// a second connection, which for an in-memory database is a different, empty database
+	for i := range decks {
+		stats, err := s.deckStatistics(userID, &decks[i], study)
+		if err != nil {
+			return nil, fmt.Errorf("error getting deck statistics: %w", err)
+		}
+		decks[i].Stats = stats
+	}
+
+	return decks, nil
 }
 
-func (s *Storage) GetDecks(userID string) ([]Deck, error) {
+// listDecks returns the user's decks, newest first, without statistics
+func (s *Storage) listDecks(userID string) ([]Deck, error) {
 	query := `
-		SELECT id, name, level, language_code, transcription_type, new_cards_per_day, user_id, created_at, updated_at, deleted_at
+		SELECT ` + deckColumns + `
 		FROM decks
 		WHERE user_id = ? AND deleted_at IS NULL ORDER BY created_at DESC
 	`
@@ -84,28 +354,11 @@ func (s *Storage) GetDecks(userID string) ([]Deck, error) {
 
 	var decks []Deck
 	for rows.Next() {
-		var deck Deck
-		if err := rows.Scan(
-			&deck.ID,
-			&deck.Name,
-			&deck.Level,
-			&deck.LanguageCode,
-			&deck.TranscriptionType,
-			&deck.NewCardsPerDay,
-			&deck.UserID,
-			&deck.CreatedAt,
-			&deck.UpdatedAt,
-			&deck.DeletedAt,
-		); err != nil {
-			return nil, fmt.Errorf("error scanning deck: %w", err)
-		}
-
-		stats, err := s.GetDeckStatistics(userID, deck.ID, deck.NewCardsPerDay)
+		deck, err := scanDeck(rows)
 		if err != nil {
-			return nil, fmt.Errorf("error getting deck statistics: %w", err)
+			return nil, fmt.Errorf("error scanning deck: %w", err)
 		}
 
-		deck.Stats = stats
 		decks = append(decks, deck)
 	}
 
@@ -116,26 +369,115 @@ func (s *Storage) GetDecks(userID string) ([]Deck, error) {
 	return decks, nil
 }
 
-func (s *Storage) GetDeck(deckID string) (*Deck, error) {
+// GetImportedSourceFiles returns the bundled deck files the user currently has a deck imported from
+func (s *Storage) GetImportedSourceFiles(userID string) (map[string]bool, error) {
 	query := `
-		SELECT id, name, level, language_code, transcription_type, new_cards_per_day, user_id, created_at, updated_at, deleted_at
+		SELECT DISTINCT import_file_name
 		FROM decks
-		WHERE id = ? AND deleted_at IS NULL
+		WHERE user_id = ? AND import_type = ? AND deleted_at IS NULL
 	`
 
-	var deck Deck
+	rows, err := s.db.Query(query, userID, DeckSourceBundled)
+	if err != nil {
+		return nil, fmt.Errorf("error getting imported source files: %w", err)
+	}
+	defer rows.Close()
+
+	files := make(map[string]bool)
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&file); err != nil {
+			return nil, fmt.Errorf("error scanning source file: %w", err)
+		}
+		files[file] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating source file rows: %w", err)
+	}
+
+	return files, nil
+}
+
+// SetDeckSource records the import a deck's cards came from, replacing the previous one.
+// A zero ImportedAt is set to the current time.
+func (s *Storage) SetDeckSource(deckID string, source DeckSource) error {
+	importedAt := time.Now()
+	if source.ImportedAt != nil {
+		importedAt = *source.ImportedAt
+	}
+
+	query := `
+		UPDATE decks
+		SET import_type = ?, import_file_name = ?, import_language = ?, imported_at = ?
+		WHERE id = ?
+	`
+
+	if _, err := s.db.Exec(query, source.Type, source.FileName, source.LanguageCode, importedAt, deckID); err != nil {
+		return fmt.Errorf("error setting deck source: %w", err)
+	}
+
+	return nil
+}
+
+// GetDeckSource returns where a deck was imported from, or nil for decks the user built by hand
+func (s *Storage) GetDeckSource(deckID string) (*DeckSource, error) {
+	query := `
+		SELECT import_type, import_file_name, import_language, imported_at
+		FROM decks
+		WHERE id = ?
+	`
+
+	var source DeckSource
 	err := s.db.QueryRow(query, deckID).Scan(
-		&deck.ID,
-		&deck.Name,
-		&deck.Level,
-		&deck.LanguageCode,
-		&deck.TranscriptionType,
-		&deck.NewCardsPerDay,
-		&deck.UserID,
-		&deck.CreatedAt,
-		&deck.UpdatedAt,
-		&deck.DeletedAt,
+		&source.Type,
+		&source.FileName,
+		&source.LanguageCode,
+		&source.ImportedAt,
 	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("error getting deck source: %w", err)
+	}
+
+	if source.Type == "" {
+		return nil, nil
+	}
+
+	return &source, nil
+}
+
+// GetDeckBySourceFile returns the user's most recent non-deleted deck imported from the bundled deck file
+func (s *Storage) GetDeckBySourceFile(userID, sourceFile string) (*Deck, error) {
+	query := `
+		SELECT id
+		FROM decks
+		WHERE user_id = ? AND import_type = ? AND import_file_name = ? AND deleted_at IS NULL
+		ORDER BY created_at DESC
+		LIMIT 1
+	`
+
+	var deckID string
+	if err := s.db.QueryRow(query, userID, DeckSourceBundled, sourceFile).Scan(&deckID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("error getting deck by source file: %w", err)
+	}
+
+	return s.GetDeck(deckID)
+}
+
+func (s *Storage) GetDeck(deckID string) (*Deck, error) {
+	query := `
+		SELECT ` + deckColumns + `
+		FROM decks
+		WHERE id = ? AND deleted_at IS NULL
+	`
+
+	deck, err := scanDeck(s.db.QueryRow(query, deckID))
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -144,7 +486,12 @@ func (s *Storage) GetDeck(deckID string) (*Deck, error) {
 		return nil, fmt.Errorf("error getting deck: %w", err)
 	}
 
-	stats, err := s.GetDeckStatistics(deck.UserID, deck.ID, deck.NewCardsPerDay)
+	settings, err := s.GetUserSettings(deck.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting user settings: %w", err)
+	}
+
+	stats, err := s.GetDeckStatistics(deck.UserID, settings, &deck)
 	if err != nil {
 		return nil, fmt.Errorf("error getting deck statistics: %w", err)
 	}
@@ -157,14 +504,26 @@ func (s *Storage) GetDeck(deckID string) (*Deck, error) {
 func (s *Storage) UpdateDeckSettings(deckID string, deck *Deck) error {
 	query := `
 		UPDATE decks
-		SET new_cards_per_day = ?, name = ?, updated_at = ?
+		SET new_cards_per_day = ?, name = ?, description = ?, language_code = ?, transcription_type = ?,
+		    min_ease = ?, ease_good_bonus = ?, ease_lapse_penalty = ?,
+		    generate_audio = ?, generate_images = ?, audio_content = ?,
+		    new_card_days = ?, stuck_review_limit = ?, confidence_scheduling = ?, leech_action = ?,
+		    example_count = ?, new_card_boost = ?, review_mode = ?, interval_modifier = ?,
+		    example_on_back = ?, rating_buttons = ?, updated_at = ?
 		WHERE id = ? AND deleted_at IS NULL
 	`
 
 	now := time.Now()
-	result, err := s.db.Exec(query, deck.NewCardsPerDay, deck.Name, now, deckID)
+	result, err := s.db.Exec(query,
+		deck.NewCardsPerDay, deck.Name, deck.Description, deck.LanguageCode, deck.TranscriptionType,
+		deck.MinEase, deck.EaseGoodBonus, deck.EaseLapsePenalty,
+		deck.GenerateAudio, deck.GenerateImages, deck.AudioContent,
+		deck.NewCardDays, deck.StuckReviewLimit, deck.ConfidenceScheduling, deck.LeechAction,
+		deck.ExampleCount, deck.NewCardBoost, deck.ReviewMode, deck.IntervalModifier,
+		deck.ExampleOnBack, deck.RatingButtons, now,
+		deckID)
 	if err != nil {
-		return fmt.Errorf("error updating deck new cards per day: %w", err)
+		return fmt.Errorf("error updating deck settings: %w", err)
 	}
 
 	rowsAffected, err := result.RowsAffected()
@@ -261,58 +620,142 @@ func (s *Storage) DeleteDeck(deckID string) error {
 	return nil
 }
 
+// moveCards reassigns the live cards of one deck to another within tx, SRS state included, and returns how many were moved
+func moveCards(tx *sql.Tx, userID, fromDeckID, toDeckID string, now time.Time) (int, error) {
+	query := `
+		UPDATE cards
+		SET deck_id = ?, updated_at = ?
+		WHERE deck_id = ? AND user_id = ? AND deleted_at IS NULL
+	`
+
+	result, err := tx.Exec(query, toDeckID, now, fromDeckID, userID)
+	if err != nil {
+		return 0, fmt.Errorf("error moving cards: %w", err)
+	}
+
+	moved, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error checking moved cards: %w", err)
+	}
+
+	return int(moved), nil
+}
+
+// MergeDecks moves every live card of the source deck into the target deck and soft-deletes the source.
+// Cards keep their review history and scheduling. Soft-deleted cards stay with the deleted source deck.
+// ErrNotFound is returned when either deck is missing, deleted or owned by someone else.
+func (s *Storage) MergeDecks(userID, sourceDeckID, targetDeckID string) (moved int, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	// The handler checked the target already, but it may have been deleted since
+	var targetID string
+	err = tx.QueryRow(
+		`SELECT id FROM decks WHERE id = ? AND user_id = ? AND deleted_at IS NULL`,
+		targetDeckID, userID,
+	).Scan(&targetID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+			return 0, err
+		}
+		return 0, fmt.Errorf("error fetching target deck: %w", err)
+	}
+
+	now := time.Now()
+
+	moved, err = moveCards(tx, userID, sourceDeckID, targetDeckID, now)
+	if err != nil {
+		return 0, err
+	}
+
+	deckQuery := `
+		UPDATE decks
+		SET deleted_at = ?, updated_at = ?
+		WHERE id = ? AND user_id = ? AND deleted_at IS NULL
+	`
+	result, err := tx.Exec(deckQuery, now, now, sourceDeckID, userID)
+	if err != nil {
+		return 0, fmt.Errorf("error marking deck as deleted: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error checking rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		err = ErrNotFound
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return moved, nil
+}
+
 type DeckStatistics struct {
-	NewCards            int `json:"new_cards"`
-	LearningCards       int `json:"learning_cards"`
-	ReviewCards         int `json:"review_cards"`
+	NewCards      int `json:"new_cards"`
+	LearningCards int `json:"learning_cards"`
+	ReviewCards   int `json:"review_cards"`
+	// CompletedTodayCards counts cards reviewed today that are done for the day: in the review state,
+	// so graduated or passed, with the next review after today. A card is counted once however often
+	// it was reviewed, and cards still stepping through learning or relearning are never counted.
 	CompletedTodayCards int `json:"completed_today_cards"`
 }
 
-func (s *Storage) GetDeckStatistics(userID string, deckID string, newCardsPerDay int) (*DeckStatistics, error) {
+// GetDeckStatistics counts what the deck has left to study today, new cards within its daily limit and boost
+func (s *Storage) GetDeckStatistics(userID string, settings *UserSettings, deck *Deck) (*DeckStatistics, error) {
+	study, err := s.loadQueueSettings(userID, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.deckStatistics(userID, deck, study)
+}
+
+// deckStatistics is GetDeckStatistics with the queueSettings already loaded
+func (s *Storage) deckStatistics(userID string, deck *Deck, study queueSettings) (*DeckStatistics, error) {
 	stats := &DeckStatistics{}
-	todayEnd := time.Now().Truncate(24 * time.Hour).Add(24*time.Hour - time.Nanosecond)
+	now := time.Now()
+	todayEnd := now.Truncate(24 * time.Hour).Add(24*time.Hour - time.Nanosecond)
 
 	today := time.Now().Truncate(24 * time.Hour)
 	tomorrow := today.Add(24 * time.Hour)
 
 	dueDueQuery := `
         SELECT
-            COALESCE(SUM(CASE WHEN (c.state = 'learning' OR c.state = 'relearning') AND c.next_review <= ? THEN 1 ELSE 0 END), 0) as learning_due_count,
-            COALESCE(SUM(CASE WHEN c.state = 'review' AND c.next_review <= ? THEN 1 ELSE 0 END), 0) as review_due_count,
-            COALESCE(SUM(CASE WHEN c.last_reviewed_at >= ? AND c.last_reviewed_at < ? AND c.next_review >= ? THEN 1 ELSE 0 END), 0) as completed_today_count
+            COALESCE(SUM(CASE WHEN (c.state = 'learning' OR c.state = 'relearning') AND c.next_review <= ? AND (c.buried_until IS NULL OR c.buried_until <= ?) THEN 1 ELSE 0 END), 0) as learning_due_count,
+            COALESCE(SUM(CASE WHEN c.state = 'review' AND c.next_review <= ? AND (c.buried_until IS NULL OR c.buried_until <= ?) THEN 1 ELSE 0 END), 0) as review_due_count,
+            COALESCE(SUM(CASE WHEN c.state = 'review' AND c.last_reviewed_at >= ? AND c.last_reviewed_at < ? AND c.next_review >= ? THEN 1 ELSE 0 END), 0) as completed_today_count
         FROM cards c
-        WHERE c.user_id = ? AND c.deck_id = ? AND c.deleted_at IS NULL;
+        WHERE c.user_id = ? AND c.deck_id = ? AND c.deleted_at IS NULL AND c.suspended_at IS NULL;
     `
 
-	err := s.db.QueryRow(dueDueQuery, todayEnd, todayEnd, today, tomorrow, tomorrow, userID, deckID).Scan(
+	err := s.db.QueryRow(dueDueQuery, todayEnd, now, todayEnd, now, today, tomorrow, tomorrow, userID, deck.ID).Scan(
 		&stats.LearningCards,
 		&stats.ReviewCards,
 		&stats.CompletedTodayCards,
 	)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return nil, fmt.Errorf("error calculating due cards statistics for deck %s: %w", deckID, err)
+		return nil, fmt.Errorf("error calculating due cards statistics for deck %s: %w", deck.ID, err)
 	}
 
-	// today variable is already defined above
-	countNewStartedTodayQuery := `
-		SELECT COUNT(*)
-		FROM cards c
-		WHERE c.user_id = ?
-		AND c.deck_id = ?
-		AND c.deleted_at IS NULL
-		AND c.first_reviewed_at >= ?
-	`
-
-	var newCardsStartedToday int
-	err = s.db.QueryRow(countNewStartedTodayQuery, userID, deckID, today).Scan(&newCardsStartedToday)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return nil, fmt.Errorf("error counting new cards started today: %w", err)
+	newCardsStartedToday, err := s.newCardsStartedToday(userID, deck.ID)
+	if err != nil {
+		return nil, err
 	}
 
-	newCardsRemaining := newCardsPerDay - newCardsStartedToday
-	if newCardsRemaining < 0 {
-		newCardsRemaining = 0
-	}
+	newCardsRemaining := study.newCardAllowance(deck, newCardsStartedToday)
 
 	countTotalNewCardsQuery := `
 		SELECT COUNT(*)
@@ -320,12 +763,14 @@ func (s *Storage) GetDeckStatistics(userID string, deckID string, newCardsPerDay
 		WHERE c.user_id = ?
 		AND c.deck_id = ?
 		AND c.deleted_at IS NULL
+		AND c.suspended_at IS NULL
+		AND (c.buried_until IS NULL OR c.buried_until <= ?)
 		AND c.state = 'new'
 		AND c.review_count = 0
 	`
 
 	var totalNewCards int
-	err = s.db.QueryRow(countTotalNewCardsQuery, userID, deckID).Scan(&totalNewCards)
+	err = s.db.QueryRow(countTotalNewCardsQuery, userID, deck.ID, now).Scan(&totalNewCards)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return nil, fmt.Errorf("error counting total new cards: %w", err)
 	}
@@ -339,30 +784,36 @@ func (s *Storage) GetDeckStatistics(userID string, deckID string, newCardsPerDay
 	return stats, nil
 }
 
+// GetOrCreateGeneratedDeck returns the user's deck of generated cards for a language, creating it on first use.
+// Decks are matched by normalized language code, decks stored under an ISO code like "ja" before codes were
+// normalized included. Decks created before the is_generated flag are found by their name.
 func (s *Storage) GetOrCreateGeneratedDeck(userID string, languageCode string, transcriptionType string) (*Deck, error) {
+	languageCode = utils.NormalizeLanguageCode(languageCode)
+	variants := utils.LanguageCodeVariants(languageCode)
+
 	query := `
-		SELECT id, name, level, language_code, transcription_type, new_cards_per_day, user_id, created_at, updated_at, deleted_at
+		SELECT ` + deckColumns + `
 		FROM decks
-		WHERE user_id = ? AND language_code = ? AND name LIKE 'Generated %' AND deleted_at IS NULL
+		WHERE user_id = ? AND LOWER(language_code) IN (?` + strings.Repeat(", ?", len(variants)-1) + `) AND deleted_at IS NULL
+		AND (is_generated = 1 OR (import_type = '' AND name LIKE 'Generated %'))
+		ORDER BY is_generated DESC, created_at
 		LIMIT 1
 	`
 
-	var deck Deck
-	err := s.db.QueryRow(query, userID, languageCode).Scan(
-		&deck.ID,
-		&deck.Name,
-		&deck.Level,
-		&deck.LanguageCode,
-		&deck.TranscriptionType,
-		&deck.NewCardsPerDay,
-		&deck.UserID,
-		&deck.CreatedAt,
-		&deck.UpdatedAt,
-		&deck.DeletedAt,
-	)
+	args := []any{userID}
+	for _, variant := range variants {
+		args = append(args, variant)
+	}
+
+	deck, err := scanDeck(s.db.QueryRow(query, args...))
 
 	if err == nil {
-		stats, err := s.GetDeckStatistics(userID, deck.ID, deck.NewCardsPerDay)
+		settings, err := s.GetUserSettings(userID)
+		if err != nil {
+			return nil, fmt.Errorf("error getting user settings: %w", err)
+		}
+
+		stats, err := s.GetDeckStatistics(userID, settings, &deck)
 		if err != nil {
 			return nil, fmt.Errorf("error getting deck statistics: %w", err)
 		}
@@ -372,11 +823,20 @@ func (s *Storage) GetOrCreateGeneratedDeck(userID string, languageCode string, t
 
 	if errors.Is(err, sql.ErrNoRows) {
 		languageName := utils.GetLanguageNameFromCode(languageCode)
+		if !utils.IsKnownLanguageCode(languageCode) {
+			languageName = strings.ToUpper(languageCode)
+		}
 
 		name := fmt.Sprintf("Generated %s Cards", languageName)
 		level := "mixed"
 
-		return s.CreateDeck(userID, name, level, languageCode, transcriptionType)
+		return s.CreateDeck(userID, CreateDeckParams{
+			Name:              name,
+			Level:             level,
+			IsGenerated:       true,
+			LanguageCode:      languageCode,
+			TranscriptionType: transcriptionType,
+		})
 	}
 
 	return nil, fmt.Errorf("error finding generated deck: %w", err)
@@ -384,16 +844,21 @@ func (s *Storage) GetOrCreateGeneratedDeck(userID string, languageCode string, t
 
 // GetCardsByDeckID gets all cards for a specific deck
 func (s *Storage) GetCardsByDeckID(deckID, userID string) ([]Card, error) {
+	return s.GetDeckCardsPage(deckID, userID, -1, 0)
+}
+
+// GetDeckCardsPage returns limit cards of a deck starting at offset, newest first. Suspended cards are included.
+// A negative limit returns every card from offset on.
+func (s *Storage) GetDeckCardsPage(deckID, userID string, limit, offset int) ([]Card, error) {
 	query := `
-		SELECT id, deck_id, fields, user_id, next_review, interval, ease, 
-		       review_count, laps_count, last_reviewed_at, first_reviewed_at, state,
-		       learning_step, created_at, updated_at, deleted_at
-		FROM cards
+		SELECT ` + cardColumns + `
+		FROM cards c
 		WHERE deck_id = ? AND user_id = ? AND deleted_at IS NULL
-		ORDER BY created_at DESC
+		ORDER BY created_at DESC, rowid DESC
+		LIMIT ? OFFSET ?
 	`
 
-	rows, err := s.db.Query(query, deckID, userID)
+	rows, err := s.db.Query(query, deckID, userID, limit, offset)
 	if err != nil {
 		return nil, fmt.Errorf("error getting cards for deck: %w", err)
 	}
@@ -401,31 +866,10 @@ func (s *Storage) GetCardsByDeckID(deckID, userID string) ([]Card, error) {
 
 	var cards []Card
 	for rows.Next() {
-		var card Card
-		var intervalNs int64
-
-		if err := rows.Scan(
-			&card.ID,
-			&card.DeckID,
-			&card.Fields,
-			&card.UserID,
-			&card.NextReview,
-			&intervalNs,
-			&card.Ease,
-			&card.ReviewCount,
-			&card.LapsCount,
-			&card.LastReviewedAt,
-			&card.FirstReviewedAt,
-			&card.State,
-			&card.LearningStep,
-			&card.CreatedAt,
-			&card.UpdatedAt,
-			&card.DeletedAt,
-		); err != nil {
+		card, err := scanCard(rows)
+		if err != nil {
 			return nil, fmt.Errorf("error scanning card: %w", err)
 		}
-
-		card.Interval = time.Duration(intervalNs)
 		cards = append(cards, card)
 	}
 
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// Checks run by CheckDeckStats, each counting cards whose data the deck statistics can't account for
+const (
+	DeckCheckUnknownState = "unknown_state" // the card's state is none of the card states, so no count includes it
+	DeckCheckReviewedNew  = "reviewed_new"  // a new card with reviews, left out of the new card count
+	DeckCheckUnscheduled  = "unscheduled"   // a studied card without a next review, it never comes due
+)
+
+// DeckDiscrepancy is one failed consistency check of a deck and how many cards fail it
+type DeckDiscrepancy struct {
+	Check string `json:"check"`
+	Count int    `json:"count"`
+}
+
+// DeckStatsCheck is a fresh computation of a deck's statistics together with the consistency checks
+// that explain where they may differ from what the deck's cards suggest
+type DeckStatsCheck struct {
+	DeckID        string            `json:"deck_id"`
+	Stats         *DeckStatistics   `json:"stats"`
+	Breakdown     *DeckBreakdown    `json:"breakdown"`
+	Discrepancies []DeckDiscrepancy `json:"discrepancies"`
+	CheckedAt     time.Time         `json:"checked_at"`
+}
+
+// CheckDeckStats recomputes the deck's statistics and breakdown from its cards and runs the consistency
+// checks. Deck statistics are computed on every read and nothing is cached, so there is nothing to persist.
+func (s *Storage) CheckDeckStats(deckID string) (*DeckStatsCheck, error) {
+	// GetDeck computes the statistics afresh
+	deck, err := s.GetDeck(deckID)
+	if err != nil {
+		return nil, err
+	}
+
+	breakdown, err := s.GetDeckBreakdown(deck.UserID, deck.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT
+			COALESCE(SUM(CASE WHEN state IS NOT NULL AND state NOT IN (?, ?, ?, ?) THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN state = ? AND review_count > 0 THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN state IN (?, ?, ?) AND next_review IS NULL THEN 1 ELSE 0 END), 0)
+		FROM cards
+		WHERE user_id = ? AND deck_id = ? AND deleted_at IS NULL
+	`
+
+	var unknownState, reviewedNew, unscheduled int
+	err = s.db.QueryRow(query,
+		StateNew, StateLearning, StateReview, StateRelearning,
+		StateNew,
+		StateLearning, StateReview, StateRelearning,
+		deck.UserID, deck.ID,
+	).Scan(&unknownState, &reviewedNew, &unscheduled)
+	if err != nil {
+		return nil, fmt.Errorf("error checking deck cards: %w", err)
+	}
+
+	check := &DeckStatsCheck{
+		DeckID:        deck.ID,
+		Stats:         deck.Stats,
+		Breakdown:     breakdown,
+		Discrepancies: []DeckDiscrepancy{},
+		CheckedAt:     time.Now(),
+	}
+
+	for _, d := range []DeckDiscrepancy{
+		{Check: DeckCheckUnknownState, Count: unknownState},
+		{Check: DeckCheckReviewedNew, Count: reviewedNew},
+		{Check: DeckCheckUnscheduled, Count: unscheduled},
+	} {
+		if d.Count > 0 {
+			check.Discrepancies = append(check.Discrepancies, d)
+		}
+	}
+
+	return check, nil
+}
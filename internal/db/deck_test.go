@@ -0,0 +1,286 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGetOrCreateGeneratedDeck_PerLanguage(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, imported := newTestDeck(t, storage)
+
+	japanese, err := storage.GetOrCreateGeneratedDeck(userID, "jp", "furigana")
+	if err != nil {
+		t.Fatalf("failed to create generated deck: %v", err)
+	}
+	if japanese.ID == imported.ID {
+		t.Fatal("generated cards should not land in a deck the user imported")
+	}
+
+	again, err := storage.GetOrCreateGeneratedDeck(userID, "ja", "furigana")
+	if err != nil {
+		t.Fatalf("failed to get generated deck: %v", err)
+	}
+	if again.ID != japanese.ID {
+		t.Error("ISO code should reuse the generated deck of the same language")
+	}
+
+	// A deck stored under the ISO code before codes were normalized
+	georgian, err := storage.CreateDeck(userID, CreateDeckParams{Name: "Generated Georgian Cards", Level: "mixed", IsGenerated: true, LanguageCode: "ka", TranscriptionType: "mkhedruli"})
+	if err != nil {
+		t.Fatalf("failed to create deck: %v", err)
+	}
+	found, err := storage.GetOrCreateGeneratedDeck(userID, "ge", "mkhedruli")
+	if err != nil {
+		t.Fatalf("failed to get generated deck: %v", err)
+	}
+	if found.ID != georgian.ID {
+		t.Error("a generated deck stored under the ISO code should be found by the app's code")
+	}
+
+	first, err := storage.GetOrCreateGeneratedDeck(userID, "xx", "none")
+	if err != nil {
+		t.Fatalf("failed to create generated deck: %v", err)
+	}
+	second, err := storage.GetOrCreateGeneratedDeck(userID, "yy", "none")
+	if err != nil {
+		t.Fatalf("failed to create generated deck: %v", err)
+	}
+	if first.ID == second.ID || first.Name == second.Name {
+		t.Errorf("unknown languages should get distinct decks, got %q and %q", first.Name, second.Name)
+	}
+}
+
+func TestCreateDeck_DefaultTranscription(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, _ := newTestDeck(t, storage)
+
+	for languageCode, transcriptionType := range map[string]string{"jp": "furigana", "zh": "pinyin", "en": "none"} {
+		deck, err := storage.CreateDeck(userID, CreateDeckParams{Name: "Deck", LanguageCode: languageCode})
+		if err != nil {
+			t.Fatalf("failed to create deck: %v", err)
+		}
+		if deck.TranscriptionType != transcriptionType {
+			t.Errorf("expected %s decks to default to %s, got %s", languageCode, transcriptionType, deck.TranscriptionType)
+		}
+	}
+}
+
+func TestGetDeckStatistics_CompletedToday(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	if err := storage.AddCardsInBatch(userID, deck.ID, cardFields(2), DefaultCardBatchSize); err != nil {
+		t.Fatalf("failed to add cards: %v", err)
+	}
+
+	cards, err := storage.GetCardsByDeckID(deck.ID, userID)
+	if err != nil {
+		t.Fatalf("failed to load cards: %v", err)
+	}
+	card, other := cards[0], cards[1]
+
+	completedToday := func() int {
+		t.Helper()
+		stats, err := storage.GetDeckStatistics(userID, DefaultUserSettings(), deck)
+		if err != nil {
+			t.Fatalf("GetDeckStatistics failed: %v", err)
+		}
+		return stats.CompletedTodayCards
+	}
+
+	review := func(rating int, expected int) {
+		t.Helper()
+		if err := storage.ReviewCard(&card, deck, rating, 1000); err != nil {
+			t.Fatalf("failed to review card: %v", err)
+		}
+		if got := completedToday(); got != expected {
+			t.Fatalf("after rating %d in state %s: expected %d completed today, got %d", rating, card.State, expected, got)
+		}
+	}
+
+	review(RatingAgain, 0) // first learning step
+	review(RatingGood, 0)  // second learning step, due again in minutes
+	review(RatingGood, 1)  // graduated, due tomorrow
+	review(RatingAgain, 0) // lapsed into relearning
+	review(RatingGood, 1)  // passed relearning, counted once more and only once
+
+	// A learning step crossing midnight pushes the card past today without finishing it
+	today := time.Now().Truncate(24 * time.Hour)
+	_, err = storage.db.Exec(`UPDATE cards SET state = ?, learning_step = 2, last_reviewed_at = ?, next_review = ? WHERE id = ?`,
+		StateLearning, time.Now(), today.Add(24*time.Hour+5*time.Minute), other.ID)
+	if err != nil {
+		t.Fatalf("failed to move card to learning: %v", err)
+	}
+	if got := completedToday(); got != 1 {
+		t.Fatalf("a learning card due after midnight must not count as completed, got %d", got)
+	}
+}
+
+func TestCheckDeckStats(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	if err := storage.AddCardsInBatch(userID, deck.ID, cardFields(5), DefaultCardBatchSize); err != nil {
+		t.Fatalf("failed to add cards: %v", err)
+	}
+
+	cards, err := storage.GetCardsByDeckID(deck.ID, userID)
+	if err != nil {
+		t.Fatalf("failed to load cards: %v", err)
+	}
+
+	if err := storage.ReviewCard(&cards[0], deck, RatingGood, 1000); err != nil {
+		t.Fatalf("failed to review card: %v", err)
+	}
+
+	// Drift as a manual fix could leave it: a reviewed card put back to new and a card losing its schedule
+	if _, err := storage.db.Exec(`UPDATE cards SET state = 'new' WHERE id = ?`, cards[0].ID); err != nil {
+		t.Fatalf("failed to reset card state: %v", err)
+	}
+	if _, err := storage.db.Exec(`UPDATE cards SET state = 'review', next_review = NULL WHERE id = ?`, cards[1].ID); err != nil {
+		t.Fatalf("failed to clear card schedule: %v", err)
+	}
+
+	check, err := storage.CheckDeckStats(deck.ID)
+	if err != nil {
+		t.Fatalf("CheckDeckStats failed: %v", err)
+	}
+
+	counts := map[string]int{}
+	rows, err := storage.db.Query(`SELECT state, COUNT(*) FROM cards WHERE deck_id = ? AND deleted_at IS NULL GROUP BY state`, deck.ID)
+	if err != nil {
+		t.Fatalf("failed to count cards: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var state string
+		var count int
+		if err := rows.Scan(&state, &count); err != nil {
+			t.Fatalf("failed to scan count: %v", err)
+		}
+		counts[state] = count
+	}
+
+	if check.Breakdown.New != counts["new"] || check.Breakdown.Review != counts["review"] || check.Breakdown.Total != 5 {
+		t.Fatalf("breakdown %+v doesn't match the cards %v", *check.Breakdown, counts)
+	}
+
+	var unreviewedNew int
+	if err := storage.db.QueryRow(`SELECT COUNT(*) FROM cards WHERE deck_id = ? AND state = 'new' AND review_count = 0`, deck.ID).Scan(&unreviewedNew); err != nil {
+		t.Fatalf("failed to count new cards: %v", err)
+	}
+	if check.Stats.NewCards != unreviewedNew {
+		t.Fatalf("expected %d new cards in the stats, got %d", unreviewedNew, check.Stats.NewCards)
+	}
+
+	expected := []DeckDiscrepancy{
+		{Check: DeckCheckReviewedNew, Count: 1},
+		{Check: DeckCheckUnscheduled, Count: 1},
+	}
+	if len(check.Discrepancies) != len(expected) {
+		t.Fatalf("expected discrepancies %v, got %v", expected, check.Discrepancies)
+	}
+	for i, d := range expected {
+		if check.Discrepancies[i] != d {
+			t.Fatalf("expected discrepancies %v, got %v", expected, check.Discrepancies)
+		}
+	}
+}
+
+func TestMergeDecks(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, source := newTestDeck(t, storage)
+
+	target, err := storage.CreateDeck(userID, CreateDeckParams{Name: "Target", LanguageCode: source.LanguageCode})
+	if err != nil {
+		t.Fatalf("failed to create deck: %v", err)
+	}
+
+	if err := storage.AddCardsInBatch(userID, source.ID, cardFields(3), DefaultCardBatchSize); err != nil {
+		t.Fatalf("failed to add cards: %v", err)
+	}
+	cards, err := storage.GetCardsByDeckID(source.ID, userID)
+	if err != nil {
+		t.Fatalf("failed to load cards: %v", err)
+	}
+	if err := storage.DeleteCard(cards[0].ID, userID); err != nil {
+		t.Fatalf("failed to delete card: %v", err)
+	}
+
+	moved, err := storage.MergeDecks(userID, source.ID, target.ID)
+	if err != nil {
+		t.Fatalf("MergeDecks failed: %v", err)
+	}
+	if moved != 2 {
+		t.Errorf("expected only the 2 live cards to be moved, got %d", moved)
+	}
+
+	var deckID string
+	if err := storage.db.QueryRow(`SELECT deck_id FROM cards WHERE id = ?`, cards[0].ID).Scan(&deckID); err != nil {
+		t.Fatalf("failed to load deleted card: %v", err)
+	}
+	if deckID != source.ID {
+		t.Error("a soft-deleted card should stay with the source deck")
+	}
+
+	// A target deleted before the merge runs must not receive cards
+	other, err := storage.CreateDeck(userID, CreateDeckParams{Name: "Other", LanguageCode: source.LanguageCode})
+	if err != nil {
+		t.Fatalf("failed to create deck: %v", err)
+	}
+	if err := storage.AddCardsInBatch(userID, other.ID, cardFields(1), DefaultCardBatchSize); err != nil {
+		t.Fatalf("failed to add cards: %v", err)
+	}
+	if err := storage.DeleteDeck(target.ID); err != nil {
+		t.Fatalf("failed to delete deck: %v", err)
+	}
+	if _, err := storage.MergeDecks(userID, other.ID, target.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a deleted target, got %v", err)
+	}
+	left, err := storage.GetCardsByDeckID(other.ID, userID)
+	if err != nil {
+		t.Fatalf("failed to load cards: %v", err)
+	}
+	if len(left) != 1 {
+		t.Errorf("cards should stay in the source deck when the merge fails, got %d", len(left))
+	}
+}
+
+func TestCreateBundledDeck_Once(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, _ := newTestDeck(t, storage)
+
+	params := CreateDeckParams{
+		Name:   "N5",
+		Source: &DeckSource{Type: DeckSourceBundled, FileName: "n5.json", LanguageCode: "jp"},
+	}
+
+	first, created, err := storage.CreateBundledDeck(userID, params)
+	if err != nil {
+		t.Fatalf("CreateBundledDeck failed: %v", err)
+	}
+	if !created {
+		t.Fatal("the first import should create a deck")
+	}
+
+	second, created, err := storage.CreateBundledDeck(userID, params)
+	if err != nil {
+		t.Fatalf("CreateBundledDeck failed: %v", err)
+	}
+	if created || second.ID != first.ID {
+		t.Errorf("a repeated import should return deck %s, got %s (created %v)", first.ID, second.ID, created)
+	}
+
+	if err := storage.DeleteDeck(first.ID); err != nil {
+		t.Fatalf("failed to delete deck: %v", err)
+	}
+	third, created, err := storage.CreateBundledDeck(userID, params)
+	if err != nil {
+		t.Fatalf("CreateBundledDeck failed: %v", err)
+	}
+	if !created || third.ID == first.ID {
+		t.Error("importing again after deleting the deck should create a new one")
+	}
+}
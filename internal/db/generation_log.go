@@ -0,0 +1,100 @@
+package db
+
+import (
+	"fmt"
+	nanoid "github.com/matoous/go-nanoid/v2"
+	"time"
+)
+
+const (
+	// MaxGenerationLogs is how many logged generations are kept and returned for a card
+	MaxGenerationLogs = 20
+	// GenerationLogRetention is how long logged generations are kept
+	GenerationLogRetention = 30 * 24 * time.Hour
+)
+
+// GenerationLog is the prompt and raw model response of one card generation, kept for debugging
+type GenerationLog struct {
+	ID        string    `db:"id" json:"id"`
+	CardID    string    `db:"card_id" json:"card_id"`
+	UserID    string    `db:"user_id" json:"user_id"`
+	Prompt    string    `db:"prompt" json:"prompt"`
+	Response  string    `db:"response" json:"response"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// SaveGenerationLog stores a card generation's prompt and response. The log is pruned on every save: the card
+// keeps its MaxGenerationLogs newest entries and entries older than GenerationLogRetention are dropped for all cards.
+func (s *Storage) SaveGenerationLog(cardID, userID, prompt, response string) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	now := time.Now()
+	query := `
+		INSERT INTO generation_log (id, card_id, user_id, prompt, response, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+	if _, err = tx.Exec(query, nanoid.Must(), cardID, userID, prompt, response, now); err != nil {
+		return fmt.Errorf("error saving generation log: %w", err)
+	}
+
+	pruneQuery := `
+		DELETE FROM generation_log
+		WHERE created_at < ?
+		   OR (card_id = ? AND user_id = ? AND id NOT IN (
+				SELECT id FROM generation_log
+				WHERE card_id = ? AND user_id = ?
+				ORDER BY created_at DESC, rowid DESC
+				LIMIT ?
+		   ))
+	`
+	_, err = tx.Exec(pruneQuery, now.Add(-GenerationLogRetention), cardID, userID, cardID, userID, MaxGenerationLogs)
+	if err != nil {
+		return fmt.Errorf("error pruning generation log: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+// GetGenerationLogs returns the card's most recent logged generations, newest first
+func (s *Storage) GetGenerationLogs(cardID string) ([]GenerationLog, error) {
+	query := `
+		SELECT id, card_id, user_id, prompt, response, created_at
+		FROM generation_log
+		WHERE card_id = ?
+		ORDER BY created_at DESC, rowid DESC
+		LIMIT ?
+	`
+
+	rows, err := s.db.Query(query, cardID, MaxGenerationLogs)
+	if err != nil {
+		return nil, fmt.Errorf("error getting generation logs: %w", err)
+	}
+	defer rows.Close()
+
+	logs := make([]GenerationLog, 0)
+	for rows.Next() {
+		var log GenerationLog
+		if err := rows.Scan(&log.ID, &log.CardID, &log.UserID, &log.Prompt, &log.Response, &log.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning generation log: %w", err)
+		}
+		logs = append(logs, log)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating generation logs: %w", err)
+	}
+
+	return logs, nil
+}
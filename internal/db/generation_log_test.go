@@ -0,0 +1,59 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSaveGenerationLog_Prunes(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	card, err := storage.AddCard(userID, deck.ID, `{"term":"card"}`)
+	if err != nil {
+		t.Fatalf("failed to add card: %v", err)
+	}
+	other, err := storage.AddCard(userID, deck.ID, `{"term":"other"}`)
+	if err != nil {
+		t.Fatalf("failed to add card: %v", err)
+	}
+
+	if err := storage.SaveGenerationLog(other.ID, userID, "old prompt", "old response"); err != nil {
+		t.Fatalf("SaveGenerationLog failed: %v", err)
+	}
+	expired := time.Now().Add(-GenerationLogRetention - time.Hour)
+	if _, err := storage.db.Exec(`UPDATE generation_log SET created_at = ? WHERE card_id = ?`, expired, other.ID); err != nil {
+		t.Fatalf("failed to age log: %v", err)
+	}
+
+	for i := 0; i < MaxGenerationLogs+5; i++ {
+		if err := storage.SaveGenerationLog(card.ID, userID, fmt.Sprintf("prompt %d", i), "response"); err != nil {
+			t.Fatalf("SaveGenerationLog failed: %v", err)
+		}
+	}
+
+	var count int
+	if err := storage.db.QueryRow(`SELECT COUNT(*) FROM generation_log WHERE card_id = ?`, card.ID).Scan(&count); err != nil {
+		t.Fatalf("failed to count logs: %v", err)
+	}
+	if count != MaxGenerationLogs {
+		t.Fatalf("expected %d logs kept for the card, got %d", MaxGenerationLogs, count)
+	}
+
+	logs, err := storage.GetGenerationLogs(card.ID)
+	if err != nil {
+		t.Fatalf("GetGenerationLogs failed: %v", err)
+	}
+	if logs[0].Prompt != fmt.Sprintf("prompt %d", MaxGenerationLogs+4) {
+		t.Fatalf("expected the newest log first, got %q", logs[0].Prompt)
+	}
+
+	expiredLogs, err := storage.GetGenerationLogs(other.ID)
+	if err != nil {
+		t.Fatalf("GetGenerationLogs failed: %v", err)
+	}
+	if len(expiredLogs) != 0 {
+		t.Fatalf("expected logs past retention to be pruned, got %d", len(expiredLogs))
+	}
+}
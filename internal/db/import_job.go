@@ -0,0 +1,155 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ImportJob is the persisted record of a Telegram file import
+type ImportJob struct {
+	ID             string    `db:"id" json:"id"`
+	UserID         string    `db:"user_id" json:"user_id"`
+	TelegramChatID int64     `db:"telegram_chat_id" json:"telegram_chat_id"`
+	MessageID      int       `db:"message_id" json:"message_id"` // Status message the bot keeps editing
+	FileName       string    `db:"file_name" json:"file_name"`
+	Status         string    `db:"status" json:"status"`       // One of the ImportJobStatus constants
+	Total          int       `db:"total" json:"total"`         // Items parsed from the file, 0 until parsing is done
+	Processed      int       `db:"processed" json:"processed"` // Items saved as cards so far
+	CreatedAt      time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// Import job statuses, every status but ImportJobStatusRunning is final
+const (
+	ImportJobStatusRunning     = "running"
+	ImportJobStatusCompleted   = "completed"
+	ImportJobStatusFailed      = "failed"
+	ImportJobStatusCanceled    = "canceled"
+	ImportJobStatusInterrupted = "interrupted" // the server stopped while the import was running
+)
+
+// CreateImportJob saves a new import in the running state
+func (s *Storage) CreateImportJob(job *ImportJob) error {
+	now := time.Now()
+	job.Status = ImportJobStatusRunning
+	job.CreatedAt = now
+	job.UpdatedAt = now
+
+	query := `
+		INSERT INTO import_jobs (id, user_id, telegram_chat_id, message_id, file_name, status, total, processed, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	_, err := s.db.Exec(query, job.ID, job.UserID, job.TelegramChatID, job.MessageID, job.FileName,
+		job.Status, job.Total, job.Processed, job.CreatedAt, job.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("error creating import job: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateImportJobProgress records how many of the job's items are known and saved
+func (s *Storage) UpdateImportJobProgress(jobID string, total, processed int) error {
+	_, err := s.db.Exec(`UPDATE import_jobs SET total = ?, processed = ?, updated_at = ? WHERE id = ?`,
+		total, processed, time.Now(), jobID)
+	if err != nil {
+		return fmt.Errorf("error updating import job progress: %w", err)
+	}
+
+	return nil
+}
+
+// FinishImportJob moves a running job to a final status
+func (s *Storage) FinishImportJob(jobID string, status string, processed int) error {
+	_, err := s.db.Exec(`UPDATE import_jobs SET status = ?, processed = ?, updated_at = ? WHERE id = ? AND status = ?`,
+		status, processed, time.Now(), jobID, ImportJobStatusRunning)
+	if err != nil {
+		return fmt.Errorf("error finishing import job: %w", err)
+	}
+
+	return nil
+}
+
+// GetImportJob returns the import job with the given ID
+func (s *Storage) GetImportJob(jobID string) (*ImportJob, error) {
+	query := `
+		SELECT id, user_id, telegram_chat_id, message_id, file_name, status, total, processed, created_at, updated_at
+		FROM import_jobs
+		WHERE id = ?
+	`
+
+	var job ImportJob
+	err := s.db.QueryRow(query, jobID).Scan(
+		&job.ID,
+		&job.UserID,
+		&job.TelegramChatID,
+		&job.MessageID,
+		&job.FileName,
+		&job.Status,
+		&job.Total,
+		&job.Processed,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("error getting import job: %w", err)
+	}
+
+	return &job, nil
+}
+
+// InterruptRunningImportJobs marks every job still running as interrupted and returns them.
+// It is meant for startup, when no import of this process can be running yet.
+func (s *Storage) InterruptRunningImportJobs() ([]ImportJob, error) {
+	query := `
+		SELECT id, user_id, telegram_chat_id, message_id, file_name, status, total, processed, created_at, updated_at
+		FROM import_jobs
+		WHERE status = ?
+		ORDER BY created_at
+	`
+
+	rows, err := s.db.Query(query, ImportJobStatusRunning)
+	if err != nil {
+		return nil, fmt.Errorf("error getting running import jobs: %w", err)
+	}
+	defer rows.Close()
+
+	jobs := make([]ImportJob, 0)
+	for rows.Next() {
+		var job ImportJob
+		if err := rows.Scan(
+			&job.ID,
+			&job.UserID,
+			&job.TelegramChatID,
+			&job.MessageID,
+			&job.FileName,
+			&job.Status,
+			&job.Total,
+			&job.Processed,
+			&job.CreatedAt,
+			&job.UpdatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("error scanning import job: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating import jobs: %w", err)
+	}
+
+	for i := range jobs {
+		if err := s.FinishImportJob(jobs[i].ID, ImportJobStatusInterrupted, jobs[i].Processed); err != nil {
+			return nil, err
+		}
+		jobs[i].Status = ImportJobStatusInterrupted
+	}
+
+	return jobs, nil
+}
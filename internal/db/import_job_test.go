@@ -0,0 +1,80 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestInterruptRunningImportJobs_AfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "imports.db")
+
+	storage, err := ConnectDB(path)
+	if err != nil {
+		t.Fatalf("failed to connect to test database: %v", err)
+	}
+
+	if err := storage.SaveUser(&User{ID: "importer", TelegramID: 7, LanguageCode: "ru"}); err != nil {
+		t.Fatalf("failed to save user: %v", err)
+	}
+
+	halfDone := &ImportJob{ID: "half-done", UserID: "importer", TelegramChatID: 7, MessageID: 100, FileName: "words.csv"}
+	finished := &ImportJob{ID: "finished", UserID: "importer", TelegramChatID: 7, MessageID: 101, FileName: "verbs.csv"}
+	for _, job := range []*ImportJob{halfDone, finished} {
+		if err := storage.CreateImportJob(job); err != nil {
+			t.Fatalf("failed to create import job: %v", err)
+		}
+	}
+
+	if err := storage.UpdateImportJobProgress(halfDone.ID, 40, 20); err != nil {
+		t.Fatalf("failed to update progress: %v", err)
+	}
+	if err := storage.FinishImportJob(finished.ID, ImportJobStatusCompleted, 10); err != nil {
+		t.Fatalf("failed to finish import job: %v", err)
+	}
+
+	// The process stops without finishing the first job
+	if err := storage.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	storage, err = ConnectDB(path)
+	if err != nil {
+		t.Fatalf("failed to reconnect to test database: %v", err)
+	}
+	t.Cleanup(func() { _ = storage.Close() })
+
+	jobs, err := storage.InterruptRunningImportJobs()
+	if err != nil {
+		t.Fatalf("InterruptRunningImportJobs failed: %v", err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != halfDone.ID {
+		t.Fatalf("expected only the half-done job, got %+v", jobs)
+	}
+	if jobs[0].Total != 40 || jobs[0].Processed != 20 || jobs[0].MessageID != 100 {
+		t.Fatalf("expected the job's progress and status message to survive the restart, got %+v", jobs[0])
+	}
+
+	job, err := storage.GetImportJob(halfDone.ID)
+	if err != nil {
+		t.Fatalf("failed to load import job: %v", err)
+	}
+	if job.Status != ImportJobStatusInterrupted {
+		t.Fatalf("expected status %q, got %q", ImportJobStatusInterrupted, job.Status)
+	}
+
+	job, err = storage.GetImportJob(finished.ID)
+	if err != nil {
+		t.Fatalf("failed to load import job: %v", err)
+	}
+	if job.Status != ImportJobStatusCompleted {
+		t.Fatalf("a finished job must keep its status, got %q", job.Status)
+	}
+
+	jobs, err = storage.InterruptRunningImportJobs()
+	if err != nil {
+		t.Fatalf("InterruptRunningImportJobs failed: %v", err)
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("an interrupted job should only be reported once, got %d", len(jobs))
+	}
+}
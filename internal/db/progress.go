@@ -1,6 +1,8 @@
 package db
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	nanoid "github.com/matoous/go-nanoid/v2"
 	"math"
@@ -20,13 +22,90 @@ const (
 	FuzzPercentage float64 = 0.05 // 5% fuzz for review intervals > 1 day
 	DefaultEase            = 2.5
 	MinEaseFactor          = 1.3
+
+	DefaultEaseGoodBonus    = 0.10 // Added to ease on a successful review
+	DefaultEaseLapsePenalty = 0.20 // Subtracted from ease on a lapse
+	DefaultIntervalModifier = 1.0  // Scale of review intervals, decks can speed up or slow down their schedule
+
+	LeechLapseThreshold = 8 // Lapses after which a card is flagged as a leech and the deck's leech action applies
+
+	HardIntervalMultiplier = 1.2  // Scale of the previous interval for a Hard review
+	HardEasePenalty        = 0.15 // Subtracted from ease on a Hard review
+	EasyBonus              = 1.3  // Extra scale on top of the ease for an Easy review
+	EasyEaseBonus          = 0.15 // Added to ease on an Easy review
+	// EasyGraduateIntervalDays is the first review interval of a learning card answered Easy
+	EasyGraduateIntervalDays float64 = 4.0
+)
+
+// Confidence scheduling, enabled per deck, reads the answer time as a confidence signal on review cards
+const (
+	ConfidenceFastAnswerMs   = 4000  // A Good answer at most this fast was confident
+	ConfidenceSlowAnswerMs   = 20000 // A Good answer at least this slow was a struggle
+	ConfidenceMisclickMs     = 1000  // An Again at most this fast is likely a misclick
+	ConfidenceFastMultiplier = 1.15  // Interval scale for confident answers
+	ConfidenceSlowMultiplier = 0.85  // Interval scale for slow answers
 )
 
+// EaseSettings controls how ease and review intervals change on review; decks can override the defaults
+type EaseSettings struct {
+	MinEase      float64
+	GoodBonus    float64
+	LapsePenalty float64
+	// IntervalModifier multiplies review intervals after the ease is applied, 0 is treated as 1
+	IntervalModifier float64
+}
+
+func DefaultEaseSettings() EaseSettings {
+	return EaseSettings{
+		MinEase:          MinEaseFactor,
+		GoodBonus:        DefaultEaseGoodBonus,
+		LapsePenalty:     DefaultEaseLapsePenalty,
+		IntervalModifier: DefaultIntervalModifier,
+	}
+}
+
+// EaseSettings returns the deck's ease settings, falling back to defaults for a nil deck
+func (d *Deck) EaseSettings() EaseSettings {
+	if d == nil {
+		return DefaultEaseSettings()
+	}
+
+	return EaseSettings{
+		MinEase:          d.MinEase,
+		GoodBonus:        d.EaseGoodBonus,
+		LapsePenalty:     d.EaseLapsePenalty,
+		IntervalModifier: d.IntervalModifier,
+	}
+}
+
+// Ratings of a review. Hard and Easy came later and are only offered on decks with four rating buttons,
+// hence their values.
 const (
 	RatingAgain = 1
 	RatingGood  = 2
+	RatingHard  = 3
+	RatingEasy  = 4
+)
+
+// Rating buttons a deck offers, DefaultRatingButtons being Again and Good only
+const (
+	DefaultRatingButtons = 2
+	FourRatingButtons    = 4
 )
 
+// IsValidRatingButtons reports whether buttons is a supported number of rating buttons
+func IsValidRatingButtons(buttons int) bool {
+	return buttons == DefaultRatingButtons || buttons == FourRatingButtons
+}
+
+// IsValidRating reports whether rating is one of the ratings a deck with the given rating buttons offers
+func IsValidRating(rating int, buttons int) bool {
+	if buttons == FourRatingButtons {
+		return rating >= RatingAgain && rating <= RatingEasy
+	}
+	return rating == RatingAgain || rating == RatingGood
+}
+
 type CardState string
 
 const (
@@ -40,7 +119,7 @@ type Review struct {
 	ID           string        `db:"id" json:"id"`
 	UserID       string        `db:"user_id" json:"user_id"`
 	CardID       string        `db:"card_id" json:"card_id"`
-	Rating       int           `db:"rating" json:"rating"` // 1=Again, 2=Good
+	Rating       int           `db:"rating" json:"rating"` // 1=Again, 2=Good, 3=Hard, 4=Easy
 	ReviewedAt   time.Time     `db:"reviewed_at" json:"reviewed_at"`
 	TimeSpentMs  int           `db:"time_spent_ms" json:"time_spent_ms"`
 	PrevInterval time.Duration `db:"prev_interval" json:"prev_interval"`
@@ -53,13 +132,17 @@ const ()
 
 // In db/review.go
 
-func (s *Storage) ReviewCard(card *Card, rating int, timeSpentMs int) error {
+func (s *Storage) ReviewCard(card *Card, deck *Deck, rating int, timeSpentMs int) error {
 	now := time.Now()
 
 	// Store original values for logging and specific logic
 	initialCardState := CardState(card.State)
 	prevInterval := card.Interval
 	prevEase := card.Ease
+	prevLearningStep := card.LearningStep
+	prevNextReview := card.NextReview
+	prevLastReviewedAt := card.LastReviewedAt
+	prevFirstReviewedAt := card.FirstReviewedAt
 
 	// 1. Calculate next parameters using the core function
 	params, err := calculateNextReviewParameters(
@@ -68,6 +151,7 @@ func (s *Storage) ReviewCard(card *Card, rating int, timeSpentMs int) error {
 		card.Interval, // This is the interval *before* this review
 		card.Ease,     // This is the ease *before* this review
 		rating,
+		deck.EaseSettings(),
 	)
 
 	if err != nil {
@@ -80,15 +164,23 @@ func (s *Storage) ReviewCard(card *Card, rating int, timeSpentMs int) error {
 	card.Ease = params.Ease
 	card.Interval = params.Interval // This is the base new interval (unfuzzed)
 
+	// 2b. Adjust by answer time on decks that opted in
+	if deck != nil && deck.ConfidenceScheduling {
+		applyConfidence(&params, initialCardState, prevEase, rating, timeSpentMs)
+		card.Ease = params.Ease
+		card.Interval = params.Interval
+	}
+
 	// 3. Handle LapsCount (specific to Review -> Relearning transition)
-	if initialCardState == StateReview && rating == RatingAgain {
+	lapsed := initialCardState == StateReview && rating == RatingAgain
+	if lapsed {
 		card.LapsCount++
 	}
 
 	// 4. Apply Fuzzing if applicable (only for actual reviews, not previews)
 	oneDay := 24 * time.Hour
-	// Fuzzing condition: original state was Review, rating was Good, calculated interval > 1 day
-	if initialCardState == StateReview && rating == RatingGood && card.Interval > oneDay && FuzzPercentage > 0.0 {
+	// Fuzzing condition: original state was Review, the card was recalled, calculated interval > 1 day
+	if initialCardState == StateReview && rating != RatingAgain && card.Interval > oneDay && FuzzPercentage > 0.0 {
 		fuzzRangeSeconds := card.Interval.Seconds() * FuzzPercentage
 		// IMPORTANT: Ensure rand is seeded at application startup: rand.Seed(time.Now().UnixNano())
 		fuzzAmountSeconds := (rand.Float64()*2.0 - 1.0) * fuzzRangeSeconds
@@ -134,32 +226,75 @@ func (s *Storage) ReviewCard(card *Card, rating int, timeSpentMs int) error {
 	}
 	defer tx.Rollback() // Defer rollback in case of panic or early return
 
+	// The card's previous scheduling is kept with the review so that UndoLastReview can restore it
 	reviewQuery := `
-		INSERT INTO reviews (id, user_id, card_id, rating, reviewed_at, time_spent_ms, prev_interval, new_interval, prev_ease, new_ease)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO reviews (
+			id, user_id, card_id, rating, reviewed_at, time_spent_ms, prev_interval, new_interval, prev_ease, new_ease,
+			prev_state, prev_learning_step, prev_next_review, prev_last_reviewed_at, prev_first_reviewed_at,
+			prev_learning_reviews, prev_stuck_at
+		)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, learning_reviews, stuck_at
+		FROM cards WHERE id = ? AND user_id = ?
 	`
 	prevIntervalNs := prevInterval.Nanoseconds()
 	newIntervalNs := card.Interval.Nanoseconds() // Use the final (possibly fuzzed) interval
 
-	_, dbErr = tx.Exec(reviewQuery,
+	result, dbErr := tx.Exec(reviewQuery,
 		nanoid.Must(), card.UserID, card.ID, rating, now, timeSpentMs,
 		prevIntervalNs, newIntervalNs, prevEase, card.Ease, // Use prevEase and new card.Ease
+		initialCardState, prevLearningStep, prevNextReview, prevLastReviewedAt, prevFirstReviewedAt,
+		card.ID, card.UserID,
 	)
 	if dbErr != nil {
 		return fmt.Errorf("error creating review: %w", dbErr)
 	}
 
+	// The review is copied from the card's row, without it nothing would be logged
+	inserted, dbErr := result.RowsAffected()
+	if dbErr != nil {
+		return fmt.Errorf("error checking created review: %w", dbErr)
+	}
+	if inserted != 1 {
+		return ErrNotFound
+	}
+
+	stuckReviewLimit := 0
+	leechAction := LeechActionSuspend
+	if deck != nil {
+		stuckReviewLimit = deck.StuckReviewLimit
+		if IsValidLeechAction(deck.LeechAction) {
+			leechAction = deck.LeechAction
+		}
+	}
+
+	// learning_reviews counts reviews since the card last reached the review state, a card that reaches the
+	// deck's stuck review limit that way is flagged until it graduates. A card reaching LeechLapseThreshold
+	// lapses is flagged as a leech by that lapse, and then suspended or tagged as the deck's leech action says.
 	updateCardQuery := `
 		UPDATE cards
 		SET next_review = ?, interval = ?, ease = ?, review_count = ?,
 		    laps_count = ?, last_reviewed_at = ?, first_reviewed_at = ?,
-		    state = ?, learning_step = ?, updated_at = ?
+		    state = ?, learning_step = ?, updated_at = ?,
+		    learning_reviews = CASE WHEN ? = 'review' THEN 0 ELSE learning_reviews + 1 END,
+		    stuck_at = CASE
+		        WHEN ? = 'review' THEN NULL
+		        WHEN ? > 0 AND learning_reviews + 1 >= ? THEN COALESCE(stuck_at, ?)
+		        ELSE stuck_at
+		    END,
+		    leech_at = CASE WHEN ? AND ? >= ? THEN COALESCE(leech_at, ?) ELSE leech_at END,
+		    suspended_at = CASE WHEN ? AND ? AND leech_at IS NULL AND ? >= ? THEN ? ELSE suspended_at END,
+		    tags = CASE WHEN ? AND ? AND leech_at IS NULL AND ? >= ? THEN TRIM(tags || ' ' || ?) ELSE tags END
 		WHERE id = ? AND user_id = ?
 	`
 	_, dbErr = tx.Exec(updateCardQuery,
 		card.NextReview, card.Interval.Nanoseconds(), card.Ease, card.ReviewCount,
 		card.LapsCount, card.LastReviewedAt, card.FirstReviewedAt,
 		card.State, card.LearningStep, now, // updated_at
+		card.State,
+		card.State, stuckReviewLimit, stuckReviewLimit, now,
+		lapsed, card.LapsCount, LeechLapseThreshold, now,
+		lapsed, leechAction == LeechActionSuspend, card.LapsCount, LeechLapseThreshold, now,
+		lapsed, leechAction == LeechActionTag, card.LapsCount, LeechLapseThreshold, LeechTag,
 		card.ID, card.UserID,
 	)
 	if dbErr != nil {
@@ -173,6 +308,178 @@ func (s *Storage) ReviewCard(card *Card, rating int, timeSpentMs int) error {
 	return nil
 }
 
+// Reasons UndoLastReview refuses to undo a review
+var (
+	ErrNoReviewToUndo      = errors.New("card has no review to undo")
+	ErrReviewNotReversible = errors.New("review can't be undone")
+)
+
+// UndoLastReview reverts the card's latest review: its scheduling goes back to what it was before the review,
+// flags set by the review (stuck, leech and the suspension of a leech) are lifted and the review is deleted.
+// Reviews logged before their previous state was recorded, and reviews the card has changed since, aren't
+// reversible. Only the latest review can be undone, undoing again reverts the review before it.
+func (s *Storage) UndoLastReview(userID, cardID string) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM cards WHERE id = ? AND user_id = ? AND deleted_at IS NULL)`,
+		cardID, userID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("error checking card: %w", err)
+	}
+	if !exists {
+		err = ErrNotFound
+		return err
+	}
+
+	query := `
+		SELECT r.id, r.rating, CAST(r.prev_interval AS INTEGER), r.prev_ease, r.prev_state, r.prev_learning_step,
+		       r.prev_next_review, r.prev_last_reviewed_at, r.prev_first_reviewed_at, r.prev_learning_reviews,
+		       r.prev_stuck_at, COALESCE(c.last_reviewed_at = r.reviewed_at, 0)
+		FROM reviews r
+		JOIN cards c ON c.id = r.card_id AND c.user_id = r.user_id
+		WHERE r.card_id = ? AND r.user_id = ?
+		ORDER BY r.reviewed_at DESC
+		LIMIT 1
+	`
+
+	var (
+		reviewID, prevState                                     string
+		rating, prevLearningStep, prevLearningReviews           int
+		prevIntervalNs                                          int64
+		prevEase                                                float64
+		prevNextReview, prevLastReviewedAt, prevFirstReviewedAt *time.Time
+		prevStuckAt                                             *time.Time
+		latest                                                  bool
+	)
+	err = tx.QueryRow(query, cardID, userID).Scan(
+		&reviewID, &rating, &prevIntervalNs, &prevEase, &prevState, &prevLearningStep,
+		&prevNextReview, &prevLastReviewedAt, &prevFirstReviewedAt, &prevLearningReviews,
+		&prevStuckAt, &latest,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNoReviewToUndo
+			return err
+		}
+		return fmt.Errorf("error getting last review: %w", err)
+	}
+
+	// prev_state is empty for reviews logged before undo was supported, and a card whose last review time
+	// differs from the review's was changed by something else since
+	if prevState == "" || !latest {
+		err = ErrReviewNotReversible
+		return err
+	}
+
+	lapses := 0
+	if CardState(prevState) == StateReview && rating == RatingAgain {
+		lapses = 1
+	}
+
+	updateQuery := `
+		UPDATE cards
+		SET next_review = ?, interval = ?, ease = ?, review_count = MAX(review_count - 1, 0),
+		    laps_count = MAX(laps_count - ?, 0), last_reviewed_at = ?, first_reviewed_at = ?,
+		    state = ?, learning_step = ?, learning_reviews = ?, stuck_at = ?,
+		    leech_at = CASE WHEN leech_at = (SELECT reviewed_at FROM reviews WHERE id = ?) THEN NULL ELSE leech_at END,
+		    suspended_at = CASE WHEN suspended_at = (SELECT reviewed_at FROM reviews WHERE id = ?) THEN NULL ELSE suspended_at END,
+		    tags = CASE
+		        WHEN leech_at = (SELECT reviewed_at FROM reviews WHERE id = ?) THEN TRIM(REPLACE(' ' || tags || ' ', ' ' || ? || ' ', ' '))
+		        ELSE tags
+		    END,
+		    updated_at = ?
+		WHERE id = ? AND user_id = ?
+	`
+	_, err = tx.Exec(updateQuery,
+		prevNextReview, prevIntervalNs, prevEase,
+		lapses, prevLastReviewedAt, prevFirstReviewedAt,
+		prevState, prevLearningStep, prevLearningReviews, prevStuckAt,
+		reviewID,
+		reviewID,
+		reviewID, LeechTag,
+		time.Now(),
+		cardID, userID,
+	)
+	if err != nil {
+		return fmt.Errorf("error restoring card: %w", err)
+	}
+
+	if _, err = tx.Exec(`DELETE FROM reviews WHERE id = ?`, reviewID); err != nil {
+		return fmt.Errorf("error deleting review: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+// applyConfidence adjusts review parameters by answer time. Only cards answered in the review state
+// are touched, and only when the time is known: a fast Good lengthens the interval by
+// ConfidenceFastMultiplier and a slow one shortens it by ConfidenceSlowMultiplier, keeping it within the
+// review bounds. A lapse answered within ConfidenceMisclickMs still relearns the card but keeps its ease.
+func applyConfidence(params *NextReviewParameters, initialState CardState, prevEase float64, rating int, timeSpentMs int) {
+	if initialState != StateReview || timeSpentMs <= 0 {
+		return
+	}
+
+	switch rating {
+	case RatingGood:
+		multiplier := 1.0
+		if timeSpentMs <= ConfidenceFastAnswerMs {
+			multiplier = ConfidenceFastMultiplier
+		} else if timeSpentMs >= ConfidenceSlowAnswerMs {
+			multiplier = ConfidenceSlowMultiplier
+		}
+
+		interval := time.Duration(float64(params.Interval) * multiplier)
+		minReviewInterval := time.Duration(GraduateToReviewIntervalDays * 24 * float64(time.Hour))
+		maxIntervalDuration := time.Duration(MaxReviewIntervalDays) * 24 * time.Hour
+		params.Interval = min(max(interval, minReviewInterval), maxIntervalDuration)
+	case RatingAgain:
+		if timeSpentMs <= ConfidenceMisclickMs && prevEase > params.Ease {
+			params.Ease = prevEase
+		}
+	}
+}
+
+// modifiedReviewInterval applies the deck's interval modifier to a review interval, keeping it at least the
+// graduation interval
+func modifiedReviewInterval(interval float64, easeSettings EaseSettings) time.Duration {
+	if easeSettings.IntervalModifier > 0 {
+		interval *= easeSettings.IntervalModifier
+	}
+
+	minReviewInterval := time.Duration(GraduateToReviewIntervalDays * 24 * float64(time.Hour))
+	return max(time.Duration(interval), minReviewInterval)
+}
+
+// repeatLearningStep keeps a learning or relearning card on its step for a Hard answer and waits that step's delay again
+func repeatLearningStep(params *NextReviewParameters) {
+	if params.LearningStep == 1 {
+		params.Interval = LearningStep1Duration
+	} else {
+		params.Interval = LearningStep2Duration
+	}
+}
+
+// graduateEasy moves a learning or relearning card answered Easy straight to review with EasyGraduateIntervalDays
+func graduateEasy(params *NextReviewParameters) {
+	params.State = StateReview
+	params.LearningStep = 0
+	params.Interval = time.Duration(EasyGraduateIntervalDays * 24 * float64(time.Hour))
+}
+
 type NextReviewParameters struct {
 	Interval     time.Duration
 	Ease         float64
@@ -186,6 +493,7 @@ func calculateNextReviewParameters(
 	currentInterval time.Duration,
 	currentEase float64,
 	rating int,
+	easeSettings EaseSettings,
 ) (NextReviewParameters, error) {
 	params := NextReviewParameters{
 		Interval:     currentInterval,     // Start with current, will be updated
@@ -199,9 +507,9 @@ func calculateNextReviewParameters(
 		params.Ease = DefaultEase
 		effectivePrevEase = DefaultEase
 	} else {
-		if params.Ease < MinEaseFactor {
-			params.Ease = MinEaseFactor
-			effectivePrevEase = MinEaseFactor
+		if params.Ease < easeSettings.MinEase {
+			params.Ease = easeSettings.MinEase
+			effectivePrevEase = easeSettings.MinEase
 		}
 	}
 
@@ -209,11 +517,13 @@ func calculateNextReviewParameters(
 	case StateNew:
 		params.State = StateLearning
 		params.LearningStep = 1
-		if rating == RatingAgain {
+		if rating == RatingAgain || rating == RatingHard {
 			params.Interval = LearningStep1Duration
 		} else if rating == RatingGood {
 			params.LearningStep = 2
 			params.Interval = LearningStep2Duration
+		} else if rating == RatingEasy {
+			graduateEasy(&params)
 		}
 		// Ease is set to DefaultEase for new cards, no adjustment here
 
@@ -230,6 +540,10 @@ func calculateNextReviewParameters(
 				params.LearningStep = 0 // No longer in a specific learning step
 				params.Interval = time.Duration(GraduateToReviewIntervalDays * 24 * float64(time.Hour))
 			}
+		} else if rating == RatingHard {
+			repeatLearningStep(&params)
+		} else if rating == RatingEasy {
+			graduateEasy(&params)
 		}
 		// Ease generally doesn't change during learning steps unless it's a new card (handled by initial ease setting)
 
@@ -238,19 +552,19 @@ func calculateNextReviewParameters(
 			params.State = StateRelearning
 			params.LearningStep = 2
 			params.Interval = LearningStep2Duration
-			params.Ease = math.Max(MinEaseFactor, effectivePrevEase-0.20) // Use ease before this review
+			params.Ease = math.Max(easeSettings.MinEase, effectivePrevEase-easeSettings.LapsePenalty) // Use ease before this review
 		} else if rating == RatingGood {
 			// State remains StateReview
-			params.Ease = math.Max(MinEaseFactor, effectivePrevEase+0.10) // Use ease before this review
-
-			calculatedIntervalValue := float64(currentInterval) * params.Ease // currentInterval is prevInterval here
-			params.Interval = time.Duration(calculatedIntervalValue)
-
-			minReviewInterval := time.Duration(GraduateToReviewIntervalDays * 24 * float64(time.Hour))
-			if params.Interval < minReviewInterval {
-				params.Interval = minReviewInterval
-			}
+			params.Ease = math.Max(easeSettings.MinEase, effectivePrevEase+easeSettings.GoodBonus) // Use ease before this review
+			params.Interval = modifiedReviewInterval(float64(currentInterval)*params.Ease, easeSettings)
 			// Fuzzing is applied later in ReviewCard if needed, not here
+		} else if rating == RatingHard {
+			// Recalled with difficulty: the interval grows by a fixed factor and the ease drops
+			params.Ease = math.Max(easeSettings.MinEase, effectivePrevEase-HardEasePenalty)
+			params.Interval = modifiedReviewInterval(float64(currentInterval)*HardIntervalMultiplier, easeSettings)
+		} else if rating == RatingEasy {
+			params.Ease = math.Max(easeSettings.MinEase, effectivePrevEase+EasyEaseBonus)
+			params.Interval = modifiedReviewInterval(float64(currentInterval)*params.Ease*EasyBonus, easeSettings)
 		}
 
 	case StateRelearning:
@@ -266,6 +580,10 @@ func calculateNextReviewParameters(
 				params.LearningStep = 0
 				params.Interval = time.Duration(GraduateToReviewIntervalDays * 24 * float64(time.Hour))
 			}
+		} else if rating == RatingHard {
+			repeatLearningStep(&params)
+		} else if rating == RatingEasy {
+			graduateEasy(&params)
 		}
 		// Ease is not changed during relearning steps (it was adjusted at the lapse)
 
@@ -0,0 +1,466 @@
+package db
+
+import (
+	"errors"
+	nanoid "github.com/matoous/go-nanoid/v2"
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCalculateNextReviewParameters_EaseSettings(t *testing.T) {
+	interval := 3 * 24 * time.Hour
+
+	tests := []struct {
+		name         string
+		ease         float64
+		rating       int
+		easeSettings EaseSettings
+		expectedEase float64
+	}{
+		{
+			name:         "Default lapse penalty",
+			ease:         2.5,
+			rating:       RatingAgain,
+			easeSettings: DefaultEaseSettings(),
+			expectedEase: 2.3,
+		},
+		{
+			name:         "Custom lapse penalty",
+			ease:         2.5,
+			rating:       RatingAgain,
+			easeSettings: EaseSettings{MinEase: MinEaseFactor, GoodBonus: DefaultEaseGoodBonus, LapsePenalty: 0.5},
+			expectedEase: 2.0,
+		},
+		{
+			name:         "Custom good bonus",
+			ease:         2.5,
+			rating:       RatingGood,
+			easeSettings: EaseSettings{MinEase: MinEaseFactor, GoodBonus: 0.25, LapsePenalty: DefaultEaseLapsePenalty},
+			expectedEase: 2.75,
+		},
+		{
+			name:         "Lapse penalty clamped by default floor",
+			ease:         1.5,
+			rating:       RatingAgain,
+			easeSettings: EaseSettings{MinEase: MinEaseFactor, GoodBonus: DefaultEaseGoodBonus, LapsePenalty: 0.5},
+			expectedEase: MinEaseFactor,
+		},
+		{
+			name:         "Lapse penalty clamped by custom floor",
+			ease:         1.7,
+			rating:       RatingAgain,
+			easeSettings: EaseSettings{MinEase: 1.6, GoodBonus: DefaultEaseGoodBonus, LapsePenalty: 0.2},
+			expectedEase: 1.6,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := calculateNextReviewParameters(StateReview, 0, interval, tt.ease, tt.rating, tt.easeSettings)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if math.Abs(params.Ease-tt.expectedEase) > 1e-9 {
+				t.Errorf("Expected ease %.2f, got %.2f", tt.expectedEase, params.Ease)
+			}
+		})
+	}
+}
+
+func TestCalculateNextReviewParameters_IntervalModifier(t *testing.T) {
+	interval := 10 * 24 * time.Hour
+	deck := &Deck{MinEase: MinEaseFactor, EaseGoodBonus: DefaultEaseGoodBonus, EaseLapsePenalty: DefaultEaseLapsePenalty, IntervalModifier: 0.8}
+
+	// Every rating that schedules a review scales its interval by the modifier alike
+	for _, rating := range []int{RatingHard, RatingGood, RatingEasy} {
+		base, err := calculateNextReviewParameters(StateReview, 0, interval, DefaultEase, rating, DefaultEaseSettings())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		modified, err := calculateNextReviewParameters(StateReview, 0, interval, DefaultEase, rating, deck.EaseSettings())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if ratio := float64(modified.Interval) / float64(base.Interval); math.Abs(ratio-0.8) > 1e-9 {
+			t.Errorf("Rating %d: expected the interval scaled by 0.8, got %v vs %v (ratio %.4f)", rating, modified.Interval, base.Interval, ratio)
+		}
+		if modified.Ease != base.Ease {
+			t.Errorf("Rating %d: expected the modifier to leave ease alone, got %.2f vs %.2f", rating, modified.Ease, base.Ease)
+		}
+	}
+
+	// Learning steps aren't review intervals and keep their fixed durations
+	learning, err := calculateNextReviewParameters(StateLearning, 1, LearningStep1Duration, DefaultEase, RatingGood, deck.EaseSettings())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if learning.Interval != LearningStep2Duration {
+		t.Errorf("Expected learning step interval %v, got %v", LearningStep2Duration, learning.Interval)
+	}
+}
+
+func TestCalculateNextReviewParameters_HardEasy(t *testing.T) {
+	interval := 10 * 24 * time.Hour
+	settings := DefaultEaseSettings()
+
+	review := func(rating int) NextReviewParameters {
+		params, err := calculateNextReviewParameters(StateReview, 0, interval, DefaultEase, rating, settings)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return params
+	}
+
+	hard, good, easy := review(RatingHard), review(RatingGood), review(RatingEasy)
+
+	if want := time.Duration(float64(interval) * HardIntervalMultiplier); hard.Interval != want {
+		t.Errorf("Expected Hard interval %v, got %v", want, hard.Interval)
+	}
+	if math.Abs(hard.Ease-(DefaultEase-HardEasePenalty)) > 1e-9 {
+		t.Errorf("Expected Hard to lower ease to %.2f, got %.2f", DefaultEase-HardEasePenalty, hard.Ease)
+	}
+	if math.Abs(easy.Ease-(DefaultEase+EasyEaseBonus)) > 1e-9 {
+		t.Errorf("Expected Easy to raise ease to %.2f, got %.2f", DefaultEase+EasyEaseBonus, easy.Ease)
+	}
+	if !(hard.Interval < good.Interval && good.Interval < easy.Interval) {
+		t.Errorf("Expected Hard < Good < Easy intervals, got %v, %v, %v", hard.Interval, good.Interval, easy.Interval)
+	}
+
+	// The cap applies to the new ratings too
+	longInterval := time.Duration(MaxReviewIntervalDays) * 24 * time.Hour
+	capped, err := calculateNextReviewParameters(StateReview, 0, longInterval, DefaultEase, RatingEasy, settings)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if capped.Interval != longInterval {
+		t.Errorf("Expected Easy interval capped at %v, got %v", longInterval, capped.Interval)
+	}
+
+	// Learning cards repeat their step on Hard and graduate straight away on Easy
+	hardStep, err := calculateNextReviewParameters(StateLearning, 2, LearningStep2Duration, DefaultEase, RatingHard, settings)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hardStep.State != StateLearning || hardStep.LearningStep != 2 || hardStep.Interval != LearningStep2Duration {
+		t.Errorf("Expected Hard to repeat learning step 2, got %s step %d in %v", hardStep.State, hardStep.LearningStep, hardStep.Interval)
+	}
+
+	easyNew, err := calculateNextReviewParameters(StateNew, 0, 0, DefaultEase, RatingEasy, settings)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := time.Duration(EasyGraduateIntervalDays * 24 * float64(time.Hour)); easyNew.State != StateReview || easyNew.Interval != want {
+		t.Errorf("Expected an Easy new card to graduate with %v, got %s in %v", want, easyNew.State, easyNew.Interval)
+	}
+}
+
+func TestApplyConfidence(t *testing.T) {
+	interval := 10 * 24 * time.Hour
+	good, err := calculateNextReviewParameters(StateReview, 0, interval, 2.5, RatingGood, DefaultEaseSettings())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	again, err := calculateNextReviewParameters(StateReview, 0, interval, 2.5, RatingAgain, DefaultEaseSettings())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name             string
+		state            CardState
+		base             NextReviewParameters
+		rating           int
+		timeSpentMs      int
+		expectedInterval time.Duration
+		expectedEase     float64
+	}{
+		{
+			name: "Fast good lengthens", state: StateReview, base: good, rating: RatingGood, timeSpentMs: 2000,
+			expectedInterval: time.Duration(float64(good.Interval) * ConfidenceFastMultiplier), expectedEase: good.Ease,
+		},
+		{
+			name: "Slow good shortens", state: StateReview, base: good, rating: RatingGood, timeSpentMs: 30000,
+			expectedInterval: time.Duration(float64(good.Interval) * ConfidenceSlowMultiplier), expectedEase: good.Ease,
+		},
+		{
+			name: "Ordinary good unchanged", state: StateReview, base: good, rating: RatingGood, timeSpentMs: 8000,
+			expectedInterval: good.Interval, expectedEase: good.Ease,
+		},
+		{
+			name: "Unknown time unchanged", state: StateReview, base: good, rating: RatingGood, timeSpentMs: 0,
+			expectedInterval: good.Interval, expectedEase: good.Ease,
+		},
+		{
+			name: "Learning card unchanged", state: StateLearning, base: good, rating: RatingGood, timeSpentMs: 2000,
+			expectedInterval: good.Interval, expectedEase: good.Ease,
+		},
+		{
+			name: "Misclicked again keeps ease", state: StateReview, base: again, rating: RatingAgain, timeSpentMs: 500,
+			expectedInterval: again.Interval, expectedEase: 2.5,
+		},
+		{
+			name: "Considered again keeps penalty", state: StateReview, base: again, rating: RatingAgain, timeSpentMs: 5000,
+			expectedInterval: again.Interval, expectedEase: again.Ease,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := tt.base
+			applyConfidence(&params, tt.state, 2.5, tt.rating, tt.timeSpentMs)
+
+			if params.Interval != tt.expectedInterval {
+				t.Errorf("Expected interval %v, got %v", tt.expectedInterval, params.Interval)
+			}
+			if math.Abs(params.Ease-tt.expectedEase) > 1e-9 {
+				t.Errorf("Expected ease %.2f, got %.2f", tt.expectedEase, params.Ease)
+			}
+			if params.State != tt.base.State {
+				t.Errorf("Expected state %s, got %s", tt.base.State, params.State)
+			}
+		})
+	}
+}
+
+func TestReviewCard_ConfidenceScheduling(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	interval := 10 * 24 * time.Hour
+	base, err := calculateNextReviewParameters(StateReview, 0, interval, 2.5, RatingGood, deck.EaseSettings())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	review := func(t *testing.T, deck *Deck, timeSpentMs int) time.Duration {
+		t.Helper()
+
+		card, err := storage.AddCard(userID, deck.ID, `{"term":"word"}`)
+		if err != nil {
+			t.Fatalf("failed to add card: %v", err)
+		}
+		card.State = string(StateReview)
+		card.Interval = interval
+		card.Ease = 2.5
+
+		if err := storage.ReviewCard(card, deck, RatingGood, timeSpentMs); err != nil {
+			t.Fatalf("ReviewCard failed: %v", err)
+		}
+		return card.Interval
+	}
+
+	// Intervals are fuzzed by FuzzPercentage, so they are compared against the fuzz range around the expected one
+	withinFuzz := func(got, expected time.Duration) bool {
+		return math.Abs(float64(got-expected)) <= float64(expected)*FuzzPercentage+float64(time.Second)
+	}
+
+	t.Run("Disabled by default", func(t *testing.T) {
+		if deck.ConfidenceScheduling {
+			t.Fatalf("Expected confidence scheduling to be off for new decks")
+		}
+
+		for _, timeSpentMs := range []int{500, 2000, 30000} {
+			if got := review(t, deck, timeSpentMs); !withinFuzz(got, base.Interval) {
+				t.Errorf("Expected interval near %v for %dms, got %v", base.Interval, timeSpentMs, got)
+			}
+		}
+	})
+
+	t.Run("Fast good beats slow good", func(t *testing.T) {
+		enabled := *deck
+		enabled.ConfidenceScheduling = true
+		if err := storage.UpdateDeckSettings(deck.ID, &enabled); err != nil {
+			t.Fatalf("failed to update deck settings: %v", err)
+		}
+		saved, err := storage.GetDeck(deck.ID)
+		if err != nil {
+			t.Fatalf("failed to load deck: %v", err)
+		}
+		if !saved.ConfidenceScheduling {
+			t.Fatalf("Expected confidence scheduling to be saved")
+		}
+
+		fast := review(t, saved, 2000)
+		slow := review(t, saved, 30000)
+
+		if fast <= slow {
+			t.Errorf("Expected fast good interval %v to be longer than slow %v", fast, slow)
+		}
+		if expected := time.Duration(float64(base.Interval) * ConfidenceFastMultiplier); !withinFuzz(fast, expected) {
+			t.Errorf("Expected fast interval near %v, got %v", expected, fast)
+		}
+		if expected := time.Duration(float64(base.Interval) * ConfidenceSlowMultiplier); !withinFuzz(slow, expected) {
+			t.Errorf("Expected slow interval near %v, got %v", expected, slow)
+		}
+	})
+}
+
+func TestReviewCard_LeechAction(t *testing.T) {
+	tests := []struct {
+		name          string
+		action        string
+		expectSuspend bool
+		expectTag     bool
+	}{
+		{name: "Suspend", action: LeechActionSuspend, expectSuspend: true},
+		{name: "Tag", action: LeechActionTag, expectTag: true},
+		{name: "None", action: LeechActionNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newTestStorage(t)
+			userID, deck := newTestDeck(t, storage)
+
+			deck.LeechAction = tt.action
+			if err := storage.UpdateDeckSettings(deck.ID, deck); err != nil {
+				t.Fatalf("failed to update deck settings: %v", err)
+			}
+			deck, err := storage.GetDeck(deck.ID)
+			if err != nil {
+				t.Fatalf("failed to load deck: %v", err)
+			}
+			if deck.LeechAction != tt.action {
+				t.Fatalf("Expected leech action %q, got %q", tt.action, deck.LeechAction)
+			}
+
+			card, err := storage.AddCard(userID, deck.ID, `{"term":"word"}`)
+			if err != nil {
+				t.Fatalf("failed to add card: %v", err)
+			}
+			card.State = string(StateReview)
+			card.Interval = 3 * 24 * time.Hour
+			card.Ease = 2.5
+			card.LapsCount = LeechLapseThreshold - 2
+
+			leechState := func() (leech bool, suspended bool) {
+				t.Helper()
+				var leechAt, suspendedAt *time.Time
+				if err := storage.db.QueryRow(`SELECT leech_at, suspended_at FROM cards WHERE id = ?`, card.ID).Scan(&leechAt, &suspendedAt); err != nil {
+					t.Fatalf("failed to read leech state: %v", err)
+				}
+				return leechAt != nil, suspendedAt != nil
+			}
+
+			// A lapse below the threshold flags nothing
+			if err := storage.ReviewCard(card, deck, RatingAgain, 5000); err != nil {
+				t.Fatalf("ReviewCard failed: %v", err)
+			}
+			if leech, suspended := leechState(); leech || suspended {
+				t.Fatalf("Expected no leech below the threshold, got leech=%v suspended=%v", leech, suspended)
+			}
+
+			// The lapse reaching the threshold applies the deck's action
+			card.State = string(StateReview)
+			card.Interval = 3 * 24 * time.Hour
+			if err := storage.ReviewCard(card, deck, RatingAgain, 5000); err != nil {
+				t.Fatalf("ReviewCard failed: %v", err)
+			}
+			if card.LapsCount != LeechLapseThreshold {
+				t.Fatalf("Expected %d lapses, got %d", LeechLapseThreshold, card.LapsCount)
+			}
+
+			leech, suspended := leechState()
+			if !leech {
+				t.Errorf("Expected the card to be flagged as a leech")
+			}
+			if suspended != tt.expectSuspend {
+				t.Errorf("Expected suspended=%v, got %v", tt.expectSuspend, suspended)
+			}
+
+			stored, err := storage.GetCard(card.ID, userID)
+			if err != nil {
+				t.Fatalf("failed to load card: %v", err)
+			}
+			if tagged := slices.Contains(stored.Tags, LeechTag); tagged != tt.expectTag {
+				t.Errorf("Expected tagged=%v, got tags %v", tt.expectTag, stored.Tags)
+			}
+
+			due, err := storage.GetDueCards(userID, deck.ID, 10)
+			if err != nil {
+				t.Fatalf("GetDueCards failed: %v", err)
+			}
+			if studied := len(due) == 1; studied == tt.expectSuspend {
+				t.Errorf("Expected the card in the due queue to be %v, got %d due cards", !tt.expectSuspend, len(due))
+			}
+
+			// Undoing the lapse takes the leech action back with it
+			if err := storage.UndoLastReview(userID, card.ID); err != nil {
+				t.Fatalf("UndoLastReview failed: %v", err)
+			}
+			if leech, suspended := leechState(); leech || suspended {
+				t.Errorf("Expected the undo to clear the leech, got leech=%v suspended=%v", leech, suspended)
+			}
+			stored, err = storage.GetCard(card.ID, userID)
+			if err != nil {
+				t.Fatalf("failed to load card: %v", err)
+			}
+			if len(stored.Tags) != 0 {
+				t.Errorf("Expected the undo to remove the leech tag, got %v", stored.Tags)
+			}
+		})
+	}
+}
+
+func TestReviewCard_SharedCardID(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	card, err := storage.AddCard(userID, deck.ID, `{"term":"word"}`)
+	if err != nil {
+		t.Fatalf("failed to add card: %v", err)
+	}
+
+	// Another user's card with the same ID, cards are keyed by ID and user
+	otherID := nanoid.Must()
+	if err := storage.SaveUser(&User{ID: otherID, TelegramID: 2, LanguageCode: "en"}); err != nil {
+		t.Fatalf("failed to save user: %v", err)
+	}
+	otherDeck, err := storage.CreateDeck(otherID, CreateDeckParams{Name: "Other Deck", Level: "mixed", LanguageCode: "jp", TranscriptionType: "furigana"})
+	if err != nil {
+		t.Fatalf("failed to create deck: %v", err)
+	}
+	other, err := storage.AddCard(otherID, otherDeck.ID, `{"term":"other"}`)
+	if err != nil {
+		t.Fatalf("failed to add card: %v", err)
+	}
+	if _, err := storage.db.Exec(`UPDATE cards SET id = ?, learning_reviews = 7, last_reviewed_at = ? WHERE id = ?`,
+		card.ID, time.Now().Add(-time.Hour), other.ID); err != nil {
+		t.Fatalf("failed to share card ID: %v", err)
+	}
+
+	if err := storage.ReviewCard(card, deck, RatingGood, 5000); err != nil {
+		t.Fatalf("ReviewCard failed: %v", err)
+	}
+
+	var reviews, prevLearningReviews int
+	if err := storage.db.QueryRow(`SELECT COUNT(*), MAX(prev_learning_reviews) FROM reviews WHERE card_id = ?`, card.ID).
+		Scan(&reviews, &prevLearningReviews); err != nil {
+		t.Fatalf("failed to read reviews: %v", err)
+	}
+	if reviews != 1 || prevLearningReviews != 0 {
+		t.Fatalf("Expected one review copied from the reviewer's card, got %d with prev_learning_reviews %d", reviews, prevLearningReviews)
+	}
+
+	if err := storage.UndoLastReview(userID, card.ID); err != nil {
+		t.Fatalf("UndoLastReview failed: %v", err)
+	}
+	restored, err := storage.GetCard(card.ID, userID)
+	if err != nil {
+		t.Fatalf("failed to load card: %v", err)
+	}
+	if restored.State != string(StateNew) {
+		t.Errorf("Expected the undone card to be new again, got %s", restored.State)
+	}
+
+	stranger := *restored
+	stranger.UserID = "someone-else"
+	if err := storage.ReviewCard(&stranger, deck, RatingGood, 5000); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound reviewing a card the user doesn't have, got %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	nanoid "github.com/matoous/go-nanoid/v2"
+	"time"
+)
+
+// Anki card types, the type column of an Anki collection's cards table
+const (
+	AnkiCardTypeNew        = 0
+	AnkiCardTypeLearning   = 1
+	AnkiCardTypeReview     = 2
+	AnkiCardTypeRelearning = 3
+)
+
+// ImportedScheduling is a card's review state as Anki keeps it. Due is a time rather than Anki's day number,
+// which only means something relative to the collection it came from.
+type ImportedScheduling struct {
+	Type         int       `json:"type"`          // One of the AnkiCardType constants
+	Due          time.Time `json:"due"`           // When the card is next due, zero for right away
+	IntervalDays int       `json:"interval_days"` // Anki's ivl
+	Factor       int       `json:"factor"`        // Anki's ease in permille, 2500 being an ease of 2.5
+	Reps         int       `json:"reps"`
+	Lapses       int       `json:"lapses"`
+}
+
+// applyTo maps the Anki state onto card. The mapping is approximate:
+//   - review cards keep their interval, clamped to MaxReviewIntervalDays, and their due date
+//   - learning and relearning cards restart at the first learning step, Anki's steps don't carry over
+//   - the ease is Anki's factor, raised to MinEaseFactor if it's lower
+//   - Anki doesn't export when a card was last reviewed, it is estimated as one interval before the due date
+//
+// New cards and unknown types are left new.
+func (sched ImportedScheduling) applyTo(card *Card, now time.Time) {
+	var state CardState
+	switch sched.Type {
+	case AnkiCardTypeLearning:
+		state = StateLearning
+	case AnkiCardTypeReview:
+		state = StateReview
+	case AnkiCardTypeRelearning:
+		state = StateRelearning
+	default:
+		return
+	}
+
+	card.State = string(state)
+	card.LearningStep = 0
+	card.ReviewCount = sched.Reps
+	card.LapsCount = sched.Lapses
+
+	if sched.Factor > 0 {
+		card.Ease = max(float64(sched.Factor)/1000, MinEaseFactor)
+	}
+
+	if sched.IntervalDays > 0 {
+		card.Interval = time.Duration(min(sched.IntervalDays, MaxReviewIntervalDays)) * 24 * time.Hour
+	} else if state == StateReview {
+		card.Interval = time.Duration(GraduateToReviewIntervalDays * float64(24*time.Hour))
+	}
+
+	due := sched.Due
+	if due.IsZero() {
+		due = now
+	}
+	card.NextReview = &due
+
+	lastReviewed := due.Add(-card.Interval)
+	if state != StateReview || lastReviewed.After(now) {
+		lastReviewed = now
+	}
+	card.LastReviewedAt = &lastReviewed
+	card.FirstReviewedAt = &lastReviewed
+}
+
+// AddScheduledCards inserts cards in one transaction, each taking the review state of the Anki scheduling at
+// the same index. Cards with no scheduling, or a nil entry, come in as new. It returns the IDs of the new cards
+// in the order of fieldsArray.
+func (s *Storage) AddScheduledCards(ctx context.Context, userID, deckID string, fieldsArray []string, schedules []*ImportedScheduling) (ids []string, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO cards (
+			id, deck_id, fields, user_id, next_review, interval, ease, review_count, laps_count,
+			last_reviewed_at, first_reviewed_at, state, learning_step, created_at, updated_at
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error preparing statement: %w", err)
+	}
+	defer stmt.Close()
+
+	ids = make([]string, 0, len(fieldsArray))
+	now := time.Now()
+	for i, fields := range fieldsArray {
+		card := Card{Ease: DefaultEase, State: string(StateNew)}
+		if i < len(schedules) && schedules[i] != nil {
+			schedules[i].applyTo(&card, now)
+		}
+
+		id := nanoid.Must()
+		_, err = stmt.ExecContext(ctx,
+			id, deckID, fields, userID, card.NextReview, card.Interval.Nanoseconds(), card.Ease,
+			card.ReviewCount, card.LapsCount, card.LastReviewedAt, card.FirstReviewedAt, card.State, card.LearningStep,
+			now, now,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error inserting card %d: %w", i, err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return ids, nil
+}
@@ -1,5 +1,56 @@
 package db
 
+import "fmt"
+
+// columnMigrations lists columns added after their table was first created.
+// CREATE TABLE IF NOT EXISTS leaves existing tables untouched, so these are added with ALTER TABLE.
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"decks", "min_ease", "REAL NOT NULL DEFAULT 1.3"},
+	{"decks", "ease_good_bonus", "REAL NOT NULL DEFAULT 0.1"},
+	{"decks", "ease_lapse_penalty", "REAL NOT NULL DEFAULT 0.2"},
+	{"decks", "description", "TEXT NOT NULL DEFAULT ''"},
+	{"decks", "is_generated", "INTEGER NOT NULL DEFAULT 0"},
+	{"decks", "generate_audio", "INTEGER NOT NULL DEFAULT 1"},
+	{"decks", "generate_images", "INTEGER NOT NULL DEFAULT 0"},
+	{"decks", "audio_content", "TEXT NOT NULL DEFAULT 'combined'"},
+	{"decks", "new_card_days", "INTEGER NOT NULL DEFAULT 127"},
+	{"decks", "stuck_review_limit", "INTEGER NOT NULL DEFAULT 15"},
+	{"decks", "confidence_scheduling", "INTEGER NOT NULL DEFAULT 0"},
+	{"decks", "leech_action", "TEXT NOT NULL DEFAULT 'suspend'"},
+	{"decks", "example_count", "INTEGER NOT NULL DEFAULT 1"},
+	{"decks", "import_type", "TEXT NOT NULL DEFAULT ''"},
+	{"decks", "import_file_name", "TEXT NOT NULL DEFAULT ''"},
+	{"decks", "import_language", "TEXT NOT NULL DEFAULT ''"},
+	{"decks", "imported_at", "TIMESTAMP"},
+	{"decks", "new_card_boost", "INTEGER NOT NULL DEFAULT 0"},
+	{"decks", "review_mode", "TEXT NOT NULL DEFAULT 'text'"},
+	{"decks", "interval_modifier", "REAL NOT NULL DEFAULT 1.0"},
+	{"decks", "example_on_back", "INTEGER NOT NULL DEFAULT 0"},
+	{"decks", "rating_buttons", "INTEGER NOT NULL DEFAULT 2"},
+	{"cards", "priority", "INTEGER NOT NULL DEFAULT 0"},
+	{"cards", "learning_reviews", "INTEGER NOT NULL DEFAULT 0"},
+	{"cards", "stuck_at", "TIMESTAMP"},
+	{"cards", "leech_at", "TIMESTAMP"},
+	{"cards", "suspended_at", "TIMESTAMP"},
+	{"cards", "generation_status", "TEXT NOT NULL DEFAULT ''"},
+	{"cards", "generation_error", "TEXT NOT NULL DEFAULT ''"},
+	{"cards", "buried_until", "TIMESTAMP"},
+	{"cards", "tags", "TEXT NOT NULL DEFAULT ''"},
+	{"reviews", "prev_state", "TEXT NOT NULL DEFAULT ''"},
+	{"reviews", "prev_learning_step", "INTEGER NOT NULL DEFAULT 0"},
+	{"reviews", "prev_learning_reviews", "INTEGER NOT NULL DEFAULT 0"},
+	{"reviews", "prev_next_review", "TIMESTAMP"},
+	{"reviews", "prev_last_reviewed_at", "TIMESTAMP"},
+	{"reviews", "prev_first_reviewed_at", "TIMESTAMP"},
+	{"reviews", "prev_stuck_at", "TIMESTAMP"},
+	{"users", "is_admin", "INTEGER NOT NULL DEFAULT 0"},
+	{"tasks", "time_spent_ms", "INTEGER"},
+}
+
 func (s *Storage) UpdateSchema() error {
 	// Flashcard schema
 	schema := `
@@ -97,6 +148,49 @@ func (s *Storage) UpdateSchema() error {
 		FOREIGN KEY (user_id) REFERENCES users(id)
 	);
 
+	-- File imports, kept so imports cut short by a restart can be found and reported
+	CREATE TABLE IF NOT EXISTS import_jobs (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		telegram_chat_id INTEGER NOT NULL,
+		message_id INTEGER NOT NULL,
+		file_name TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		total INTEGER NOT NULL DEFAULT 0,
+		processed INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_import_jobs_status ON import_jobs(status);
+
+	CREATE TABLE IF NOT EXISTS task_gen_attempts (
+		card_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		last_failed_at TIMESTAMP NOT NULL,
+		retry_after TIMESTAMP NOT NULL,
+		PRIMARY KEY (card_id, user_id),
+		FOREIGN KEY (card_id, user_id) REFERENCES cards(id, user_id),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS generation_log (
+		id TEXT PRIMARY KEY,
+		card_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		prompt TEXT NOT NULL,
+		response TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		FOREIGN KEY (card_id, user_id) REFERENCES cards(id, user_id),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_generation_log_card ON generation_log(card_id, created_at);
+	CREATE INDEX IF NOT EXISTS idx_generation_log_created ON generation_log(created_at);
+
 	-- Create index on next_review to speed up due card queries
 	CREATE INDEX IF NOT EXISTS idx_cards_next_review ON cards(next_review, user_id);
 	
@@ -118,5 +212,26 @@ func (s *Storage) UpdateSchema() error {
 		return err
 	}
 
+	return s.addMissingColumns()
+}
+
+func (s *Storage) addMissingColumns() error {
+	for _, m := range columnMigrations {
+		var count int
+		err := s.db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, m.table, m.column).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("error checking column %s.%s: %w", m.table, m.column, err)
+		}
+
+		if count > 0 {
+			continue
+		}
+
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)
+		if _, err := s.db.Exec(query); err != nil {
+			return fmt.Errorf("error adding column %s.%s: %w", m.table, m.column, err)
+		}
+	}
+
 	return nil
 }
\ No newline at end of file
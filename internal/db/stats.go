@@ -191,3 +191,220 @@ func (s *Storage) GetUserStudyHistory(userID string, days int) ([]StudyHistoryIt
 
 	return history, nil
 }
+
+// ReviewHistoryRow is a single review in the user's raw study log
+type ReviewHistoryRow struct {
+	ReviewedAt   time.Time
+	Term         string
+	DeckName     string
+	Rating       int
+	TimeSpentMs  int
+	PrevInterval time.Duration
+	NewInterval  time.Duration
+}
+
+// StreamReviewHistory calls fn for every review of the user in chronological order.
+// Rows are read one at a time so large histories are never held in memory; iteration
+// stops at the first error returned by fn.
+func (s *Storage) StreamReviewHistory(userID string, fn func(row ReviewHistoryRow) error) error {
+	query := `
+		SELECT
+			r.reviewed_at,
+			COALESCE(json_extract(c.fields, '$.term'), ''),
+			d.name,
+			r.rating,
+			r.time_spent_ms,
+			CAST(r.prev_interval AS INTEGER),
+			CAST(r.new_interval AS INTEGER)
+		FROM reviews r
+		JOIN cards c ON c.id = r.card_id AND c.user_id = r.user_id
+		JOIN decks d ON d.id = c.deck_id
+		WHERE r.user_id = ?
+		AND c.deleted_at IS NULL
+		ORDER BY r.reviewed_at ASC
+	`
+
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return fmt.Errorf("error querying review history: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row ReviewHistoryRow
+		var prevIntervalNs, newIntervalNs int64
+
+		if err := rows.Scan(
+			&row.ReviewedAt,
+			&row.Term,
+			&row.DeckName,
+			&row.Rating,
+			&row.TimeSpentMs,
+			&prevIntervalNs,
+			&newIntervalNs,
+		); err != nil {
+			return fmt.Errorf("error scanning review history: %w", err)
+		}
+
+		row.PrevInterval = time.Duration(prevIntervalNs)
+		row.NewInterval = time.Duration(newIntervalNs)
+
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+const (
+	// SuggestionWindowDays is how far back review history is analyzed for deck suggestions
+	SuggestionWindowDays = 30
+	// MinReviewsForSuggestion is the number of mature reviews needed before retention is meaningful
+	MinReviewsForSuggestion = 20
+
+	highRetentionThreshold = 0.95
+	lowRetentionThreshold  = 0.80
+	// heavyWorkloadFactor flags a deck whose daily reviews exceed this multiple of its new cards per day
+	heavyWorkloadFactor = 10
+)
+
+// DeckSuggestions holds retention and workload analysis of a deck with human-readable recommendations
+type DeckSuggestions struct {
+	Retention       float64  `json:"retention"`         // Share of mature reviews answered correctly, 0..1
+	MatureReviews   int      `json:"mature_reviews"`    // Reviews of cards with an interval of at least a day
+	TotalReviews    int      `json:"total_reviews"`     // All reviews in the window
+	AvgDailyReviews float64  `json:"avg_daily_reviews"` // Average reviews per day with activity
+	Suggestions     []string `json:"suggestions"`
+}
+
+// GetDeckSuggestions analyzes recent reviews of a deck and suggests changes to its settings.
+// Only reviews of cards that had already graduated (interval >= 1 day) count toward retention,
+// learning steps would otherwise inflate it.
+func (s *Storage) GetDeckSuggestions(userID, deckID string, newCardsPerDay int) (*DeckSuggestions, error) {
+	since := time.Now().AddDate(0, 0, -SuggestionWindowDays)
+
+	query := `
+		SELECT
+			COUNT(*) as total_reviews,
+			COALESCE(SUM(CASE WHEN CAST(r.prev_interval AS INTEGER) >= ? THEN 1 ELSE 0 END), 0) as mature_reviews,
+			COALESCE(SUM(CASE WHEN CAST(r.prev_interval AS INTEGER) >= ? AND r.rating >= ? THEN 1 ELSE 0 END), 0) as mature_passed,
+			COUNT(DISTINCT DATE(r.reviewed_at)) as active_days
+		FROM reviews r
+		JOIN cards c ON c.id = r.card_id AND c.user_id = r.user_id
+		WHERE r.user_id = ?
+		AND c.deck_id = ?
+		AND c.deleted_at IS NULL
+		AND r.reviewed_at >= ?
+	`
+
+	oneDayNs := (24 * time.Hour).Nanoseconds()
+
+	var suggestions DeckSuggestions
+	var maturePassed, activeDays int
+	err := s.db.QueryRow(query, oneDayNs, oneDayNs, RatingGood, userID, deckID, since).Scan(
+		&suggestions.TotalReviews,
+		&suggestions.MatureReviews,
+		&maturePassed,
+		&activeDays,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error analyzing deck reviews: %w", err)
+	}
+
+	if suggestions.MatureReviews > 0 {
+		suggestions.Retention = float64(maturePassed) / float64(suggestions.MatureReviews)
+	}
+
+	if activeDays > 0 {
+		suggestions.AvgDailyReviews = float64(suggestions.TotalReviews) / float64(activeDays)
+	}
+
+	suggestions.Suggestions = buildDeckSuggestions(suggestions, newCardsPerDay)
+
+	return &suggestions, nil
+}
+
+func buildDeckSuggestions(stats DeckSuggestions, newCardsPerDay int) []string {
+	if stats.MatureReviews < MinReviewsForSuggestion {
+		return []string{fmt.Sprintf(
+			"Not enough review history yet (%d of %d mature reviews) — keep studying for a better recommendation",
+			stats.MatureReviews, MinReviewsForSuggestion,
+		)}
+	}
+
+	retention := stats.Retention * 100
+	heavyWorkload := newCardsPerDay > 0 && stats.AvgDailyReviews > float64(newCardsPerDay*heavyWorkloadFactor)
+
+	var suggestions []string
+
+	switch {
+	case stats.Retention >= highRetentionThreshold && !heavyWorkload:
+		suggestions = append(suggestions, fmt.Sprintf("Retention %.0f%% — consider raising new cards per day", retention))
+	case stats.Retention < lowRetentionThreshold:
+		suggestions = append(suggestions, fmt.Sprintf("Retention %.0f%% — intervals may be too long, consider lowering new cards per day", retention))
+	default:
+		suggestions = append(suggestions, fmt.Sprintf("Retention %.0f%% — current settings look good", retention))
+	}
+
+	if heavyWorkload {
+		suggestions = append(suggestions, fmt.Sprintf(
+			"Workload is high (%.0f reviews per day) — consider lowering new cards per day", stats.AvgDailyReviews,
+		))
+	}
+
+	return suggestions
+}
+
+// TaskTypeStats summarizes the user's completed tasks of a single type
+type TaskTypeStats struct {
+	Type           TaskType `json:"type"`
+	Completed      int      `json:"completed"`
+	Correct        int      `json:"correct"`
+	Accuracy       float64  `json:"accuracy"`          // Share of correct answers, from 0 to 1
+	AvgTimeSpentMs int      `json:"avg_time_spent_ms"` // Averaged over tasks with a recorded answer time only
+}
+
+// GetTaskStats returns accuracy and answer timing of completed tasks grouped by task type
+func (s *Storage) GetTaskStats(userID string) ([]TaskTypeStats, error) {
+	query := `
+		SELECT type,
+		       COUNT(*),
+		       IFNULL(SUM(CASE WHEN is_correct THEN 1 ELSE 0 END), 0),
+		       IFNULL(AVG(time_spent_ms), 0)
+		FROM tasks
+		WHERE user_id = ?
+		AND deleted_at IS NULL
+		AND completed_at IS NOT NULL
+		GROUP BY type
+		ORDER BY type
+	`
+
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting task stats: %w", err)
+	}
+	defer rows.Close()
+
+	stats := make([]TaskTypeStats, 0)
+	for rows.Next() {
+		var item TaskTypeStats
+		var avgTimeMs float64
+		if err := rows.Scan(&item.Type, &item.Completed, &item.Correct, &avgTimeMs); err != nil {
+			return nil, fmt.Errorf("error scanning task stats: %w", err)
+		}
+
+		item.AvgTimeSpentMs = int(avgTimeMs)
+		if item.Completed > 0 {
+			item.Accuracy = float64(item.Correct) / float64(item.Completed)
+		}
+
+		stats = append(stats, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating task stats rows: %w", err)
+	}
+
+	return stats, nil
+}
@@ -1,12 +1,14 @@
 package db
 
 import (
+	"atamagaii/internal/utils"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	nanoid "github.com/matoous/go-nanoid/v2"
+	"strings"
 	"time"
 )
 
@@ -30,9 +32,11 @@ type Task struct {
 	CompletedAt  *time.Time `db:"completed_at" json:"completed_at,omitempty"`
 	UserResponse *string    `db:"user_response" json:"user_response,omitempty"`
 	IsCorrect    *bool      `db:"is_correct" json:"is_correct,omitempty"`
+	TimeSpentMs  *int       `db:"time_spent_ms" json:"time_spent_ms,omitempty"` // Unknown for tasks submitted before it was recorded
 	CreatedAt    time.Time  `db:"created_at" json:"created_at"`
 	UpdatedAt    time.Time  `db:"updated_at" json:"updated_at"`
 	DeletedAt    *time.Time `db:"deleted_at" json:"deleted_at,omitempty"`
+	LanguageCode string     `json:"language_code,omitempty"` // Language of the card's deck; not stored, filled in where the deck is known
 }
 
 // AddTask adds a new task to the database
@@ -107,10 +111,9 @@ func (s *Storage) GetCardsForTaskGeneration() ([]Card, error) {
 
 	// Get cards that were reviewed today, are in review state, and have next_review in the future
 	// Use LEFT JOIN to exclude cards that already have tasks generated today
+	// and cards backing off after failed generations, see RecordTaskGenFailure
 	query := `
-		SELECT c.id, c.deck_id, c.fields, c.user_id, c.next_review, c.interval, c.ease,
-		       c.review_count, c.laps_count, c.last_reviewed_at, c.first_reviewed_at, c.state,
-		       c.learning_step, c.created_at, c.updated_at, c.deleted_at
+		SELECT ` + cardColumns + `
 		FROM cards c
 		LEFT JOIN (
 			SELECT DISTINCT card_id, user_id
@@ -119,47 +122,34 @@ func (s *Storage) GetCardsForTaskGeneration() ([]Card, error) {
 			AND created_at < ?
 			AND deleted_at IS NULL
 		) t ON c.id = t.card_id AND c.user_id = t.user_id
+		LEFT JOIN task_gen_attempts a ON a.card_id = c.id AND a.user_id = c.user_id
 		WHERE c.state = ?
 		  AND c.deleted_at IS NULL
 		  AND c.last_reviewed_at >= ?
 		  AND c.last_reviewed_at < ?
 		  AND c.next_review > ?
 		  AND t.card_id IS NULL
+		  AND (a.card_id IS NULL OR (a.failures < ? AND a.retry_after <= ?))
 	`
 
-	rows, err := s.db.Query(query, today, tomorrow, StateReview, today, tomorrow, time.Now())
+	now := time.Now()
+	rows, err := s.db.Query(query, today, tomorrow, StateReview, today, tomorrow, now, MaxTaskGenFailures, now)
 	if err != nil {
 		return nil, fmt.Errorf("error getting cards for task generation: %w", err)
 	}
 	defer rows.Close()
 
+	return scanTaskGenerationCards(rows)
+}
+
+// scanTaskGenerationCards reads the card rows selected for task generation
+func scanTaskGenerationCards(rows *sql.Rows) ([]Card, error) {
 	var cards []Card
 	for rows.Next() {
-		var card Card
-		var intervalNs int64
-
-		if err := rows.Scan(
-			&card.ID,
-			&card.DeckID,
-			&card.Fields,
-			&card.UserID,
-			&card.NextReview,
-			&intervalNs,
-			&card.Ease,
-			&card.ReviewCount,
-			&card.LapsCount,
-			&card.LastReviewedAt,
-			&card.FirstReviewedAt,
-			&card.State,
-			&card.LearningStep,
-			&card.CreatedAt,
-			&card.UpdatedAt,
-			&card.DeletedAt,
-		); err != nil {
+		card, err := scanCard(rows)
+		if err != nil {
 			return nil, fmt.Errorf("error scanning card for task generation: %w", err)
 		}
-
-		card.Interval = time.Duration(intervalNs)
 		cards = append(cards, card)
 	}
 
@@ -170,8 +160,77 @@ func (s *Storage) GetCardsForTaskGeneration() ([]Card, error) {
 	return cards, nil
 }
 
-// GetKnownWordsFromDeck retrieves terms from cards in the same deck that the user has already studied
-func (s *Storage) GetKnownWordsFromDeck(userID, deckID string, limit int) ([]string, error) {
+// GetDeckCardsForTaskGeneration retrieves review-state cards of a deck that have no task generated today,
+// most recently reviewed first
+func (s *Storage) GetDeckCardsForTaskGeneration(userID, deckID string, limit int) ([]Card, error) {
+	today := time.Now().Truncate(24 * time.Hour)
+	tomorrow := today.Add(24 * time.Hour)
+
+	query := `
+		SELECT ` + cardColumns + `
+		FROM cards c
+		LEFT JOIN (
+			SELECT DISTINCT card_id, user_id
+			FROM tasks
+			WHERE created_at >= ?
+			AND created_at < ?
+			AND deleted_at IS NULL
+		) t ON c.id = t.card_id AND c.user_id = t.user_id
+		WHERE c.user_id = ?
+		  AND c.deck_id = ?
+		  AND c.state = ?
+		  AND c.deleted_at IS NULL
+		  AND t.card_id IS NULL
+		ORDER BY c.last_reviewed_at DESC
+		LIMIT ?
+	`
+
+	rows, err := s.db.Query(query, today, tomorrow, userID, deckID, StateReview, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error getting deck cards for task generation: %w", err)
+	}
+	defer rows.Close()
+
+	return scanTaskGenerationCards(rows)
+}
+
+// CountTasksCreatedToday returns how many tasks were generated for the user today
+func (s *Storage) CountTasksCreatedToday(userID string) (int, error) {
+	today := time.Now().Truncate(24 * time.Hour)
+
+	var count int
+	err := s.db.QueryRow(`
+		SELECT COUNT(*)
+		FROM tasks
+		WHERE user_id = ? AND created_at >= ? AND deleted_at IS NULL
+	`, userID, today).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting tasks created today: %w", err)
+	}
+
+	return count, nil
+}
+
+const (
+	// DefaultKnownWordsLimit caps how many known words are passed as context to task prompts
+	DefaultKnownWordsLimit = 30
+	// knownWordsPoolFactor controls how many recent cards are considered per returned word
+	knownWordsPoolFactor = 3
+)
+
+// GetKnownWordsFromDeck retrieves unique terms from cards in the same deck that the user has already studied.
+// With spread set, words are sampled evenly across recent study instead of taking only the newest ones.
+func (s *Storage) GetKnownWordsFromDeck(userID, deckID string, limit int, spread bool) ([]string, error) {
+	if limit <= 0 {
+		limit = DefaultKnownWordsLimit
+	}
+
+	poolSize := limit
+	if spread {
+		poolSize = limit * knownWordsPoolFactor
+	}
+
+	// Fetch more rows than needed since duplicates are dropped below
 	query := `
 		SELECT fields
 		FROM cards
@@ -183,12 +242,13 @@ func (s *Storage) GetKnownWordsFromDeck(userID, deckID string, limit int) ([]str
 		LIMIT ?
 	`
 
-	rows, err := s.db.Query(query, userID, deckID, limit)
+	rows, err := s.db.Query(query, userID, deckID, poolSize*knownWordsPoolFactor)
 	if err != nil {
 		return nil, fmt.Errorf("error getting known words from deck: %w", err)
 	}
 	defer rows.Close()
 
+	seen := make(map[string]bool)
 	var knownWords []string
 	for rows.Next() {
 		var fields string
@@ -201,27 +261,52 @@ func (s *Storage) GetKnownWordsFromDeck(userID, deckID string, limit int) ([]str
 			continue // Skip this item if we can't parse it
 		}
 
-		// Add the term to our known words list
-		knownWords = append(knownWords, vocabItem.Term)
+		term := strings.TrimSpace(vocabItem.Term)
+		key := utils.NormalizeTermForDedup(term, vocabItem.LanguageCode)
+		if term == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		knownWords = append(knownWords, term)
+		if len(knownWords) >= poolSize {
+			break
+		}
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating known words rows: %w", err)
 	}
 
-	return knownWords, nil
+	if len(knownWords) <= limit {
+		return knownWords, nil
+	}
+
+	if !spread {
+		return knownWords[:limit], nil
+	}
+
+	// Pick evenly spaced words, starting from the most recent one
+	sampled := make([]string, 0, limit)
+	for i := 0; i < limit; i++ {
+		sampled = append(sampled, knownWords[i*len(knownWords)/limit])
+	}
+
+	return sampled, nil
 }
 
 func (s *Storage) GetTasksDueForUser(userID string, limit int, deckID string) ([]Task, error) {
 	query := `
 		SELECT t.id, t.type, t.content, t.answer, t.card_id, t.user_id, 
-		       t.completed_at, t.user_response, t.is_correct, 
-		       t.created_at, t.updated_at, t.deleted_at
+		       t.completed_at, t.user_response, t.is_correct, t.time_spent_ms,
+		       t.created_at, t.updated_at, t.deleted_at, d.language_code
 		FROM tasks t
 		JOIN cards c ON t.card_id = c.id AND t.user_id = c.user_id
+		JOIN decks d ON d.id = c.deck_id
 		WHERE t.user_id = ?
 		  AND t.deleted_at IS NULL
 		  AND t.completed_at IS NULL
+		  AND c.deleted_at IS NULL
 		  AND c.state = ?
 	`
 
@@ -254,9 +339,11 @@ func (s *Storage) GetTasksDueForUser(userID string, limit int, deckID string) ([
 			&task.CompletedAt,
 			&task.UserResponse,
 			&task.IsCorrect,
+			&task.TimeSpentMs,
 			&task.CreatedAt,
 			&task.UpdatedAt,
 			&task.DeletedAt,
+			&task.LanguageCode,
 		); err != nil {
 			return nil, fmt.Errorf("error scanning due task: %w", err)
 		}
@@ -270,6 +357,76 @@ func (s *Storage) GetTasksDueForUser(userID string, limit int, deckID string) ([
 	return tasks, nil
 }
 
+// CountTasksDueForUser counts the tasks GetTasksDueForUser would return across all decks, without a limit
+func (s *Storage) CountTasksDueForUser(userID string) (int, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM tasks t
+		JOIN cards c ON t.card_id = c.id AND t.user_id = c.user_id
+		WHERE t.user_id = ?
+		  AND t.deleted_at IS NULL
+		  AND t.completed_at IS NULL
+		  AND c.deleted_at IS NULL
+		  AND c.state = ?
+	`
+
+	var count int
+	if err := s.db.QueryRow(query, userID, StateReview).Scan(&count); err != nil {
+		return 0, fmt.Errorf("error counting due tasks for user: %w", err)
+	}
+
+	return count, nil
+}
+
+// GetTasksByCard returns all non-deleted tasks generated from a card, both completed and pending
+func (s *Storage) GetTasksByCard(cardID, userID string) ([]Task, error) {
+	query := `
+		SELECT id, type, content, answer, card_id, user_id,
+		       completed_at, user_response, is_correct, time_spent_ms,
+		       created_at, updated_at, deleted_at
+		FROM tasks
+		WHERE card_id = ?
+		  AND user_id = ?
+		  AND deleted_at IS NULL
+		ORDER BY created_at
+	`
+
+	rows, err := s.db.Query(query, cardID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting tasks for card: %w", err)
+	}
+	defer rows.Close()
+
+	var tasks []Task
+	for rows.Next() {
+		var task Task
+		if err := rows.Scan(
+			&task.ID,
+			&task.Type,
+			&task.Content,
+			&task.Answer,
+			&task.CardID,
+			&task.UserID,
+			&task.CompletedAt,
+			&task.UserResponse,
+			&task.IsCorrect,
+			&task.TimeSpentMs,
+			&task.CreatedAt,
+			&task.UpdatedAt,
+			&task.DeletedAt,
+		); err != nil {
+			return nil, fmt.Errorf("error scanning card task: %w", err)
+		}
+		tasks = append(tasks, task)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating card task rows: %w", err)
+	}
+
+	return tasks, nil
+}
+
 // TasksPerDeck represents a summary of tasks for a specific deck
 type TasksPerDeck struct {
 	DeckID       string `json:"deck_id"`
@@ -283,7 +440,7 @@ func (s *Storage) GetTaskStatsByDeck(userID string) ([]TasksPerDeck, error) {
 	query := `
 		SELECT d.id, d.name, COUNT(t.id) as task_count, d.language_code
 		FROM decks d
-		LEFT JOIN cards c ON d.id = c.deck_id
+		LEFT JOIN cards c ON d.id = c.deck_id AND c.deleted_at IS NULL
 		LEFT JOIN tasks t ON c.id = t.card_id
 		WHERE d.user_id = ?
 		  AND d.deleted_at IS NULL
@@ -344,6 +501,8 @@ type TaskVocabRecallContent struct {
 		D string `json:"d"`
 	} `json:"options"`
 	CorrectAnswer string `json:"correct_answer,omitempty"`
+	// FreeText tasks have no options, the question is a meaning and the answer is the typed term
+	FreeText bool `json:"free_text,omitempty"`
 }
 
 func UnmarshalTaskContent[T any](task *Task) (T, error) {
@@ -354,19 +513,21 @@ func UnmarshalTaskContent[T any](task *Task) (T, error) {
 	return content, nil
 }
 
-// SubmitTaskResponse submits a user's response to a task and marks it as completed
-func (s *Storage) SubmitTaskResponse(taskID, userID, response string, isCorrect bool) error {
+// SubmitTaskResponse submits a user's response to a task and marks it as completed.
+// timeSpentMs is nil when the client didn't measure how long answering took.
+func (s *Storage) SubmitTaskResponse(taskID, userID, response string, isCorrect bool, timeSpentMs *int) error {
 	now := time.Now()
 	query := `
 		UPDATE tasks
 		SET completed_at = ?,
 		    user_response = ?,
 		    is_correct = ?,
+		    time_spent_ms = ?,
 		    updated_at = ?
 		WHERE id = ? AND user_id = ? AND deleted_at IS NULL
 	`
 
-	result, err := s.db.Exec(query, now, response, isCorrect, now, taskID, userID)
+	result, err := s.db.Exec(query, now, response, isCorrect, timeSpentMs, now, taskID, userID)
 	if err != nil {
 		return fmt.Errorf("error updating task completion: %w", err)
 	}
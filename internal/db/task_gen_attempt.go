@@ -0,0 +1,163 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// TaskGenFailureBackoff is how long a card waits after its first failed task generation, doubling with every further failure
+	TaskGenFailureBackoff = 10 * time.Minute
+	// MaxTaskGenFailures is how many failures it takes before a card is left out of task generation until it is requeued
+	MaxTaskGenFailures = 5
+	// TaskGenUnsupportedBackoff is how long a card no task can be made from is left out of task generation.
+	// Cards are only picked up the day they are reviewed, so this covers the rest of that day.
+	TaskGenUnsupportedBackoff = 24 * time.Hour
+)
+
+// TaskGenFailure tracks a card whose task generation keeps failing
+type TaskGenFailure struct {
+	CardID       string    `db:"card_id" json:"card_id"`
+	UserID       string    `db:"user_id" json:"user_id"`
+	Failures     int       `db:"failures" json:"failures"`
+	LastError    string    `db:"last_error" json:"last_error"`
+	LastFailedAt time.Time `db:"last_failed_at" json:"last_failed_at"`
+	RetryAfter   time.Time `db:"retry_after" json:"retry_after"`
+	Exhausted    bool      `json:"exhausted"` // Reached MaxTaskGenFailures, only a requeue brings it back
+}
+
+// taskGenRetryAfter is when a card that has failed the given number of times may be tried again
+func taskGenRetryAfter(failures int, failedAt time.Time) time.Time {
+	return failedAt.Add(TaskGenFailureBackoff << min(failures-1, MaxTaskGenFailures))
+}
+
+// RecordTaskGenFailure counts a failed task generation for the card and pushes its next attempt back
+func (s *Storage) RecordTaskGenFailure(card Card, lastError string) error {
+	failure, err := s.GetTaskGenFailure(card.ID, card.UserID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	failures := 1
+	if failure != nil {
+		failures = failure.Failures + 1
+	}
+
+	now := time.Now()
+	query := `
+		INSERT INTO task_gen_attempts (card_id, user_id, failures, last_error, last_failed_at, retry_after)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(card_id, user_id) DO UPDATE SET
+			failures = excluded.failures,
+			last_error = excluded.last_error,
+			last_failed_at = excluded.last_failed_at,
+			retry_after = excluded.retry_after
+	`
+
+	_, err = s.db.Exec(query, card.ID, card.UserID, failures, lastError, now, taskGenRetryAfter(failures, now))
+	if err != nil {
+		return fmt.Errorf("error recording task generation failure: %w", err)
+	}
+
+	return nil
+}
+
+// RecordTaskGenUnsupported keeps a card no task can be generated from out of task generation for
+// TaskGenUnsupportedBackoff. It isn't counted as a failure, so the card is never exhausted by it.
+func (s *Storage) RecordTaskGenUnsupported(card Card, reason string) error {
+	now := time.Now()
+	query := `
+		INSERT INTO task_gen_attempts (card_id, user_id, failures, last_error, last_failed_at, retry_after)
+		VALUES (?, ?, 0, ?, ?, ?)
+		ON CONFLICT(card_id, user_id) DO UPDATE SET
+			last_error = excluded.last_error,
+			last_failed_at = excluded.last_failed_at,
+			retry_after = excluded.retry_after
+	`
+
+	_, err := s.db.Exec(query, card.ID, card.UserID, reason, now, now.Add(TaskGenUnsupportedBackoff))
+	if err != nil {
+		return fmt.Errorf("error recording unsupported task generation: %w", err)
+	}
+
+	return nil
+}
+
+// ClearTaskGenFailures forgets the card's failed attempts, so the next pass tries it right away
+func (s *Storage) ClearTaskGenFailures(cardID, userID string) error {
+	if _, err := s.db.Exec(`DELETE FROM task_gen_attempts WHERE card_id = ? AND user_id = ?`, cardID, userID); err != nil {
+		return fmt.Errorf("error clearing task generation failures: %w", err)
+	}
+
+	return nil
+}
+
+// GetTaskGenFailure returns the failed attempts recorded for a card
+func (s *Storage) GetTaskGenFailure(cardID, userID string) (*TaskGenFailure, error) {
+	query := `
+		SELECT card_id, user_id, failures, last_error, last_failed_at, retry_after
+		FROM task_gen_attempts
+		WHERE card_id = ? AND user_id = ?
+	`
+
+	var failure TaskGenFailure
+	err := s.db.QueryRow(query, cardID, userID).Scan(
+		&failure.CardID,
+		&failure.UserID,
+		&failure.Failures,
+		&failure.LastError,
+		&failure.LastFailedAt,
+		&failure.RetryAfter,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("error getting task generation failure: %w", err)
+	}
+
+	failure.Exhausted = failure.Failures >= MaxTaskGenFailures
+	return &failure, nil
+}
+
+// GetTaskGenFailures lists cards with failed task generation, the most failing first
+func (s *Storage) GetTaskGenFailures(limit int) ([]TaskGenFailure, error) {
+	query := `
+		SELECT card_id, user_id, failures, last_error, last_failed_at, retry_after
+		FROM task_gen_attempts
+		ORDER BY failures DESC, last_failed_at DESC
+		LIMIT ?
+	`
+
+	rows, err := s.db.Query(query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error getting task generation failures: %w", err)
+	}
+	defer rows.Close()
+
+	failures := make([]TaskGenFailure, 0)
+	for rows.Next() {
+		var failure TaskGenFailure
+		if err := rows.Scan(
+			&failure.CardID,
+			&failure.UserID,
+			&failure.Failures,
+			&failure.LastError,
+			&failure.LastFailedAt,
+			&failure.RetryAfter,
+		); err != nil {
+			return nil, fmt.Errorf("error scanning task generation failure: %w", err)
+		}
+
+		failure.Exhausted = failure.Failures >= MaxTaskGenFailures
+		failures = append(failures, failure)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating task generation failures: %w", err)
+	}
+
+	return failures, nil
+}
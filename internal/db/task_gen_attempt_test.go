@@ -0,0 +1,104 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetCardsForTaskGeneration_SkipsFailingCards(t *testing.T) {
+	storage := newTestStorage(t)
+	userID, deck := newTestDeck(t, storage)
+
+	if err := storage.AddCardsInBatch(userID, deck.ID, cardFields(1), DefaultCardBatchSize); err != nil {
+		t.Fatalf("failed to add cards: %v", err)
+	}
+
+	cards, err := storage.GetCardsByDeckID(deck.ID, userID)
+	if err != nil {
+		t.Fatalf("failed to load cards: %v", err)
+	}
+	card := cards[0]
+
+	for card.State != string(StateReview) {
+		if err := storage.ReviewCard(&card, deck, RatingGood, 1000); err != nil {
+			t.Fatalf("failed to review card: %v", err)
+		}
+	}
+
+	eligible := func() bool {
+		t.Helper()
+		cards, err := storage.GetCardsForTaskGeneration()
+		if err != nil {
+			t.Fatalf("GetCardsForTaskGeneration failed: %v", err)
+		}
+		for _, c := range cards {
+			if c.ID == card.ID {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Pretend the backoff has passed
+	expireBackoff := func() {
+		t.Helper()
+		if _, err := storage.db.Exec(`UPDATE task_gen_attempts SET retry_after = ? WHERE card_id = ?`, time.Now().Add(-time.Minute), card.ID); err != nil {
+			t.Fatalf("failed to expire backoff: %v", err)
+		}
+	}
+
+	if !eligible() {
+		t.Fatal("expected the reviewed card to need a task")
+	}
+
+	if err := storage.RecordTaskGenFailure(card, "AI provider error"); err != nil {
+		t.Fatalf("RecordTaskGenFailure failed: %v", err)
+	}
+	if eligible() {
+		t.Fatal("expected the card to back off after a failure")
+	}
+
+	expireBackoff()
+	if !eligible() {
+		t.Fatal("expected the card to be retried once the backoff passed")
+	}
+
+	for i := 1; i < MaxTaskGenFailures; i++ {
+		if err := storage.RecordTaskGenFailure(card, "AI provider error"); err != nil {
+			t.Fatalf("RecordTaskGenFailure failed: %v", err)
+		}
+	}
+	expireBackoff()
+	if eligible() {
+		t.Fatalf("expected the card to be skipped after %d failures", MaxTaskGenFailures)
+	}
+
+	failures, err := storage.GetTaskGenFailures(10)
+	if err != nil {
+		t.Fatalf("GetTaskGenFailures failed: %v", err)
+	}
+	if len(failures) != 1 || failures[0].Failures != MaxTaskGenFailures || !failures[0].Exhausted {
+		t.Fatalf("expected the card in the failure report as exhausted, got %+v", failures)
+	}
+
+	if err := storage.ClearTaskGenFailures(card.ID, userID); err != nil {
+		t.Fatalf("ClearTaskGenFailures failed: %v", err)
+	}
+	if !eligible() {
+		t.Fatal("expected a requeued card to be picked up again")
+	}
+
+	if err := storage.RecordTaskGenUnsupported(card, "card supports no task type"); err != nil {
+		t.Fatalf("RecordTaskGenUnsupported failed: %v", err)
+	}
+	if eligible() {
+		t.Fatal("expected an unsupported card to be left out of the next passes")
+	}
+	failure, err := storage.GetTaskGenFailure(card.ID, userID)
+	if err != nil {
+		t.Fatalf("GetTaskGenFailure failed: %v", err)
+	}
+	if failure.Failures != 0 || failure.Exhausted {
+		t.Errorf("an unsupported card should not count as failing, got %+v", failure)
+	}
+}
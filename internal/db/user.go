@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 	"time"
 )
 
@@ -12,6 +13,96 @@ import (
 type UserSettings struct {
 	MaxTasksPerDay int        `json:"max_tasks_per_day"`
 	TaskTypes      []TaskType `json:"task_types"`
+	NewCardsPaused bool       `json:"new_cards_paused"`
+	StudyOrder     string     `json:"study_order,omitempty"` // Empty means StudyOrderReviewsFirst
+	// MeaningLanguages limits generated meanings to a subset of SupportedMeaningLanguages, empty means all
+	MeaningLanguages []string `json:"meaning_languages,omitempty"`
+	// DefaultNewCardsPerDay is the new card limit given to decks the user creates, 0 means DefaultNewCardsPerDay
+	DefaultNewCardsPerDay int `json:"default_new_cards_per_day,omitempty"`
+	// TranslationPassScore is the check score a translation task needs to count as correct, 0 means DefaultTranslationPassScore
+	TranslationPassScore int `json:"translation_pass_score,omitempty"`
+	// KnownWordExamples makes generated card examples prefer words the user already studied in the deck
+	KnownWordExamples bool `json:"known_word_examples,omitempty"`
+	// TaskAudioRate is the speaking rate of listening task audio relative to card audio, 0 means DefaultTaskAudioRate
+	TaskAudioRate float64 `json:"task_audio_rate,omitempty"`
+	// FreeTextVocabRecall makes vocab recall tasks ask for the term to be typed instead of picked from options
+	FreeTextVocabRecall bool `json:"free_text_vocab_recall,omitempty"`
+	// Timezone is the IANA time zone the user's study days follow, empty means UTC
+	Timezone string `json:"timezone,omitempty"`
+	// DisplayLanguage picks which of the card meanings and example translations clients show,
+	// one of SupportedMeaningLanguages, empty means it follows the user's language code
+	DisplayLanguage string `json:"display_language,omitempty"`
+	// NewCardReset is the latest reset of the daily new card budget, see ResetDailyNewCards
+	NewCardReset *NewCardReset `json:"new_card_reset,omitempty"`
+}
+
+// NewCardReset forgives the new cards each deck had started on Day when the budget was reset, so they no
+// longer count against it. It only applies on Day, the cards themselves keep their history.
+type NewCardReset struct {
+	Day   string         `json:"day"` // YYYY-MM-DD, see studyDay
+	Decks map[string]int `json:"decks"`
+}
+
+// IsValidTimezone reports whether name is an IANA time zone known to the server
+func IsValidTimezone(name string) bool {
+	_, err := time.LoadLocation(name)
+	return name != "" && err == nil
+}
+
+// Bounds and default of UserSettings.TaskAudioRate, listening tasks are read a bit slower than card audio
+const (
+	DefaultTaskAudioRate = 0.8
+	MinTaskAudioRate     = 0.5
+	MaxTaskAudioRate     = 1.0
+)
+
+// IsValidTaskAudioRate reports whether rate is an allowed task audio speaking rate
+func IsValidTaskAudioRate(rate float64) bool {
+	return rate >= MinTaskAudioRate && rate <= MaxTaskAudioRate
+}
+
+// Bounds and default of UserSettings.TranslationPassScore
+const (
+	DefaultTranslationPassScore = 80
+	MinTranslationPassScore     = 50
+	MaxTranslationPassScore     = 100
+)
+
+// IsValidTranslationPassScore reports whether score is an allowed translation pass score
+func IsValidTranslationPassScore(score int) bool {
+	return score >= MinTranslationPassScore && score <= MaxTranslationPassScore
+}
+
+// SupportedMeaningLanguages are the languages card meanings and example translations are generated in
+var SupportedMeaningLanguages = []string{"en", "ru"}
+
+// Study orders decide whether due reviews or new cards come first in a study session
+const (
+	StudyOrderReviewsFirst = "reviews_first"
+	StudyOrderNewFirst     = "new_first"
+)
+
+// IsValidStudyOrder reports whether order is one of the supported study orders
+func IsValidStudyOrder(order string) bool {
+	return order == StudyOrderReviewsFirst || order == StudyOrderNewFirst
+}
+
+// Bounds for UserSettings.MaxTasksPerDay, values outside are clamped on update
+const (
+	MinTasksPerDayLimit = 1
+	MaxTasksPerDayLimit = 100
+)
+
+// ClampMaxTasksPerDay keeps a daily task limit within MinTasksPerDayLimit and MaxTasksPerDayLimit
+func ClampMaxTasksPerDay(n int) int {
+	return min(max(n, MinTasksPerDayLimit), MaxTasksPerDayLimit)
+}
+
+// IsUserSelectableTaskType reports whether users can enable taskType in their settings
+func IsUserSelectableTaskType(taskType TaskType) bool {
+	return taskType == TaskTypeVocabRecall ||
+		taskType == TaskTypeSentenceTranslation ||
+		taskType == TaskTypeAudio
 }
 
 type User struct {
@@ -24,6 +115,7 @@ type User struct {
 	AvatarURL    *string       `db:"avatar_url" json:"avatar_url"`
 	Settings     *UserSettings `db:"settings" json:"settings,omitempty"`
 	SettingsJSON *string       `db:"-" json:"-"` // Used for SQL operations
+	IsAdmin      bool          `db:"is_admin" json:"is_admin"`
 	CreatedAt    time.Time     `db:"created_at" json:"created_at"`
 	UpdatedAt    time.Time     `db:"updated_at" json:"updated_at"`
 	DeletedAt    *time.Time    `db:"deleted_at" json:"deleted_at"`
@@ -38,7 +130,7 @@ const (
 func (s *Storage) GetUserByID(userID string) (*User, error) {
 	var user User
 	var settingsStr sql.NullString
-	query := `SELECT id, telegram_id, username, avatar_url, name, points, language_code, settings, created_at, updated_at FROM users WHERE id = ?`
+	query := `SELECT id, telegram_id, username, avatar_url, name, points, language_code, settings, is_admin, created_at, updated_at FROM users WHERE id = ?`
 	err := s.db.QueryRow(query, userID).Scan(
 		&user.ID,
 		&user.TelegramID,
@@ -48,6 +140,7 @@ func (s *Storage) GetUserByID(userID string) (*User, error) {
 		&user.Points,
 		&user.LanguageCode,
 		&settingsStr,
+		&user.IsAdmin,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -67,24 +160,129 @@ func (s *Storage) GetUserByID(userID string) (*User, error) {
 		user.Settings = &settings
 	} else {
 		// Set default settings if none exist
-		user.Settings = &UserSettings{
-			MaxTasksPerDay: 10, // Default to 10 tasks per day
-			TaskTypes: []TaskType{
-				TaskTypeVocabRecall,
-				TaskTypeSentenceTranslation,
-				TaskTypeAudio,
-			},
-		}
+		user.Settings = DefaultUserSettings()
 	}
 
 	return &user, nil
 }
 
+// GetUserSettings loads the user's settings, DefaultUserSettings for a user who doesn't exist. Load them once
+// per request and pass them down, the Resolve functions read single settings from them.
+func (s *Storage) GetUserSettings(userID string) (*UserSettings, error) {
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return DefaultUserSettings(), nil
+		}
+		return nil, err
+	}
+
+	return user.Settings, nil
+}
+
+// DefaultUserSettings are the settings of a user who never saved any
+func DefaultUserSettings() *UserSettings {
+	return &UserSettings{
+		MaxTasksPerDay: 10, // Default to 10 tasks per day
+		TaskTypes: []TaskType{
+			TaskTypeVocabRecall,
+			TaskTypeSentenceTranslation,
+			TaskTypeAudio,
+		},
+	}
+}
+
+// IsValidDisplayLanguage reports whether lang is one of SupportedMeaningLanguages
+func IsValidDisplayLanguage(lang string) bool {
+	return slices.Contains(SupportedMeaningLanguages, lang)
+}
+
+// ResolveDisplayLanguage returns the language card translations are shown in, the user's choice
+// if they made one, Russian for Russian speakers and English otherwise
+func ResolveDisplayLanguage(settings *UserSettings, languageCode string) string {
+	if settings != nil && IsValidDisplayLanguage(settings.DisplayLanguage) {
+		return settings.DisplayLanguage
+	}
+
+	if languageCode == "ru" {
+		return "ru"
+	}
+
+	return "en"
+}
+
+// IsValidMeaningLanguages reports whether languages is a non-empty subset of SupportedMeaningLanguages
+func IsValidMeaningLanguages(languages []string) bool {
+	if len(languages) == 0 {
+		return false
+	}
+
+	for _, lang := range languages {
+		if !slices.Contains(SupportedMeaningLanguages, lang) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ResolveStudyOrder returns the user's preferred order of reviews and new cards, StudyOrderReviewsFirst unless
+// settings set a valid one
+func ResolveStudyOrder(settings *UserSettings) string {
+	if settings == nil || !IsValidStudyOrder(settings.StudyOrder) {
+		return StudyOrderReviewsFirst
+	}
+
+	return settings.StudyOrder
+}
+
+// ResolveNewCardsPerDay returns the new card limit for decks the user creates, DefaultNewCardsPerDay unless set
+func ResolveNewCardsPerDay(settings *UserSettings) int {
+	if settings == nil || !IsValidNewCardsPerDay(settings.DefaultNewCardsPerDay) {
+		return DefaultNewCardsPerDay
+	}
+
+	return settings.DefaultNewCardsPerDay
+}
+
+// ResolveTranslationPassScore returns the score the user's translations need to pass, DefaultTranslationPassScore
+// unless set
+func ResolveTranslationPassScore(settings *UserSettings) int {
+	if settings == nil || !IsValidTranslationPassScore(settings.TranslationPassScore) {
+		return DefaultTranslationPassScore
+	}
+
+	return settings.TranslationPassScore
+}
+
+// ResolveTaskAudioRate returns the speaking rate of the user's listening task audio, DefaultTaskAudioRate unless set
+func ResolveTaskAudioRate(settings *UserSettings) float64 {
+	if settings == nil || !IsValidTaskAudioRate(settings.TaskAudioRate) {
+		return DefaultTaskAudioRate
+	}
+
+	return settings.TaskAudioRate
+}
+
+// ResolveLocation returns the time zone settings ask for, UTC if none or an unknown one is set
+func ResolveLocation(settings *UserSettings) *time.Location {
+	if settings == nil || settings.Timezone == "" {
+		return time.UTC
+	}
+
+	location, err := time.LoadLocation(settings.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+
+	return location
+}
+
 // GetUser retrieves a user by their Telegram ID
 func (s *Storage) GetUser(telegramID int64) (*User, error) {
 	var user User
 	var settingsStr sql.NullString
-	query := `SELECT id, telegram_id, username, avatar_url, name, points, language_code, settings, created_at, updated_at FROM users WHERE telegram_id = ?`
+	query := `SELECT id, telegram_id, username, avatar_url, name, points, language_code, settings, is_admin, created_at, updated_at FROM users WHERE telegram_id = ?`
 	err := s.db.QueryRow(query, telegramID).Scan(
 		&user.ID,
 		&user.TelegramID,
@@ -94,6 +292,7 @@ func (s *Storage) GetUser(telegramID int64) (*User, error) {
 		&user.Points,
 		&user.LanguageCode,
 		&settingsStr,
+		&user.IsAdmin,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -113,14 +312,7 @@ func (s *Storage) GetUser(telegramID int64) (*User, error) {
 		user.Settings = &settings
 	} else {
 		// Set default settings if none exist
-		user.Settings = &UserSettings{
-			MaxTasksPerDay: 10, // Default to 10 tasks per day
-			TaskTypes: []TaskType{
-				TaskTypeVocabRecall,
-				TaskTypeSentenceTranslation,
-				TaskTypeAudio,
-			},
-		}
+		user.Settings = DefaultUserSettings()
 	}
 
 	return &user, nil
@@ -178,3 +370,24 @@ func (s *Storage) UpdateUser(user *User) error {
 
 	return nil
 }
+
+// SetUserAdmin grants or revokes access to the admin API; it takes effect on the user's next login
+func (s *Storage) SetUserAdmin(userID string, isAdmin bool) error {
+	query := `UPDATE users SET is_admin = ?, updated_at = ? WHERE id = ?`
+
+	result, err := s.db.Exec(query, isAdmin, time.Now(), userID)
+	if err != nil {
+		return fmt.Errorf("error updating user admin flag: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting affected rows: %w", err)
+	}
+
+	if affected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
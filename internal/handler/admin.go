@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"atamagaii/internal/contract"
+	"atamagaii/internal/db"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"log"
+	"net/http"
+)
+
+// GetUserAsAdmin returns another user's profile for support
+func (h *Handler) GetUserAsAdmin(c echo.Context) error {
+	userID := c.Param("id")
+	if userID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "User ID is required")
+	}
+
+	user, err := h.db.GetUserByID(userID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeUserNotFound, "User not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch user").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
+
+// ResetUserDailyNewCards restores a user's new-card budget for today, used by support
+// when a sync glitch counted the same cards twice
+func (h *Handler) ResetUserDailyNewCards(c echo.Context) error {
+	adminID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	userID := c.Param("id")
+	if userID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "User ID is required")
+	}
+
+	if _, err := h.db.GetUserByID(userID); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeUserNotFound, "User not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch user").WithInternal(err)
+	}
+
+	reset, err := h.db.ResetDailyNewCards(userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to reset daily new cards").WithInternal(err)
+	}
+
+	log.Printf("Admin %s reset daily new cards for user %s: %d cards", adminID, userID, reset)
+
+	return c.JSON(http.StatusOK, contract.ResetDailyResponse{
+		UserID:     userID,
+		CardsReset: reset,
+	})
+}
+
+// GetTaskGeneratorStatus reports whether the task generator is paused and what its last pass did
+func (h *Handler) GetTaskGeneratorStatus(c echo.Context) error {
+	if h.taskGenerator == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Task generator is not configured")
+	}
+
+	return c.JSON(http.StatusOK, h.taskGenerator.Status())
+}
+
+// PauseTaskGenerator stops scheduled task generation passes, e.g. to cap AI spend
+func (h *Handler) PauseTaskGenerator(c echo.Context) error {
+	if h.taskGenerator == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Task generator is not configured")
+	}
+
+	h.taskGenerator.Pause()
+
+	return c.JSON(http.StatusOK, h.taskGenerator.Status())
+}
+
+// ResumeTaskGenerator lets scheduled task generation passes run again
+func (h *Handler) ResumeTaskGenerator(c echo.Context) error {
+	if h.taskGenerator == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Task generator is not configured")
+	}
+
+	h.taskGenerator.Resume()
+
+	return c.JSON(http.StatusOK, h.taskGenerator.Status())
+}
+
+// GetTaskGenFailures lists cards whose task generation keeps failing, including the ones left out until requeued
+func (h *Handler) GetTaskGenFailures(c echo.Context) error {
+	limit := parseIntQuery(c, "limit", 50)
+
+	failures, err := h.db.GetTaskGenFailures(limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch task generation failures").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, failures)
+}
+
+// GetCardGenerationLogs returns the prompts and raw responses of a card's logged generations, newest first.
+// Generations are only logged while the log_generations AI setting is on.
+func (h *Handler) GetCardGenerationLogs(c echo.Context) error {
+	cardID := c.Param("id")
+	if cardID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Card ID is required")
+	}
+
+	if _, err := h.db.GetCardByID(cardID); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeCardNotFound, "Card not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch card").WithInternal(err)
+	}
+
+	logs, err := h.db.GetGenerationLogs(cardID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch generation logs").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, logs)
+}
+
+// RecomputeDeckStats recomputes a deck's statistics from its cards and reports cards the statistics
+// can't account for, used by support when a deck's counts look wrong
+func (h *Handler) RecomputeDeckStats(c echo.Context) error {
+	deckID := c.Param("id")
+	if deckID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Deck ID is required")
+	}
+
+	check, err := h.db.CheckDeckStats(deckID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to recompute deck statistics").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, check)
+}
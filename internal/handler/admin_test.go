@@ -0,0 +1,167 @@
+package handler_test
+
+import (
+	"atamagaii/internal/contract"
+	"atamagaii/internal/db"
+	"atamagaii/internal/job"
+	"atamagaii/internal/testutils"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+func TestResetUserDailyNewCards(t *testing.T) {
+	adminTelegramID := int64(testutils.TelegramTestUserID + 3)
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{AdminTelegramIDs: []int64{adminTelegramID}})
+
+	learner, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+4, "learner", "Learner")
+	require.NoError(t, err)
+
+	admin, err := testutils.AuthHelper(t, e, adminTelegramID, "support", "Support")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, learner.Token, "Daily Budget Deck")
+
+	settings, _ := json.Marshal(map[string]interface{}{"name": deck.Name, "new_cards_per_day": 2})
+	rec := testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(settings), learner.Token, http.StatusOK)
+	updated := testutils.ParseResponse[db.Deck](t, rec)
+
+	countNew := func() int {
+		rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/due?deck_id="+deck.ID, "", learner.Token, http.StatusOK)
+		cards := testutils.ParseResponse[[]contract.CardResponse](t, rec)
+		n := 0
+		for _, card := range cards {
+			if card.State == "new" {
+				n++
+			}
+		}
+		return n
+	}
+
+	storage := testutils.GetDBStorage()
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/due?deck_id="+deck.ID, "", learner.Token, http.StatusOK)
+	due := testutils.ParseResponse[[]contract.CardResponse](t, rec)
+	require.Len(t, due, 2)
+
+	var studied []*db.Card
+	for _, c := range due {
+		card, err := storage.GetCard(c.ID, learner.User.ID)
+		require.NoError(t, err)
+		require.NoError(t, storage.ReviewCard(card, &updated, db.RatingGood, 3000))
+		studied = append(studied, card)
+	}
+	require.Equal(t, 0, countNew(), "Daily new-card budget should be used up")
+
+	path := "/v1/admin/users/" + learner.User.ID + "/reset-daily"
+	testutils.PerformRequest(t, e, http.MethodPost, path, "", learner.Token, http.StatusForbidden)
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/admin/users/missing-user/reset-daily", "", admin.Token, http.StatusNotFound)
+
+	rec = testutils.PerformRequest(t, e, http.MethodPost, path, "", admin.Token, http.StatusOK)
+	result := testutils.ParseResponse[contract.ResetDailyResponse](t, rec)
+	require.Equal(t, 2, result.CardsReset)
+
+	require.Equal(t, 2, countNew(), "New-card budget should be restored")
+
+	for _, before := range studied {
+		after, err := storage.GetCard(before.ID, learner.User.ID)
+		require.NoError(t, err)
+		require.Equal(t, before.State, after.State, "SRS state must be kept")
+		require.Equal(t, before.Interval, after.Interval)
+		require.Equal(t, before.ReviewCount, after.ReviewCount)
+		require.NotNil(t, after.NextReview)
+		require.True(t, before.NextReview.Equal(*after.NextReview))
+		require.NotNil(t, after.FirstReviewedAt)
+		require.True(t, before.FirstReviewedAt.Equal(*after.FirstReviewedAt), "Card history must not be rewritten")
+	}
+}
+
+func TestAdminRoutes_RequireAdmin(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	member, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+5, "member", "Member")
+	require.NoError(t, err)
+	require.False(t, member.User.IsAdmin)
+
+	userPath := "/v1/admin/users/" + member.User.ID
+	testutils.PerformRequest(t, e, http.MethodGet, userPath, "", member.Token, http.StatusForbidden)
+	testutils.PerformRequest(t, e, http.MethodPost, userPath+"/reset-daily", "", member.Token, http.StatusForbidden)
+	testutils.PerformRequest(t, e, http.MethodGet, userPath, "", "", http.StatusUnauthorized)
+
+	require.NoError(t, testutils.GetDBStorage().SetUserAdmin(member.User.ID, true))
+
+	// the flag is read at login, the old token stays unprivileged
+	testutils.PerformRequest(t, e, http.MethodGet, userPath, "", member.Token, http.StatusForbidden)
+
+	admin, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+5, "member", "Member")
+	require.NoError(t, err)
+	require.True(t, admin.User.IsAdmin)
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, userPath, "", admin.Token, http.StatusOK)
+	user := testutils.ParseResponse[db.User](t, rec)
+	require.Equal(t, member.User.ID, user.ID)
+
+	testutils.PerformRequest(t, e, http.MethodPost, userPath+"/reset-daily", "", admin.Token, http.StatusOK)
+}
+
+func TestTaskGeneratorAdminRoutes(t *testing.T) {
+	adminTelegramID := int64(testutils.TelegramTestUserID + 3)
+	generator := job.NewTaskGenerator(testutils.GetDBStorage(), nil, nil, nil, job.TaskGeneratorConfig{})
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{
+		AdminTelegramIDs: []int64{adminTelegramID},
+		TaskGenerator:    generator,
+	})
+
+	admin, err := testutils.AuthHelper(t, e, adminTelegramID, "support", "Support")
+	require.NoError(t, err)
+
+	member, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+8, "bystander", "Bystander")
+	require.NoError(t, err)
+
+	const path = "/v1/admin/jobs/task-generator"
+	testutils.PerformRequest(t, e, http.MethodPost, path+"/pause", "", member.Token, http.StatusForbidden)
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, path, "", admin.Token, http.StatusOK)
+	status := testutils.ParseResponse[job.TaskGeneratorStatus](t, rec)
+	require.False(t, status.Paused)
+	require.Nil(t, status.LastRun.StartedAt)
+
+	rec = testutils.PerformRequest(t, e, http.MethodPost, path+"/pause", "", admin.Token, http.StatusOK)
+	status = testutils.ParseResponse[job.TaskGeneratorStatus](t, rec)
+	require.True(t, status.Paused)
+	require.True(t, generator.Status().Paused)
+
+	rec = testutils.PerformRequest(t, e, http.MethodPost, path+"/resume", "", admin.Token, http.StatusOK)
+	status = testutils.ParseResponse[job.TaskGeneratorStatus](t, rec)
+	require.False(t, status.Paused)
+}
+
+func TestRecomputeDeckStats(t *testing.T) {
+	adminTelegramID := int64(testutils.TelegramTestUserID + 3)
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{AdminTelegramIDs: []int64{adminTelegramID}})
+
+	learner, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+35, "drifter", "Drifter")
+	require.NoError(t, err)
+
+	admin, err := testutils.AuthHelper(t, e, adminTelegramID, "support", "Support")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, learner.Token, "Drifting Deck")
+
+	path := "/v1/admin/decks/" + deck.ID + "/recompute-stats"
+	testutils.PerformRequest(t, e, http.MethodPost, path, "", learner.Token, http.StatusForbidden)
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/admin/decks/missing-deck/recompute-stats", "", admin.Token, http.StatusNotFound)
+
+	rec := testutils.PerformRequest(t, e, http.MethodPost, path, "", admin.Token, http.StatusOK)
+	check := testutils.ParseResponse[db.DeckStatsCheck](t, rec)
+	require.NotNil(t, check.Breakdown, "Recompute should report the deck breakdown")
+	require.NotNil(t, check.Stats, "Recompute should report the deck stats")
+
+	breakdown, err := testutils.GetDBStorage().GetDeckBreakdown(learner.User.ID, deck.ID)
+	require.NoError(t, err)
+	require.Equal(t, *breakdown, *check.Breakdown)
+	require.Equal(t, breakdown.Total, breakdown.New, "A fresh import only has new cards")
+	require.Equal(t, min(deck.NewCardsPerDay, breakdown.New), check.Stats.NewCards)
+	require.Empty(t, check.Discrepancies)
+}
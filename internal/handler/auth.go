@@ -12,6 +12,7 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"slices"
 	"time"
 )
 
@@ -116,7 +117,15 @@ func (h *Handler) TelegramAuth(c echo.Context) error {
 		}
 	}
 
-	token, err := generateJWT(user.ID, user.TelegramID, h.jwtSecret)
+	// Users listed in the config are promoted on login, others are managed through the is_admin column
+	if !user.IsAdmin && slices.Contains(h.adminTelegramIDs, user.TelegramID) {
+		if err := h.db.SetUserAdmin(user.ID, true); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user").SetInternal(err)
+		}
+		user.IsAdmin = true
+	}
+
+	token, err := generateJWT(user.ID, user.TelegramID, user.IsAdmin, h.jwtSecret)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate JWT").SetInternal(err)
 	}
@@ -129,13 +138,14 @@ func (h *Handler) TelegramAuth(c echo.Context) error {
 	return c.JSON(http.StatusOK, resp)
 }
 
-func generateJWT(userID string, chatID int64, secretKey string) (string, error) {
+func generateJWT(userID string, chatID int64, isAdmin bool, secretKey string) (string, error) {
 	claims := &contract.JWTClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
 		},
-		UID:    userID,
-		ChatID: chatID,
+		UID:     userID,
+		ChatID:  chatID,
+		IsAdmin: isAdmin,
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
@@ -148,6 +158,24 @@ func generateJWT(userID string, chatID int64, secretKey string) (string, error)
 	return t, nil
 }
 
+// GetUserSettings returns the user's settings with defaults filled in for anything not saved yet
+func (h *Handler) GetUserSettings(c echo.Context) error {
+	uid, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	user, err := h.db.GetUserByID(uid)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeUserNotFound, "User not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch user").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, contract.NewUserSettingsResponse(user.Settings, user.LanguageCode))
+}
+
 // UpdateUserHandler handles the API request to update a user's profile
 func (h *Handler) UpdateUserHandler(c echo.Context) error {
 	// Get user from JWT token
@@ -159,7 +187,7 @@ func (h *Handler) UpdateUserHandler(c echo.Context) error {
 	// Check if user exists
 	dbUser, err := h.db.GetUserByID(uid)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, "User not found")
+		return newCodedError(http.StatusNotFound, contract.ErrorCodeUserNotFound, "User not found")
 	}
 
 	// Parse request body
@@ -188,24 +216,81 @@ func (h *Handler) UpdateUserHandler(c echo.Context) error {
 		}
 
 		if req.Settings.MaxTasksPerDay != nil {
-			dbUser.Settings.MaxTasksPerDay = *req.Settings.MaxTasksPerDay
+			dbUser.Settings.MaxTasksPerDay = db.ClampMaxTasksPerDay(*req.Settings.MaxTasksPerDay)
+		}
+
+		if req.Settings.NewCardsPaused != nil {
+			dbUser.Settings.NewCardsPaused = *req.Settings.NewCardsPaused
+		}
+
+		if req.Settings.StudyOrder != nil {
+			if !db.IsValidStudyOrder(*req.Settings.StudyOrder) {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid study order")
+			}
+			dbUser.Settings.StudyOrder = *req.Settings.StudyOrder
+		}
+
+		if req.Settings.MeaningLanguages != nil {
+			if !db.IsValidMeaningLanguages(req.Settings.MeaningLanguages) {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid meaning languages")
+			}
+			dbUser.Settings.MeaningLanguages = req.Settings.MeaningLanguages
+		}
+
+		if req.Settings.DefaultNewCardsPerDay != nil {
+			if !db.IsValidNewCardsPerDay(*req.Settings.DefaultNewCardsPerDay) {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Default new cards per day must be between 1 and %d", db.MaxNewCardsPerDay))
+			}
+			dbUser.Settings.DefaultNewCardsPerDay = *req.Settings.DefaultNewCardsPerDay
+		}
+
+		if req.Settings.TranslationPassScore != nil {
+			if !db.IsValidTranslationPassScore(*req.Settings.TranslationPassScore) {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Translation pass score must be between %d and %d", db.MinTranslationPassScore, db.MaxTranslationPassScore))
+			}
+			dbUser.Settings.TranslationPassScore = *req.Settings.TranslationPassScore
+		}
+
+		if req.Settings.KnownWordExamples != nil {
+			dbUser.Settings.KnownWordExamples = *req.Settings.KnownWordExamples
+		}
+
+		if req.Settings.FreeTextVocabRecall != nil {
+			dbUser.Settings.FreeTextVocabRecall = *req.Settings.FreeTextVocabRecall
 		}
 
-		if req.Settings.TaskTypes != nil && len(req.Settings.TaskTypes) > 0 {
-			var taskTypes []db.TaskType
+		if req.Settings.TaskAudioRate != nil {
+			if !db.IsValidTaskAudioRate(*req.Settings.TaskAudioRate) {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Task audio rate must be between %.1f and %.1f", db.MinTaskAudioRate, db.MaxTaskAudioRate))
+			}
+			dbUser.Settings.TaskAudioRate = *req.Settings.TaskAudioRate
+		}
+
+		if req.Settings.Timezone != nil {
+			if !db.IsValidTimezone(*req.Settings.Timezone) {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unknown timezone: %s", *req.Settings.Timezone))
+			}
+			dbUser.Settings.Timezone = *req.Settings.Timezone
+		}
+
+		if req.Settings.DisplayLanguage != nil {
+			if !db.IsValidDisplayLanguage(*req.Settings.DisplayLanguage) {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unsupported display language: %s", *req.Settings.DisplayLanguage))
+			}
+			dbUser.Settings.DisplayLanguage = *req.Settings.DisplayLanguage
+		}
+
+		if len(req.Settings.TaskTypes) > 0 {
+			taskTypes := make([]db.TaskType, 0, len(req.Settings.TaskTypes))
 			for _, t := range req.Settings.TaskTypes {
 				taskType := db.TaskType(t)
-				// Validate task type
-				if taskType == db.TaskTypeVocabRecall ||
-					taskType == db.TaskTypeSentenceTranslation ||
-					taskType == db.TaskTypeAudio {
-					taskTypes = append(taskTypes, taskType)
+				if !db.IsUserSelectableTaskType(taskType) {
+					return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid task type: %s", t))
 				}
+				taskTypes = append(taskTypes, taskType)
 			}
 
-			if len(taskTypes) > 0 {
-				dbUser.Settings.TaskTypes = taskTypes
-			}
+			dbUser.Settings.TaskTypes = taskTypes
 		}
 	}
 
@@ -2,6 +2,7 @@ package handler_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"os"
 	"testing"
@@ -73,3 +74,95 @@ func TestTelegramAuth_MissingQuery(t *testing.T) {
 		t.Errorf("Expected error '%s', got '%s'", expectedError, resp.Error)
 	}
 }
+
+func TestGetUserSettings(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+10, "settler", "Settler")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/user/settings", "", resp.Token, http.StatusOK)
+	defaults := testutils.ParseResponse[contract.UserSettingsResponse](t, rec)
+
+	if defaults.MaxTasksPerDay != 10 {
+		t.Errorf("Expected default max_tasks_per_day 10, got %d", defaults.MaxTasksPerDay)
+	}
+	if len(defaults.TaskTypes) != 3 {
+		t.Errorf("Expected 3 default task types, got %v", defaults.TaskTypes)
+	}
+	if defaults.NewCardsPaused {
+		t.Error("Expected new cards not to be paused by default")
+	}
+	if defaults.StudyOrder != "reviews_first" {
+		t.Errorf("Expected default study_order 'reviews_first', got '%s'", defaults.StudyOrder)
+	}
+	if len(defaults.MeaningLanguages) != 2 {
+		t.Errorf("Expected both meaning languages by default, got %v", defaults.MeaningLanguages)
+	}
+
+	update := `{"settings":{"max_tasks_per_day":25,"task_types":["audio"],"new_cards_paused":true,"study_order":"new_first","meaning_languages":["ru"]}}`
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", update, resp.Token, http.StatusOK)
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/user/settings", "", resp.Token, http.StatusOK)
+	saved := testutils.ParseResponse[contract.UserSettingsResponse](t, rec)
+
+	if saved.MaxTasksPerDay != 25 {
+		t.Errorf("Expected max_tasks_per_day 25, got %d", saved.MaxTasksPerDay)
+	}
+	if len(saved.TaskTypes) != 1 || saved.TaskTypes[0] != "audio" {
+		t.Errorf("Expected task_types [audio], got %v", saved.TaskTypes)
+	}
+	if !saved.NewCardsPaused {
+		t.Error("Expected new cards to be paused")
+	}
+	if saved.StudyOrder != "new_first" {
+		t.Errorf("Expected study_order 'new_first', got '%s'", saved.StudyOrder)
+	}
+	if len(saved.MeaningLanguages) != 1 || saved.MeaningLanguages[0] != "ru" {
+		t.Errorf("Expected meaning_languages [ru], got %v", saved.MeaningLanguages)
+	}
+}
+
+func TestUpdateUser_ValidatesTaskSettings(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+11, "clamper", "Clamper")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		maxTasks int
+		expected int
+	}{
+		{name: "zero is raised to the minimum", maxTasks: 0, expected: 1},
+		{name: "negative is raised to the minimum", maxTasks: -5, expected: 1},
+		{name: "in range is kept", maxTasks: 42, expected: 42},
+		{name: "huge is lowered to the maximum", maxTasks: 100000, expected: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"settings":{"max_tasks_per_day":%d}}`, tt.maxTasks)
+			testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", body, resp.Token, http.StatusOK)
+
+			rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/user/settings", "", resp.Token, http.StatusOK)
+			settings := testutils.ParseResponse[contract.UserSettingsResponse](t, rec)
+			if settings.MaxTasksPerDay != tt.expected {
+				t.Errorf("Expected max_tasks_per_day %d, got %d", tt.expected, settings.MaxTasksPerDay)
+			}
+		})
+	}
+
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", `{"settings":{"task_types":["audio","question"]}}`, resp.Token, http.StatusBadRequest)
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", `{"settings":{"task_types":["vocab_recall","bogus"]}}`, resp.Token, http.StatusBadRequest)
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/user/settings", "", resp.Token, http.StatusOK)
+	settings := testutils.ParseResponse[contract.UserSettingsResponse](t, rec)
+	if len(settings.TaskTypes) != 3 {
+		t.Errorf("Rejected updates should leave task types unchanged, got %v", settings.TaskTypes)
+	}
+}
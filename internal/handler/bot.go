@@ -1,10 +1,13 @@
 package handler
 
 import (
+	"atamagaii/internal/ai"
 	"atamagaii/internal/contract"
 	"atamagaii/internal/db"
+	"atamagaii/internal/middleware"
 	"atamagaii/internal/utils"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,11 +18,24 @@ import (
 	nanoid "github.com/matoous/go-nanoid/v2"
 	"log"
 	"math/rand"
+	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// webhookSecretHeader carries the secret token Telegram was given in SetWebhook
+const webhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
 func (h *Handler) HandleWebhook(c echo.Context) error {
+	if h.webhookSecret != "" {
+		secret := c.Request().Header.Get(webhookSecretHeader)
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(h.webhookSecret)) != 1 {
+			return c.NoContent(http.StatusForbidden)
+		}
+	}
+
 	var update tgbotapi.Update
 	if err := c.Bind(&update); err != nil {
 		log.Printf("Failed to bind update: %v", err)
@@ -30,6 +46,11 @@ func (h *Handler) HandleWebhook(c echo.Context) error {
 		return c.NoContent(200)
 	}
 
+	if update.CallbackQuery != nil {
+		h.handleCallbackQuery(update.CallbackQuery)
+		return c.NoContent(200)
+	}
+
 	if resp := h.handleUpdate(update); resp.Text != "" {
 		_, err := h.bot.SendMessage(context.Background(), resp)
 		if err != nil {
@@ -136,6 +157,12 @@ func (h *Handler) handleUpdate(update tgbotapi.Update) (msg *telegram.SendMessag
 
 	// Handle document uploads
 	if update.Message.Document != nil {
+		// Reject files we can't import before announcing or downloading anything
+		if reason := checkImportDocument(update.Message.Document); reason != "" {
+			msg.Text = "❌ " + reason
+			return msg
+		}
+
 		msg.Text = "📄 Получен файл\\. Начинаю обработку\\.\\.\\."
 		msg.ParseMode = models.ParseModeMarkdown
 
@@ -182,7 +209,7 @@ func (h *Handler) handleUpdate(update tgbotapi.Update) (msg *telegram.SendMessag
 			log.Printf("Failed to send initial message: %v", err)
 		} else {
 			// Trigger automatic card generation in background with message ID
-			go h.generateCardContentAsync(cardResp.ID, cardResp.DeckID, user.TelegramID, sentMsg.ID)
+			go h.generateCardContentAsync(cardResp.ID, cardResp.DeckID, user.TelegramID, sentMsg.ID, 0)
 		}
 
 		// Return empty response since we already sent the message
@@ -245,7 +272,7 @@ func (h *Handler) createCardFromMessage(userID string, messageText string) (*con
 		return nil, "", fmt.Errorf("error adding card: %w", err)
 	}
 
-	cardResponse, err := formatCardResponse(*card)
+	cardResponse, err := formatCardResponse(*card, "")
 	if err != nil {
 		return nil, "", fmt.Errorf("error formatting card response: %w", err)
 	}
@@ -253,10 +280,10 @@ func (h *Handler) createCardFromMessage(userID string, messageText string) (*con
 	return &cardResponse, languageCode, nil
 }
 
-// generateCardContentAsync generates card content in the background and sends notification when done
-func (h *Handler) generateCardContentAsync(cardID, deckID string, telegramChatID int64, originalMessageID int) {
-	ctx := context.Background()
-
+// generateCardContentAsync generates card content in the background and sends notification when done.
+// At most maxBotGenerations run at once, each attempt is bounded by the AI timeout and a failed first
+// attempt is retried up to botAutoRetries times, botRetryDelay apart, before the user is told.
+func (h *Handler) generateCardContentAsync(cardID, deckID string, telegramChatID int64, originalMessageID int, attempt int) {
 	card, err := h.db.GetCardByID(cardID)
 	if err != nil {
 		log.Printf("Failed to get card %s for async generation: %v", cardID, err)
@@ -269,10 +296,21 @@ func (h *Handler) generateCardContentAsync(cardID, deckID string, telegramChatID
 		return
 	}
 
-	updatedFields, err := h.generateCardContent(ctx, card)
+	updatedFields, err := h.runBotGeneration(card)
+
+	// a retry the user pressed is already a repeated attempt, it gets no automatic retries of its own
+	for retry := 0; err != nil && attempt == 0 && retry < h.botAutoRetries && isRetryableGeneration(err); retry++ {
+		log.Printf("Failed to generate content for card %s, retrying in %s: %v", cardID, h.botRetryDelay, err)
+		h.updateStatusMessage(telegramChatID, originalMessageID, fmt.Sprintf("*%s*\n\n⏳ Не получилось с первого раза, пробую ещё раз\\.\\.\\.",
+			telegram.EscapeMarkdown(fields.Term)))
+
+		time.Sleep(h.botRetryDelay)
+		updatedFields, err = h.runBotGeneration(card)
+	}
+
 	if err != nil {
 		log.Printf("Failed to generate content for card %s: %v", cardID, err)
-		h.sendGenerationFailedNotification(telegramChatID, fields.Term, originalMessageID)
+		h.sendGenerationFailedNotification(telegramChatID, fields.Term, cardID, originalMessageID, attempt, err)
 		return
 	}
 
@@ -287,6 +325,33 @@ func (h *Handler) generateCardContentAsync(cardID, deckID string, telegramChatID
 	)
 }
 
+// runBotGeneration makes one generation attempt once a slot is free, waiting for the slot counts against the timeout
+func (h *Handler) runBotGeneration(card *db.Card) (*contract.CardFields, error) {
+	timeout := h.aiTimeout
+	if timeout <= 0 {
+		timeout = middleware.DefaultAIRequestTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	select {
+	case h.botGenerations <- struct{}{}:
+		defer func() { <-h.botGenerations }()
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no free generation slot: %w", ctx.Err())
+	}
+
+	return h.generateCardContent(ctx, card)
+}
+
+// isRetryableGeneration reports whether another attempt could succeed, an unsupported language never will,
+// flagged content was already retried with the strict prompt and an exhausted quota won't recover in seconds
+func isRetryableGeneration(err error) bool {
+	failure := classifyGenerationError(err)
+	return failure != generationFailureLanguage && failure != generationFailureFlagged && failure != generationFailureQuota
+}
+
 // sendGenerationSuccessNotification sends a notification when card generation is successful
 func (h *Handler) sendGenerationSuccessNotification(
 	chatID int64,
@@ -333,7 +398,7 @@ func (h *Handler) sendGenerationSuccessNotification(
 }
 
 // sendGenerationFailedNotification sends a notification when card generation fails
-func (h *Handler) sendGenerationFailedNotification(chatID int64, term string, originalMessageID int) {
+func (h *Handler) sendGenerationFailedNotification(chatID int64, term, cardID string, originalMessageID, attempt int, genErr error) {
 	// First, delete the original "generating..." message
 	deleteMsg := &telegram.DeleteMessageParams{
 		ChatID:    chatID,
@@ -344,14 +409,149 @@ func (h *Handler) sendGenerationFailedNotification(chatID int64, term string, or
 		log.Printf("Failed to delete original message: %v", err)
 	}
 
-	// Send failure notification
+	msg := h.generationFailedMessage(chatID, term, cardID, attempt, genErr)
+	if _, err := h.bot.SendMessage(context.Background(), msg); err != nil {
+		log.Printf("Failed to send generation failed notification: %v", err)
+	}
+}
+
+// generationRetryPrefix marks callback data of the "retry" button, followed by "<card id>:<attempt>"
+const generationRetryPrefix = "regen:"
+
+type generationFailure int
+
+const (
+	generationFailureUnknown generationFailure = iota
+	generationFailureQuota
+	generationFailureParse
+	generationFailureLanguage
+	generationFailureFlagged
+	generationFailureTimeout
+	generationFailureEmpty
+)
+
+func classifyGenerationError(err error) generationFailure {
+	switch {
+	case errors.Is(err, ai.ErrQuotaExceeded):
+		return generationFailureQuota
+	case errors.Is(err, ai.ErrInvalidResponse):
+		return generationFailureParse
+	case errors.Is(err, ai.ErrEmptyResponse):
+		return generationFailureEmpty
+	case errors.Is(err, ai.ErrUnsupportedLanguage):
+		return generationFailureLanguage
+	case errors.Is(err, ai.ErrContentFlagged):
+		return generationFailureFlagged
+	case errors.Is(err, context.DeadlineExceeded):
+		return generationFailureTimeout
+	default:
+		return generationFailureUnknown
+	}
+}
+
+// hint explains the failure to the user in a way that suggests what to do next
+func (f generationFailure) hint() string {
+	switch f {
+	case generationFailureQuota:
+		return "Сервис генерации сейчас перегружен: исчерпан лимит запросов. Попробуй через несколько минут."
+	case generationFailureParse:
+		return "Модель вернула ответ в неожиданном формате. Обычно помогает повторная попытка."
+	case generationFailureLanguage:
+		return "Генерация для языка этой карточки пока не поддерживается."
+	case generationFailureFlagged:
+		return "Сгенерированный пример не прошёл проверку на уместность. Можно попробовать ещё раз."
+	case generationFailureEmpty:
+		return "Модель ничего не ответила, так бывает при высокой нагрузке. Попробуй ещё раз."
+	case generationFailureTimeout:
+		return "Генерация заняла слишком много времени. Попробуй ещё раз чуть позже."
+	default:
+		return "Что-то пошло не так. Попробуй позже."
+	}
+}
+
+// generationFailedMessage builds the failure notification with a reason and, while retries remain, a retry button
+func (h *Handler) generationFailedMessage(chatID int64, term, cardID string, attempt int, genErr error) *telegram.SendMessageParams {
+	failure := classifyGenerationError(genErr)
+
+	text := fmt.Sprintf("❌ Не удалось сгенерировать контент для карточки *%s*\\.\n\n%s",
+		telegram.EscapeMarkdown(term),
+		telegram.EscapeMarkdown(failure.hint()))
+
 	msg := &telegram.SendMessageParams{
 		ChatID:    chatID,
-		Text:      fmt.Sprintf("❌ Не удалось сгенерировать контент для карточки *%s*\\. Попробуй позже\\.", telegram.EscapeMarkdown(term)),
 		ParseMode: models.ParseModeMarkdown,
 	}
 
-	if _, err := h.bot.SendMessage(context.Background(), msg); err != nil {
-		log.Printf("Failed to send generation failed notification: %v", err)
+	retriesLeft := h.maxGenerationRetries - attempt
+	if failure != generationFailureLanguage && retriesLeft > 0 {
+		text += fmt.Sprintf("\n\nОсталось попыток: %d из %d", retriesLeft, h.maxGenerationRetries)
+		msg.ReplyMarkup = models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{
+					{
+						Text:         "🔄 Повторить",
+						CallbackData: fmt.Sprintf("%s%s:%d", generationRetryPrefix, cardID, attempt+1),
+					},
+				},
+			},
+		}
+	}
+
+	msg.Text = text
+	return msg
+}
+
+func parseGenerationRetryData(data string) (cardID string, attempt int, ok bool) {
+	rest, found := strings.CutPrefix(data, generationRetryPrefix)
+	if !found {
+		return "", 0, false
+	}
+
+	cardID, attemptStr, found := strings.Cut(rest, ":")
+	if !found || cardID == "" {
+		return "", 0, false
+	}
+
+	attempt, err := strconv.Atoi(attemptStr)
+	if err != nil || attempt <= 0 {
+		return "", 0, false
 	}
+
+	return cardID, attempt, true
+}
+
+// handleCallbackQuery handles inline button presses, currently only retrying failed card generation
+func (h *Handler) handleCallbackQuery(query *tgbotapi.CallbackQuery) {
+	answer := &telegram.AnswerCallbackQueryParams{CallbackQueryID: query.ID}
+	defer func() {
+		if _, err := h.bot.AnswerCallbackQuery(context.Background(), answer); err != nil {
+			log.Printf("Failed to answer callback query: %v", err)
+		}
+	}()
+
+	cardID, attempt, ok := parseGenerationRetryData(query.Data)
+	if !ok || query.From == nil || query.Message == nil || query.Message.Chat == nil {
+		return
+	}
+
+	user, err := h.db.GetUser(query.From.ID)
+	if err != nil {
+		log.Printf("Failed to get user for callback query: %v", err)
+		answer.Text = "Пользователь не найден."
+		return
+	}
+
+	card, err := h.db.GetCardByID(cardID)
+	if err != nil || card.UserID != user.ID {
+		answer.Text = "Карточка не найдена."
+		return
+	}
+
+	if attempt > h.maxGenerationRetries {
+		answer.Text = "Лимит попыток исчерпан."
+		return
+	}
+
+	answer.Text = "⏳ Генерирую заново..."
+	go h.generateCardContentAsync(card.ID, card.DeckID, query.Message.Chat.ID, query.Message.MessageID, attempt)
 }
@@ -3,19 +3,23 @@ package handler
 import (
 	"atamagaii/internal/ai"
 	"atamagaii/internal/contract"
+	"atamagaii/internal/db"
 	"atamagaii/internal/utils"
 	"bytes"
 	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	telegram "github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 	"io"
 	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -36,9 +40,69 @@ type VocabImportItem struct {
 	LanguageCode             string `json:"language_code"`
 }
 
+// MaxImportFileSize is the largest document the bot downloads for an import
+const MaxImportFileSize = 5 << 20
+
+// importFileSuffixes are the file extensions the bot imports
+var importFileSuffixes = []string{".csv", ".tsv", ".txt"}
+
+// importMimeTypes are the non-text MIME types clients send CSV files with
+var importMimeTypes = map[string]bool{
+	"application/csv":          true,
+	"application/vnd.ms-excel": true,
+	"application/octet-stream": true,
+}
+
+// checkImportDocument uses the metadata Telegram sends with a document to reject it before downloading,
+// it returns the reason to show the user or an empty string if the document can be imported
+func checkImportDocument(document *tgbotapi.Document) string {
+	fileName := strings.ToLower(document.FileName)
+	hasSuffix := false
+	for _, suffix := range importFileSuffixes {
+		if strings.HasSuffix(fileName, suffix) {
+			hasSuffix = true
+			break
+		}
+	}
+
+	mimeType := strings.ToLower(document.MimeType)
+	if !hasSuffix || (mimeType != "" && !strings.HasPrefix(mimeType, "text/") && !importMimeTypes[mimeType]) {
+		return "Неподдерживаемый формат файла. Поддерживаются только CSV, TSV и TXT файлы."
+	}
+
+	if document.FileSize > MaxImportFileSize {
+		return fmt.Sprintf("Файл слишком большой. Максимальный размер — %d МБ.", MaxImportFileSize>>20)
+	}
+
+	return ""
+}
+
 // processFileImport handles the file import process
 func (h *Handler) processFileImport(userID string, telegramChatID int64, document *tgbotapi.Document, messageID int) {
-	ctx := context.Background()
+	importID, ctx := h.imports.start(userID, document.FileName)
+	defer h.imports.finish(importID)
+
+	// The job record outlives the process, so an import cut short by a restart can still be reported
+	status, processed := db.ImportJobStatusFailed, 0
+	if err := h.db.CreateImportJob(&db.ImportJob{
+		ID:             importID,
+		UserID:         userID,
+		TelegramChatID: telegramChatID,
+		MessageID:      messageID,
+		FileName:       document.FileName,
+	}); err != nil {
+		log.Printf("Failed to save import job: %v", err)
+	}
+	defer func() {
+		if err := h.db.FinishImportJob(importID, status, processed); err != nil {
+			log.Printf("Failed to finish import job: %v", err)
+		}
+	}()
+
+	if reason := checkImportDocument(document); reason != "" {
+		h.sendFileImportError(telegramChatID, telegram.EscapeMarkdown(reason), messageID)
+		return
+	}
 
 	// Download the file
 	fileContent, err := h.downloadTelegramFile(document.FileID)
@@ -48,24 +112,15 @@ func (h *Handler) processFileImport(userID string, telegramChatID int64, documen
 		return
 	}
 
-	// Parse the file based on extension
-	allowedSuffixes := []string{".csv", ".txt"}
-	inAllowedSuffix := false
-	for _, suffix := range allowedSuffixes {
-		if strings.HasSuffix(document.FileName, suffix) {
-			inAllowedSuffix = true
-			break
-		}
-	}
+	var items []VocabImportItem
+	items, err = h.parseImportFile(ctx, document.FileName, fileContent)
 
-	if !inAllowedSuffix {
-		h.sendFileImportError(telegramChatID, "Неподдерживаемый формат файла\\. Поддерживаются только CSV и TXT файлы\\.", messageID)
+	if ctx.Err() != nil {
+		status = db.ImportJobStatusCanceled
+		h.sendFileImportError(telegramChatID, "Импорт отменён\\.", messageID)
 		return
 	}
 
-	var items []VocabImportItem
-	items, err = h.parseCSVFile(ctx, fileContent)
-
 	if err != nil {
 		log.Printf("Failed to parse file: %v", err)
 		h.sendFileImportError(telegramChatID, "Не удалось обработать файл\\. Проверь формат данных\\.", messageID)
@@ -77,13 +132,78 @@ func (h *Handler) processFileImport(userID string, telegramChatID int64, documen
 		return
 	}
 
+	slog.Info("file import parsed",
+		slog.String("user_id", userID),
+		slog.String("file_name", document.FileName),
+		slog.Int("items", len(items)),
+	)
+
+	if err := h.db.UpdateImportJobProgress(importID, len(items), 0); err != nil {
+		log.Printf("Failed to update import job: %v", err)
+	}
+
 	// Update status
-	h.updateImportStatus(telegramChatID, messageID, fmt.Sprintf("📝 Обработано %d записей. Создаю колоду\\.\\.\\.", len(items)))
+	h.updateStatusMessage(telegramChatID, messageID, fmt.Sprintf("📝 Обработано %d записей. Создаю колоду\\.\\.\\.", len(items)))
+
+	result := h.importVocabItems(ctx, userID, document.FileName, items, func(imported int) {
+		if err := h.db.UpdateImportJobProgress(importID, len(items), imported); err != nil {
+			log.Printf("Failed to update import job: %v", err)
+		}
+		h.updateStatusMessage(telegramChatID, messageID, fmt.Sprintf("📝 Импортировано %d карточек\\.\\.\\.", imported))
+	})
+
+	slog.Info("file import finished",
+		slog.String("user_id", userID),
+		slog.String("file_name", document.FileName),
+		slog.Int("items", result.Parsed),
+		slog.Int("skipped", result.Skipped),
+		slog.Int("imported", result.Imported),
+		slog.Int("failed", result.Failed),
+		slog.Int("canceled", result.Canceled),
+		slog.Int("decks", len(result.DeckIDs)),
+	)
+
+	processed = result.Imported
+
+	// Send final notification
+	if result.Canceled > 0 {
+		status = db.ImportJobStatusCanceled
+		h.sendFileImportError(telegramChatID, fmt.Sprintf("Импорт отменён\\. Успели добавить карточек: %d\\.", result.Imported), messageID)
+	} else if result.Imported > 0 {
+		status = db.ImportJobStatusCompleted
+		h.sendFileImportSuccess(telegramChatID, messageID, result.Imported, result.DeckIDs[0])
+	} else {
+		h.sendFileImportError(telegramChatID, "Не удалось импортировать карточки\\. Проверь формат файла\\.", messageID)
+	}
+}
+
+// fileImportResult counts what happened to the parsed items of an imported file;
+// Parsed always equals Skipped + Imported + Failed + Canceled
+type fileImportResult struct {
+	Parsed   int      // Items read from the file
+	Skipped  int      // Items without a term
+	Imported int      // Items saved as cards
+	Failed   int      // Items whose deck or cards couldn't be saved
+	Canceled int      // Items left out because the import was canceled
+	DeckIDs  []string // Decks that received cards
+}
+
+// importVocabItems saves parsed items as cards in the user's "Generated" deck of each item's language
+// and records fileName as the source of every deck that got cards. progress is called with the running
+// total after every deck. Once ctx is canceled the remaining languages are skipped and a deck whose cards
+// are still being inserted gets none of them. Readings missing from the new cards are filled in last, under the same ctx.
+func (h *Handler) importVocabItems(ctx context.Context, userID, fileName string, items []VocabImportItem, progress func(imported int)) fileImportResult {
+	result := fileImportResult{Parsed: len(items)}
 
 	// Group items by language
 	itemsByLang := make(map[string][]VocabImportItem)
 	for _, item := range items {
-		lang := item.LanguageCode
+		if strings.TrimSpace(item.Term) == "" {
+			result.Skipped++
+			continue
+		}
+
+		lang := utils.NormalizeLanguageCode(item.LanguageCode)
 		if lang == "" {
 			// Try to detect language from the term
 			lang = DetectLanguageFromString(item.Term)
@@ -91,17 +211,32 @@ func (h *Handler) processFileImport(userID string, telegramChatID int64, documen
 		itemsByLang[lang] = append(itemsByLang[lang], item)
 	}
 
-	// Create decks and import cards for each language
-	totalImported := 0
-	var importedDecks []string
+	// CSV exports often come without readings, they are filled in once every language is saved
+	type importedCards struct {
+		deck    *db.Deck
+		cardIDs []string
+	}
+	var needReadings []importedCards
 
+	// Create decks and import cards for each language
 	for lang, langItems := range itemsByLang {
+		if ctx.Err() != nil {
+			result.Canceled += len(langItems)
+			continue
+		}
+
 		transcriptionType := utils.GetDefaultTranscriptionType(lang)
 
 		// Get or create the "Generated" deck for this language
 		deck, err := h.db.GetOrCreateGeneratedDeck(userID, lang, transcriptionType)
 		if err != nil {
-			log.Printf("Failed to get/create deck for language %s: %v", lang, err)
+			slog.Error("file import deck failed",
+				slog.String("user_id", userID),
+				slog.String("language", lang),
+				slog.Int("items", len(langItems)),
+				slog.String("error", err.Error()),
+			)
+			result.Failed += len(langItems)
 			continue
 		}
 
@@ -126,25 +261,58 @@ func (h *Handler) processFileImport(userID string, telegramChatID int64, documen
 		}
 
 		// Batch insert cards
-		err = h.db.AddCardsInBatch(userID, deck.ID, fieldStrings)
+		cardIDs, err := h.db.AddCardsInBatchContext(ctx, userID, deck.ID, fieldStrings, db.DefaultCardBatchSize)
+		if err != nil && ctx.Err() != nil {
+			result.Canceled += len(langItems)
+			continue
+		}
 		if err != nil {
-			log.Printf("Failed to import cards for language %s: %v", lang, err)
+			slog.Error("file import cards failed",
+				slog.String("user_id", userID),
+				slog.String("deck", deck.Name),
+				slog.String("language", lang),
+				slog.Int("items", len(langItems)),
+				slog.String("error", err.Error()),
+			)
+			result.Failed += len(langItems)
 			continue
 		}
 
-		totalImported += len(langItems)
-		importedDecks = append(importedDecks, deck.ID)
+		slog.Info("file import cards added",
+			slog.String("user_id", userID),
+			slog.String("deck", deck.Name),
+			slog.String("language", lang),
+			slog.Int("cards", len(langItems)),
+		)
+
+		result.Imported += len(langItems)
+		result.DeckIDs = append(result.DeckIDs, deck.ID)
+
+		source := db.DeckSource{Type: db.DeckSourceCSV, FileName: fileName, LanguageCode: lang}
+		if err := h.db.SetDeckSource(deck.ID, source); err != nil {
+			slog.Error("file import deck source failed",
+				slog.String("deck", deck.ID),
+				slog.String("error", err.Error()),
+			)
+		}
 
-		// Update status
-		h.updateImportStatus(telegramChatID, messageID, fmt.Sprintf("📝 Импортировано %d карточек\\.\\.\\.", totalImported))
+		if canGenerateTranscriptions(deck) {
+			needReadings = append(needReadings, importedCards{deck: deck, cardIDs: cardIDs})
+		}
+
+		if progress != nil {
+			progress(result.Imported)
+		}
 	}
 
-	// Send final notification
-	if totalImported > 0 {
-		h.sendFileImportSuccess(telegramChatID, messageID, totalImported, importedDecks[0])
-	} else {
-		h.sendFileImportError(telegramChatID, "Не удалось импортировать карточки\\. Проверь формат файла\\.", messageID)
+	for _, imported := range needReadings {
+		if ctx.Err() != nil {
+			break
+		}
+		h.fillTranscriptionsAfterImport(ctx, imported.deck, imported.cardIDs)
 	}
+
+	return result
 }
 
 // ColumnMapping represents the mapping of CSV columns to our fields
@@ -182,12 +350,186 @@ func getRandomMiddleItem[T any](items []T) T {
 	return items[randomIndex]
 }
 
-// parseCSVFile parses CSV file using column mapping
-func (h *Handler) parseCSVFile(ctx context.Context, content []byte) ([]VocabImportItem, error) {
+// isBlankRecord reports whether a CSV record has no non-space field
+func isBlankRecord(record []string) bool {
+	for _, field := range record {
+		if strings.TrimSpace(field) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// isCSVMetadataRecord reports whether a record is a comment or export header line rather than vocabulary,
+// e.g. "#separator:tab" or the "Welcome" line some apps put on top of exported decks
+func isCSVMetadataRecord(record []string) bool {
+	first := strings.TrimSpace(record[0])
+	return strings.HasPrefix(first, "#") || strings.HasPrefix(first, "Welcome")
+}
+
+// csvDataStart returns the index of the first vocabulary record, skipping leading blank and metadata
+// records; it returns len(records) when there is no data at all
+func csvDataStart(records [][]string) int {
+	for i, record := range records {
+		if isBlankRecord(record) || isCSVMetadataRecord(record) {
+			continue
+		}
+		return i
+	}
+	return len(records)
+}
+
+// csvHeaderAliases lists, per import field, the column names found in exports: Anki note type fields like
+// Expression/Reading/Meaning, our own deck export and common spreadsheet headers, normalized by normalizeCSVHeader
+var csvHeaderAliases = map[string][]string{
+	"term":                       {"term", "expression", "word", "vocab", "vocabulary", "front", "kanji"},
+	"transcription":              {"transcription", "reading", "kana", "pronunciation"},
+	"term_with_transcription":    {"term_with_transcription", "furigana", "expression_furigana", "word_furigana"},
+	"meaning_en":                 {"meaning_en", "meaning", "english", "definition", "back"},
+	"meaning_ru":                 {"meaning_ru", "russian"},
+	"example_native":             {"example_native", "example", "sentence"},
+	"example_en":                 {"example_en", "sentence_meaning", "sentence_english"},
+	"example_ru":                 {"example_ru", "sentence_russian"},
+	"example_with_transcription": {"example_with_transcription", "sentence_furigana", "example_furigana"},
+	"frequency":                  {"frequency", "freq"},
+}
+
+// csvHeaderField returns the import field a column name is an alias of, or "" for unknown columns
+func csvHeaderField(name string) string {
+	name = normalizeCSVHeader(name)
+	for field, aliases := range csvHeaderAliases {
+		if slices.Contains(aliases, name) {
+			return field
+		}
+	}
+	return ""
+}
+
+// normalizeCSVHeader lowercases a column name and joins its words with underscores, so
+// "Sentence-Meaning" and "sentence meaning" both become "sentence_meaning"
+func normalizeCSVHeader(name string) string {
+	name = strings.TrimPrefix(strings.TrimSpace(name), "#columns:")
+	return strings.Join(strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == ' ' || r == '_' || r == '-'
+	}), "_")
+}
+
+// headerColumnMapping builds a column mapping from a header record. It only succeeds when a term column
+// and at least one other known column are named; if several columns map to one field, the first wins.
+func headerColumnMapping(record []string) (*ColumnMapping, bool) {
+	mapping := &ColumnMapping{
+		TermIndex:                     -1,
+		TranscriptionIndex:            -1,
+		TermWithTranscriptionIndex:    -1,
+		MeaningEnIndex:                -1,
+		MeaningRuIndex:                -1,
+		ExampleNativeIndex:            -1,
+		ExampleEnIndex:                -1,
+		ExampleRuIndex:                -1,
+		ExampleWithTranscriptionIndex: -1,
+		FrequencyIndex:                -1,
+	}
+
+	known := 0
+	for i, name := range record {
+		var index *int
+		switch csvHeaderField(name) {
+		case "term":
+			index = &mapping.TermIndex
+		case "transcription":
+			index = &mapping.TranscriptionIndex
+		case "term_with_transcription":
+			index = &mapping.TermWithTranscriptionIndex
+		case "meaning_en":
+			index = &mapping.MeaningEnIndex
+		case "meaning_ru":
+			index = &mapping.MeaningRuIndex
+		case "example_native":
+			index = &mapping.ExampleNativeIndex
+		case "example_en":
+			index = &mapping.ExampleEnIndex
+		case "example_ru":
+			index = &mapping.ExampleRuIndex
+		case "example_with_transcription":
+			index = &mapping.ExampleWithTranscriptionIndex
+		case "frequency":
+			index = &mapping.FrequencyIndex
+		default:
+			continue
+		}
+		if *index < 0 {
+			*index = i
+			known++
+		}
+	}
+
+	if mapping.TermIndex < 0 || known < 2 {
+		return nil, false
+	}
+	return mapping, true
+}
+
+// findHeaderMapping looks for a header naming the columns: a "#columns:" metadata line as written by
+// Anki and our deck export, or a header as the first data record. It returns the mapping and the index
+// of the first record after the header.
+func findHeaderMapping(records [][]string, dataStart int) (*ColumnMapping, int, bool) {
+	for _, record := range records[:dataStart] {
+		if len(record) > 0 && strings.HasPrefix(strings.TrimSpace(record[0]), "#columns:") {
+			if mapping, ok := headerColumnMapping(record); ok {
+				return mapping, dataStart, true
+			}
+		}
+	}
+
+	if dataStart < len(records) {
+		if mapping, ok := headerColumnMapping(records[dataStart]); ok {
+			return mapping, dataStart + 1, true
+		}
+	}
+
+	return nil, 0, false
+}
+
+// errColumnDetection marks CSV files the AI could not analyze, as opposed to files that are malformed
+var errColumnDetection = errors.New("failed to analyze columns")
+
+// csvAnalysis is what was detected about a CSV file before its rows are turned into items
+type csvAnalysis struct {
+	records      [][]string // Data rows, without metadata lines or a header
+	mapping      *ColumnMapping
+	languageCode string
+	fromHeader   bool // The mapping came from named columns rather than AI detection
+	wordList     bool // A plain text file of one term per line
+}
+
+// parseImportFile parses an import file using the column mapping analyzeImportFile finds for it
+func (h *Handler) parseImportFile(ctx context.Context, fileName string, content []byte) ([]VocabImportItem, error) {
+	analysis, err := h.analyzeImportFile(ctx, fileName, content)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.extractItems(analysis.records, analysis.mapping), nil
+}
+
+// analyzeImportFile picks how an import file is read, both the import and its validation go through it. A .txt
+// file without tabs is a word list of one term per line; every other file, Anki's tab-separated .txt exports
+// included, is analyzed as CSV.
+func (h *Handler) analyzeImportFile(ctx context.Context, fileName string, content []byte) (*csvAnalysis, error) {
+	if strings.HasSuffix(strings.ToLower(fileName), ".txt") && !bytes.ContainsRune(content, '\t') {
+		return analyzeWordList(content)
+	}
+
+	return h.analyzeCSVFile(ctx, content)
+}
+
+// analyzeCSVFile reads a CSV file and detects its column mapping and language
+func (h *Handler) analyzeCSVFile(ctx context.Context, content []byte) (*csvAnalysis, error) {
 	reader := csv.NewReader(bytes.NewReader(content))
 	reader.Comma = '\t' // Tab-separated as in the example
 	reader.LazyQuotes = true
-	reader.TrimLeadingSpace = true
+	// No TrimLeadingSpace: with a tab delimiter it also drops leading tabs, shifting empty columns away.
+	// Fields are trimmed when they are extracted.
 	reader.FieldsPerRecord = -1 // Variable number of fields
 
 	// Read all records first
@@ -201,22 +543,27 @@ func (h *Handler) parseCSVFile(ctx context.Context, content []byte) ([]VocabImpo
 	}
 
 	// Skip metadata lines at the beginning
-	dataStartIndex := 0
-	for i, record := range allRecords {
-		if len(record) > 0 && !strings.HasPrefix(record[0], "#") || strings.HasPrefix(record[0], "Welcome") {
-			dataStartIndex = i
-			break
-		}
-	}
+	dataStartIndex := csvDataStart(allRecords)
 
 	if dataStartIndex >= len(allRecords) {
 		return nil, fmt.Errorf("no data found in CSV file")
 	}
 
+	// Named columns are mapped directly, the AI only guesses the layout of files without a header
+	if mapping, start, ok := findHeaderMapping(allRecords, dataStartIndex); ok {
+		log.Printf("Column mapping from header: %+v", mapping)
+		return &csvAnalysis{
+			records:      allRecords[start:],
+			mapping:      mapping,
+			languageCode: detectRecordsLanguage(allRecords[start:], mapping),
+			fromHeader:   true,
+		}, nil
+	}
+
 	// get middle sample row for analysis, use getRandomMiddleItem to avoid bias
 	sampleRow := getRandomMiddleItem(allRecords[dataStartIndex:])
 	// If the sample row is empty, fallback to the first data row
-	if len(sampleRow) == 0 {
+	if isBlankRecord(sampleRow) {
 		sampleRow = allRecords[dataStartIndex]
 	}
 
@@ -225,7 +572,7 @@ func (h *Handler) parseCSVFile(ctx context.Context, content []byte) ([]VocabImpo
 		if i > 0 {
 			line += "\n"
 		}
-		field = strings.TrimSpace(field)
+		field = utils.StripHTML(field)
 		if field == "" {
 			continue // Skip empty fields
 		}
@@ -234,7 +581,7 @@ func (h *Handler) parseCSVFile(ctx context.Context, content []byte) ([]VocabImpo
 
 	analysisResult, err := h.aiClient.ParseCSVFields(ctx, line)
 	if err != nil {
-		return nil, fmt.Errorf("failed to analyze columns: %w", err)
+		return nil, fmt.Errorf("%w: %w", errColumnDetection, err)
 	}
 
 	if analysisResult.LanguageCode == "" {
@@ -247,13 +594,28 @@ func (h *Handler) parseCSVFile(ctx context.Context, content []byte) ([]VocabImpo
 		return nil, fmt.Errorf("failed to detect column mapping: %w", err)
 	}
 
-	// Parse all data rows using the mapping
-	var items []VocabImportItem
-	for i := dataStartIndex; i < len(allRecords); i++ {
-		record := allRecords[i]
+	return &csvAnalysis{
+		records:      allRecords[dataStartIndex:],
+		mapping:      mapping,
+		languageCode: analysisResult.LanguageCode,
+	}, nil
+}
 
-		// Skip empty rows
-		if len(record) == 0 || (len(record) == 1 && record[0] == "") {
+// detectRecordsLanguage guesses the language of a file from the first term, for files mapped without the AI
+func detectRecordsLanguage(records [][]string, mapping *ColumnMapping) string {
+	for _, record := range records {
+		if mapping.TermIndex < len(record) && strings.TrimSpace(record[mapping.TermIndex]) != "" {
+			return DetectLanguageFromString(record[mapping.TermIndex])
+		}
+	}
+	return ""
+}
+
+// extractItems parses data rows using the mapping, skipping empty rows and rows without a term
+func (h *Handler) extractItems(records [][]string, mapping *ColumnMapping) []VocabImportItem {
+	var items []VocabImportItem
+	for _, record := range records {
+		if isBlankRecord(record) {
 			continue
 		}
 
@@ -263,30 +625,41 @@ func (h *Handler) parseCSVFile(ctx context.Context, content []byte) ([]VocabImpo
 		}
 	}
 
-	return items, nil
+	return items
 }
 
-// parseTxtFile parses plain text file (one term per line)
-func (h *Handler) parseTxtFile(_ context.Context, content []byte) ([]VocabImportItem, error) {
-	lines := strings.Split(string(content), "\n")
-	var items []VocabImportItem
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
+// analyzeWordList reads a plain text file with one term per line, mapping each line to the term
+func analyzeWordList(content []byte) (*csvAnalysis, error) {
+	var records [][]string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			records = append(records, []string{line})
 		}
+	}
 
-		// Detect language
-		lang := DetectLanguageFromString(line)
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no data found in text file")
+	}
 
-		items = append(items, VocabImportItem{
-			Term:         line,
-			LanguageCode: lang,
-		})
+	mapping := &ColumnMapping{
+		TermIndex:                     0,
+		TranscriptionIndex:            -1,
+		TermWithTranscriptionIndex:    -1,
+		MeaningEnIndex:                -1,
+		MeaningRuIndex:                -1,
+		ExampleNativeIndex:            -1,
+		ExampleEnIndex:                -1,
+		ExampleRuIndex:                -1,
+		ExampleWithTranscriptionIndex: -1,
+		FrequencyIndex:                -1,
 	}
 
-	return items, nil
+	return &csvAnalysis{
+		records:      records,
+		mapping:      mapping,
+		languageCode: detectRecordsLanguage(records, mapping),
+		wordList:     true,
+	}, nil
 }
 
 func (h *Handler) detectColumnMapping(analysisResult ai.CSVToJSONFields) (*ColumnMapping, error) {
@@ -353,39 +726,39 @@ func (h *Handler) extractItemFromRecord(record []string, mapping *ColumnMapping)
 	item := VocabImportItem{}
 
 	if mapping.TermIndex >= 0 && mapping.TermIndex < len(record) {
-		item.Term = strings.TrimSpace(record[mapping.TermIndex])
+		item.Term = utils.StripHTML(record[mapping.TermIndex])
 	}
 
 	if mapping.TranscriptionIndex >= 0 && mapping.TranscriptionIndex < len(record) {
-		item.Transcription = strings.TrimSpace(record[mapping.TranscriptionIndex])
+		item.Transcription = utils.StripHTML(record[mapping.TranscriptionIndex])
 	}
 
 	if mapping.TermWithTranscriptionIndex >= 0 && mapping.TermWithTranscriptionIndex < len(record) {
-		item.TermWithTranscription = strings.TrimSpace(record[mapping.TermWithTranscriptionIndex])
+		item.TermWithTranscription = utils.StripHTML(record[mapping.TermWithTranscriptionIndex])
 	}
 
 	if mapping.MeaningEnIndex >= 0 && mapping.MeaningEnIndex < len(record) {
-		item.MeaningEn = strings.TrimSpace(record[mapping.MeaningEnIndex])
+		item.MeaningEn = utils.StripHTML(record[mapping.MeaningEnIndex])
 	}
 
 	if mapping.MeaningRuIndex >= 0 && mapping.MeaningRuIndex < len(record) {
-		item.MeaningRu = strings.TrimSpace(record[mapping.MeaningRuIndex])
+		item.MeaningRu = utils.StripHTML(record[mapping.MeaningRuIndex])
 	}
 
 	if mapping.ExampleNativeIndex >= 0 && mapping.ExampleNativeIndex < len(record) {
-		item.ExampleNative = strings.TrimSpace(record[mapping.ExampleNativeIndex])
+		item.ExampleNative = utils.StripHTML(record[mapping.ExampleNativeIndex])
 	}
 
 	if mapping.ExampleEnIndex >= 0 && mapping.ExampleEnIndex < len(record) {
-		item.ExampleEn = strings.TrimSpace(record[mapping.ExampleEnIndex])
+		item.ExampleEn = utils.StripHTML(record[mapping.ExampleEnIndex])
 	}
 
 	if mapping.ExampleRuIndex >= 0 && mapping.ExampleRuIndex < len(record) {
-		item.ExampleRu = strings.TrimSpace(record[mapping.ExampleRuIndex])
+		item.ExampleRu = utils.StripHTML(record[mapping.ExampleRuIndex])
 	}
 
 	if mapping.ExampleWithTranscriptionIndex >= 0 && mapping.ExampleWithTranscriptionIndex < len(record) {
-		item.ExampleWithTranscription = strings.TrimSpace(record[mapping.ExampleWithTranscriptionIndex])
+		item.ExampleWithTranscription = utils.StripHTML(record[mapping.ExampleWithTranscriptionIndex])
 	}
 
 	if mapping.FrequencyIndex >= 0 && mapping.FrequencyIndex < len(record) {
@@ -394,9 +767,25 @@ func (h *Handler) extractItemFromRecord(record []string, mapping *ColumnMapping)
 		}
 	}
 
+	item.MeaningEn, item.MeaningRu = routeTranslation(item.MeaningEn, item.MeaningRu)
+	item.ExampleEn, item.ExampleRu = routeTranslation(item.ExampleEn, item.ExampleRu)
+
 	return item
 }
 
+// routeTranslation fixes up files with a single translation column in an unknown language: when only
+// one of the English and Russian fields is filled, the text moves to the field matching its script
+func routeTranslation(en, ru string) (string, string) {
+	switch {
+	case en != "" && ru == "" && utils.DetectTranslationLanguage(en) == "ru":
+		return "", en
+	case ru != "" && en == "" && utils.DetectTranslationLanguage(ru) == "en":
+		return ru, ""
+	default:
+		return en, ru
+	}
+}
+
 // downloadTelegramFile downloads a file from Telegram
 func (h *Handler) downloadTelegramFile(fileID string) ([]byte, error) {
 	// Get file info from Telegram
@@ -447,7 +836,8 @@ func (h *Handler) downloadTelegramFile(fileID string) ([]byte, error) {
 
 // Helper functions for sending notifications
 
-func (h *Handler) updateImportStatus(chatID int64, messageID int, status string) {
+// updateStatusMessage edits a progress message the bot sent earlier, e.g. during imports or card generation
+func (h *Handler) updateStatusMessage(chatID int64, messageID int, status string) {
 	editMsg := &telegram.EditMessageTextParams{
 		ChatID:    chatID,
 		MessageID: messageID,
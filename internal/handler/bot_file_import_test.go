@@ -0,0 +1,372 @@
+package handler
+
+import (
+	"atamagaii/internal/ai"
+	"atamagaii/internal/contract"
+	"atamagaii/internal/db"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportVocabItems_CountsMatchCards(t *testing.T) {
+	storage, err := db.ConnectDB(filepath.Join(t.TempDir(), "import.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = storage.Close() })
+
+	user := &db.User{ID: "import-user", TelegramID: 42, LanguageCode: "ru"}
+	require.NoError(t, storage.SaveUser(user))
+
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	h := &Handler{db: storage}
+	items := []VocabImportItem{
+		{Term: "แมว", MeaningEn: "cat"},
+		{Term: "หมา", MeaningEn: "dog"},
+		{Term: "კატა", MeaningEn: "cat"},
+		{Term: "  ", MeaningEn: "no term"},
+	}
+
+	var progress []int
+	result := h.importVocabItems(context.Background(), user.ID, "words.csv", items, func(imported int) {
+		progress = append(progress, imported)
+	})
+
+	require.Equal(t, 4, result.Parsed)
+	require.Equal(t, 1, result.Skipped)
+	require.Equal(t, 3, result.Imported)
+	require.Equal(t, 0, result.Failed)
+	require.Equal(t, result.Parsed, result.Skipped+result.Imported+result.Failed)
+	require.Len(t, result.DeckIDs, 2)
+	require.Equal(t, result.Imported, progress[len(progress)-1])
+
+	stored := 0
+	for _, deckID := range result.DeckIDs {
+		cards, err := storage.GetCardsByDeckID(deckID, user.ID)
+		require.NoError(t, err)
+		stored += len(cards)
+	}
+	require.Equal(t, result.Imported, stored, "Reported count should match the cards actually saved")
+
+	logged := 0
+	scanner := bufio.NewScanner(&logs)
+	for scanner.Scan() {
+		var entry struct {
+			Msg    string `json:"msg"`
+			UserID string `json:"user_id"`
+			Deck   string `json:"deck"`
+			Cards  int    `json:"cards"`
+		}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		if entry.Msg == "file import cards added" {
+			require.Equal(t, user.ID, entry.UserID)
+			require.NotEmpty(t, entry.Deck)
+			logged += entry.Cards
+		}
+	}
+	require.Equal(t, result.Imported, logged, "Logged card counts should add up to the imported total")
+}
+
+func TestImportVocabItems_RecordsDeckSource(t *testing.T) {
+	storage, err := db.ConnectDB(filepath.Join(t.TempDir(), "source.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = storage.Close() })
+
+	user := &db.User{ID: "source-user", TelegramID: 44, LanguageCode: "ru"}
+	require.NoError(t, storage.SaveUser(user))
+
+	// Anki decks reach the bot as text exports
+	h := &Handler{db: storage}
+	result := h.importVocabItems(context.Background(), user.ID, "Thai Basics.txt", []VocabImportItem{
+		{Term: "แมว", MeaningEn: "cat"},
+		{Term: "หมา", MeaningEn: "dog"},
+	}, nil)
+	require.Len(t, result.DeckIDs, 1)
+
+	source, err := storage.GetDeckSource(result.DeckIDs[0])
+	require.NoError(t, err)
+	require.NotNil(t, source)
+	require.Equal(t, db.DeckSourceCSV, source.Type)
+	require.Equal(t, "Thai Basics.txt", source.FileName)
+	require.Equal(t, "th", source.LanguageCode)
+	require.NotNil(t, source.ImportedAt)
+}
+
+// csvColumnsAI maps the first column to the term and the second to the English meaning
+type csvColumnsAI struct {
+	ai.AIClient
+	sample string
+}
+
+func (c *csvColumnsAI) ParseCSVFields(_ context.Context, line string) (ai.CSVToJSONFields, error) {
+	c.sample = line
+
+	var fields ai.CSVToJSONFields
+	fields.Term.Value, fields.Term.ColumnIndex = "term", 0
+	fields.MeaningEn.Value, fields.MeaningEn.ColumnIndex = "meaning", 1
+	fields.LanguageCode = "jp"
+	return fields, nil
+}
+
+func TestParseCSVFile_SkipsMetadataAndBlankLines(t *testing.T) {
+	content := "#separator:tab\n" +
+		"#html:false\n" +
+		"\n" +
+		"Welcome to your exported deck\n" +
+		"   \n" +
+		"猫\tcat\n" +
+		"\n" +
+		"犬\tdog\n" +
+		"\t\n" +
+		"鳥\tbird\n"
+
+	aiClient := &csvColumnsAI{}
+	h := &Handler{aiClient: aiClient}
+
+	items, err := h.parseImportFile(context.Background(), "words.tsv", []byte(content))
+	require.NoError(t, err)
+	require.NotContains(t, aiClient.sample, "#", "Metadata should not be sampled for column detection")
+
+	terms := make([]string, len(items))
+	for i, item := range items {
+		terms[i] = item.Term
+	}
+	require.Equal(t, []string{"猫", "犬", "鳥"}, terms)
+	require.Equal(t, "cat", items[0].MeaningEn)
+}
+
+func TestParseCSVFile_HeaderAliases(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{
+			name:    "anki field names",
+			content: "Expression\tReading\tMeaning\tSentence\n食べる\tたべる\tto eat\t<b>パンを食べる</b>\n飲む\tのむ\tto drink\t\n",
+		},
+		{
+			name:    "columns metadata line",
+			content: "#separator:tab\n#columns:Expression\tReading\tMeaning\tSentence\n食べる\tたべる\tto eat\tパンを食べる\n飲む\tのむ\tto drink\t\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No AI client: a named header must be mapped without column detection
+			h := &Handler{}
+
+			items, err := h.parseImportFile(context.Background(), "words.tsv", []byte(tt.content))
+			require.NoError(t, err)
+			require.Len(t, items, 2)
+
+			require.Equal(t, "食べる", items[0].Term)
+			require.Equal(t, "たべる", items[0].Transcription)
+			require.Equal(t, "to eat", items[0].MeaningEn)
+			require.Equal(t, "パンを食べる", items[0].ExampleNative)
+			require.Equal(t, "飲む", items[1].Term)
+		})
+	}
+}
+
+func TestHeaderColumnMapping(t *testing.T) {
+	mapping, ok := headerColumnMapping([]string{"Word", "Sentence-Meaning", "Notes", "word furigana", "meaning_ru"})
+	require.True(t, ok)
+	require.Equal(t, 0, mapping.TermIndex)
+	require.Equal(t, 1, mapping.ExampleEnIndex)
+	require.Equal(t, 3, mapping.TermWithTranscriptionIndex)
+	require.Equal(t, 4, mapping.MeaningRuIndex)
+	require.Equal(t, -1, mapping.TranscriptionIndex)
+
+	_, ok = headerColumnMapping([]string{"猫", "cat"})
+	require.False(t, ok, "Data rows should not be taken for a header")
+
+	_, ok = headerColumnMapping([]string{"Reading", "Meaning"})
+	require.False(t, ok, "A header without a term column should fall back to detection")
+}
+
+func TestCSVDataStart(t *testing.T) {
+	tests := []struct {
+		name    string
+		records [][]string
+		want    int
+	}{
+		{name: "data right away", records: [][]string{{"猫", "cat"}}, want: 0},
+		{name: "comments and welcome", records: [][]string{{"#deck:N5"}, {"Welcome", "x"}, {"猫", "cat"}}, want: 2},
+		{name: "empty records", records: [][]string{{}, {""}, {" ", ""}, {"猫", "cat"}}, want: 3},
+		{name: "only metadata", records: [][]string{{"#notetype:Basic"}, {}}, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, csvDataStart(tt.records))
+		})
+	}
+}
+
+func TestExtractItemFromRecord_RoutesTranslationByScript(t *testing.T) {
+	// files often carry one "sentence meaning" column, which column detection labels English
+	mapping := &ColumnMapping{
+		TermIndex:                     0,
+		TranscriptionIndex:            -1,
+		TermWithTranscriptionIndex:    -1,
+		MeaningEnIndex:                1,
+		MeaningRuIndex:                -1,
+		ExampleNativeIndex:            2,
+		ExampleEnIndex:                3,
+		ExampleRuIndex:                -1,
+		ExampleWithTranscriptionIndex: -1,
+		FrequencyIndex:                -1,
+	}
+
+	h := &Handler{}
+
+	russian := h.extractItemFromRecord([]string{"猫", "кошка", "猫が寝ている。", "Кошка спит."}, mapping)
+	require.Equal(t, "кошка", russian.MeaningRu)
+	require.Empty(t, russian.MeaningEn)
+	require.Equal(t, "Кошка спит.", russian.ExampleRu)
+	require.Empty(t, russian.ExampleEn)
+
+	english := h.extractItemFromRecord([]string{"猫", "cat", "猫が寝ている。", "The cat is sleeping."}, mapping)
+	require.Equal(t, "cat", english.MeaningEn)
+	require.Equal(t, "The cat is sleeping.", english.ExampleEn)
+	require.Empty(t, english.ExampleRu)
+}
+
+func TestHandleUpdate_RejectsDocumentBeforeDownload(t *testing.T) {
+	storage, err := db.ConnectDB(filepath.Join(t.TempDir(), "documents.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = storage.Close() })
+
+	// No bot is set up, so announcing or downloading the file would panic
+	h := &Handler{db: storage}
+
+	send := func(document *tgbotapi.Document) string {
+		msg := h.handleUpdate(tgbotapi.Update{Message: &tgbotapi.Message{
+			From:     &tgbotapi.User{ID: 42, FirstName: "Uploader"},
+			Document: document,
+		}})
+		require.NotNil(t, msg)
+		return msg.Text
+	}
+
+	text := send(&tgbotapi.Document{FileID: "pdf", FileName: "words.pdf", MimeType: "application/pdf", FileSize: 1024})
+	require.Contains(t, text, "Неподдерживаемый формат")
+
+	text = send(&tgbotapi.Document{FileID: "fake", FileName: "words.csv", MimeType: "application/pdf", FileSize: 1024})
+	require.Contains(t, text, "Неподдерживаемый формат", "The MIME type should be checked along with the name")
+
+	text = send(&tgbotapi.Document{FileID: "big", FileName: "words.csv", MimeType: "text/csv", FileSize: MaxImportFileSize + 1})
+	require.Contains(t, text, "слишком большой")
+}
+
+func TestExportDeckTSV_ImportRoundTrip(t *testing.T) {
+	storage, err := db.ConnectDB(filepath.Join(t.TempDir(), "export.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = storage.Close() })
+
+	user := &db.User{ID: "export-user", TelegramID: 43, LanguageCode: "en"}
+	require.NoError(t, storage.SaveUser(user))
+	deck, err := storage.CreateDeck(user.ID, db.CreateDeckParams{Name: "Export Me", LanguageCode: "jp", TranscriptionType: "furigana"})
+	require.NoError(t, err)
+
+	// Empty columns in the middle of a row must not shift the fields after them
+	exported := []VocabImportItem{
+		{Term: "猫", MeaningEn: "cat", ExampleNative: "猫が寝ている。", Frequency: 120},
+		{Term: "犬", Transcription: "いぬ", MeaningRu: "собака", ExampleEn: "The dog barks.\nLoudly."},
+		{Term: "鳥", MeaningEn: `"bird" tab	inside`, ExampleWithTranscription: "鳥[とり]が飛ぶ"},
+	}
+	for _, item := range exported {
+		fields, err := json.Marshal(contract.CardFields{
+			Term:                     item.Term,
+			Transcription:            item.Transcription,
+			MeaningEn:                item.MeaningEn,
+			MeaningRu:                item.MeaningRu,
+			ExampleNative:            item.ExampleNative,
+			ExampleEn:                item.ExampleEn,
+			ExampleWithTranscription: item.ExampleWithTranscription,
+			Frequency:                item.Frequency,
+		})
+		require.NoError(t, err)
+		_, err = storage.AddCard(user.ID, deck.ID, string(fields))
+		require.NoError(t, err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/decks/"+deck.ID+"/export.tsv", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(deck.ID)
+	c.Set("user", &jwt.Token{Claims: &contract.JWTClaims{UID: user.ID}})
+
+	// No AI client: the export's #columns line maps the columns
+	h := &Handler{db: storage}
+	require.NoError(t, h.ExportDeckTSV(c))
+
+	imported, err := h.parseImportFile(context.Background(), "deck_"+deck.ID+".tsv", rec.Body.Bytes())
+	require.NoError(t, err)
+
+	// The import collapses whitespace inside a field, as it does for Anki's HTML line breaks
+	exported[1].ExampleEn = "The dog barks. Loudly."
+	exported[2].MeaningEn = `"bird" tab inside`
+	require.Equal(t, exported, imported)
+}
+
+// readingsAI records the terms it was asked to transcribe
+type readingsAI struct {
+	ai.AIClient
+	terms []string
+}
+
+func (r *readingsAI) GenerateTranscription(_ context.Context, term, example, _ string) (*ai.TranscriptionResult, error) {
+	r.terms = append(r.terms, term)
+	return &ai.TranscriptionResult{TermWithTranscription: term + "[reading]", ExampleWithTranscription: example}, nil
+}
+
+func TestImportVocabItems_FillsReadingsOfImportedCardsOnly(t *testing.T) {
+	storage, err := db.ConnectDB(filepath.Join(t.TempDir(), "readings.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = storage.Close() })
+
+	user := &db.User{ID: "readings-user", TelegramID: 45, LanguageCode: "ru"}
+	require.NoError(t, storage.SaveUser(user))
+
+	deck, err := storage.GetOrCreateGeneratedDeck(user.ID, "jp", "furigana")
+	require.NoError(t, err)
+	require.NoError(t, storage.AddCardsInBatch(user.ID, deck.ID, []string{`{"term":"犬","meaning_en":"dog","language_code":"jp"}`}, db.DefaultCardBatchSize))
+
+	aiClient := &readingsAI{}
+	h := &Handler{db: storage, aiClient: aiClient}
+	result := h.importVocabItems(context.Background(), user.ID, "words.csv", []VocabImportItem{
+		{Term: "猫", MeaningEn: "cat", LanguageCode: "jp"},
+		{Term: "鳥", MeaningEn: "bird", LanguageCode: "jp"},
+	}, nil)
+	require.Equal(t, 2, result.Imported)
+	require.Equal(t, []string{deck.ID}, result.DeckIDs)
+
+	require.ElementsMatch(t, []string{"猫", "鳥"}, aiClient.terms, "Only the imported cards should be transcribed")
+
+	cards, err := storage.GetCardsByDeckID(deck.ID, user.ID)
+	require.NoError(t, err)
+	for _, card := range cards {
+		var fields contract.CardFields
+		require.NoError(t, json.Unmarshal([]byte(card.Fields), &fields))
+		if fields.Term == "犬" {
+			require.Empty(t, fields.TermWithTranscription, "Cards from before the import should be left alone")
+		} else {
+			require.Equal(t, fields.Term+"[reading]", fields.TermWithTranscription)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package handler
+
+import (
+	"atamagaii/internal/ai"
+	"atamagaii/internal/contract"
+	"atamagaii/internal/db"
+	"context"
+	"errors"
+	"fmt"
+	telegram "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGenerationFailedMessage_ReflectsReason(t *testing.T) {
+	h := &Handler{maxGenerationRetries: DefaultMaxGenerationRetries}
+
+	quotaErr := fmt.Errorf("failed to generate content: %w", fmt.Errorf("%w: 429", ai.ErrQuotaExceeded))
+	parseErr := fmt.Errorf("error generating card content: %w", fmt.Errorf("%w: unexpected end of JSON input", ai.ErrInvalidResponse))
+
+	quotaMsg := h.generationFailedMessage(1, "猫", "card1", 0, quotaErr)
+	parseMsg := h.generationFailedMessage(1, "猫", "card1", 0, parseErr)
+
+	require.NotEqual(t, quotaMsg.Text, parseMsg.Text, "Quota and parse failures should be explained differently")
+	require.Contains(t, quotaMsg.Text, "лимит запросов")
+	require.Contains(t, parseMsg.Text, "формате")
+
+	for _, msg := range []string{quotaMsg.Text, parseMsg.Text} {
+		require.True(t, strings.Contains(msg, "猫"), "Message should mention the term")
+	}
+
+	markup, ok := quotaMsg.ReplyMarkup.(models.InlineKeyboardMarkup)
+	require.True(t, ok, "Retryable failure should offer a retry button")
+	require.Equal(t, generationRetryPrefix+"card1:1", markup.InlineKeyboard[0][0].CallbackData)
+}
+
+func TestGenerationFailedMessage_RetryLimit(t *testing.T) {
+	h := &Handler{maxGenerationRetries: 2}
+	genErr := errors.New("boom")
+
+	msg := h.generationFailedMessage(1, "猫", "card1", 1, genErr)
+	require.Contains(t, msg.Text, "Осталось попыток: 1 из 2")
+	require.NotNil(t, msg.ReplyMarkup)
+
+	msg = h.generationFailedMessage(1, "猫", "card1", 2, genErr)
+	require.Nil(t, msg.ReplyMarkup, "No retry button once the limit is reached")
+
+	langErr := fmt.Errorf("%w: xx", ai.ErrUnsupportedLanguage)
+	msg = h.generationFailedMessage(1, "猫", "card1", 0, langErr)
+	require.Nil(t, msg.ReplyMarkup, "Retrying an unsupported language can't help")
+}
+
+func TestParseGenerationRetryData(t *testing.T) {
+	cardID, attempt, ok := parseGenerationRetryData(generationRetryPrefix + "abc_-123:2")
+	require.True(t, ok)
+	require.Equal(t, "abc_-123", cardID)
+	require.Equal(t, 2, attempt)
+
+	for _, data := range []string{"", "other:abc:1", generationRetryPrefix + "abc", generationRetryPrefix + ":1", generationRetryPrefix + "abc:0"} {
+		_, _, ok := parseGenerationRetryData(data)
+		require.False(t, ok, "Expected %q to be rejected", data)
+	}
+}
+
+func TestHandleWebhook_VerifiesSecret(t *testing.T) {
+	h := &Handler{webhookSecret: "webhook-secret"}
+	e := echo.New()
+
+	post := func(secret string) int {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(`{"update_id":1}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if secret != "" {
+			req.Header.Set(webhookSecretHeader, secret)
+		}
+		rec := httptest.NewRecorder()
+		require.NoError(t, h.HandleWebhook(e.NewContext(req, rec)))
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusForbidden, post(""), "Updates without the secret should be rejected")
+	require.Equal(t, http.StatusForbidden, post("wrong-secret"))
+	require.Equal(t, http.StatusOK, post("webhook-secret"))
+}
+
+// fakeTelegram answers Bot API calls with a generic success and records the texts the bot sent or edited
+type fakeTelegram struct {
+	mu    sync.Mutex
+	texts []string
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseMultipartForm(1 << 20)
+
+	f.mu.Lock()
+	if text := r.FormValue("text"); text != "" {
+		f.texts = append(f.texts, text)
+	}
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if path.Base(r.URL.Path) == "deleteMessage" {
+		_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+		return
+	}
+	_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"date":0,"chat":{"id":1,"type":"private"}}}`))
+}
+
+func (f *fakeTelegram) Texts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.texts...)
+}
+
+// slowCardAI takes a while per generation, tracks how many run at once and always fails for failTerm
+type slowCardAI struct {
+	ai.AIClient
+	failTerm     string
+	inFlight     atomic.Int32
+	maxInFlight  atomic.Int32
+	failAttempts atomic.Int32
+}
+
+func (f *slowCardAI) GenerateCardContent(_ context.Context, term string, _ string, _ ai.CardGenerationOptions) (*contract.CardFields, error) {
+	current := f.inFlight.Add(1)
+	defer f.inFlight.Add(-1)
+	for {
+		seen := f.maxInFlight.Load()
+		if current <= seen || f.maxInFlight.CompareAndSwap(seen, current) {
+			break
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if term == f.failTerm {
+		f.failAttempts.Add(1)
+		return nil, fmt.Errorf("%w: unexpected end of JSON input", ai.ErrInvalidResponse)
+	}
+	return &contract.CardFields{Term: term, MeaningRu: "перевод", ExampleNative: term + "です。"}, nil
+}
+
+func TestGenerateCardContentAsync_BoundedWithRetry(t *testing.T) {
+	storage, err := db.ConnectDB(filepath.Join(t.TempDir(), "bot.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = storage.Close() })
+
+	user := &db.User{ID: "bot-user", TelegramID: 42, LanguageCode: "ru"}
+	require.NoError(t, storage.SaveUser(user))
+
+	deck, err := storage.CreateDeck(user.ID, db.CreateDeckParams{Name: "Bot Deck", Level: "mixed", LanguageCode: "jp", TranscriptionType: "furigana"})
+	require.NoError(t, err)
+	deck.GenerateAudio = false
+	require.NoError(t, storage.UpdateDeckSettings(deck.ID, deck))
+
+	terms := []string{"猫", "犬", "鳥", "魚", "馬", "失敗"}
+	cardIDs := make([]string, len(terms))
+	for i, term := range terms {
+		card, err := storage.AddCard(user.ID, deck.ID, fmt.Sprintf(`{"term":%q}`, term))
+		require.NoError(t, err)
+		cardIDs[i] = card.ID
+	}
+
+	tg := &fakeTelegram{}
+	server := httptest.NewServer(tg)
+	t.Cleanup(server.Close)
+
+	bot, err := telegram.New("123:test", telegram.WithServerURL(server.URL), telegram.WithSkipGetMe())
+	require.NoError(t, err)
+
+	aiClient := &slowCardAI{failTerm: "失敗"}
+	h := &Handler{
+		bot:                  bot,
+		db:                   storage,
+		aiClient:             aiClient,
+		aiTimeout:            5 * time.Second,
+		maxGenerationRetries: DefaultMaxGenerationRetries,
+		botAutoRetries:       DefaultBotAutoRetries,
+		botRetryDelay:        10 * time.Millisecond,
+		botGenerations:       make(chan struct{}, 2),
+	}
+
+	var wg sync.WaitGroup
+	for i, cardID := range cardIDs {
+		wg.Add(1)
+		go func(messageID int, cardID string) {
+			defer wg.Done()
+			h.generateCardContentAsync(cardID, deck.ID, user.TelegramID, messageID, 0)
+		}(i+1, cardID)
+	}
+	wg.Wait()
+
+	require.LessOrEqual(t, aiClient.maxInFlight.Load(), int32(2), "Generations beyond the limit should wait for a slot")
+	require.Equal(t, int32(2), aiClient.failAttempts.Load(), "A failed generation should be retried exactly once")
+
+	var failed, succeeded int
+	for _, text := range tg.Texts() {
+		switch {
+		case strings.Contains(text, "Не удалось сгенерировать"):
+			failed++
+			require.Contains(t, text, "失敗")
+		case strings.Contains(text, "Карточка готова"):
+			succeeded++
+		}
+	}
+	require.Equal(t, 1, failed, "The final failure should be reported to the user")
+	require.Equal(t, len(terms)-1, succeeded)
+}
+
+// failingCardAI fails every generation with err and counts the attempts
+type failingCardAI struct {
+	ai.AIClient
+	err      error
+	attempts atomic.Int32
+}
+
+func (f *failingCardAI) GenerateCardContent(_ context.Context, _ string, _ string, _ ai.CardGenerationOptions) (*contract.CardFields, error) {
+	f.attempts.Add(1)
+	return nil, f.err
+}
+
+func TestGenerateCardContentAsync_AutomaticRetries(t *testing.T) {
+	storage, err := db.ConnectDB(filepath.Join(t.TempDir(), "bot.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = storage.Close() })
+
+	user := &db.User{ID: "bot-user", TelegramID: 42, LanguageCode: "ru"}
+	require.NoError(t, storage.SaveUser(user))
+
+	deck, err := storage.CreateDeck(user.ID, db.CreateDeckParams{Name: "Bot Deck", Level: "mixed", LanguageCode: "jp", TranscriptionType: "furigana"})
+	require.NoError(t, err)
+
+	card, err := storage.AddCard(user.ID, deck.ID, `{"term":"猫"}`)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(&fakeTelegram{})
+	t.Cleanup(server.Close)
+
+	bot, err := telegram.New("123:test", telegram.WithServerURL(server.URL), telegram.WithSkipGetMe())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		err      error
+		attempt  int
+		expected int32
+	}{
+		{name: "first attempt", err: ai.ErrInvalidResponse, attempt: 0, expected: 3},
+		{name: "retry pressed by the user", err: ai.ErrInvalidResponse, attempt: 1, expected: 1},
+		{name: "quota exhausted", err: ai.ErrQuotaExceeded, attempt: 0, expected: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aiClient := &failingCardAI{err: tt.err}
+			h := &Handler{
+				bot:                  bot,
+				db:                   storage,
+				aiClient:             aiClient,
+				aiTimeout:            5 * time.Second,
+				maxGenerationRetries: DefaultMaxGenerationRetries,
+				botAutoRetries:       2,
+				botRetryDelay:        time.Millisecond,
+				botGenerations:       make(chan struct{}, 1),
+			}
+
+			h.generateCardContentAsync(card.ID, deck.ID, user.TelegramID, 1, tt.attempt)
+			require.Equal(t, tt.expected, aiClient.attempts.Load())
+		})
+	}
+}
@@ -1,13 +1,19 @@
 package handler
 
 import (
+	"atamagaii/internal/ai"
 	"atamagaii/internal/contract"
 	"atamagaii/internal/db"
+	"atamagaii/internal/utils"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"regexp"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 )
@@ -43,6 +49,9 @@ func (h *Handler) GenerateCard(c echo.Context) error {
 
 	_, err = h.generateCardContent(c.Request().Context(), card)
 	if err != nil {
+		if errors.Is(err, ai.ErrQuotaExceeded) {
+			return newCodedError(http.StatusServiceUnavailable, contract.ErrorCodeAIUnavailable, "AI provider is busy, try again later").WithInternal(err)
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to generate card content").WithInternal(err)
 	}
 
@@ -51,7 +60,13 @@ func (h *Handler) GenerateCard(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch updated card").WithInternal(err)
 	}
 
-	response, err := formatCardResponse(*updatedCard)
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
+	}
+	displayLanguage := db.ResolveDisplayLanguage(user.Settings, user.LanguageCode)
+
+	response, err := formatCardResponse(*updatedCard, displayLanguage)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to format card response").WithInternal(err)
 	}
@@ -66,6 +81,10 @@ func (h *Handler) generateCardContent(ctx context.Context, card *db.Card) (*cont
 		return nil, fmt.Errorf("failed to get deck: %w", err)
 	}
 
+	if !utils.IsKnownLanguageCode(deck.LanguageCode) {
+		return nil, fmt.Errorf("%w: %s", ai.ErrUnsupportedLanguage, deck.LanguageCode)
+	}
+
 	// Parse card fields
 	var fields contract.CardFields
 	if err := json.Unmarshal([]byte(card.Fields), &fields); err != nil {
@@ -76,42 +95,69 @@ func (h *Handler) generateCardContent(ctx context.Context, card *db.Card) (*cont
 		return nil, fmt.Errorf("card has no term field")
 	}
 
+	user, err := h.db.GetUserByID(card.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	opts := ai.CardGenerationOptions{ExampleCount: deck.ExampleCount}
+	if user.Settings != nil {
+		opts.MeaningLanguages = user.Settings.MeaningLanguages
+
+		if user.Settings.KnownWordExamples {
+			knownWords, err := h.db.GetKnownWordsFromDeck(card.UserID, deck.ID, db.DefaultKnownWordsLimit, true)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get known words: %w", err)
+			}
+			opts.KnownWords = knownWords
+		}
+	}
+
+	var record *ai.GenerationRecord
+	if h.logGenerations {
+		record = &ai.GenerationRecord{}
+		ctx = ai.WithGenerationRecord(ctx, record)
+	}
+
 	// Generate content using AI
-	updatedFields, err := h.aiClient.GenerateCardContent(ctx, fields.Term, deck.LanguageCode)
+	updatedFields, err := h.aiClient.GenerateCardContent(ctx, fields.Term, deck.LanguageCode, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate content: %w", err)
 	}
+	h.saveGenerationLog(card, record)
 
-	updatedFields.LanguageCode = deck.LanguageCode
+	flagged, err := h.isFlaggedCardContent(ctx, updatedFields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to moderate content: %w", err)
+	}
+
+	if flagged {
+		log.Printf("Generated content for card %s was flagged, retrying with strict prompt", card.ID)
 
-	// Generate combined audio for word and example
-	if updatedFields.AudioExample == "" && updatedFields.ExampleNative != "" {
-		combinedAudioFileName := fmt.Sprintf("%s_combined.wav", card.ID)
-		combinedText := fmt.Sprintf("%s<break time=\"300ms\"/>%s", updatedFields.Term, updatedFields.ExampleNative)
-		tempFilePath, err := h.aiClient.GenerateAudio(ctx, combinedText, deck.LanguageCode)
+		opts.Strict = true
+		updatedFields, err = h.aiClient.GenerateCardContent(ctx, fields.Term, deck.LanguageCode, opts)
 		if err != nil {
-			fmt.Printf("Error generating combined audio: %v\n", err)
-		} else {
-			tempFile, err := os.Open(tempFilePath)
-			if err != nil {
-				fmt.Printf("Error opening temp file: %v\n", err)
-			} else {
-				defer tempFile.Close()
-				defer os.Remove(tempFilePath)
-
-				audioURL, err := h.storageProvider.UploadFile(
-					ctx,
-					tempFile,
-					combinedAudioFileName,
-					"audio/wav",
-				)
-				if err != nil {
-					fmt.Printf("Error uploading combined audio: %v\n", err)
-				} else {
-					updatedFields.AudioExample = audioURL
-				}
-			}
+			return nil, fmt.Errorf("failed to generate content: %w", err)
 		}
+		h.saveGenerationLog(card, record)
+
+		flagged, err = h.isFlaggedCardContent(ctx, updatedFields)
+		if err != nil {
+			return nil, fmt.Errorf("failed to moderate content: %w", err)
+		}
+
+		if flagged {
+			return nil, ai.ErrContentFlagged
+		}
+	}
+
+	updatedFields.LanguageCode = deck.LanguageCode
+	// the note belongs to the learner, keep it across regeneration
+	updatedFields.UserNote = fields.UserNote
+
+	// Generate audio for what the deck wants read out, unless the deck has audio turned off
+	if deck.GenerateAudio && needsCardAudio(updatedFields, deck.AudioContent) {
+		h.generateCardAudio(ctx, card.ID, updatedFields, deck.LanguageCode, deck.AudioContent)
 	}
 
 	// Update card with generated content
@@ -126,3 +172,443 @@ func (h *Handler) generateCardContent(ctx context.Context, card *db.Card) (*cont
 
 	return updatedFields, nil
 }
+
+// saveGenerationLog stores the prompt and response captured in record with secrets redacted. It does nothing
+// when generations aren't logged or the AI client recorded nothing; failures are only logged.
+func (h *Handler) saveGenerationLog(card *db.Card, record *ai.GenerationRecord) {
+	if record == nil || record.Prompt == "" {
+		return
+	}
+
+	if err := h.db.SaveGenerationLog(card.ID, card.UserID, h.redactSecrets(record.Prompt), h.redactSecrets(record.Response)); err != nil {
+		log.Printf("Failed to save generation log for card %s: %v", card.ID, err)
+	}
+}
+
+// apiKeyPattern matches Google API keys, which could end up in error text quoted back by the model
+var apiKeyPattern = regexp.MustCompile(`AIza[0-9A-Za-z_\-]{35}`)
+
+// redactSecrets masks the handler's own secrets and API keys in text that is stored for debugging
+func (h *Handler) redactSecrets(text string) string {
+	for _, secret := range []string{h.botToken, h.jwtSecret, h.webhookSecret} {
+		if secret != "" {
+			text = strings.ReplaceAll(text, secret, "[REDACTED]")
+		}
+	}
+	return apiKeyPattern.ReplaceAllString(text, "[REDACTED]")
+}
+
+// needsCardAudio reports whether fields have the text the deck's audio content reads out but no recording of it yet
+func needsCardAudio(fields *contract.CardFields, audioContent string) bool {
+	if audioContent == db.AudioContentTermOnly {
+		return fields.AudioWord == "" && fields.Term != ""
+	}
+
+	return fields.AudioExample == "" && fields.ExampleNative != ""
+}
+
+// audioBreak is the pause read between the parts of a card's audio
+const audioBreak = `<break time="300ms"/>`
+
+// exampleSentences returns the card's example sentences, all of them when the card has several
+func exampleSentences(fields *contract.CardFields) []string {
+	if len(fields.Examples) == 0 {
+		return []string{fields.ExampleNative}
+	}
+
+	sentences := make([]string, 0, len(fields.Examples))
+	for _, example := range fields.Examples {
+		if example.Native != "" {
+			sentences = append(sentences, example.Native)
+		}
+	}
+	return sentences
+}
+
+// generateCardAudio records the text picked by audioContent and stores its URL in the matching field:
+// the term alone goes to fields.AudioWord, the example or the term followed by the example to fields.AudioExample.
+// Failures are logged and leave the fields untouched, a card without audio is still usable.
+func (h *Handler) generateCardAudio(ctx context.Context, cardID string, fields *contract.CardFields, languageCode, audioContent string) {
+	var text, suffix string
+	switch audioContent {
+	case db.AudioContentTermOnly:
+		text, suffix = fields.Term, "term"
+	case db.AudioContentExampleOnly:
+		text, suffix = strings.Join(exampleSentences(fields), audioBreak), "example"
+	default:
+		text, suffix = strings.Join(append([]string{fields.Term}, exampleSentences(fields)...), audioBreak), "combined"
+	}
+
+	tempFilePath, err := h.aiClient.GenerateAudio(ctx, text, languageCode)
+	if err != nil {
+		fmt.Printf("Error generating %s audio: %v\n", suffix, err)
+		return
+	}
+
+	tempFile, err := os.Open(tempFilePath)
+	if err != nil {
+		fmt.Printf("Error opening temp file: %v\n", err)
+		return
+	}
+	defer tempFile.Close()
+	defer os.Remove(tempFilePath)
+
+	audioURL, err := h.storageProvider.UploadFile(
+		ctx,
+		tempFile,
+		fmt.Sprintf("%s_%s.wav", cardID, suffix),
+		"audio/wav",
+	)
+	if err != nil {
+		fmt.Printf("Error uploading %s audio: %v\n", suffix, err)
+		return
+	}
+
+	if audioContent == db.AudioContentTermOnly {
+		fields.AudioWord = audioURL
+	} else {
+		fields.AudioExample = audioURL
+	}
+}
+
+// startDeckAudioRegeneration runs regenerateDeckAudio in the background, replacing the deck's running
+// regeneration unless that one already covers it
+func (h *Handler) startDeckAudioRegeneration(deckID, userID, languageCode, audioContent string, missingOnly bool) {
+	ctx, done, ok := h.deckAudio.start(deckID, missingOnly)
+	if !ok {
+		return
+	}
+
+	go func() {
+		defer done()
+		h.regenerateDeckAudio(ctx, deckID, userID, languageCode, audioContent, missingOnly)
+	}()
+}
+
+// regenerateDeckAudio re-records the audio of every card in a deck, used after the deck language changes.
+// With missingOnly it keeps existing recordings and only records cards that have none.
+func (h *Handler) regenerateDeckAudio(ctx context.Context, deckID, userID, languageCode, audioContent string, missingOnly bool) {
+	cards, err := h.db.GetCardsByDeckID(deckID, userID)
+	if err != nil {
+		log.Printf("Error fetching cards for audio regeneration of deck %s: %v", deckID, err)
+		return
+	}
+
+	for _, card := range cards {
+		if ctx.Err() != nil {
+			log.Printf("Audio regeneration of deck %s stopped: %v", deckID, ctx.Err())
+			return
+		}
+
+		var fields contract.CardFields
+		if err := json.Unmarshal([]byte(card.Fields), &fields); err != nil {
+			log.Printf("Error parsing fields of card %s: %v", card.ID, err)
+			continue
+		}
+
+		fields.LanguageCode = languageCode
+		if !missingOnly {
+			if audioContent == db.AudioContentTermOnly {
+				fields.AudioWord = ""
+			} else {
+				fields.AudioExample = ""
+			}
+		}
+
+		if !needsCardAudio(&fields, audioContent) {
+			continue
+		}
+
+		h.generateCardAudio(ctx, card.ID, &fields, languageCode, audioContent)
+
+		fieldsJSON, err := json.Marshal(fields)
+		if err != nil {
+			log.Printf("Error serializing fields of card %s: %v", card.ID, err)
+			continue
+		}
+
+		if err := h.db.UpdateCardFields(card.ID, string(fieldsJSON)); err != nil {
+			log.Printf("Error updating card %s after audio regeneration: %v", card.ID, err)
+		}
+	}
+
+	log.Printf("Regenerated audio for %d cards in deck %s", len(cards), deckID)
+}
+
+// isFlaggedCardContent checks the example sentences, which is where inappropriate content usually shows up
+func (h *Handler) isFlaggedCardContent(ctx context.Context, fields *contract.CardFields) (bool, error) {
+	if h.moderator == nil {
+		return false, nil
+	}
+
+	texts := []string{fields.ExampleNative, fields.ExampleEn, fields.ExampleRu}
+	for _, example := range fields.Examples {
+		texts = append(texts, example.Native, example.En, example.Ru)
+	}
+
+	for _, text := range texts {
+		if text == "" {
+			continue
+		}
+
+		flagged, err := h.moderator.IsFlagged(ctx, text)
+		if err != nil {
+			return false, err
+		}
+
+		if flagged {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// transcriptionLanguages maps the transcription types the AI can fill in to the deck language they apply to
+var transcriptionLanguages = map[string]string{
+	"furigana": "jp",
+	"pinyin":   "zh",
+}
+
+// DefaultTranscriptionBatch caps how many cards a single generate-transcriptions request processes
+const DefaultTranscriptionBatch = 50
+
+func canGenerateTranscriptions(deck *db.Deck) bool {
+	language, ok := transcriptionLanguages[deck.TranscriptionType]
+	return ok && language == deck.LanguageCode
+}
+
+func needsTranscription(fields contract.CardFields) bool {
+	if fields.Term == "" {
+		return false
+	}
+	return fields.TermWithTranscription == "" || (fields.ExampleNative != "" && fields.ExampleWithTranscription == "")
+}
+
+// fillTranscriptions asks the AI for readings of cards that lack them, only filling empty fields.
+// Only the cards in cardIDs are considered, or every card of the deck when cardIDs is nil.
+// At most limit cards are processed (0 means all), remaining counts cards still missing transcription.
+func (h *Handler) fillTranscriptions(ctx context.Context, deck *db.Deck, cardIDs []string, limit int) (updated int, remaining int, err error) {
+	cards, err := h.db.GetCardsByDeckID(deck.ID, deck.UserID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get deck cards: %w", err)
+	}
+
+	if cardIDs != nil {
+		wanted := make(map[string]bool, len(cardIDs))
+		for _, id := range cardIDs {
+			wanted[id] = true
+		}
+
+		selected := cards[:0]
+		for _, card := range cards {
+			if wanted[card.ID] {
+				selected = append(selected, card)
+			}
+		}
+		cards = selected
+	}
+
+	for i, card := range cards {
+		var fields contract.CardFields
+		if err := json.Unmarshal([]byte(card.Fields), &fields); err != nil {
+			log.Printf("Error parsing fields of card %s: %v", card.ID, err)
+			continue
+		}
+
+		if !needsTranscription(fields) {
+			continue
+		}
+
+		if limit > 0 && updated >= limit {
+			remaining++
+			continue
+		}
+
+		result, err := h.aiClient.GenerateTranscription(ctx, fields.Term, fields.ExampleNative, deck.TranscriptionType)
+		if err != nil {
+			// count this card and everything after it as remaining, the caller can retry later
+			for _, rest := range cards[i:] {
+				var restFields contract.CardFields
+				if json.Unmarshal([]byte(rest.Fields), &restFields) == nil && needsTranscription(restFields) {
+					remaining++
+				}
+			}
+			return updated, remaining, fmt.Errorf("failed to generate transcription for card %s: %w", card.ID, err)
+		}
+
+		if fields.TermWithTranscription == "" {
+			fields.TermWithTranscription = result.TermWithTranscription
+		}
+		if fields.ExampleNative != "" && fields.ExampleWithTranscription == "" {
+			fields.ExampleWithTranscription = result.ExampleWithTranscription
+		}
+
+		fieldsJSON, err := json.Marshal(fields)
+		if err != nil {
+			return updated, remaining, fmt.Errorf("failed to serialize fields of card %s: %w", card.ID, err)
+		}
+
+		if err := h.db.UpdateCardFields(card.ID, string(fieldsJSON)); err != nil {
+			return updated, remaining, fmt.Errorf("failed to update card %s: %w", card.ID, err)
+		}
+
+		updated++
+	}
+
+	return updated, remaining, nil
+}
+
+// fillTranscriptionsAfterImport fills readings of the just imported cards, at most DefaultTranscriptionBatch of them
+// so an import stays short; the rest are left to generate-transcriptions. Decks without AI transcription are left alone.
+func (h *Handler) fillTranscriptionsAfterImport(ctx context.Context, deck *db.Deck, cardIDs []string) {
+	if !canGenerateTranscriptions(deck) || len(cardIDs) == 0 {
+		return
+	}
+
+	updated, remaining, err := h.fillTranscriptions(ctx, deck, cardIDs, DefaultTranscriptionBatch)
+	if err != nil {
+		log.Printf("Error generating transcriptions for deck %s: %v", deck.ID, err)
+	}
+
+	log.Printf("Generated transcriptions for %d cards in deck %s, %d left without", updated, deck.ID, remaining)
+}
+
+// GenerateDeckTranscriptions fills in missing readings (furigana, pinyin) for cards of a deck
+func (h *Handler) GenerateDeckTranscriptions(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	deckID := c.Param("id")
+	if deckID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Deck ID is required")
+	}
+
+	deck, err := h.db.GetDeck(deckID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck").WithInternal(err)
+	}
+
+	if deck.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+
+	if !canGenerateTranscriptions(deck) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Transcriptions can't be generated for this deck")
+	}
+
+	limit := parseIntQuery(c, "limit", DefaultTranscriptionBatch)
+	if limit == 0 {
+		limit = DefaultTranscriptionBatch
+	}
+
+	updated, remaining, err := h.fillTranscriptions(c.Request().Context(), deck, nil, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to generate transcriptions").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, contract.GenerateTranscriptionsResponse{
+		Updated:   updated,
+		Remaining: remaining,
+	})
+}
+
+// DefaultGenerationBatch caps how many cards a single generate-missing request generates
+const DefaultGenerationBatch = 20
+
+// needsContent reports whether the card has only its term, like cards created from bot messages
+func needsContent(fields contract.CardFields) bool {
+	return fields.Term != "" && fields.MeaningEn == "" && fields.MeaningRu == ""
+}
+
+// GenerateMissingContent generates content for the deck's cards that have only a term. A card that fails
+// doesn't stop the batch: every card's outcome is reported and recorded on the card, and failed_only=true
+// retries just the cards that failed before.
+func (h *Handler) GenerateMissingContent(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	deckID := c.Param("id")
+	if deckID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Deck ID is required")
+	}
+
+	deck, err := h.db.GetDeck(deckID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck").WithInternal(err)
+	}
+
+	if deck.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+
+	limit := parseIntQuery(c, "limit", DefaultGenerationBatch)
+	if limit == 0 {
+		limit = DefaultGenerationBatch
+	}
+
+	var failedBefore map[string]string
+	if c.QueryParam("failed_only") == "true" {
+		failedBefore, err = h.db.GetFailedGenerations(userID, deckID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch failed generations").WithInternal(err)
+		}
+	}
+
+	cards, err := h.db.GetCardsByDeckID(deckID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck cards").WithInternal(err)
+	}
+
+	ctx := c.Request().Context()
+	response := contract.GenerateMissingResponse{Results: []contract.CardGenerationResult{}}
+
+	for _, card := range cards {
+		var fields contract.CardFields
+		if err := json.Unmarshal([]byte(card.Fields), &fields); err != nil {
+			log.Printf("Error parsing fields of card %s: %v", card.ID, err)
+			continue
+		}
+
+		if !needsContent(fields) {
+			continue
+		}
+
+		if _, failed := failedBefore[card.ID]; failedBefore != nil && !failed {
+			continue
+		}
+
+		// cards past the batch or the request deadline are left for the next call
+		if len(response.Results) >= limit || ctx.Err() != nil {
+			response.Remaining++
+			continue
+		}
+
+		result := contract.CardGenerationResult{CardID: card.ID, Term: fields.Term, Status: db.GenerationStatusGenerated}
+		if _, err := h.generateCardContent(ctx, &card); err != nil {
+			result.Status = db.GenerationStatusFailed
+			result.Error = h.redactSecrets(err.Error())
+			response.Failed++
+		} else {
+			response.Generated++
+		}
+
+		if err := h.db.SetCardGenerationStatus(card.ID, result.Status, result.Error); err != nil {
+			log.Printf("Error recording generation status of card %s: %v", card.ID, err)
+		}
+
+		response.Results = append(response.Results, result)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
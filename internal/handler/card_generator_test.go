@@ -0,0 +1,555 @@
+package handler_test
+
+import (
+	"atamagaii/internal/ai"
+	"atamagaii/internal/contract"
+	"atamagaii/internal/db"
+	"atamagaii/internal/testutils"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func importTestDeck(t *testing.T, e *echo.Echo, token, name string) db.Deck {
+	body, _ := json.Marshal(map[string]any{
+		"name":      name,
+		"file_name": "japanese_n5.json",
+		"force":     true,
+	})
+
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), token, http.StatusCreated)
+	deck := testutils.ParseResponse[db.Deck](t, rec)
+	require.NotEmpty(t, deck.ID, "Failed to import test deck")
+	return deck
+}
+
+func firstDueCard(t *testing.T, e *echo.Echo, token, deckID string) contract.CardResponse {
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/due?deck_id="+deckID, "", token, http.StatusOK)
+	cards := testutils.ParseResponse[[]contract.CardResponse](t, rec)
+	require.NotEmpty(t, cards, "Expected at least one due card")
+	return cards[0]
+}
+
+func TestGenerateCard_RetriesFlaggedContent(t *testing.T) {
+	var strictCalls, totalCalls int
+	mockAI := &testutils.MockAIClient{
+		GenerateCardContentFunc: func(_ context.Context, term string, _ string, opts ai.CardGenerationOptions) (*contract.CardFields, error) {
+			totalCalls++
+			example := "This badword example."
+			if opts.Strict {
+				strictCalls++
+				example = "This is a clean example."
+			}
+			return &contract.CardFields{Term: term, MeaningEn: "meaning", ExampleNative: term, ExampleEn: example}, nil
+		},
+	}
+	moderator := &testutils.MockModerator{FlagWord: "badword"}
+
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{AIClient: mockAI, Moderator: moderator})
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Moderation Deck")
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+
+	body, _ := json.Marshal(map[string]string{"card_id": card.ID, "deck_id": deck.ID})
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/generate", string(body), resp.Token, http.StatusOK)
+
+	generated := testutils.ParseResponse[contract.CardResponse](t, rec)
+	require.Equal(t, 2, totalCalls, "Flagged content should trigger exactly one retry")
+	require.Equal(t, 1, strictCalls, "Retry should use the strict prompt")
+	require.Equal(t, "This is a clean example.", generated.Fields.ExampleEn)
+}
+
+func TestGenerateCard_RejectsContentFlaggedTwice(t *testing.T) {
+	totalCalls := 0
+	mockAI := &testutils.MockAIClient{
+		GenerateCardContentFunc: func(_ context.Context, term string, _ string, _ ai.CardGenerationOptions) (*contract.CardFields, error) {
+			totalCalls++
+			return &contract.CardFields{Term: term, ExampleEn: "Still a badword example."}, nil
+		},
+	}
+	moderator := &testutils.MockModerator{FlagWord: "badword"}
+
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{AIClient: mockAI, Moderator: moderator})
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Moderation Deck Rejected")
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+
+	body, _ := json.Marshal(map[string]string{"card_id": card.ID, "deck_id": deck.ID})
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/generate", string(body), resp.Token, http.StatusInternalServerError)
+
+	require.Equal(t, 2, totalCalls, "Generation should be retried once before rejecting")
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/"+card.ID, "", resp.Token, http.StatusOK)
+	stored := testutils.ParseResponse[contract.CardResponse](t, rec)
+	require.NotContains(t, stored.Fields.ExampleEn, "badword", "Flagged content must not be saved")
+}
+
+func TestGenerateCard_AIDeadlineExceeded(t *testing.T) {
+	mockAI := &testutils.MockAIClient{
+		GenerateCardContentFunc: func(ctx context.Context, term string, _ string, _ ai.CardGenerationOptions) (*contract.CardFields, error) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(2 * time.Second):
+				return &contract.CardFields{Term: term}, nil
+			}
+		},
+	}
+
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{AIClient: mockAI, AITimeout: 50 * time.Millisecond})
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Deadline Deck")
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+
+	body, _ := json.Marshal(map[string]string{"card_id": card.ID, "deck_id": deck.ID})
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/generate", string(body), resp.Token, http.StatusGatewayTimeout)
+}
+
+func TestGenerateCard_PreservesUserNote(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "User Note Deck")
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+
+	fields := card.Fields
+	fields.UserNote = "Looks like a cat sitting on a mat"
+	body, _ := json.Marshal(map[string]contract.CardFields{"fields": fields})
+	rec := testutils.PerformRequest(t, e, http.MethodPut, "/v1/cards/"+card.ID, string(body), resp.Token, http.StatusOK)
+	updated := testutils.ParseResponse[contract.CardResponse](t, rec)
+	require.Equal(t, fields.UserNote, updated.Fields.UserNote)
+
+	body, _ = json.Marshal(map[string]string{"card_id": card.ID, "deck_id": deck.ID})
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/generate", string(body), resp.Token, http.StatusOK)
+	generated := testutils.ParseResponse[contract.CardResponse](t, rec)
+	require.Equal(t, "This is an example.", generated.Fields.ExampleEn, "Generated fields should be applied")
+	require.Equal(t, fields.UserNote, generated.Fields.UserNote, "Regeneration must not overwrite the user note")
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/"+card.ID, "", resp.Token, http.StatusOK)
+	stored := testutils.ParseResponse[contract.CardResponse](t, rec)
+	require.Equal(t, fields.UserNote, stored.Fields.UserNote)
+}
+
+func TestGenerateCard_DeckAudioDisabled(t *testing.T) {
+	uploads := &testutils.MockStorageProvider{}
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{StorageProvider: uploads})
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Silent Deck")
+	require.True(t, deck.GenerateAudio, "Audio should be enabled by default")
+	require.False(t, deck.GenerateImages, "Images should be disabled by default")
+
+	settings, _ := json.Marshal(map[string]interface{}{
+		"name":              deck.Name,
+		"new_cards_per_day": deck.NewCardsPerDay,
+		"generate_audio":    false,
+	})
+	rec := testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(settings), resp.Token, http.StatusOK)
+	updated := testutils.ParseResponse[db.Deck](t, rec)
+	require.False(t, updated.GenerateAudio)
+
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+
+	body, _ := json.Marshal(map[string]string{"card_id": card.ID, "deck_id": deck.ID})
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/generate", string(body), resp.Token, http.StatusOK)
+	generated := testutils.ParseResponse[contract.CardResponse](t, rec)
+
+	require.Empty(t, generated.Fields.AudioExample)
+	require.Empty(t, uploads.Uploads(), "No media should be uploaded for an audio-disabled deck")
+
+	settings, _ = json.Marshal(map[string]interface{}{
+		"name":              deck.Name,
+		"new_cards_per_day": deck.NewCardsPerDay,
+		"generate_audio":    true,
+	})
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(settings), resp.Token, http.StatusOK)
+
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/generate", string(body), resp.Token, http.StatusOK)
+	generated = testutils.ParseResponse[contract.CardResponse](t, rec)
+
+	require.NotEmpty(t, generated.Fields.AudioExample)
+	require.Len(t, uploads.Uploads(), 1)
+}
+
+func TestGenerateCard_ExampleOnlyAudio(t *testing.T) {
+	var spoken []string
+	mockAI := &testutils.MockAIClient{
+		GenerateAudioFunc: func(ctx context.Context, text string, language string) (string, error) {
+			spoken = append(spoken, text)
+			f, err := os.CreateTemp("", "audio-*.wav")
+			if err != nil {
+				return "", err
+			}
+			defer f.Close()
+			return f.Name(), nil
+		},
+	}
+
+	uploads := &testutils.MockStorageProvider{}
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{AIClient: mockAI, StorageProvider: uploads})
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+17, "narrator", "Narrator")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Example Audio Deck")
+	require.Equal(t, db.AudioContentCombined, deck.AudioContent, "Combined audio should be the default")
+
+	settings, _ := json.Marshal(map[string]interface{}{
+		"name":              deck.Name,
+		"new_cards_per_day": deck.NewCardsPerDay,
+		"audio_content":     "spoken_word",
+	})
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(settings), resp.Token, http.StatusBadRequest)
+
+	settings, _ = json.Marshal(map[string]interface{}{
+		"name":              deck.Name,
+		"new_cards_per_day": deck.NewCardsPerDay,
+		"audio_content":     db.AudioContentExampleOnly,
+	})
+	rec := testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(settings), resp.Token, http.StatusOK)
+	updated := testutils.ParseResponse[db.Deck](t, rec)
+	require.Equal(t, db.AudioContentExampleOnly, updated.AudioContent)
+
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+
+	body, _ := json.Marshal(map[string]string{"card_id": card.ID, "deck_id": deck.ID})
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/generate", string(body), resp.Token, http.StatusOK)
+	generated := testutils.ParseResponse[contract.CardResponse](t, rec)
+
+	require.Equal(t, []string{generated.Fields.ExampleNative}, spoken, "Only the example sentence should be synthesized")
+	require.NotEmpty(t, generated.Fields.AudioExample)
+	require.Empty(t, generated.Fields.AudioWord)
+	require.Len(t, uploads.Uploads(), 1)
+}
+
+func TestGenerateCard_ExampleCount(t *testing.T) {
+	var spoken []string
+	mockAI := &testutils.MockAIClient{
+		GenerateAudioFunc: func(ctx context.Context, text string, language string) (string, error) {
+			spoken = append(spoken, text)
+			f, err := os.CreateTemp("", "audio-*.wav")
+			if err != nil {
+				return "", err
+			}
+			defer f.Close()
+			return f.Name(), nil
+		},
+	}
+
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{AIClient: mockAI})
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+33, "examples", "Examples")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Examples Deck")
+	require.Equal(t, db.DefaultExampleCount, deck.ExampleCount)
+
+	settings, _ := json.Marshal(map[string]interface{}{
+		"name":              deck.Name,
+		"new_cards_per_day": deck.NewCardsPerDay,
+		"example_count":     db.MaxExampleCount + 1,
+	})
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(settings), resp.Token, http.StatusBadRequest)
+
+	settings, _ = json.Marshal(map[string]interface{}{
+		"name":              deck.Name,
+		"new_cards_per_day": deck.NewCardsPerDay,
+		"example_count":     2,
+	})
+	rec := testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(settings), resp.Token, http.StatusOK)
+	updated := testutils.ParseResponse[db.Deck](t, rec)
+	require.Equal(t, 2, updated.ExampleCount)
+
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+
+	body, _ := json.Marshal(map[string]string{"card_id": card.ID, "deck_id": deck.ID})
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/generate", string(body), resp.Token, http.StatusOK)
+	generated := testutils.ParseResponse[contract.CardResponse](t, rec)
+
+	fields := generated.Fields
+	require.Len(t, fields.Examples, 2)
+	require.Equal(t, fields.Examples[0].Native, fields.ExampleNative, "The first example should fill the single example fields")
+
+	require.Len(t, spoken, 1)
+	require.Contains(t, spoken[0], fields.Examples[0].Native)
+	require.Contains(t, spoken[0], fields.Examples[1].Native, "Combined audio should read every example")
+}
+
+func TestGenerateCard_AudioFrontDeck(t *testing.T) {
+	uploads := &testutils.MockStorageProvider{}
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{StorageProvider: uploads})
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+34, "listener", "Listener")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Listening Deck")
+	require.Equal(t, db.ReviewModeText, deck.ReviewMode)
+
+	updateSettings := func(settings map[string]interface{}, status int) db.Deck {
+		settings["name"] = deck.Name
+		settings["new_cards_per_day"] = deck.NewCardsPerDay
+		body, _ := json.Marshal(settings)
+		rec := testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(body), resp.Token, status)
+		if status != http.StatusOK {
+			return db.Deck{}
+		}
+		return testutils.ParseResponse[db.Deck](t, rec)
+	}
+
+	updateSettings(map[string]interface{}{"review_mode": "listening"}, http.StatusBadRequest)
+	updateSettings(map[string]interface{}{"review_mode": db.ReviewModeAudioFront, "generate_audio": false}, http.StatusBadRequest)
+
+	updated := updateSettings(map[string]interface{}{"generate_audio": false}, http.StatusOK)
+	require.False(t, updated.GenerateAudio)
+
+	updated = updateSettings(map[string]interface{}{"review_mode": db.ReviewModeAudioFront}, http.StatusOK)
+	require.Equal(t, db.ReviewModeAudioFront, updated.ReviewMode)
+	require.True(t, updated.GenerateAudio, "Audio-first decks should always generate audio")
+
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+	require.Equal(t, db.ReviewModeAudioFront, card.ReviewMode)
+
+	body, _ := json.Marshal(map[string]string{"card_id": card.ID, "deck_id": deck.ID})
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/generate", string(body), resp.Token, http.StatusOK)
+	generated := testutils.ParseResponse[contract.CardResponse](t, rec)
+	require.NotEmpty(t, generated.Fields.AudioExample)
+	require.True(t, generated.HasAudio)
+
+	card = firstDueCard(t, e, resp.Token, deck.ID)
+	require.Equal(t, generated.ID, card.ID)
+	require.Equal(t, db.ReviewModeAudioFront, card.ReviewMode)
+	require.True(t, card.HasAudio)
+}
+
+func TestGenerateDeckTranscriptions(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	require.NoError(t, err)
+
+	storage := testutils.GetDBStorage()
+	fields := []string{
+		`{"term":"猫","meaning_en":"cat","example_native":"猫がいる。"}`,
+		`{"term":"犬","meaning_en":"dog"}`,
+		`{"term":"鳥","meaning_en":"bird","term_with_transcription":"鳥[とり]"}`,
+	}
+
+	furigana, err := storage.CreateDeck(resp.User.ID, db.CreateDeckParams{Name: "Furigana Deck", Level: "mixed", LanguageCode: "jp", TranscriptionType: "furigana"})
+	require.NoError(t, err)
+	require.NoError(t, storage.AddCardsInBatch(resp.User.ID, furigana.ID, fields, db.DefaultCardBatchSize))
+
+	plain, err := storage.CreateDeck(resp.User.ID, db.CreateDeckParams{Name: "Plain Deck", Level: "mixed", LanguageCode: "jp", TranscriptionType: "none"})
+	require.NoError(t, err)
+	require.NoError(t, storage.AddCardsInBatch(resp.User.ID, plain.ID, fields, db.DefaultCardBatchSize))
+
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/"+furigana.ID+"/generate-transcriptions?limit=1", "", resp.Token, http.StatusOK)
+	result := testutils.ParseResponse[contract.GenerateTranscriptionsResponse](t, rec)
+	require.Equal(t, 1, result.Updated)
+	require.Equal(t, 1, result.Remaining, "Cards that already have readings should not be counted")
+
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/"+furigana.ID+"/generate-transcriptions", "", resp.Token, http.StatusOK)
+	result = testutils.ParseResponse[contract.GenerateTranscriptionsResponse](t, rec)
+	require.Equal(t, 1, result.Updated)
+	require.Equal(t, 0, result.Remaining)
+
+	cards, err := storage.GetCardsByDeckID(furigana.ID, resp.User.ID)
+	require.NoError(t, err)
+	for _, card := range cards {
+		var f contract.CardFields
+		require.NoError(t, json.Unmarshal([]byte(card.Fields), &f))
+
+		switch f.Term {
+		case "猫":
+			require.Equal(t, "猫[reading]", f.TermWithTranscription)
+			require.Equal(t, "猫がいる。[reading]", f.ExampleWithTranscription)
+		case "犬":
+			require.Equal(t, "犬[reading]", f.TermWithTranscription)
+			require.Empty(t, f.ExampleWithTranscription, "No example means no example reading")
+		case "鳥":
+			require.Equal(t, "鳥[とり]", f.TermWithTranscription, "Existing readings must be kept")
+		}
+	}
+
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/"+plain.ID+"/generate-transcriptions", "", resp.Token, http.StatusBadRequest)
+
+	cards, err = storage.GetCardsByDeckID(plain.ID, resp.User.ID)
+	require.NoError(t, err)
+	for _, card := range cards {
+		var f contract.CardFields
+		require.NoError(t, json.Unmarshal([]byte(card.Fields), &f))
+		if f.Term != "鳥" {
+			require.Empty(t, f.TermWithTranscription, "Decks without transcription must be skipped")
+		}
+	}
+}
+
+func TestGenerateCard_UsesMeaningLanguagesSetting(t *testing.T) {
+	var requested [][]string
+	mockAI := &testutils.MockAIClient{
+		GenerateCardContentFunc: func(_ context.Context, term string, _ string, opts ai.CardGenerationOptions) (*contract.CardFields, error) {
+			requested = append(requested, opts.MeaningLanguages)
+			return &contract.CardFields{Term: term, MeaningRu: "значение", ExampleNative: term, ExampleRu: "Пример."}, nil
+		},
+	}
+
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{AIClient: mockAI})
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+7, "russian", "Russian")
+	require.NoError(t, err)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"settings": map[string][]string{"meaning_languages": {"de"}},
+	})
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", string(body), resp.Token, http.StatusBadRequest)
+
+	body, _ = json.Marshal(map[string]interface{}{
+		"settings": map[string][]string{"meaning_languages": {"ru"}},
+	})
+	rec := testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", string(body), resp.Token, http.StatusOK)
+	user := testutils.ParseResponse[db.User](t, rec)
+	require.Equal(t, []string{"ru"}, user.Settings.MeaningLanguages)
+
+	deck := importTestDeck(t, e, resp.Token, "Russian Meanings Deck")
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+
+	body, _ = json.Marshal(map[string]string{"card_id": card.ID, "deck_id": deck.ID})
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/generate", string(body), resp.Token, http.StatusOK)
+	generated := testutils.ParseResponse[contract.CardResponse](t, rec)
+
+	require.Equal(t, [][]string{{"ru"}}, requested)
+	require.Empty(t, generated.Fields.MeaningEn)
+	require.Equal(t, "значение", generated.Fields.MeaningRu)
+}
+
+func TestGenerateCard_LogsGeneration(t *testing.T) {
+	mockAI := &testutils.MockAIClient{
+		GenerateCardContentFunc: func(ctx context.Context, term string, _ string, _ ai.CardGenerationOptions) (*contract.CardFields, error) {
+			ai.RecordGeneration(ctx, "Word: "+term, `{"term":"`+term+`","note":"`+testutils.TestBotToken+`"}`)
+			return &contract.CardFields{Term: term, MeaningEn: "meaning", ExampleNative: term}, nil
+		},
+	}
+
+	adminTelegramID := int64(testutils.TelegramTestUserID + 29)
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{
+		AIClient:         mockAI,
+		AdminTelegramIDs: []int64{adminTelegramID},
+		LogGenerations:   true,
+	})
+
+	learner, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+30, "logged", "Logged")
+	require.NoError(t, err)
+
+	admin, err := testutils.AuthHelper(t, e, adminTelegramID, "debugger", "Debugger")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, learner.Token, "Generation Log Deck")
+	card := firstDueCard(t, e, learner.Token, deck.ID)
+
+	fields := card.Fields
+
+	body, _ := json.Marshal(map[string]string{"card_id": card.ID, "deck_id": deck.ID})
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/generate", string(body), learner.Token, http.StatusOK)
+
+	testutils.PerformRequest(t, e, http.MethodGet, "/v1/admin/cards/"+card.ID+"/generations", "", learner.Token, http.StatusForbidden)
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/admin/cards/"+card.ID+"/generations", "", admin.Token, http.StatusOK)
+	logs := testutils.ParseResponse[[]db.GenerationLog](t, rec)
+	require.Len(t, logs, 1)
+	require.Equal(t, card.ID, logs[0].CardID)
+	require.Equal(t, "Word: "+fields.Term, logs[0].Prompt)
+	require.Contains(t, logs[0].Response, `"term":"`+fields.Term+`"`)
+	require.NotContains(t, logs[0].Response, testutils.TestBotToken, "Secrets should be redacted")
+	require.Contains(t, logs[0].Response, "[REDACTED]")
+}
+
+func TestGenerateMissingContent_PartialFailure(t *testing.T) {
+	unsupported := true
+	mockAI := &testutils.MockAIClient{
+		GenerateCardContentFunc: func(_ context.Context, term string, _ string, _ ai.CardGenerationOptions) (*contract.CardFields, error) {
+			if unsupported && strings.HasPrefix(term, "失敗") {
+				return nil, errors.New("term not supported")
+			}
+			return &contract.CardFields{Term: term, MeaningEn: "meaning of " + term}, nil
+		},
+	}
+
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{AIClient: mockAI})
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+40, "batchgen", "Batch Gen")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Partial Generation Deck")
+	storage := testutils.GetDBStorage()
+
+	expected := map[string]string{}
+	for _, term := range []string{"成功一", "失敗一", "成功二", "失敗二"} {
+		fields, _ := json.Marshal(contract.CardFields{Term: term, LanguageCode: "jp"})
+		card, err := storage.AddCard(resp.User.ID, deck.ID, string(fields))
+		require.NoError(t, err)
+
+		expected[card.ID] = db.GenerationStatusGenerated
+		if strings.HasPrefix(term, "失敗") {
+			expected[card.ID] = db.GenerationStatusFailed
+		}
+	}
+
+	path := "/v1/decks/" + deck.ID + "/generate-missing"
+	rec := testutils.PerformRequest(t, e, http.MethodPost, path, "", resp.Token, http.StatusOK)
+	result := testutils.ParseResponse[contract.GenerateMissingResponse](t, rec)
+
+	require.Equal(t, 2, result.Generated)
+	require.Equal(t, 2, result.Failed)
+	require.Equal(t, 0, result.Remaining)
+	require.Len(t, result.Results, 4, "Only the cards without content should be generated")
+	for _, r := range result.Results {
+		require.Equal(t, expected[r.CardID], r.Status, "Unexpected outcome for %s", r.Term)
+		if r.Status == db.GenerationStatusFailed {
+			require.Contains(t, r.Error, "term not supported")
+		} else {
+			require.Empty(t, r.Error)
+		}
+	}
+
+	failed, err := storage.GetFailedGenerations(resp.User.ID, deck.ID)
+	require.NoError(t, err)
+	require.Len(t, failed, 2, "Failures should be recorded on the cards")
+	for cardID, reason := range failed {
+		require.Equal(t, db.GenerationStatusFailed, expected[cardID])
+		require.Contains(t, reason, "term not supported")
+	}
+
+	// A retry pass targets only the cards that failed
+	unsupported = false
+	rec = testutils.PerformRequest(t, e, http.MethodPost, path+"?failed_only=true", "", resp.Token, http.StatusOK)
+	retry := testutils.ParseResponse[contract.GenerateMissingResponse](t, rec)
+
+	require.Equal(t, 2, retry.Generated)
+	require.Equal(t, 0, retry.Failed)
+	for _, r := range retry.Results {
+		require.Equal(t, db.GenerationStatusFailed, expected[r.CardID], "Only failed cards should be retried")
+	}
+
+	failed, err = storage.GetFailedGenerations(resp.User.ID, deck.ID)
+	require.NoError(t, err)
+	require.Empty(t, failed)
+}
@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"context"
+	"sync"
+)
+
+// deckAudioJob is a running audio regeneration of a deck
+type deckAudioJob struct {
+	missingOnly bool
+	cancel      context.CancelFunc
+}
+
+// deckAudioJobs keeps at most one audio regeneration running per deck, so repeated settings saves
+// don't stack passes over the whole deck
+type deckAudioJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*deckAudioJob
+}
+
+func newDeckAudioJobs() *deckAudioJobs {
+	return &deckAudioJobs{jobs: make(map[string]*deckAudioJob)}
+}
+
+// start registers a regeneration of the deck and returns its context and the func to call when it is done.
+// A running regeneration that re-records every card already covers one for missing audio only, then ok is
+// false. Any other running regeneration is canceled in favour of the new one.
+func (j *deckAudioJobs) start(deckID string, missingOnly bool) (ctx context.Context, done func(), ok bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if running, exists := j.jobs[deckID]; exists {
+		if missingOnly && !running.missingOnly {
+			return nil, nil, false
+		}
+		running.cancel()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &deckAudioJob{missingOnly: missingOnly, cancel: cancel}
+	j.jobs[deckID] = job
+
+	done = func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+
+		cancel()
+		if j.jobs[deckID] == job {
+			delete(j.jobs, deckID)
+		}
+	}
+
+	return ctx, done, true
+}
+
+// stop cancels the deck's running regeneration, if any
+func (j *deckAudioJobs) stop(deckID string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if job, ok := j.jobs[deckID]; ok {
+		job.cancel()
+		delete(j.jobs, deckID)
+	}
+}
@@ -0,0 +1,28 @@
+package handler
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestDeckAudioJobs_OnePerDeck(t *testing.T) {
+	jobs := newDeckAudioJobs()
+
+	full, doneFull, ok := jobs.start("deck", false)
+	require.True(t, ok)
+
+	_, _, ok = jobs.start("deck", true)
+	require.False(t, ok, "Recording missing audio is covered by the running full pass")
+
+	again, doneAgain, ok := jobs.start("deck", false)
+	require.True(t, ok)
+	require.Error(t, full.Err(), "A new full pass should cancel the running one")
+
+	doneFull()
+	require.Contains(t, jobs.jobs, "deck", "The canceled pass should not unregister its replacement")
+
+	jobs.stop("deck")
+	require.Error(t, again.Err())
+	doneAgain()
+	require.Empty(t, jobs.jobs)
+}
@@ -1,14 +1,21 @@
 package handler
 
 import (
+	"atamagaii/internal/ai"
+	"atamagaii/internal/contract"
 	"atamagaii/internal/db"
 	"atamagaii/internal/utils"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
+	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 )
 
 // AvailableDecksResponse represents the structure of available decks grouped by language
@@ -25,9 +32,117 @@ type LanguageGroup struct {
 
 // DeckInfo represents information about an available deck for import
 type DeckInfo struct {
-	ID    string `json:"id"`
-	Name  string `json:"name"`
-	Level string `json:"level"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Level    string `json:"level"`
+	Imported bool   `json:"imported"` // The user already has a deck imported from this file
+}
+
+// CreateDeckFromFileResponse is the created deck along with how many file entries were left out
+type CreateDeckFromFileResponse struct {
+	db.Deck
+	SkippedItems  int  `json:"skipped_items"`            // Entries without a term or meaning that were not imported
+	FilteredItems int  `json:"filtered_items,omitempty"` // Entries left out by the frequency cutoff
+	AlreadyExists bool `json:"already_exists,omitempty"` // The user already had a deck from this file, nothing was imported
+}
+
+// ImportPreviewSize is how many mapped cards a dry-run import returns as a sample
+const ImportPreviewSize = 5
+
+// ImportPreviewResponse describes what an import would create without creating it
+type ImportPreviewResponse struct {
+	Name              string              `json:"name"`
+	Level             string              `json:"level"`
+	LanguageCode      string              `json:"language_code"`
+	TranscriptionType string              `json:"transcription_type"`
+	CardCount         int                 `json:"card_count"`
+	SkippedItems      int                 `json:"skipped_items"`
+	FilteredItems     int                 `json:"filtered_items,omitempty"`
+	MediaFiles        int                 `json:"media_files"`      // Audio and image references the cards would carry
+	AlreadyImported   bool                `json:"already_imported"` // A non-forced import would return the existing deck
+	SampleCards       []db.VocabularyItem `json:"sample_cards"`
+}
+
+// countMediaFiles counts the audio and image references of the items
+func countMediaFiles(items []db.VocabularyItem) int {
+	count := 0
+	for _, item := range items {
+		for _, ref := range []string{item.AudioWord, item.AudioExample, item.ImageURL} {
+			if ref != "" {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// lookupAvailableDeck finds the metadata of a bundled deck file and checks it is usable for an import
+func lookupAvailableDeck(available AvailableDecksResponse, fileName string) (LanguageGroup, DeckInfo, error) {
+	for _, lang := range available.Languages {
+		for _, deck := range lang.Decks {
+			if deck.ID != fileName {
+				continue
+			}
+
+			if !utils.IsKnownLanguageCode(lang.Code) {
+				return LanguageGroup{}, DeckInfo{}, fmt.Errorf("deck %s has unknown language code %q", fileName, lang.Code)
+			}
+
+			if strings.TrimSpace(deck.Level) == "" {
+				return LanguageGroup{}, DeckInfo{}, fmt.Errorf("deck %s has no level", fileName)
+			}
+
+			return lang, deck, nil
+		}
+	}
+
+	return LanguageGroup{}, DeckInfo{}, db.ErrNotFound
+}
+
+// filterAvailableDecksByLanguage keeps only the language group with the given code
+func filterAvailableDecksByLanguage(available AvailableDecksResponse, code string) (AvailableDecksResponse, bool) {
+	code = utils.NormalizeLanguageCode(code)
+	for _, lang := range available.Languages {
+		if utils.NormalizeLanguageCode(lang.Code) == code {
+			return AvailableDecksResponse{Languages: []LanguageGroup{lang}}, true
+		}
+	}
+
+	return AvailableDecksResponse{}, false
+}
+
+// validVocabularyItems drops entries that would become blank cards and returns how many were dropped
+func validVocabularyItems(items []db.VocabularyItem) ([]db.VocabularyItem, int) {
+	valid := make([]db.VocabularyItem, 0, len(items))
+	for _, item := range items {
+		if item.IsValid() {
+			valid = append(valid, item)
+		}
+	}
+
+	return valid, len(items) - len(valid)
+}
+
+// filterByFrequencyRank keeps entries whose frequency rank is within maxRank. It also returns the best
+// rank in the file, 0 when the file carries no frequency data at all.
+func filterByFrequencyRank(items []db.VocabularyItem, maxRank int) ([]db.VocabularyItem, int) {
+	bestRank := 0
+	filtered := make([]db.VocabularyItem, 0, len(items))
+	for _, item := range items {
+		if item.Frequency <= 0 {
+			continue
+		}
+
+		if bestRank == 0 || item.Frequency < bestRank {
+			bestRank = item.Frequency
+		}
+
+		if item.Frequency <= maxRank {
+			filtered = append(filtered, item)
+		}
+	}
+
+	return filtered, bestRank
 }
 
 func (h *Handler) CreateDeckFromFile(c echo.Context) error {
@@ -66,6 +181,30 @@ func (h *Handler) CreateDeckFromFile(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Failed to parse vocabulary data: %v", err))
 	}
 
+	vocabularyItems, skipped := validVocabularyItems(vocabularyItems)
+	if len(vocabularyItems) == 0 {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, fmt.Sprintf("File %s has no valid entries, %d entries are missing a term or meaning", req.FileName, skipped))
+	}
+
+	if skipped > 0 {
+		log.Printf("Skipping %d entries without a term or meaning in %s", skipped, req.FileName)
+	}
+
+	filtered := 0
+	if req.MaxFrequencyRank > 0 {
+		kept, bestRank := filterByFrequencyRank(vocabularyItems, req.MaxFrequencyRank)
+		if bestRank == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("File %s has no frequency data", req.FileName))
+		}
+
+		if len(kept) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("No entries within frequency rank %d, the most frequent entry in %s has rank %d", req.MaxFrequencyRank, req.FileName, bestRank))
+		}
+
+		filtered = len(vocabularyItems) - len(kept)
+		vocabularyItems = kept
+	}
+
 	metadataPath := filepath.Join(materialsDir, "materials", "available_decks.json")
 	metadataData, err := os.ReadFile(metadataPath)
 	if err != nil {
@@ -77,50 +216,93 @@ func (h *Handler) CreateDeckFromFile(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Failed to parse available decks metadata: %v", err))
 	}
 
-	var (
-		languageCode      = "en"
-		level             = "A1"
+	lang, deckInfo, err := lookupAvailableDeck(availableDecks, req.FileName)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Deck with ID %s not found in available decks", req.FileName))
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Invalid available decks metadata").WithInternal(err)
+	}
+
+	languageCode := lang.Code
+	level := deckInfo.Level
+
+	var transcriptionType string
+	switch languageCode {
+	case "jp":
+		transcriptionType = "furigana"
+	case "ge":
+		transcriptionType = "transliteration"
+	case "th":
+		transcriptionType = "aua"
+	default:
 		transcriptionType = "none"
-	)
+	}
 
-	deckFound := false
-	for _, lang := range availableDecks.Languages {
-		for _, deck := range lang.Decks {
-			if deck.ID == req.FileName {
-				languageCode = lang.Code
-				level = deck.Level
-				deckFound = true
-
-				switch languageCode {
-				case "jp":
-					transcriptionType = "furigana"
-				case "ge":
-					transcriptionType = "transliteration"
-				case "th":
-					transcriptionType = "aua"
-				default:
-					transcriptionType = "none"
-				}
-				break
-			}
+	if req.DryRun {
+		existing, err := h.db.GetDeckBySourceFile(userID, req.FileName)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to check existing decks").WithInternal(err)
 		}
-		if deckFound {
-			break
+
+		sample := slices.Clone(vocabularyItems[:min(ImportPreviewSize, len(vocabularyItems))])
+		for i := range sample {
+			sample[i].LanguageCode = languageCode
+			sample[i].TranscriptionType = transcriptionType
 		}
+
+		return c.JSON(http.StatusOK, ImportPreviewResponse{
+			Name:              req.Name,
+			Level:             level,
+			LanguageCode:      languageCode,
+			TranscriptionType: transcriptionType,
+			CardCount:         len(vocabularyItems),
+			SkippedItems:      skipped,
+			FilteredItems:     filtered,
+			MediaFiles:        countMediaFiles(vocabularyItems),
+			AlreadyImported:   existing != nil && !req.Force,
+			SampleCards:       sample,
+		})
 	}
 
-	if !deckFound {
-		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Deck with ID %s not found in available decks", req.FileName))
+	params := db.CreateDeckParams{
+		Name:              req.Name,
+		Description:       req.Description,
+		Level:             level,
+		LanguageCode:      languageCode,
+		TranscriptionType: transcriptionType,
+		Source:            &db.DeckSource{Type: db.DeckSourceBundled, FileName: req.FileName, LanguageCode: languageCode},
 	}
 
-	deck, err := h.db.CreateDeck(userID, req.Name, level, languageCode, transcriptionType)
+	var deck *db.Deck
+	if req.Force {
+		deck, err = h.db.CreateDeck(userID, params)
+	} else {
+		// a repeated tap on import returns the deck created by the first one
+		var created bool
+		deck, created, err = h.db.CreateBundledDeck(userID, params)
+		if err == nil && !created {
+			return c.JSON(http.StatusOK, CreateDeckFromFileResponse{Deck: *deck, AlreadyExists: true})
+		}
+	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Failed to create deck: %v", err))
 	}
 
-	fieldsArray := make([]string, len(vocabularyItems))
+	fieldsArray := vocabularyCardFields(vocabularyItems, languageCode, transcriptionType)
+
+	if err := h.db.AddCardsInBatch(userID, deck.ID, fieldsArray, db.DefaultCardBatchSize); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Failed to add cards to deck: %v", err))
+	}
+
+	return c.JSON(http.StatusCreated, CreateDeckFromFileResponse{Deck: *deck, SkippedItems: skipped, FilteredItems: filtered})
+}
+
+// vocabularyCardFields serializes vocabulary items into card fields of a deck in the given language
+func vocabularyCardFields(items []db.VocabularyItem, languageCode, transcriptionType string) []string {
+	fieldsArray := make([]string, len(items))
 
-	for i, item := range vocabularyItems {
+	for i, item := range items {
 		fieldsContent := map[string]interface{}{
 			"term":                       item.Term,
 			"transcription":              item.Transcription,
@@ -142,14 +324,86 @@ func (h *Handler) CreateDeckFromFile(c echo.Context) error {
 		fieldsArray[i] = string(fieldsJSON)
 	}
 
-	if err := h.db.AddCardsInBatch(userID, deck.ID, fieldsArray); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Failed to add cards to deck: %v", err))
+	return fieldsArray
+}
+
+// ImportJSONDeck creates a deck from vocabulary items the user uploads in the bundled deck format
+func (h *Handler) ImportJSONDeck(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	req := new(ImportJSONDeckRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+
+	if err := c.Validate(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	languageCode := utils.NormalizeLanguageCode(req.LanguageCode)
+	if !utils.IsKnownLanguageCode(languageCode) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown language code")
+	}
+
+	transcriptionType := req.TranscriptionType
+	if transcriptionType == "" {
+		transcriptionType = utils.GetDefaultTranscriptionType(languageCode)
+	} else if !utils.IsKnownTranscriptionType(transcriptionType) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown transcription type")
+	}
+
+	level := strings.TrimSpace(req.Level)
+	if level == "" {
+		level = "mixed"
+	}
+
+	items, skipped := validVocabularyItems(req.Items)
+	if len(items) == 0 {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, fmt.Sprintf("No valid entries, %d entries are missing a term or meaning", skipped))
+	}
+
+	deck, err := h.db.CreateDeck(userID, db.CreateDeckParams{
+		Name:              req.Name,
+		Description:       req.Description,
+		Level:             level,
+		LanguageCode:      languageCode,
+		TranscriptionType: transcriptionType,
+		Source:            &db.DeckSource{Type: db.DeckSourceJSON, LanguageCode: languageCode},
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create deck").WithInternal(err)
+	}
+
+	fieldsArray := vocabularyCardFields(items, languageCode, transcriptionType)
+	var cardIDs []string
+	if req.PreserveScheduling {
+		schedules := make([]*db.ImportedScheduling, len(items))
+		for i, item := range items {
+			schedules[i] = item.Scheduling
+		}
+		cardIDs, err = h.db.AddScheduledCards(c.Request().Context(), userID, deck.ID, fieldsArray, schedules)
+	} else {
+		cardIDs, err = h.db.AddCardsInBatchContext(c.Request().Context(), userID, deck.ID, fieldsArray, db.DefaultCardBatchSize)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to add cards to deck").WithInternal(err)
 	}
 
-	return c.JSON(http.StatusCreated, deck)
+	// Anki exports often come without readings, fill them in where the AI can
+	h.fillTranscriptionsAfterImport(c.Request().Context(), deck, cardIDs)
+
+	return c.JSON(http.StatusCreated, CreateDeckFromFileResponse{Deck: *deck, SkippedItems: skipped})
 }
 
 func (h *Handler) GetAvailableDecks(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
 	materialsDir, err := utils.FindDirUp("data", 3)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "data not found")
@@ -166,5 +420,200 @@ func (h *Handler) GetAvailableDecks(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Failed to parse available decks metadata: %v", err))
 	}
 
+	// Onboarding asks for the target language first and only lists that language's decks
+	if language := strings.TrimSpace(c.QueryParam("language")); language != "" {
+		filtered, ok := filterAvailableDecksByLanguage(availableDecks, language)
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "No decks available for this language")
+		}
+		availableDecks = filtered
+	}
+
+	importedFiles, err := h.db.GetImportedSourceFiles(userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch imported decks").WithInternal(err)
+	}
+
+	for i := range availableDecks.Languages {
+		for j := range availableDecks.Languages[i].Decks {
+			deck := &availableDecks.Languages[i].Decks[j]
+			deck.Imported = importedFiles[deck.ID]
+		}
+	}
+
 	return c.JSON(http.StatusOK, availableDecks)
 }
+
+// ImportValidationReport describes how a CSV/TSV file would be imported, without importing it
+type ImportValidationReport struct {
+	FileName       string               `json:"file_name"`
+	LanguageCode   string               `json:"language_code"`
+	MappingSource  string               `json:"mapping_source"` // "header" for named columns, "word_list" for a .txt list of terms, "detected" otherwise
+	Columns        []ImportColumnReport `json:"columns"`
+	TotalRows      int                  `json:"total_rows"`      // Non-blank rows after metadata lines and the header
+	ImportableRows int                  `json:"importable_rows"` // Rows with a term
+	Warnings       []string             `json:"warnings"`
+}
+
+// ImportColumnReport is one mapped column of a validated file
+type ImportColumnReport struct {
+	Field  string `json:"field"`  // Import field, e.g. "term" or "meaning_en"
+	Index  int    `json:"index"`  // Zero-based column in the file
+	Sample string `json:"sample"` // The column's value in the first row with a term
+}
+
+// mappedColumns lists the columns a mapping uses in import field order
+func mappedColumns(mapping *ColumnMapping) []ImportColumnReport {
+	fields := []struct {
+		name  string
+		index int
+	}{
+		{"term", mapping.TermIndex},
+		{"transcription", mapping.TranscriptionIndex},
+		{"term_with_transcription", mapping.TermWithTranscriptionIndex},
+		{"meaning_en", mapping.MeaningEnIndex},
+		{"meaning_ru", mapping.MeaningRuIndex},
+		{"example_native", mapping.ExampleNativeIndex},
+		{"example_en", mapping.ExampleEnIndex},
+		{"example_ru", mapping.ExampleRuIndex},
+		{"example_with_transcription", mapping.ExampleWithTranscriptionIndex},
+		{"frequency", mapping.FrequencyIndex},
+	}
+
+	columns := make([]ImportColumnReport, 0, len(fields))
+	for _, field := range fields {
+		if field.index >= 0 {
+			columns = append(columns, ImportColumnReport{Field: field.name, Index: field.index})
+		}
+	}
+	return columns
+}
+
+// validationReport summarizes an analyzed file: its mapped columns with samples, row counts and warnings
+func validationReport(fileName string, analysis *csvAnalysis) ImportValidationReport {
+	report := ImportValidationReport{
+		FileName:      fileName,
+		LanguageCode:  analysis.languageCode,
+		MappingSource: "detected",
+		Columns:       mappedColumns(analysis.mapping),
+		Warnings:      []string{},
+	}
+	if analysis.fromHeader {
+		report.MappingSource = "header"
+	}
+	if analysis.wordList {
+		report.MappingSource = "word_list"
+	}
+
+	maxIndex := 0
+	for _, column := range report.Columns {
+		maxIndex = max(maxIndex, column.Index)
+	}
+
+	var sample []string
+	shortRows := 0
+	seen := make(map[string]bool)
+	duplicates := 0
+	for _, record := range analysis.records {
+		if isBlankRecord(record) {
+			continue
+		}
+		report.TotalRows++
+
+		if len(record) <= maxIndex {
+			shortRows++
+		}
+
+		term := ""
+		if analysis.mapping.TermIndex >= 0 && analysis.mapping.TermIndex < len(record) {
+			term = strings.TrimSpace(utils.StripHTML(record[analysis.mapping.TermIndex]))
+		}
+		if term == "" {
+			continue
+		}
+		report.ImportableRows++
+
+		key := utils.NormalizeTermForDedup(term, analysis.languageCode)
+		if seen[key] {
+			duplicates++
+		}
+		seen[key] = true
+
+		if sample == nil {
+			sample = record
+		}
+	}
+
+	for i, column := range report.Columns {
+		if column.Index < len(sample) {
+			report.Columns[i].Sample = utils.StripHTML(sample[column.Index])
+		}
+	}
+
+	if analysis.mapping.TermIndex < 0 {
+		report.Warnings = append(report.Warnings, "No term column was found")
+	}
+	if analysis.mapping.MeaningEnIndex < 0 && analysis.mapping.MeaningRuIndex < 0 {
+		report.Warnings = append(report.Warnings, "No meaning column was found")
+	}
+	if skipped := report.TotalRows - report.ImportableRows; skipped > 0 && analysis.mapping.TermIndex >= 0 {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("%d rows have no term and will be skipped", skipped))
+	}
+	if shortRows > 0 {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("%d rows have fewer columns than the mapping uses", shortRows))
+	}
+	if duplicates > 0 {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("%d terms appear more than once", duplicates))
+	}
+
+	return report
+}
+
+// ValidateImportFile runs the file import's detection on an uploaded CSV/TSV file and reports what it found,
+// nothing is created. The file is sent as the "file" field of a multipart form.
+func (h *Handler) ValidateImportFile(c echo.Context) error {
+	if _, err := GetUserIDFromToken(c); err != nil {
+		return err
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "File is required").WithInternal(err)
+	}
+
+	fileName := strings.ToLower(fileHeader.Filename)
+	if strings.HasSuffix(fileName, ".zip") || strings.HasSuffix(fileName, ".apkg") {
+		return newCodedError(http.StatusBadRequest, contract.ErrorCodeNotSupported, "Archives are not supported, export the deck as CSV or TSV")
+	}
+	if !slices.ContainsFunc(importFileSuffixes, func(suffix string) bool { return strings.HasSuffix(fileName, suffix) }) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Only CSV, TSV and TXT files are supported")
+	}
+
+	if fileHeader.Size > MaxImportFileSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("File is larger than %d MB", MaxImportFileSize>>20))
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Failed to read file").WithInternal(err)
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(io.LimitReader(file, MaxImportFileSize))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Failed to read file").WithInternal(err)
+	}
+
+	analysis, err := h.analyzeImportFile(c.Request().Context(), fileHeader.Filename, content)
+	if err != nil {
+		switch {
+		case errors.Is(err, ai.ErrQuotaExceeded):
+			return newCodedError(http.StatusServiceUnavailable, contract.ErrorCodeAIUnavailable, "AI provider is busy, try again later").WithInternal(err)
+		case errors.Is(err, errColumnDetection):
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to detect columns").WithInternal(err)
+		}
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "File could not be parsed: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, validationReport(fileHeader.Filename, analysis))
+}
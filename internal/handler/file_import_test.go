@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"atamagaii/internal/contract"
+	"atamagaii/internal/db"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidVocabularyItems_SkipsMalformedEntries(t *testing.T) {
+	data := `[
+		{"term": "猫", "meaning_en": "cat"},
+		{"term": "", "meaning_en": "empty term"},
+		{"term": "   ", "meaning_ru": "пробелы"},
+		{"term": "犬"},
+		{"term": "鳥", "meaning_ru": "птица"},
+		{"meaning_en": "no term at all"}
+	]`
+
+	var items []db.VocabularyItem
+	require.NoError(t, json.Unmarshal([]byte(data), &items))
+
+	valid, skipped := validVocabularyItems(items)
+	require.Equal(t, 4, skipped)
+	require.Len(t, valid, 2)
+	require.Equal(t, "猫", valid[0].Term)
+	require.Equal(t, "鳥", valid[1].Term)
+}
+
+func TestLookupAvailableDeck(t *testing.T) {
+	available := AvailableDecksResponse{
+		Languages: []LanguageGroup{
+			{Code: "jp", Name: "Japanese", Decks: []DeckInfo{{ID: "good.json", Level: "beginner"}, {ID: "no_level.json"}}},
+			{Code: "", Name: "Broken", Decks: []DeckInfo{{ID: "no_language.json", Level: "beginner"}}},
+		},
+	}
+
+	lang, deck, err := lookupAvailableDeck(available, "good.json")
+	require.NoError(t, err)
+	require.Equal(t, "jp", lang.Code)
+	require.Equal(t, "beginner", deck.Level)
+
+	_, _, err = lookupAvailableDeck(available, "missing.json")
+	require.ErrorIs(t, err, db.ErrNotFound)
+
+	_, _, err = lookupAvailableDeck(available, "no_level.json")
+	require.ErrorContains(t, err, "no level")
+
+	_, _, err = lookupAvailableDeck(available, "no_language.json")
+	require.ErrorContains(t, err, "unknown language code")
+}
+
+// validateImportFile posts a file to ValidateImportFile as an authenticated user
+func validateImportFile(t *testing.T, h *Handler, fileName, content string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", fileName)
+	require.NoError(t, err)
+	_, err = part.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, form.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/decks/import/validate", &body)
+	req.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+	rec := httptest.NewRecorder()
+
+	c := echo.New().NewContext(req, rec)
+	c.Set("user", &jwt.Token{Claims: &contract.JWTClaims{UID: "user"}})
+
+	if err := h.ValidateImportFile(c); err != nil {
+		httpErr, ok := err.(*echo.HTTPError)
+		require.True(t, ok, "unexpected error: %v", err)
+		rec.Code = httpErr.Code
+	}
+	return rec
+}
+
+func TestValidateImportFile_DetectedColumns(t *testing.T) {
+	aiClient := &csvColumnsAI{}
+	h := &Handler{aiClient: aiClient}
+
+	content := "#separator:tab\n猫\tcat\n犬\tdog\n\tno term\n猫\tcat again\n"
+	rec := validateImportFile(t, h, "words.tsv", content)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var report ImportValidationReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+
+	require.Equal(t, "words.tsv", report.FileName)
+	require.Equal(t, "jp", report.LanguageCode)
+	require.Equal(t, "detected", report.MappingSource)
+	require.Equal(t, []ImportColumnReport{
+		{Field: "term", Index: 0, Sample: "猫"},
+		{Field: "meaning_en", Index: 1, Sample: "cat"},
+	}, report.Columns)
+	require.Equal(t, 4, report.TotalRows)
+	require.Equal(t, 3, report.ImportableRows)
+	require.Contains(t, report.Warnings, "1 rows have no term and will be skipped")
+	require.Contains(t, report.Warnings, "1 terms appear more than once")
+}
+
+func TestValidateImportFile_HeaderColumns(t *testing.T) {
+	// No AI client: a named header is mapped without column detection
+	h := &Handler{}
+
+	content := "Expression\tReading\tMeaning\n食べる\tたべる\tto eat\n飲む\tのむ\n"
+	rec := validateImportFile(t, h, "anki.txt", content)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var report ImportValidationReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+
+	require.Equal(t, "jp", report.LanguageCode)
+	require.Equal(t, "header", report.MappingSource)
+	require.Equal(t, []ImportColumnReport{
+		{Field: "term", Index: 0, Sample: "食べる"},
+		{Field: "transcription", Index: 1, Sample: "たべる"},
+		{Field: "meaning_en", Index: 2, Sample: "to eat"},
+	}, report.Columns)
+	require.Equal(t, 2, report.TotalRows)
+	require.Equal(t, 2, report.ImportableRows)
+	require.Equal(t, []string{"1 rows have fewer columns than the mapping uses"}, report.Warnings)
+}
+
+func TestValidateImportFile_WordList(t *testing.T) {
+	// No AI client: a .txt file without tabs is read one term per line, as the import reads it
+	h := &Handler{}
+
+	content := "食べる\n\n飲む\n 見る \n"
+	rec := validateImportFile(t, h, "words.txt", content)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var report ImportValidationReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+
+	require.Equal(t, "jp", report.LanguageCode)
+	require.Equal(t, "word_list", report.MappingSource)
+	require.Equal(t, []ImportColumnReport{{Field: "term", Index: 0, Sample: "食べる"}}, report.Columns)
+	require.Equal(t, 3, report.TotalRows)
+	require.Equal(t, 3, report.ImportableRows)
+
+	items, err := h.parseImportFile(context.Background(), "words.txt", []byte(content))
+	require.NoError(t, err)
+	require.Len(t, items, report.ImportableRows)
+	require.Equal(t, "見る", items[2].Term)
+}
+
+func TestValidateImportFile_RejectsArchives(t *testing.T) {
+	h := &Handler{}
+
+	rec := validateImportFile(t, h, "deck.zip", "PK")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -3,34 +3,125 @@ package handler
 import (
 	"atamagaii/internal/contract"
 	"atamagaii/internal/db"
+	"atamagaii/internal/middleware"
+	"atamagaii/internal/utils"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // DefaultTaskDelayMinutes is the default delay in minutes before a task is shown after a card enters review state
 const DefaultTaskDelayMinutes = 2
 
+// AllDecksID as deck_id asks GET /v1/cards/due for one queue across all of the user's decks
+const AllDecksID = "all"
+
 type ReviewCardRequest struct {
-	Rating      int `json:"rating" validate:"required,min=1,max=2"`
+	Rating      int `json:"rating" validate:"required,min=1,max=4"` // Hard (3) and Easy (4) only on decks with four rating buttons
 	TimeSpentMs int `json:"time_spent_ms" validate:"required"`
 }
 
 type CreateDeckFromFileRequest struct {
-	Name     string `json:"name" validate:"required"`
-	FileName string `json:"file_name" validate:"required"` // e.g., "vocab_n5.json"
+	Name        string `json:"name" validate:"required"`
+	Description string `json:"description"`
+	FileName    string `json:"file_name" validate:"required"` // e.g., "japanese_n5.json"
+	// MaxFrequencyRank keeps only entries ranked this common or better (rank 1 is the most frequent word)
+	MaxFrequencyRank int `json:"max_frequency_rank,omitempty" validate:"omitempty,min=1"`
+	// Force imports the file again even if the user already has a deck from it
+	Force bool `json:"force,omitempty"`
+	// DryRun previews the import without creating anything
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// ImportJSONDeckRequest is a user-built deck in the same item format as the bundled deck files
+type ImportJSONDeckRequest struct {
+	Name              string              `json:"name" validate:"required"`
+	Description       string              `json:"description"`
+	LanguageCode      string              `json:"language_code" validate:"required"`
+	TranscriptionType string              `json:"transcription_type,omitempty"` // Defaults to the language's usual transcription
+	Level             string              `json:"level,omitempty"`              // Defaults to "mixed"
+	Items             []db.VocabularyItem `json:"items" validate:"required,min=1,max=5000"`
+	// PreserveScheduling keeps the Anki review state of items that carry one instead of importing every card as new
+	PreserveScheduling bool `json:"preserve_scheduling,omitempty"`
+}
+
+type MergeDecksRequest struct {
+	SourceDeckID string `json:"source_deck_id" validate:"required"`
+	TargetDeckID string `json:"target_deck_id" validate:"required"`
+}
+
+type MergeDecksResponse struct {
+	Deck       *db.Deck `json:"deck"`
+	MovedCards int      `json:"moved_cards"`
+}
+
+// BulkSuspendRequest selects the cards to suspend or unsuspend; at least one filter is required
+type BulkSuspendRequest struct {
+	DeckID  string `json:"deck_id,omitempty"`
+	Tag     string `json:"tag,omitempty"`
+	IsLeech *bool  `json:"is_leech,omitempty"`
+	State   string `json:"state,omitempty"`
+}
+
+type BulkSuspendResponse struct {
+	Count int `json:"count"`
+}
+
+type BuryCardResponse struct {
+	BuriedUntil time.Time `json:"buried_until"`
+}
+
+// SuspendCardRequest suspends a card, or unsuspends it when Suspended is false
+type SuspendCardRequest struct {
+	Suspended *bool `json:"suspended,omitempty"`
 }
 
 type UpdateDeckSettingsRequest struct {
-	NewCardsPerDay int    `json:"new_cards_per_day" validate:"required,min=1,max=500"`
-	Name           string `json:"name" validate:"required"`
+	NewCardsPerDay    int     `json:"new_cards_per_day" validate:"required,min=1,max=500"`
+	Name              string  `json:"name" validate:"required"`
+	Description       *string `json:"description,omitempty"`
+	LanguageCode      string  `json:"language_code,omitempty"`
+	TranscriptionType string  `json:"transcription_type,omitempty"`
+	RegenerateAudio   bool    `json:"regenerate_audio,omitempty"`
+	GenerateAudio     *bool   `json:"generate_audio,omitempty"`
+	GenerateImages    *bool   `json:"generate_images,omitempty"`
+	AudioContent      string  `json:"audio_content,omitempty"`
+	// NewCardDays is a weekday mask of the days new cards are introduced on, bit 0 being Sunday
+	NewCardDays *int `json:"new_card_days,omitempty"`
+	// StuckReviewLimit is how many learning reviews flag a card as stuck, 0 turns flagging off
+	StuckReviewLimit *int `json:"stuck_review_limit,omitempty"`
+	// ConfidenceScheduling lets answer times lengthen or shorten review intervals
+	ConfidenceScheduling *bool `json:"confidence_scheduling,omitempty"`
+	// LeechAction is what happens to a card that lapses too often, "suspend", "tag" or "none"
+	LeechAction string `json:"leech_action,omitempty"`
+	// ExampleCount is how many example sentences cards are generated with
+	ExampleCount *int `json:"example_count,omitempty"`
+	// NewCardBoost caps the extra new cards allowed after missed study days, 0 turns the boost off
+	NewCardBoost *int `json:"new_card_boost,omitempty"`
+	// ReviewMode is how cards are presented, "text" or "audio_front"; audio_front decks always generate audio
+	ReviewMode string `json:"review_mode,omitempty"`
+	// ExampleOnBack moves example sentences from the card front to the back, so they can't give the meaning away
+	ExampleOnBack *bool `json:"example_on_back,omitempty"`
+	// RatingButtons is 2 for Again and Good, or 4 to add Hard and Easy
+	RatingButtons *int `json:"rating_buttons,omitempty"`
+
+	MinEase          *float64 `json:"min_ease,omitempty" validate:"omitempty,min=1.1,max=2.5"`
+	EaseGoodBonus    *float64 `json:"ease_good_bonus,omitempty" validate:"omitempty,min=0,max=0.5"`
+	EaseLapsePenalty *float64 `json:"ease_lapse_penalty,omitempty" validate:"omitempty,min=0,max=1"`
+	IntervalModifier *float64 `json:"interval_modifier,omitempty" validate:"omitempty,min=0.5,max=2"`
 }
 
+// UpdateCardRequest changes a card's fields, its priority or both
 type UpdateCardRequest struct {
-	Fields contract.CardFields `json:"fields" validate:"required"`
+	Fields *contract.CardFields `json:"fields,omitempty" validate:"required_without=Priority"`
+	// Priority moves a new card ahead of (higher) or behind (lower) the deck's other new cards
+	Priority *int `json:"priority,omitempty"`
 }
 
 func (h *Handler) AddFlashcardRoutes(g *echo.Group) {
@@ -38,17 +129,39 @@ func (h *Handler) AddFlashcardRoutes(g *echo.Group) {
 	g.GET("/decks/:id", h.GetDeck)
 	g.GET("/decks/available", h.GetAvailableDecks)
 	g.POST("/decks/import", h.CreateDeckFromFile)
+	g.POST("/decks/import/json", h.ImportJSONDeck, middleware.AIDeadline(h.aiTimeout))
+	g.POST("/decks/import/validate", h.ValidateImportFile, middleware.AIDeadline(h.aiTimeout))
+	g.POST("/decks/merge", h.MergeDecks)
 	g.PUT("/decks/:id/settings", h.UpdateDeckSettings)
 	g.DELETE("/decks/:id", h.DeleteDeck)
+	g.GET("/decks/:id/suggestions", h.GetDeckSuggestions)
+	g.GET("/decks/:id/breakdown", h.GetDeckBreakdown)
+	g.GET("/decks/:id/stuck", h.GetStuckCards)
+	g.GET("/decks/:id/export.tsv", h.ExportDeckTSV)
+	g.GET("/decks/:id/session", h.GetStudySession)
+	g.GET("/decks/:id/next-card", h.GetNextCard)
+	g.GET("/decks/:id/cards", h.GetDeckCards)
+	g.POST("/decks/:id/generate-transcriptions", h.GenerateDeckTranscriptions, middleware.AIDeadline(h.aiTimeout))
+	g.POST("/decks/:id/generate-missing", h.GenerateMissingContent, middleware.AIDeadline(h.aiTimeout))
 
 	g.GET("/cards/due", h.GetDueCards)
+	g.GET("/cards/recent", h.GetRecentCards)
+	g.GET("/cards/search", h.SearchCards)
 	g.GET("/cards/:id", h.GetCard)
 	g.PUT("/cards/:id", h.UpdateCard)
-	g.POST("/cards/generate", h.GenerateCard)
+	g.DELETE("/cards/:id", h.DeleteCard)
+	g.POST("/cards/:id/restore", h.RestoreCard)
+	g.POST("/cards/generate", h.GenerateCard, middleware.AIDeadline(h.aiTimeout))
+	g.POST("/cards/bulk-suspend", h.BulkSuspendCards)
+	g.POST("/cards/bulk-unsuspend", h.BulkUnsuspendCards)
+	g.POST("/cards/:id/suspend", h.SuspendCard)
+	g.POST("/cards/:id/bury", h.BuryCard)
 
 	g.POST("/cards/:id/review", h.ReviewCard)
+	g.POST("/cards/:id/undo", h.UndoReview)
 	g.GET("/stats", h.GetStats)
 	g.GET("/stats/history", h.GetStudyHistory)
+	g.GET("/stats/history.csv", h.ExportStudyHistoryCSV)
 }
 
 func (h *Handler) GetDecks(c echo.Context) error {
@@ -57,7 +170,12 @@ func (h *Handler) GetDecks(c echo.Context) error {
 		return err
 	}
 
-	decks, err := h.db.GetDecks(userID)
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
+	}
+
+	decks, err := h.db.GetDecks(userID, user.Settings)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch decks")
 	}
@@ -77,25 +195,33 @@ func (h *Handler) GetDeck(c echo.Context) error {
 	}
 
 	if len(deckID) < 3 {
-		return echo.NewHTTPError(http.StatusNotFound, "Deck not found")
+		return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
 	}
 
 	deck, err := h.db.GetDeck(deckID)
 	if err != nil {
 		if errors.Is(err, db.ErrNotFound) {
-			return echo.NewHTTPError(http.StatusNotFound, "Deck not found")
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
 		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck")
 	}
 
-	if deck.UserID != userID {
+	// admins may look at any deck to help with reports about it
+	if deck.UserID != userID && !isAdminToken(c) {
 		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
 	}
 
+	deck.Source, err = h.db.GetDeckSource(deck.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck source").WithInternal(err)
+	}
+
 	return c.JSON(http.StatusOK, deck)
 }
 
-func formatCardResponse(card db.Card) (contract.CardResponse, error) {
+// formatCardResponse converts a card for clients, displayLanguage picks the resolved Meaning and
+// ExampleTranslation and an empty displayLanguage leaves them out
+func formatCardResponse(card db.Card, displayLanguage string) (contract.CardResponse, error) {
 	response := contract.CardResponse{
 		ID:              card.ID,
 		DeckID:          card.DeckID,
@@ -111,6 +237,21 @@ func formatCardResponse(card db.Card) (contract.CardResponse, error) {
 		FirstReviewedAt: card.FirstReviewedAt,
 		State:           card.State,
 		LearningStep:    card.LearningStep,
+		Priority:        card.Priority,
+		Suspended:       card.SuspendedAt != nil,
+		Tags:            card.Tags,
+	}
+
+	if card.Interval > 0 {
+		response.IntervalDisplay = db.FormatSimpleDuration(card.Interval)
+	}
+
+	if card.NextReview != nil {
+		if dueIn := time.Until(*card.NextReview); dueIn > 0 {
+			response.DueInDisplay = db.FormatSimpleDuration(dueIn)
+		} else {
+			response.DueInDisplay = "now"
+		}
 	}
 
 	var fields contract.CardFields
@@ -118,6 +259,12 @@ func formatCardResponse(card db.Card) (contract.CardResponse, error) {
 		return response, fmt.Errorf("error unmarshalling card fields: %w", err)
 	}
 	response.Fields = fields
+	response.HasAudio = fields.AudioWord != "" || fields.AudioExample != ""
+	response.HasImage = fields.ImageURL != ""
+
+	if displayLanguage != "" {
+		response.Meaning, response.ExampleTranslation = fields.Translations(displayLanguage)
+	}
 
 	return response, nil
 }
@@ -141,10 +288,14 @@ func (h *Handler) GetDueCards(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "Deck ID is required")
 	}
 
+	if deckID == AllDecksID {
+		return h.getDueCardsAcrossDecks(c, userID)
+	}
+
 	deck, err := h.db.GetDeck(deckID)
 	if err != nil {
 		if errors.Is(err, db.ErrNotFound) {
-			return echo.NewHTTPError(http.StatusNotFound, "Deck not found")
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
 		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck")
 	}
@@ -154,33 +305,244 @@ func (h *Handler) GetDueCards(c echo.Context) error {
 	}
 
 	limit := parseIntQuery(c, "limit", 3)
+	sessionNewLimit := parseIntQuery(c, "session_new_limit", db.NoSessionNewLimit)
 
-	cards, err := h.db.GetCardsForReview(userID, deckID, limit, deck.NewCardsPerDay)
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
+	}
+	displayLanguage := db.ResolveDisplayLanguage(user.Settings, user.LanguageCode)
+
+	cards, err := h.db.GetCardsForReview(userID, user.Settings, deck, limit, sessionNewLimit)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch due cards").WithInternal(err)
 	}
 
-	responses := make([]contract.CardResponse, len(cards))
-	for i, card := range cards {
-		response, err := formatCardResponse(card)
-		if err != nil {
-			continue
+	cards, studyAgain, err := h.addStudyAgainCards(c, userID, deckID, cards, limit)
+	if err != nil {
+		return err
+	}
+
+	responses := formatReviewCardResponses(cards, deck, displayLanguage)
+	markStudyAgain(responses, studyAgain)
+
+	return c.JSON(http.StatusOK, responses)
+}
+
+// nextCardWindow is how many candidates GetNextCard sorts before taking the first. It matches the
+// default limit of GetDueCards so that both endpoints agree on which card comes first.
+const nextCardWindow = 3
+
+// GetNextCard returns only the card the review queue would show first, or 204 when nothing is left
+// to study in the deck today
+func (h *Handler) GetNextCard(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	deckID := c.Param("id")
+	if deckID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Deck ID is required")
+	}
+
+	deck, err := h.db.GetDeck(deckID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck").WithInternal(err)
+	}
+
+	if deck.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+
+	sessionNewLimit := parseIntQuery(c, "session_new_limit", db.NoSessionNewLimit)
+
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
+	}
+
+	cards, err := h.db.GetCardsForReview(userID, user.Settings, deck, nextCardWindow, sessionNewLimit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch due cards").WithInternal(err)
+	}
+
+	if len(cards) == 0 {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	displayLanguage := db.ResolveDisplayLanguage(user.Settings, user.LanguageCode)
+
+	response, err := formatReviewCardResponse(cards[0], deck, displayLanguage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to format card response").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// addStudyAgainCards serves the study_again_since parameter, the time the client's session started. Cards
+// failed since then whose lapse is still unresolved are appended to the queue while it has room, so the
+// session doesn't end before they come back. It returns the queue and the IDs of the failed cards.
+func (h *Handler) addStudyAgainCards(c echo.Context, userID, deckID string, cards []db.Card, limit int) ([]db.Card, map[string]bool, error) {
+	sinceParam := c.QueryParam("study_again_since")
+	if sinceParam == "" {
+		return cards, nil, nil
+	}
+
+	since, err := time.Parse(time.RFC3339, sinceParam)
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "study_again_since must be an RFC 3339 time")
+	}
+
+	failed, err := h.db.GetCardsFailedSince(userID, deckID, since, limit)
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch failed cards").WithInternal(err)
+	}
+
+	studyAgain := make(map[string]bool, len(failed))
+	queued := make(map[string]bool, len(cards))
+	for _, card := range cards {
+		queued[card.ID] = true
+	}
+
+	for _, card := range failed {
+		studyAgain[card.ID] = true
+		if !queued[card.ID] && len(cards) < limit {
+			cards = append(cards, card)
 		}
+	}
+
+	return cards, studyAgain, nil
+}
+
+// markStudyAgain flags the responses of cards that were failed earlier in the session
+func markStudyAgain(responses []contract.CardResponse, studyAgain map[string]bool) {
+	for i := range responses {
+		responses[i].StudyAgain = studyAgain[responses[i].ID]
+	}
+}
+
+// getDueCardsAcrossDecks serves deck_id=all, one queue drawn from every deck the user has
+func (h *Handler) getDueCardsAcrossDecks(c echo.Context, userID string) error {
+	limit := parseIntQuery(c, "limit", 3)
+	sessionNewLimit := parseIntQuery(c, "session_new_limit", db.NoSessionNewLimit)
+
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
+	}
+
+	decks, err := h.db.GetDecks(userID, user.Settings)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch decks").WithInternal(err)
+	}
+
+	cards, err := h.db.GetCardsForReviewAcrossDecks(userID, user.Settings, decks, limit, sessionNewLimit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch due cards").WithInternal(err)
+	}
+
+	cards, studyAgain, err := h.addStudyAgainCards(c, userID, "", cards, limit)
+	if err != nil {
+		return err
+	}
+
+	decksByID := make(map[string]*db.Deck, len(decks))
+	for i := range decks {
+		decksByID[decks[i].ID] = &decks[i]
+	}
 
-		intervalAgainVal := db.CalculatePreviewInterval(card, db.RatingAgain)
-		intervalGoodVal := db.CalculatePreviewInterval(card, db.RatingGood)
+	displayLanguage := db.ResolveDisplayLanguage(user.Settings, user.LanguageCode)
 
-		response.NextIntervals = contract.PotentialIntervalsForDisplay{
-			Again: db.FormatSimpleDuration(intervalAgainVal),
-			Good:  db.FormatSimpleDuration(intervalGoodVal),
+	responses := make([]contract.CardResponse, 0, len(cards))
+	for _, card := range cards {
+		deck, ok := decksByID[card.DeckID]
+		if !ok {
+			continue
 		}
 
-		responses[i] = response
+		if response, err := formatReviewCardResponse(card, deck, displayLanguage); err == nil {
+			responses = append(responses, response)
+		}
 	}
+	markStudyAgain(responses, studyAgain)
 
 	return c.JSON(http.StatusOK, responses)
 }
 
+// formatReviewCardResponses formats cards for a study session, adding the interval each rating would lead to.
+// Cards that fail to format are skipped.
+func formatReviewCardResponses(cards []db.Card, deck *db.Deck, displayLanguage string) []contract.CardResponse {
+	responses := make([]contract.CardResponse, 0, len(cards))
+	for _, card := range cards {
+		response, err := formatReviewCardResponse(card, deck, displayLanguage)
+		if err != nil {
+			continue
+		}
+		responses = append(responses, response)
+	}
+
+	return responses
+}
+
+func formatReviewCardResponse(card db.Card, deck *db.Deck, displayLanguage string) (contract.CardResponse, error) {
+	response, err := formatCardResponse(card, displayLanguage)
+	if err != nil {
+		return contract.CardResponse{}, err
+	}
+
+	easeSettings := deck.EaseSettings()
+	intervalAgainVal := db.CalculatePreviewInterval(card, db.RatingAgain, easeSettings)
+	intervalGoodVal := db.CalculatePreviewInterval(card, db.RatingGood, easeSettings)
+
+	response.NextIntervals = contract.PotentialIntervalsForDisplay{
+		Again: db.FormatSimpleDuration(intervalAgainVal),
+		Good:  db.FormatSimpleDuration(intervalGoodVal),
+	}
+	if deck.RatingButtons == db.FourRatingButtons {
+		response.NextIntervals.Hard = db.FormatSimpleDuration(db.CalculatePreviewInterval(card, db.RatingHard, easeSettings))
+		response.NextIntervals.Easy = db.FormatSimpleDuration(db.CalculatePreviewInterval(card, db.RatingEasy, easeSettings))
+	}
+	response.ReviewMode = deck.ReviewMode
+
+	if deck.ExampleOnBack {
+		moveExampleToBack(&response)
+	}
+
+	return response, nil
+}
+
+// moveExampleToBack takes the example sentences, their translation and audio out of the card's fields
+// and puts them in the back section, leaving the front with only the term. Audio-first decks keep the
+// audio on the front, it is what they ask the learner to recall from.
+func moveExampleToBack(response *contract.CardResponse) {
+	fields := &response.Fields
+	response.Back = &contract.CardBack{
+		ExampleNative:            fields.ExampleNative,
+		ExampleWithTranscription: fields.ExampleWithTranscription,
+		ExampleEn:                fields.ExampleEn,
+		ExampleRu:                fields.ExampleRu,
+		ExampleTranslation:       response.ExampleTranslation,
+		Examples:                 fields.Examples,
+	}
+
+	if response.ReviewMode != db.ReviewModeAudioFront {
+		response.Back.AudioExample = fields.AudioExample
+		fields.AudioExample = ""
+	}
+
+	fields.ExampleNative = ""
+	fields.ExampleWithTranscription = ""
+	fields.ExampleEn = ""
+	fields.ExampleRu = ""
+	fields.Examples = nil
+	response.ExampleTranslation = ""
+}
+
 func (h *Handler) ReviewCard(c echo.Context) error {
 	userID, err := GetUserIDFromToken(c)
 	if err != nil {
@@ -195,7 +557,7 @@ func (h *Handler) ReviewCard(c echo.Context) error {
 	card, err := h.db.GetCard(cardID, userID)
 	if err != nil {
 		if errors.Is(err, db.ErrNotFound) {
-			return echo.NewHTTPError(http.StatusNotFound, "Card not found")
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeCardNotFound, "Card not found")
 		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch card")
 	}
@@ -218,43 +580,86 @@ func (h *Handler) ReviewCard(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	if err := h.db.ReviewCard(card, req.Rating, req.TimeSpentMs); err != nil {
+	if !db.IsValidRating(req.Rating, deck.RatingButtons) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Hard and Easy ratings need a deck with four rating buttons")
+	}
+
+	if err := h.db.ReviewCard(card, deck, req.Rating, req.TimeSpentMs); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to process review: "+err.Error())
 	}
 
-	stats, err := h.db.GetDeckStatistics(userID, deck.ID, deck.NewCardsPerDay)
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
+	}
+	displayLanguage := db.ResolveDisplayLanguage(user.Settings, user.LanguageCode)
+
+	stats, err := h.db.GetDeckStatistics(userID, user.Settings, deck)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch stats").WithInternal(err)
 	}
 
-	nextCards, err := h.db.GetCardsForReview(userID, deck.ID, 5, deck.NewCardsPerDay)
+	sessionNewLimit := parseIntQuery(c, "session_new_limit", db.NoSessionNewLimit)
+	nextCards, err := h.db.GetCardsForReview(userID, user.Settings, deck, 5, sessionNewLimit)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch next card").WithInternal(err)
 	}
 
-	respCards := make([]contract.CardResponse, 0, len(nextCards))
+	resp := contract.ReviewCardResponse{
+		Stats:     stats,
+		NextCards: formatReviewCardResponses(nextCards, deck, displayLanguage),
+	}
 
-	for _, c := range nextCards {
-		nextCardResp, err := formatCardResponse(c)
-		if err == nil {
-			intervalAgainVal := db.CalculatePreviewInterval(c, db.RatingAgain)
-			intervalGoodVal := db.CalculatePreviewInterval(c, db.RatingGood)
+	return c.JSON(http.StatusOK, resp)
+}
 
-			nextCardResp.NextIntervals = contract.PotentialIntervalsForDisplay{
-				Again: db.FormatSimpleDuration(intervalAgainVal),
-				Good:  db.FormatSimpleDuration(intervalGoodVal),
-			}
+// UndoReview reverts the card's latest review and returns the card as it was before it
+func (h *Handler) UndoReview(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	cardID := c.Param("id")
+	if cardID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Card ID is required")
+	}
 
-			respCards = append(respCards, nextCardResp)
+	// UndoLastReview only matches cards owned by the user, so no separate ownership check is needed
+	if err := h.db.UndoLastReview(userID, cardID); err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeCardNotFound, "Card not found")
+		case errors.Is(err, db.ErrNoReviewToUndo):
+			return newCodedError(http.StatusConflict, contract.ErrorCodeNoReviewToUndo, "The card has no review to undo")
+		case errors.Is(err, db.ErrReviewNotReversible):
+			return newCodedError(http.StatusConflict, contract.ErrorCodeReviewNotReversible, "The card's last review can't be undone")
 		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to undo review").WithInternal(err)
 	}
 
-	resp := contract.ReviewCardResponse{
-		Stats:     stats,
-		NextCards: respCards,
+	card, err := h.db.GetCard(cardID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch card").WithInternal(err)
 	}
 
-	return c.JSON(http.StatusOK, resp)
+	deck, err := h.db.GetDeck(card.DeckID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck").WithInternal(err)
+	}
+
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
+	}
+	displayLanguage := db.ResolveDisplayLanguage(user.Settings, user.LanguageCode)
+
+	response, err := formatReviewCardResponse(*card, deck, displayLanguage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to format card response").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, response)
 }
 
 func (h *Handler) GetStats(c echo.Context) error {
@@ -263,8 +668,13 @@ func (h *Handler) GetStats(c echo.Context) error {
 		return err
 	}
 
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
+	}
+
 	// Get due cards count
-	dueCount, err := h.db.GetDueCardCount(userID)
+	dueCount, err := h.db.GetDueCardCount(userID, user.Settings)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch statistics")
 	}
@@ -275,10 +685,16 @@ func (h *Handler) GetStats(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch study statistics")
 	}
 
-	// Combine both statistics types in the response
+	taskStats, err := h.db.GetTaskStats(userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch task statistics").WithInternal(err)
+	}
+
+	// Combine all statistics types in the response
 	response := map[string]interface{}{
 		"due_cards":   dueCount,
 		"study_stats": studyStats,
+		"task_stats":  taskStats,
 	}
 
 	return c.JSON(http.StatusOK, response)
@@ -304,34 +720,57 @@ func (h *Handler) GetStudyHistory(c echo.Context) error {
 	})
 }
 
-func (h *Handler) GetCard(c echo.Context) error {
+// ExportStudyHistoryCSV streams every review of the user as CSV for analysis in a spreadsheet
+func (h *Handler) ExportStudyHistoryCSV(c echo.Context) error {
 	userID, err := GetUserIDFromToken(c)
 	if err != nil {
 		return err
 	}
 
-	cardID := c.Param("id")
-	if cardID == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "Card ID is required")
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="study_history.csv"`)
+
+	w := csv.NewWriter(res)
+	if err := w.Write([]string{
+		"date", "term", "deck", "rating", "time_spent_ms", "prev_interval_seconds", "new_interval_seconds",
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to write study history").WithInternal(err)
 	}
 
-	card, err := h.db.GetCard(cardID, userID)
+	err = h.db.StreamReviewHistory(userID, func(row db.ReviewHistoryRow) error {
+		return w.Write([]string{
+			row.ReviewedAt.UTC().Format(time.RFC3339),
+			row.Term,
+			row.DeckName,
+			strconv.Itoa(row.Rating),
+			strconv.Itoa(row.TimeSpentMs),
+			strconv.FormatInt(int64(row.PrevInterval.Seconds()), 10),
+			strconv.FormatInt(int64(row.NewInterval.Seconds()), 10),
+		})
+	})
 	if err != nil {
-		if errors.Is(err, db.ErrNotFound) {
-			return echo.NewHTTPError(http.StatusNotFound, "Card not found")
-		}
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch card").WithInternal(err)
+		// once rows have been flushed the status is already sent, echo then only logs the error
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to export study history").WithInternal(err)
 	}
 
-	response, err := formatCardResponse(*card)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to format card response").WithInternal(err)
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to write study history").WithInternal(err)
 	}
 
-	return c.JSON(http.StatusOK, response)
+	return nil
 }
 
-func (h *Handler) UpdateDeckSettings(c echo.Context) error {
+// deckExportColumns are the columns of a deck export, named after the import fields so the file can be imported again
+var deckExportColumns = []string{
+	"term", "transcription", "term_with_transcription", "meaning_en", "meaning_ru",
+	"example_native", "example_en", "example_ru", "example_with_transcription", "frequency",
+}
+
+// ExportDeckTSV streams the deck's cards as tab-separated values, the format the file import reads. The header lines start with "#"
+// like other exports the file import skips, fields with tabs or line breaks are quoted.
+func (h *Handler) ExportDeckTSV(c echo.Context) error {
 	userID, err := GetUserIDFromToken(c)
 	if err != nil {
 		return err
@@ -345,69 +784,576 @@ func (h *Handler) UpdateDeckSettings(c echo.Context) error {
 	deck, err := h.db.GetDeck(deckID)
 	if err != nil {
 		if errors.Is(err, db.ErrNotFound) {
-			return echo.NewHTTPError(http.StatusNotFound, "Deck not found")
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
 		}
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck")
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck").WithInternal(err)
 	}
 
 	if deck.UserID != userID {
 		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
 	}
 
-	req := new(UpdateDeckSettingsRequest)
-	if err := c.Bind(req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
-	}
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/tab-separated-values; charset=utf-8")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="deck_%s.tsv"`, deck.ID))
 
-	if err := c.Validate(req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	if _, err := fmt.Fprintf(res, "#separator:tab\n#columns:%s\n", strings.Join(deckExportColumns, "\t")); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to write deck export").WithInternal(err)
 	}
 
-	deck.NewCardsPerDay = req.NewCardsPerDay
-	deck.Name = req.Name
+	w := csv.NewWriter(res)
+	w.Comma = '\t'
 
-	if err := h.db.UpdateDeckSettings(deckID, deck); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update deck settings: "+err.Error())
-	}
+	err = h.db.StreamDeckCardFields(userID, deck.ID, func(raw string) error {
+		var fields contract.CardFields
+		if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+			return fmt.Errorf("error unmarshalling card fields: %w", err)
+		}
 
-	// Get updated deck to return to the client
-	updatedDeck, err := h.db.GetDeck(deckID)
+		frequency := ""
+		if fields.Frequency > 0 {
+			frequency = strconv.Itoa(fields.Frequency)
+		}
+
+		return w.Write([]string{
+			fields.Term,
+			fields.Transcription,
+			fields.TermWithTranscription,
+			fields.MeaningEn,
+			fields.MeaningRu,
+			fields.ExampleNative,
+			fields.ExampleEn,
+			fields.ExampleRu,
+			fields.ExampleWithTranscription,
+			frequency,
+		})
+	})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch updated deck")
+		// once rows have been flushed the status is already sent, echo then only logs the error
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to export deck").WithInternal(err)
 	}
 
-	return c.JSON(http.StatusOK, updatedDeck)
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to write deck export").WithInternal(err)
+	}
+
+	return nil
 }
 
-func (h *Handler) DeleteDeck(c echo.Context) error {
+func (h *Handler) GetCard(c echo.Context) error {
 	userID, err := GetUserIDFromToken(c)
 	if err != nil {
 		return err
 	}
 
-	deckID := c.Param("id")
-	if deckID == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "Deck ID is required")
+	cardID := c.Param("id")
+	if cardID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Card ID is required")
 	}
 
-	// Verify the deck exists and belongs to the user
-	deck, err := h.db.GetDeck(deckID)
+	card, err := h.db.GetCard(cardID, userID)
 	if err != nil {
 		if errors.Is(err, db.ErrNotFound) {
-			return echo.NewHTTPError(http.StatusNotFound, "Deck not found")
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeCardNotFound, "Card not found")
 		}
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck")
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch card").WithInternal(err)
 	}
 
-	if deck.UserID != userID {
-		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
 	}
+	displayLanguage := db.ResolveDisplayLanguage(user.Settings, user.LanguageCode)
 
-	if err := h.db.DeleteDeck(deckID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete deck: "+err.Error())
+	response, err := formatCardResponse(*card, displayLanguage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to format card response").WithInternal(err)
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+	return c.JSON(http.StatusOK, response)
+}
+
+func (h *Handler) UpdateDeckSettings(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	deckID := c.Param("id")
+	if deckID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Deck ID is required")
+	}
+
+	deck, err := h.db.GetDeck(deckID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck")
+	}
+
+	if deck.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+
+	req := new(UpdateDeckSettingsRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+
+	if err := c.Validate(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if req.LanguageCode != "" && !utils.IsKnownLanguageCode(req.LanguageCode) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown language code")
+	}
+
+	if req.TranscriptionType != "" && !utils.IsKnownTranscriptionType(req.TranscriptionType) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown transcription type")
+	}
+
+	if req.AudioContent != "" && !db.IsValidAudioContent(req.AudioContent) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown audio content")
+	}
+
+	if req.NewCardBoost != nil && (*req.NewCardBoost < 0 || *req.NewCardBoost > db.MaxNewCardsPerDay) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("New card boost must be between 0 and %d", db.MaxNewCardsPerDay))
+	}
+
+	if req.ExampleCount != nil && (*req.ExampleCount < 1 || *req.ExampleCount > db.MaxExampleCount) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Example count must be between 1 and %d", db.MaxExampleCount))
+	}
+
+	if req.ReviewMode != "" && !db.IsValidReviewMode(req.ReviewMode) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown review mode")
+	}
+
+	if req.RatingButtons != nil && !db.IsValidRatingButtons(*req.RatingButtons) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Rating buttons must be 2 or 4")
+	}
+
+	if req.LeechAction != "" && !db.IsValidLeechAction(req.LeechAction) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown leech action")
+	}
+
+	if req.NewCardDays != nil && !db.IsValidNewCardDays(*req.NewCardDays) {
+		return echo.NewHTTPError(http.StatusBadRequest, "New card days must select at least one weekday")
+	}
+
+	if req.StuckReviewLimit != nil && (*req.StuckReviewLimit < 0 || *req.StuckReviewLimit > db.MaxStuckReviewLimit) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Stuck review limit must be between 0 and %d", db.MaxStuckReviewLimit))
+	}
+
+	languageChanged := req.LanguageCode != "" && req.LanguageCode != deck.LanguageCode
+
+	deck.NewCardsPerDay = req.NewCardsPerDay
+	deck.Name = req.Name
+
+	if req.Description != nil {
+		deck.Description = *req.Description
+	}
+
+	if languageChanged {
+		deck.LanguageCode = req.LanguageCode
+		// The old transcription type rarely makes sense for a different language
+		deck.TranscriptionType = utils.GetDefaultTranscriptionType(req.LanguageCode)
+	}
+
+	if req.TranscriptionType != "" {
+		deck.TranscriptionType = req.TranscriptionType
+	}
+
+	if req.MinEase != nil {
+		deck.MinEase = *req.MinEase
+	}
+
+	if req.EaseGoodBonus != nil {
+		deck.EaseGoodBonus = *req.EaseGoodBonus
+	}
+
+	if req.EaseLapsePenalty != nil {
+		deck.EaseLapsePenalty = *req.EaseLapsePenalty
+	}
+
+	if req.IntervalModifier != nil {
+		deck.IntervalModifier = *req.IntervalModifier
+	}
+
+	if req.GenerateAudio != nil {
+		deck.GenerateAudio = *req.GenerateAudio
+	}
+
+	if req.GenerateImages != nil {
+		deck.GenerateImages = *req.GenerateImages
+	}
+
+	if req.AudioContent != "" {
+		deck.AudioContent = req.AudioContent
+	}
+
+	if req.NewCardDays != nil {
+		deck.NewCardDays = *req.NewCardDays
+	}
+
+	if req.StuckReviewLimit != nil {
+		deck.StuckReviewLimit = *req.StuckReviewLimit
+	}
+
+	if req.ConfidenceScheduling != nil {
+		deck.ConfidenceScheduling = *req.ConfidenceScheduling
+	}
+
+	if req.LeechAction != "" {
+		deck.LeechAction = req.LeechAction
+	}
+
+	if req.ExampleCount != nil {
+		deck.ExampleCount = *req.ExampleCount
+	}
+
+	if req.NewCardBoost != nil {
+		deck.NewCardBoost = *req.NewCardBoost
+	}
+
+	if req.ExampleOnBack != nil {
+		deck.ExampleOnBack = *req.ExampleOnBack
+	}
+
+	if req.RatingButtons != nil {
+		deck.RatingButtons = *req.RatingButtons
+	}
+
+	audioFrontEnabled := req.ReviewMode == db.ReviewModeAudioFront && deck.ReviewMode != db.ReviewModeAudioFront
+	if req.ReviewMode != "" {
+		deck.ReviewMode = req.ReviewMode
+	}
+
+	if deck.ReviewMode == db.ReviewModeAudioFront && !deck.GenerateAudio {
+		if req.GenerateAudio != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Audio can't be turned off for an audio-first deck")
+		}
+		deck.GenerateAudio = true
+	}
+
+	if err := h.db.UpdateDeckSettings(deckID, deck); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update deck settings: "+err.Error())
+	}
+
+	if languageChanged && req.RegenerateAudio && deck.GenerateAudio {
+		h.startDeckAudioRegeneration(deckID, userID, deck.LanguageCode, deck.AudioContent, false)
+	} else if audioFrontEnabled {
+		// cards generated while audio was off have nothing to play on their front
+		h.startDeckAudioRegeneration(deckID, userID, deck.LanguageCode, deck.AudioContent, true)
+	}
+
+	// Get updated deck to return to the client
+	updatedDeck, err := h.db.GetDeck(deckID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch updated deck")
+	}
+
+	return c.JSON(http.StatusOK, updatedDeck)
+}
+
+func (h *Handler) DeleteDeck(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	deckID := c.Param("id")
+	if deckID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Deck ID is required")
+	}
+
+	// Verify the deck exists and belongs to the user
+	deck, err := h.db.GetDeck(deckID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck")
+	}
+
+	if deck.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+
+	if err := h.db.DeleteDeck(deckID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete deck: "+err.Error())
+	}
+
+	h.deckAudio.stop(deckID)
+
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// MergeDecks moves all cards of the source deck into the target deck and removes the source
+func (h *Handler) MergeDecks(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	req := new(MergeDecksRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+
+	if err := c.Validate(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if req.SourceDeckID == req.TargetDeckID {
+		return echo.NewHTTPError(http.StatusBadRequest, "Cannot merge a deck into itself")
+	}
+
+	decks := make([]*db.Deck, 0, 2)
+	for _, deckID := range []string{req.SourceDeckID, req.TargetDeckID} {
+		deck, err := h.db.GetDeck(deckID)
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck").WithInternal(err)
+		}
+
+		if deck.UserID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+		}
+
+		decks = append(decks, deck)
+	}
+
+	source, target := decks[0], decks[1]
+	if source.LanguageCode != target.LanguageCode || source.TranscriptionType != target.TranscriptionType {
+		return echo.NewHTTPError(http.StatusBadRequest, "Decks must have the same language and transcription type")
+	}
+
+	moved, err := h.db.MergeDecks(userID, source.ID, target.ID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to merge decks").WithInternal(err)
+	}
+
+	merged, err := h.db.GetDeck(target.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, MergeDecksResponse{
+		Deck:       merged,
+		MovedCards: moved,
+	})
+}
+
+func (h *Handler) GetDeckSuggestions(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	deckID := c.Param("id")
+	if deckID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Deck ID is required")
+	}
+
+	deck, err := h.db.GetDeck(deckID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck")
+	}
+
+	if deck.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+
+	suggestions, err := h.db.GetDeckSuggestions(userID, deckID, deck.NewCardsPerDay)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to analyze deck").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, suggestions)
+}
+
+// GetDeckBreakdown returns how many of the deck's cards are in each state, unlike the due-oriented deck stats
+func (h *Handler) GetDeckBreakdown(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	deckID := c.Param("id")
+	if deckID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Deck ID is required")
+	}
+
+	deck, err := h.db.GetDeck(deckID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck")
+	}
+
+	if deck.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+
+	breakdown, err := h.db.GetDeckBreakdown(userID, deckID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to count deck cards").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, breakdown)
+}
+
+// GetStuckCards lists the deck's cards flagged for churning in learning without graduating
+func (h *Handler) GetStuckCards(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	deckID := c.Param("id")
+	if deckID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Deck ID is required")
+	}
+
+	deck, err := h.db.GetDeck(deckID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck")
+	}
+
+	if deck.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+
+	cards, err := h.db.GetStuckCards(userID, deckID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch stuck cards").WithInternal(err)
+	}
+
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
+	}
+	displayLanguage := db.ResolveDisplayLanguage(user.Settings, user.LanguageCode)
+
+	responses := make([]contract.CardResponse, 0, len(cards))
+	for _, card := range cards {
+		response, err := formatCardResponse(card, displayLanguage)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to format card response").WithInternal(err)
+		}
+		responses = append(responses, response)
+	}
+
+	return c.JSON(http.StatusOK, responses)
+}
+
+// MaxRecentCards caps the limit of GET /v1/cards/recent
+const MaxRecentCards = 100
+
+// GetRecentCards lists the user's newest cards across decks, e.g. to check what an import or the bot just added
+func (h *Handler) GetRecentCards(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	limit := parseIntQuery(c, "limit", 20)
+	if limit == 0 {
+		limit = 20
+	}
+	limit = min(limit, MaxRecentCards)
+
+	cards, err := h.db.GetRecentCards(userID, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch recent cards").WithInternal(err)
+	}
+
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
+	}
+	displayLanguage := db.ResolveDisplayLanguage(user.Settings, user.LanguageCode)
+
+	responses := make([]contract.RecentCardResponse, 0, len(cards))
+	for _, card := range cards {
+		response, err := formatCardResponse(card.Card, displayLanguage)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to format card response").WithInternal(err)
+		}
+		responses = append(responses, contract.RecentCardResponse{CardResponse: response, DeckName: card.DeckName})
+	}
+
+	return c.JSON(http.StatusOK, responses)
+}
+
+// MaxSearchCards caps the limit of GET /v1/cards/search
+const MaxSearchCards = 100
+
+// SearchCards finds the user's cards by term, meaning or example, each listed with the name of its deck
+func (h *Handler) SearchCards(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	query := strings.TrimSpace(c.QueryParam("q"))
+	if query == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Search query is required")
+	}
+
+	limit := parseIntQuery(c, "limit", 20)
+	if limit == 0 {
+		limit = 20
+	}
+	limit = min(limit, MaxSearchCards)
+	offset := parseIntQuery(c, "offset", 0)
+
+	cards, err := h.db.SearchCards(userID, query, limit, offset)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to search cards").WithInternal(err)
+	}
+
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
+	}
+	displayLanguage := db.ResolveDisplayLanguage(user.Settings, user.LanguageCode)
+
+	deckNames := make(map[string]string)
+	responses := make([]contract.RecentCardResponse, 0, len(cards))
+	for _, card := range cards {
+		deckName, ok := deckNames[card.DeckID]
+		if !ok {
+			deck, err := h.db.GetDeck(card.DeckID)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck").WithInternal(err)
+			}
+			deckName = deck.Name
+			deckNames[card.DeckID] = deckName
+		}
+
+		response, err := formatCardResponse(card, displayLanguage)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to format card response").WithInternal(err)
+		}
+		responses = append(responses, contract.RecentCardResponse{CardResponse: response, DeckName: deckName})
+	}
+
+	return c.JSON(http.StatusOK, responses)
 }
 
 func (h *Handler) UpdateCard(c echo.Context) error {
@@ -424,7 +1370,7 @@ func (h *Handler) UpdateCard(c echo.Context) error {
 	card, err := h.db.GetCard(cardID, userID)
 	if err != nil {
 		if errors.Is(err, db.ErrNotFound) {
-			return echo.NewHTTPError(http.StatusNotFound, "Card not found")
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeCardNotFound, "Card not found")
 		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch card").WithInternal(err)
 	}
@@ -447,13 +1393,25 @@ func (h *Handler) UpdateCard(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	fieldsJSON, err := json.Marshal(req.Fields)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to process card fields")
+	if req.Priority != nil && !db.IsValidCardPriority(*req.Priority) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Priority must be between %d and %d", db.MinCardPriority, db.MaxCardPriority))
 	}
 
-	if err := h.db.UpdateCardFields(cardID, string(fieldsJSON)); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update card")
+	if req.Fields != nil {
+		fieldsJSON, err := json.Marshal(req.Fields)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to process card fields")
+		}
+
+		if err := h.db.UpdateCardFields(cardID, string(fieldsJSON)); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update card")
+		}
+	}
+
+	if req.Priority != nil {
+		if err := h.db.UpdateCardPriority(cardID, userID, *req.Priority); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update card priority").WithInternal(err)
+		}
 	}
 
 	updatedCard, err := h.db.GetCard(cardID, userID)
@@ -461,7 +1419,264 @@ func (h *Handler) UpdateCard(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch updated card")
 	}
 
-	response, err := formatCardResponse(*updatedCard)
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
+	}
+	displayLanguage := db.ResolveDisplayLanguage(user.Settings, user.LanguageCode)
+
+	response, err := formatCardResponse(*updatedCard, displayLanguage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to format card response")
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (h *Handler) DeleteCard(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	cardID := c.Param("id")
+	if cardID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Card ID is required")
+	}
+
+	card, err := h.db.GetCard(cardID, userID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeCardNotFound, "Card not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch card").WithInternal(err)
+	}
+
+	deck, err := h.db.GetDeck(card.DeckID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to verify card ownership")
+	}
+
+	if deck.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+
+	if err := h.db.DeleteCard(cardID, userID); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeCardNotFound, "Card not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete card").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// BulkSuspendCards takes every card matching the filter out of study
+func (h *Handler) BulkSuspendCards(c echo.Context) error {
+	return h.setCardsSuspended(c, true)
+}
+
+// BulkUnsuspendCards brings every suspended card matching the filter back into study
+func (h *Handler) BulkUnsuspendCards(c echo.Context) error {
+	return h.setCardsSuspended(c, false)
+}
+
+func (h *Handler) setCardsSuspended(c echo.Context, suspended bool) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	req := new(BulkSuspendRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+
+	if req.DeckID == "" && req.Tag == "" && req.IsLeech == nil && req.State == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "At least one filter is required")
+	}
+
+	if req.Tag != "" && !db.IsValidTag(req.Tag) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid tag")
+	}
+
+	if req.State != "" && !db.IsValidCardState(req.State) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid card state")
+	}
+
+	filter := db.CardFilter{DeckID: req.DeckID, Tag: req.Tag, IsLeech: req.IsLeech, State: req.State}
+
+	// SetCardsSuspended only matches cards and decks owned by the user, so no separate ownership check is needed
+	count, err := h.db.SetCardsSuspended(userID, filter, suspended)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update cards").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, BulkSuspendResponse{Count: count})
+}
+
+// SuspendCard keeps a single card out of study without deleting it, or brings it back
+func (h *Handler) SuspendCard(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	cardID := c.Param("id")
+	if cardID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Card ID is required")
+	}
+
+	req := new(SuspendCardRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+
+	suspended := req.Suspended == nil || *req.Suspended
+
+	// SuspendCard only matches cards owned by the user, so no separate ownership check is needed
+	if err := h.db.SuspendCard(cardID, userID, suspended); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeCardNotFound, "Card not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update card").WithInternal(err)
+	}
+
+	card, err := h.db.GetCard(cardID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch updated card").WithInternal(err)
+	}
+
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
+	}
+	displayLanguage := db.ResolveDisplayLanguage(user.Settings, user.LanguageCode)
+
+	response, err := formatCardResponse(*card, displayLanguage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to format card response").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// BuryCard hides a card from study for the rest of the day, it comes back by itself tomorrow
+func (h *Handler) BuryCard(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	cardID := c.Param("id")
+	if cardID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Card ID is required")
+	}
+
+	// BuryCard only matches cards owned by the user, so no separate ownership check is needed
+	buriedUntil, err := h.db.BuryCard(cardID, userID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeCardNotFound, "Card not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to bury card").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, BuryCardResponse{BuriedUntil: buriedUntil})
+}
+
+// MaxDeckCards caps the limit of GET /v1/decks/:id/cards
+const MaxDeckCards = 200
+
+// GetDeckCards lists a deck's cards for browsing a page at a time, suspended cards included so they can be
+// unsuspended. Pages are chosen with limit and offset.
+func (h *Handler) GetDeckCards(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	deckID := c.Param("id")
+	if deckID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Deck ID is required")
+	}
+
+	deck, err := h.db.GetDeck(deckID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck").WithInternal(err)
+	}
+
+	if deck.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+
+	limit := parseIntQuery(c, "limit", 50)
+	if limit == 0 {
+		limit = 50
+	}
+	limit = min(limit, MaxDeckCards)
+	offset := parseIntQuery(c, "offset", 0)
+
+	cards, err := h.db.GetDeckCardsPage(deckID, userID, limit, offset)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck cards").WithInternal(err)
+	}
+
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
+	}
+	displayLanguage := db.ResolveDisplayLanguage(user.Settings, user.LanguageCode)
+
+	responses := make([]contract.CardResponse, 0, len(cards))
+	for _, card := range cards {
+		response, err := formatCardResponse(card, displayLanguage)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to format card response").WithInternal(err)
+		}
+		responses = append(responses, response)
+	}
+
+	return c.JSON(http.StatusOK, responses)
+}
+
+func (h *Handler) RestoreCard(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	cardID := c.Param("id")
+	if cardID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Card ID is required")
+	}
+
+	// RestoreCard only matches cards owned by the user, so no separate ownership check is needed
+	if err := h.db.RestoreCard(cardID, userID); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeCardNotFound, "Deleted card not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to restore card").WithInternal(err)
+	}
+
+	restoredCard, err := h.db.GetCard(cardID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch restored card").WithInternal(err)
+	}
+
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
+	}
+	displayLanguage := db.ResolveDisplayLanguage(user.Settings, user.LanguageCode)
+
+	response, err := formatCardResponse(*restoredCard, displayLanguage)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to format card response")
 	}
@@ -3,11 +3,15 @@ package handler_test
 import (
 	"atamagaii/internal/contract"
 	"atamagaii/internal/db"
+	"atamagaii/internal/handler"
 	"atamagaii/internal/testutils"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
+	"math"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 )
@@ -28,10 +32,11 @@ func TestImportDeckFromFile(t *testing.T) {
 		t.Error("Expected non-empty JWT token")
 	}
 
-	reqBody := map[string]string{
+	reqBody := map[string]any{
 		"name":        "N5 Vocabulary",
 		"description": "Basic Japanese vocabulary for JLPT N5 level",
-		"file_name":   "vocab_n5.json",
+		"file_name":   "japanese_n5.json",
+		"force":       true,
 	}
 	body, _ := json.Marshal(reqBody)
 
@@ -55,8 +60,8 @@ func TestImportDeckFromFile(t *testing.T) {
 		t.Errorf("Expected deck name 'N5 Vocabulary', got '%s'", deck.Name)
 	}
 
-	if deck.Level != "N5" {
-		t.Errorf("Expected deck level 'N5', got '%s'", deck.Level)
+	if deck.Level != "beginner" {
+		t.Errorf("Expected deck level 'beginner', got '%s'", deck.Level)
 	}
 
 	if deck.UserID != resp.User.ID {
@@ -169,10 +174,11 @@ func TestGetDueCards(t *testing.T) {
 		t.Fatalf("Failed to authenticate: %v", err)
 	}
 
-	reqBody := map[string]string{
+	reqBody := map[string]any{
 		"name":        "Test Vocabulary",
 		"description": "Test deck for due cards",
-		"file_name":   "vocab_n5.json",
+		"file_name":   "japanese_n5.json",
+		"force":       true,
 	}
 
 	body, _ := json.Marshal(reqBody)
@@ -262,10 +268,11 @@ func TestGetDecksWithDueCards(t *testing.T) {
 	}
 
 	// Import a deck
-	reqBody := map[string]string{
+	reqBody := map[string]any{
 		"name":        "Test Deck for Due Cards",
 		"description": "Testing due cards in deck listing",
-		"file_name":   "vocab_n5.json",
+		"file_name":   "japanese_n5.json",
+		"force":       true,
 	}
 	body, _ := json.Marshal(reqBody)
 
@@ -335,10 +342,11 @@ func TestDeckMetrics(t *testing.T) {
 	}
 
 	// Import a deck
-	reqBody := map[string]string{
+	reqBody := map[string]any{
 		"name":        "Test Deck for Metrics",
 		"description": "Testing card metrics in deck",
-		"file_name":   "vocab_n5.json",
+		"file_name":   "japanese_n5.json",
+		"force":       true,
 	}
 	body, _ := json.Marshal(reqBody)
 
@@ -451,3 +459,1177 @@ func TestDeckMetrics(t *testing.T) {
 func strPtr(s string) *string {
 	return &s
 }
+
+func containsCard(cards []contract.CardResponse, cardID string) bool {
+	for _, card := range cards {
+		if card.ID == cardID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDeleteAndRestoreCard(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	deck := importTestDeck(t, e, resp.Token, "Delete Card Deck")
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+
+	testutils.PerformRequest(t, e, http.MethodDelete, "/v1/cards/"+card.ID, "", resp.Token, http.StatusOK)
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/due?deck_id="+deck.ID+"&limit=7", "", resp.Token, http.StatusOK)
+	if containsCard(testutils.ParseResponse[[]contract.CardResponse](t, rec), card.ID) {
+		t.Error("Deleted card should not appear in due cards")
+	}
+
+	testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/"+card.ID, "", resp.Token, http.StatusNotFound)
+	testutils.PerformRequest(t, e, http.MethodDelete, "/v1/cards/"+card.ID, "", resp.Token, http.StatusNotFound)
+
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+card.ID+"/restore", "", resp.Token, http.StatusOK)
+	restored := testutils.ParseResponse[contract.CardResponse](t, rec)
+
+	if restored.ID != card.ID {
+		t.Errorf("Expected restored card ID %s, got %s", card.ID, restored.ID)
+	}
+
+	if restored.Fields.Term != card.Fields.Term {
+		t.Errorf("Expected restored term %q, got %q", card.Fields.Term, restored.Fields.Term)
+	}
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/due?deck_id="+deck.ID+"&limit=7", "", resp.Token, http.StatusOK)
+	if !containsCard(testutils.ParseResponse[[]contract.CardResponse](t, rec), card.ID) {
+		t.Error("Restored card should appear in due cards again")
+	}
+
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+card.ID+"/restore", "", resp.Token, http.StatusNotFound)
+}
+
+func TestImportDeckFromFile_FrequencyCutoff(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	body, _ := json.Marshal(handler.CreateDeckFromFileRequest{Name: "No Frequency", FileName: "japanese_n5.json", MaxFrequencyRank: 100})
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), resp.Token, http.StatusBadRequest)
+
+	body, _ = json.Marshal(handler.CreateDeckFromFileRequest{Name: "Too Strict", FileName: "japanese_kaishi_ru.json", MaxFrequencyRank: 5})
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), resp.Token, http.StatusBadRequest)
+
+	body, _ = json.Marshal(handler.CreateDeckFromFileRequest{Name: "Top Kaishi", FileName: "japanese_kaishi_ru.json", MaxFrequencyRank: 100})
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), resp.Token, http.StatusCreated)
+	deck := testutils.ParseResponse[handler.CreateDeckFromFileResponse](t, rec)
+
+	// 49 of the 1500 Kaishi entries have a frequency rank of 100 or better
+	if deck.FilteredItems != 1451 {
+		t.Errorf("Expected 1451 entries to be filtered out, got %d", deck.FilteredItems)
+	}
+
+	cards, err := testutils.GetDBStorage().GetCardsByDeckID(deck.ID, resp.User.ID)
+	if err != nil {
+		t.Fatalf("Failed to load cards: %v", err)
+	}
+	if len(cards) != 49 {
+		t.Fatalf("Expected 49 cards, got %d", len(cards))
+	}
+
+	for _, card := range cards {
+		var item db.VocabularyItem
+		if err := json.Unmarshal([]byte(card.Fields), &item); err != nil {
+			t.Fatalf("Failed to parse card fields: %v", err)
+		}
+		if item.Frequency < 1 || item.Frequency > 100 {
+			t.Errorf("Card %q has frequency rank %d outside the cutoff", item.Term, item.Frequency)
+		}
+	}
+}
+
+func TestMergeDecks(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	storage := testutils.GetDBStorage()
+
+	source := importTestDeck(t, e, resp.Token, "Merge Source Deck")
+	target := importTestDeck(t, e, resp.Token, "Merge Target Deck")
+
+	sourceCards, err := storage.GetCardsByDeckID(source.ID, resp.User.ID)
+	if err != nil {
+		t.Fatalf("Failed to load source cards: %v", err)
+	}
+	targetCards, err := storage.GetCardsByDeckID(target.ID, resp.User.ID)
+	if err != nil {
+		t.Fatalf("Failed to load target cards: %v", err)
+	}
+
+	studied := firstDueCard(t, e, resp.Token, source.ID)
+	reviewJSON, _ := json.Marshal(map[string]int{"rating": db.RatingGood, "time_spent_ms": 3000})
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+studied.ID+"/review", string(reviewJSON), resp.Token, http.StatusOK)
+
+	before, err := storage.GetCard(studied.ID, resp.User.ID)
+	if err != nil {
+		t.Fatalf("Failed to load reviewed card: %v", err)
+	}
+
+	other, err := storage.CreateDeck(resp.User.ID, db.CreateDeckParams{Name: "Chinese Deck", Level: "mixed", LanguageCode: "zh", TranscriptionType: "pinyin"})
+	if err != nil {
+		t.Fatalf("Failed to create deck: %v", err)
+	}
+
+	mismatched, _ := json.Marshal(handler.MergeDecksRequest{SourceDeckID: other.ID, TargetDeckID: target.ID})
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/merge", string(mismatched), resp.Token, http.StatusBadRequest)
+
+	stranger, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+9, "stranger", "Stranger")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	body, _ := json.Marshal(handler.MergeDecksRequest{SourceDeckID: source.ID, TargetDeckID: target.ID})
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/merge", string(body), stranger.Token, http.StatusForbidden)
+
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/merge", string(body), resp.Token, http.StatusOK)
+	merged := testutils.ParseResponse[handler.MergeDecksResponse](t, rec)
+
+	if merged.MovedCards != len(sourceCards) {
+		t.Errorf("Expected %d moved cards, got %d", len(sourceCards), merged.MovedCards)
+	}
+
+	cards, err := storage.GetCardsByDeckID(target.ID, resp.User.ID)
+	if err != nil {
+		t.Fatalf("Failed to load merged cards: %v", err)
+	}
+	if len(cards) != len(sourceCards)+len(targetCards) {
+		t.Errorf("Expected %d cards in the target deck, got %d", len(sourceCards)+len(targetCards), len(cards))
+	}
+
+	testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+source.ID, "", resp.Token, http.StatusNotFound)
+
+	after, err := storage.GetCard(studied.ID, resp.User.ID)
+	if err != nil {
+		t.Fatalf("Failed to load moved card: %v", err)
+	}
+	if after.DeckID != target.ID {
+		t.Errorf("Expected card to move to deck %s, got %s", target.ID, after.DeckID)
+	}
+	if after.State != before.State || after.ReviewCount != before.ReviewCount || after.Interval != before.Interval {
+		t.Errorf("Expected SRS state to be preserved, before %+v, after %+v", before, after)
+	}
+
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/merge", string(body), resp.Token, http.StatusNotFound)
+}
+
+func TestUpdateDeckSettings_LanguageAndTranscription(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	deck := importTestDeck(t, e, resp.Token, "Language Deck")
+	if deck.LanguageCode != "jp" {
+		t.Fatalf("Expected imported deck language jp, got %s", deck.LanguageCode)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"name":              deck.Name,
+		"new_cards_per_day": deck.NewCardsPerDay,
+		"language_code":     "zh",
+	})
+
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(body), resp.Token, http.StatusOK)
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+deck.ID, "", resp.Token, http.StatusOK)
+	updated := testutils.ParseResponse[db.Deck](t, rec)
+
+	if updated.LanguageCode != "zh" {
+		t.Errorf("Expected language code zh, got %s", updated.LanguageCode)
+	}
+
+	if updated.TranscriptionType != "pinyin" {
+		t.Errorf("Expected transcription type pinyin, got %s", updated.TranscriptionType)
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{
+		"name":               deck.Name,
+		"new_cards_per_day":  deck.NewCardsPerDay,
+		"transcription_type": "none",
+	})
+
+	rec = testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(body), resp.Token, http.StatusOK)
+	updated = testutils.ParseResponse[db.Deck](t, rec)
+
+	if updated.LanguageCode != "zh" || updated.TranscriptionType != "none" {
+		t.Errorf("Expected zh/none, got %s/%s", updated.LanguageCode, updated.TranscriptionType)
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{
+		"name":              deck.Name,
+		"new_cards_per_day": deck.NewCardsPerDay,
+		"language_code":     "xx",
+	})
+
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(body), resp.Token, http.StatusBadRequest)
+}
+
+func seedMatureReviews(t *testing.T, userID, deckID string, passed, failed int) {
+	storage := testutils.GetDBStorage()
+
+	cards, err := storage.GetCardsByDeckID(deckID, userID)
+	if err != nil {
+		t.Fatalf("Failed to fetch deck cards: %v", err)
+	}
+
+	if len(cards) < passed+failed {
+		t.Fatalf("Deck has %d cards, need %d", len(cards), passed+failed)
+	}
+
+	deck, err := storage.GetDeck(deckID)
+	if err != nil {
+		t.Fatalf("Failed to fetch deck: %v", err)
+	}
+
+	for i, card := range cards[:passed+failed] {
+		card.State = string(db.StateReview)
+		card.Interval = daysToDuration(3)
+		card.Ease = 2.5
+
+		rating := db.RatingGood
+		if i >= passed {
+			rating = db.RatingAgain
+		}
+
+		if err := storage.ReviewCard(&card, deck, rating, 3000); err != nil {
+			t.Fatalf("Failed to seed review: %v", err)
+		}
+	}
+}
+
+func TestGetDeckSuggestions(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	highDeck := importTestDeck(t, e, resp.Token, "High Retention Deck")
+	lowDeck := importTestDeck(t, e, resp.Token, "Low Retention Deck")
+	freshDeck := importTestDeck(t, e, resp.Token, "Fresh Deck")
+
+	seedMatureReviews(t, resp.User.ID, highDeck.ID, 20, 0)
+	seedMatureReviews(t, resp.User.ID, lowDeck.ID, 14, 6)
+
+	tests := []struct {
+		name      string
+		deckID    string
+		retention float64
+		expected  string
+	}{
+		{name: "High retention", deckID: highDeck.ID, retention: 1, expected: "consider raising new cards"},
+		{name: "Low retention", deckID: lowDeck.ID, retention: 0.7, expected: "intervals may be too long"},
+		{name: "No history", deckID: freshDeck.ID, retention: 0, expected: "Not enough review history"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+tt.deckID+"/suggestions", "", resp.Token, http.StatusOK)
+			suggestions := testutils.ParseResponse[db.DeckSuggestions](t, rec)
+
+			if math.Abs(suggestions.Retention-tt.retention) > 0.001 {
+				t.Errorf("Expected retention %.2f, got %.2f", tt.retention, suggestions.Retention)
+			}
+
+			if len(suggestions.Suggestions) == 0 || !strings.Contains(suggestions.Suggestions[0], tt.expected) {
+				t.Errorf("Expected suggestion containing %q, got %v", tt.expected, suggestions.Suggestions)
+			}
+		})
+	}
+}
+
+func TestUpdateDeckSettings_EaseSettings(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	deck := importTestDeck(t, e, resp.Token, "Ease Deck")
+	if deck.MinEase != db.MinEaseFactor || deck.EaseLapsePenalty != db.DefaultEaseLapsePenalty {
+		t.Fatalf("Expected default ease settings, got min %.2f, penalty %.2f", deck.MinEase, deck.EaseLapsePenalty)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"name":               deck.Name,
+		"new_cards_per_day":  deck.NewCardsPerDay,
+		"ease_lapse_penalty": 0.5,
+	})
+
+	rec := testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(body), resp.Token, http.StatusOK)
+	updated := testutils.ParseResponse[db.Deck](t, rec)
+
+	if updated.EaseLapsePenalty != 0.5 {
+		t.Errorf("Expected lapse penalty 0.5, got %.2f", updated.EaseLapsePenalty)
+	}
+
+	if updated.MinEase != db.MinEaseFactor || updated.EaseGoodBonus != db.DefaultEaseGoodBonus {
+		t.Errorf("Unset ease settings should keep their defaults, got min %.2f, bonus %.2f", updated.MinEase, updated.EaseGoodBonus)
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{
+		"name":              deck.Name,
+		"new_cards_per_day": deck.NewCardsPerDay,
+		"min_ease":          0.5,
+	})
+
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(body), resp.Token, http.StatusBadRequest)
+}
+
+func TestDeckDescription(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"name":        "Described Deck",
+		"description": "Core N5 vocabulary",
+		"file_name":   "japanese_n5.json",
+		"force":       true,
+	})
+
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), resp.Token, http.StatusCreated)
+	deck := testutils.ParseResponse[db.Deck](t, rec)
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+deck.ID, "", resp.Token, http.StatusOK)
+	fetched := testutils.ParseResponse[db.Deck](t, rec)
+
+	if fetched.Description != "Core N5 vocabulary" {
+		t.Errorf("Expected description %q, got %q", "Core N5 vocabulary", fetched.Description)
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{
+		"name":              fetched.Name,
+		"new_cards_per_day": fetched.NewCardsPerDay,
+		"description":       "Updated description",
+	})
+
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(body), resp.Token, http.StatusOK)
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+deck.ID, "", resp.Token, http.StatusOK)
+	fetched = testutils.ParseResponse[db.Deck](t, rec)
+
+	if fetched.Description != "Updated description" {
+		t.Errorf("Expected description %q, got %q", "Updated description", fetched.Description)
+	}
+}
+
+func TestImportDeck_LevelNotDescription(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"name":        "Level Deck",
+		"description": "This should not end up in level",
+		"file_name":   "japanese_n5.json",
+		"force":       true,
+	})
+
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), resp.Token, http.StatusCreated)
+	deck := testutils.ParseResponse[db.Deck](t, rec)
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+deck.ID, "", resp.Token, http.StatusOK)
+	fetched := testutils.ParseResponse[db.Deck](t, rec)
+
+	if fetched.Level != "beginner" {
+		t.Errorf("Expected level %q from deck metadata, got %q", "beginner", fetched.Level)
+	}
+
+	if fetched.Description != "This should not end up in level" {
+		t.Errorf("Expected description to be stored separately, got %q", fetched.Description)
+	}
+
+	generated, err := testutils.GetDBStorage().GetOrCreateGeneratedDeck(resp.User.ID, "th", "thai_romanization")
+	if err != nil {
+		t.Fatalf("Failed to create generated deck: %v", err)
+	}
+
+	if generated.Level != "mixed" || generated.Description != "" {
+		t.Errorf("Expected generated deck level %q and empty description, got %q / %q", "mixed", generated.Level, generated.Description)
+	}
+}
+
+func findAvailableDeck(t *testing.T, available handler.AvailableDecksResponse, fileName string) handler.DeckInfo {
+	for _, lang := range available.Languages {
+		for _, deck := range lang.Decks {
+			if deck.ID == fileName {
+				return deck
+			}
+		}
+	}
+
+	t.Fatalf("Deck %s not found in available decks", fileName)
+	return handler.DeckInfo{}
+}
+
+func TestGetAvailableDecks_ImportedFlag(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	// A separate user so decks imported by other tests don't count
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+1, "importer", "Importer")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/available", "", resp.Token, http.StatusOK)
+	available := testutils.ParseResponse[handler.AvailableDecksResponse](t, rec)
+
+	if findAvailableDeck(t, available, "japanese_time_terms.json").Imported {
+		t.Fatal("Deck should not be flagged imported before importing it")
+	}
+
+	body, _ := json.Marshal(map[string]string{
+		"name":      "Time Terms",
+		"file_name": "japanese_time_terms.json",
+	})
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), resp.Token, http.StatusCreated)
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/available", "", resp.Token, http.StatusOK)
+	available = testutils.ParseResponse[handler.AvailableDecksResponse](t, rec)
+
+	if !findAvailableDeck(t, available, "japanese_time_terms.json").Imported {
+		t.Error("Imported deck should be flagged imported")
+	}
+
+	if findAvailableDeck(t, available, "japanese_n5.json").Imported {
+		t.Error("Deck that was not imported should not be flagged")
+	}
+}
+
+func TestGetAvailableDecks_LanguageFilter(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/available", "", resp.Token, http.StatusOK)
+	all := testutils.ParseResponse[handler.AvailableDecksResponse](t, rec)
+	if len(all.Languages) < 2 {
+		t.Fatalf("Expected the full listing to span several languages, got %d", len(all.Languages))
+	}
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/available?language=ge", "", resp.Token, http.StatusOK)
+	georgian := testutils.ParseResponse[handler.AvailableDecksResponse](t, rec)
+
+	if len(georgian.Languages) != 1 || georgian.Languages[0].Code != "ge" {
+		t.Fatalf("Expected only the Georgian group, got %+v", georgian.Languages)
+	}
+	if len(georgian.Languages[0].Decks) == 0 {
+		t.Error("Georgian group should keep its decks")
+	}
+
+	testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/available?language=xx", "", resp.Token, http.StatusNotFound)
+}
+
+func TestImportDeckFromFile_Idempotent(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+12, "repeater", "Repeater")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	body, _ := json.Marshal(handler.CreateDeckFromFileRequest{Name: "Tapped Twice", FileName: "japanese_n5.json"})
+
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), resp.Token, http.StatusCreated)
+	first := testutils.ParseResponse[handler.CreateDeckFromFileResponse](t, rec)
+	if first.AlreadyExists {
+		t.Error("First import should create a deck")
+	}
+
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), resp.Token, http.StatusOK)
+	second := testutils.ParseResponse[handler.CreateDeckFromFileResponse](t, rec)
+	if !second.AlreadyExists || second.ID != first.ID {
+		t.Errorf("Repeated import should return the existing deck %s, got %s (already_exists=%v)", first.ID, second.ID, second.AlreadyExists)
+	}
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks", "", resp.Token, http.StatusOK)
+	decks := testutils.ParseResponse[[]db.Deck](t, rec)
+	if len(decks) != 1 {
+		t.Fatalf("Expected 1 deck after importing the same file twice, got %d", len(decks))
+	}
+
+	body, _ = json.Marshal(handler.CreateDeckFromFileRequest{Name: "Tapped Twice Again", FileName: "japanese_n5.json", Force: true})
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), resp.Token, http.StatusCreated)
+	forced := testutils.ParseResponse[handler.CreateDeckFromFileResponse](t, rec)
+	if forced.ID == first.ID {
+		t.Error("Forced import should create a new deck")
+	}
+
+	// deleting the deck lets the file be imported again without force
+	testutils.PerformRequest(t, e, http.MethodDelete, "/v1/decks/"+forced.ID, "", resp.Token, http.StatusOK)
+	testutils.PerformRequest(t, e, http.MethodDelete, "/v1/decks/"+first.ID, "", resp.Token, http.StatusOK)
+	body, _ = json.Marshal(handler.CreateDeckFromFileRequest{Name: "Reimported", FileName: "japanese_n5.json"})
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), resp.Token, http.StatusCreated)
+}
+
+func TestImportDeckFromFile_UserDefaultNewCardsPerDay(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+14, "steady", "Steady")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	body, _ := json.Marshal(handler.CreateDeckFromFileRequest{Name: "Default Pace", FileName: "japanese_n5.json"})
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), resp.Token, http.StatusCreated)
+	deck := testutils.ParseResponse[db.Deck](t, rec)
+	if deck.NewCardsPerDay != db.DefaultNewCardsPerDay {
+		t.Errorf("Expected new_cards_per_day %d without a user default, got %d", db.DefaultNewCardsPerDay, deck.NewCardsPerDay)
+	}
+
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", `{"settings":{"default_new_cards_per_day":0}}`, resp.Token, http.StatusBadRequest)
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", `{"settings":{"default_new_cards_per_day":501}}`, resp.Token, http.StatusBadRequest)
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", `{"settings":{"default_new_cards_per_day":15}}`, resp.Token, http.StatusOK)
+
+	body, _ = json.Marshal(handler.CreateDeckFromFileRequest{Name: "Own Pace", FileName: "japanese_n5.json", Force: true})
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), resp.Token, http.StatusCreated)
+	deck = testutils.ParseResponse[db.Deck](t, rec)
+	if deck.NewCardsPerDay != 15 {
+		t.Errorf("Expected imported deck to start at the user default of 15, got %d", deck.NewCardsPerDay)
+	}
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+deck.ID, "", resp.Token, http.StatusOK)
+	stored := testutils.ParseResponse[db.Deck](t, rec)
+	if stored.NewCardsPerDay != 15 {
+		t.Errorf("Expected stored deck to keep new_cards_per_day 15, got %d", stored.NewCardsPerDay)
+	}
+}
+
+func TestImportDeckFromFile_DryRun(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+15, "previewer", "Previewer")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	body, _ := json.Marshal(handler.CreateDeckFromFileRequest{Name: "Preview Only", FileName: "japanese_n5.json", DryRun: true})
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), resp.Token, http.StatusOK)
+	preview := testutils.ParseResponse[handler.ImportPreviewResponse](t, rec)
+
+	if preview.Name != "Preview Only" || preview.LanguageCode != "jp" || preview.TranscriptionType != "furigana" {
+		t.Errorf("Unexpected preview metadata: %+v", preview)
+	}
+	if preview.CardCount == 0 {
+		t.Error("Expected the preview to count the cards that would be imported")
+	}
+	if len(preview.SampleCards) != handler.ImportPreviewSize {
+		t.Errorf("Expected %d sample cards, got %d", handler.ImportPreviewSize, len(preview.SampleCards))
+	}
+	for _, card := range preview.SampleCards {
+		if card.Term == "" || card.LanguageCode != "jp" {
+			t.Errorf("Sample card should be mapped like an imported card, got %+v", card)
+		}
+	}
+	if preview.AlreadyImported {
+		t.Error("Nothing was imported yet")
+	}
+
+	decks, err := testutils.GetDBStorage().GetDecks(resp.User.ID, db.DefaultUserSettings())
+	if err != nil {
+		t.Fatalf("Failed to fetch decks: %v", err)
+	}
+	if len(decks) != 0 {
+		t.Fatalf("Dry run should not create a deck, found %d", len(decks))
+	}
+
+	body, _ = json.Marshal(handler.CreateDeckFromFileRequest{Name: "Preview Only", FileName: "japanese_n5.json"})
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), resp.Token, http.StatusCreated)
+	deck := testutils.ParseResponse[handler.CreateDeckFromFileResponse](t, rec)
+
+	cards, err := testutils.GetDBStorage().GetCardsByDeckID(deck.ID, resp.User.ID)
+	if err != nil {
+		t.Fatalf("Failed to fetch cards: %v", err)
+	}
+	if len(cards) != preview.CardCount {
+		t.Errorf("Preview counted %d cards but the import created %d", preview.CardCount, len(cards))
+	}
+
+	body, _ = json.Marshal(handler.CreateDeckFromFileRequest{Name: "Preview Again", FileName: "japanese_n5.json", DryRun: true})
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), resp.Token, http.StatusOK)
+	preview = testutils.ParseResponse[handler.ImportPreviewResponse](t, rec)
+	if !preview.AlreadyImported {
+		t.Error("Preview should flag a file the user already imported")
+	}
+}
+
+func TestCardResponse_IntervalDisplay(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	deck := importTestDeck(t, e, resp.Token, "Interval Display Deck")
+	dueCard := firstDueCard(t, e, resp.Token, deck.ID)
+
+	if dueCard.IntervalDisplay != "" {
+		t.Errorf("New card should have no interval display, got %q", dueCard.IntervalDisplay)
+	}
+
+	storage := testutils.GetDBStorage()
+
+	card, err := storage.GetCard(dueCard.ID, resp.User.ID)
+	if err != nil {
+		t.Fatalf("Failed to fetch card: %v", err)
+	}
+
+	dbDeck, err := storage.GetDeck(deck.ID)
+	if err != nil {
+		t.Fatalf("Failed to fetch deck: %v", err)
+	}
+
+	// Ease 2.4 + 0.1 bonus = 2.5, so a 1.2 day interval grows to 3 days (fuzz stays within rounding)
+	card.State = string(db.StateReview)
+	card.Interval = daysToDuration(1.2)
+	card.Ease = 2.4
+
+	if err := storage.ReviewCard(card, dbDeck, db.RatingGood, 3000); err != nil {
+		t.Fatalf("Failed to review card: %v", err)
+	}
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/"+card.ID, "", resp.Token, http.StatusOK)
+	reviewed := testutils.ParseResponse[contract.CardResponse](t, rec)
+
+	if reviewed.IntervalDisplay != "3d" {
+		t.Errorf("Expected interval display %q, got %q", "3d", reviewed.IntervalDisplay)
+	}
+
+	if reviewed.DueInDisplay != "3d" {
+		t.Errorf("Expected due in display %q, got %q", "3d", reviewed.DueInDisplay)
+	}
+}
+
+func TestExportStudyHistoryCSV(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	// A separate user so reviews made by other tests don't show up in the export
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+2, "exporter", "Exporter")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	other, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	deck := importTestDeck(t, e, resp.Token, "Export Deck")
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/due?deck_id="+deck.ID+"&limit=3", "", resp.Token, http.StatusOK)
+	cards := testutils.ParseResponse[[]contract.CardResponse](t, rec)
+	if len(cards) != 3 {
+		t.Fatalf("Expected 3 due cards, got %d", len(cards))
+	}
+
+	reviewJSON, _ := json.Marshal(map[string]int{"rating": db.RatingGood, "time_spent_ms": 4200})
+	terms := make(map[string]bool, len(cards))
+	for _, card := range cards {
+		testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+card.ID+"/review", string(reviewJSON), resp.Token, http.StatusOK)
+		terms[card.Fields.Term] = true
+	}
+
+	otherDeck := importTestDeck(t, e, other.Token, "Other Export Deck")
+	otherCard := firstDueCard(t, e, other.Token, otherDeck.ID)
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+otherCard.ID+"/review", string(reviewJSON), other.Token, http.StatusOK)
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/stats/history.csv", "", resp.Token, http.StatusOK)
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("Expected CSV content type, got %q", ct)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); !strings.Contains(cd, "attachment") {
+		t.Errorf("Expected attachment content disposition, got %q", cd)
+	}
+
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to parse CSV: %v", err)
+	}
+
+	expectedHeader := []string{"date", "term", "deck", "rating", "time_spent_ms", "prev_interval_seconds", "new_interval_seconds"}
+	if len(records) == 0 || strings.Join(records[0], ",") != strings.Join(expectedHeader, ",") {
+		t.Fatalf("Unexpected CSV header: %v", records)
+	}
+
+	rows := records[1:]
+	if len(rows) != len(cards) {
+		t.Fatalf("Expected one row per review (%d), got %d", len(cards), len(rows))
+	}
+
+	for _, row := range rows {
+		if !terms[row[1]] {
+			t.Errorf("Unexpected term %q in export", row[1])
+		}
+		if row[2] != "Export Deck" {
+			t.Errorf("Expected deck %q, got %q", "Export Deck", row[2])
+		}
+		if row[3] != fmt.Sprint(db.RatingGood) || row[4] != "4200" {
+			t.Errorf("Unexpected rating or time spent in row %v", row)
+		}
+		if _, err := time.Parse(time.RFC3339, row[0]); err != nil {
+			t.Errorf("Date %q is not RFC3339: %v", row[0], err)
+		}
+	}
+}
+
+func TestGetDeckBreakdown(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+19, "counter", "Counter")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	other, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	deck := importTestDeck(t, e, resp.Token, "Breakdown Deck")
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/due?deck_id="+deck.ID+"&limit=3", "", resp.Token, http.StatusOK)
+	cards := testutils.ParseResponse[[]contract.CardResponse](t, rec)
+	if len(cards) != 3 {
+		t.Fatalf("Expected 3 due cards, got %d", len(cards))
+	}
+
+	review := func(cardID string, ratings ...int) {
+		for _, rating := range ratings {
+			body, _ := json.Marshal(map[string]int{"rating": rating, "time_spent_ms": 3000})
+			rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+cardID+"/review", string(body), resp.Token, http.StatusOK)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Failed to review card %s with rating %d: status %d", cardID, rating, rec.Code)
+			}
+		}
+	}
+
+	review(cards[0].ID, db.RatingGood, db.RatingGood)                 // graduates to review
+	review(cards[1].ID, db.RatingGood, db.RatingGood, db.RatingAgain) // lapses into relearning
+	review(cards[2].ID, db.RatingAgain)                               // stays in learning
+
+	total, err := testutils.GetDBStorage().GetCardsByDeckID(deck.ID, resp.User.ID)
+	if err != nil {
+		t.Fatalf("Failed to load deck cards: %v", err)
+	}
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+deck.ID+"/breakdown", "", resp.Token, http.StatusOK)
+	breakdown := testutils.ParseResponse[db.DeckBreakdown](t, rec)
+
+	want := db.DeckBreakdown{
+		Total:      len(total),
+		New:        len(total) - 3,
+		Learning:   1,
+		Review:     1,
+		Relearning: 1,
+		Young:      1,
+		Mature:     0,
+	}
+	if breakdown != want {
+		t.Errorf("Expected breakdown %+v, got %+v", want, breakdown)
+	}
+
+	testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+deck.ID+"/breakdown", "", other.Token, http.StatusForbidden)
+}
+
+func TestImportJSONDeck(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+20, "builder", "Builder")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"name":          "My Words",
+		"language_code": "ja",
+		"items": []map[string]any{
+			{"term": "猫", "meaning_en": "cat", "example_native": "猫が寝ている。", "example_en": "The cat is sleeping."},
+			{"term": "犬", "meaning_ru": "собака", "term_with_transcription": "犬[いぬ]"},
+			{"term": "", "meaning_en": "no term"},
+		},
+	})
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import/json", string(body), resp.Token, http.StatusCreated)
+	created := testutils.ParseResponse[handler.CreateDeckFromFileResponse](t, rec)
+
+	if created.LanguageCode != "jp" || created.TranscriptionType != "furigana" || created.Level != "mixed" {
+		t.Errorf("Unexpected deck metadata: language %q, transcription %q, level %q", created.LanguageCode, created.TranscriptionType, created.Level)
+	}
+	if created.SkippedItems != 1 {
+		t.Errorf("Expected 1 skipped item, got %d", created.SkippedItems)
+	}
+
+	cards, err := testutils.GetDBStorage().GetCardsByDeckID(created.ID, resp.User.ID)
+	if err != nil {
+		t.Fatalf("Failed to load cards: %v", err)
+	}
+	if len(cards) != 2 {
+		t.Fatalf("Expected 2 cards, got %d", len(cards))
+	}
+
+	byTerm := make(map[string]contract.CardFields, len(cards))
+	for _, card := range cards {
+		var fields contract.CardFields
+		if err := json.Unmarshal([]byte(card.Fields), &fields); err != nil {
+			t.Fatalf("Failed to parse card fields: %v", err)
+		}
+		byTerm[fields.Term] = fields
+	}
+
+	cat := byTerm["猫"]
+	if cat.MeaningEn != "cat" || cat.ExampleNative != "猫が寝ている。" || cat.ExampleEn != "The cat is sleeping." || cat.LanguageCode != "jp" {
+		t.Errorf("Unexpected fields for 猫: %+v", cat)
+	}
+	if cat.TermWithTranscription != "猫[reading]" || cat.ExampleWithTranscription != "猫が寝ている。[reading]" {
+		t.Errorf("Missing readings should be filled in on import: %+v", cat)
+	}
+	dog := byTerm["犬"]
+	if dog.MeaningRu != "собака" || dog.TermWithTranscription != "犬[いぬ]" {
+		t.Errorf("Unexpected fields for 犬: %+v", dog)
+	}
+
+	body, _ = json.Marshal(map[string]any{
+		"name":          "Unknown Language",
+		"language_code": "xx",
+		"items":         []map[string]any{{"term": "word", "meaning_en": "word"}},
+	})
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import/json", string(body), resp.Token, http.StatusBadRequest)
+}
+
+func TestImportJSONDeck_PreserveScheduling(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+41, "migrant", "Migrant")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	due := time.Now().Add(5 * 24 * time.Hour).UTC().Truncate(time.Second)
+	items := []map[string]any{
+		{"term": "猫", "meaning_en": "cat", "scheduling": map[string]any{
+			"type": db.AnkiCardTypeReview, "due": due, "interval_days": 20, "factor": 2300, "reps": 12, "lapses": 1,
+		}},
+		{"term": "犬", "meaning_en": "dog", "scheduling": map[string]any{"type": db.AnkiCardTypeRelearning, "interval_days": 3, "factor": 1100}},
+		{"term": "鳥", "meaning_en": "bird"},
+	}
+
+	importDeck := func(name string, preserve bool) map[string]db.Card {
+		body, _ := json.Marshal(map[string]any{"name": name, "language_code": "jp", "items": items, "preserve_scheduling": preserve})
+		rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import/json", string(body), resp.Token, http.StatusCreated)
+		created := testutils.ParseResponse[handler.CreateDeckFromFileResponse](t, rec)
+
+		cards, err := testutils.GetDBStorage().GetCardsByDeckID(created.ID, resp.User.ID)
+		if err != nil {
+			t.Fatalf("Failed to load cards: %v", err)
+		}
+
+		byTerm := make(map[string]db.Card, len(cards))
+		for _, card := range cards {
+			var fields contract.CardFields
+			if err := json.Unmarshal([]byte(card.Fields), &fields); err != nil {
+				t.Fatalf("Failed to parse card fields: %v", err)
+			}
+			byTerm[fields.Term] = card
+		}
+		return byTerm
+	}
+
+	for term, card := range importDeck("Reset Scheduling", false) {
+		if card.State != string(db.StateNew) {
+			t.Errorf("Expected %s to be new without preserve_scheduling, got %s", term, card.State)
+		}
+	}
+
+	byTerm := importDeck("Kept Scheduling", true)
+
+	cat := byTerm["猫"]
+	if cat.State != string(db.StateReview) || cat.Interval != 20*24*time.Hour || cat.Ease != 2.3 {
+		t.Errorf("Expected review card with 20d interval and ease 2.3, got %s, %v, %v", cat.State, cat.Interval, cat.Ease)
+	}
+	if cat.ReviewCount != 12 || cat.LapsCount != 1 {
+		t.Errorf("Expected 12 reviews and 1 lapse, got %d and %d", cat.ReviewCount, cat.LapsCount)
+	}
+	if cat.NextReview == nil || !cat.NextReview.Equal(due) {
+		t.Errorf("Expected next review at %v, got %v", due, cat.NextReview)
+	}
+
+	dog := byTerm["犬"]
+	if dog.State != string(db.StateRelearning) || dog.LearningStep != 0 || dog.Ease != db.MinEaseFactor {
+		t.Errorf("Expected relearning card at step 0 with minimum ease, got %s, step %d, ease %v", dog.State, dog.LearningStep, dog.Ease)
+	}
+	if dog.NextReview == nil || dog.NextReview.After(time.Now()) {
+		t.Errorf("Expected relearning card without a due date to be due now, got %v", dog.NextReview)
+	}
+
+	if bird := byTerm["鳥"]; bird.State != string(db.StateNew) || bird.NextReview != nil {
+		t.Errorf("Expected card without scheduling to be new, got %s", bird.State)
+	}
+}
+
+func TestGetCard_DisplayLanguage(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+21, "reader", "Reader")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"name":          "Translations",
+		"language_code": "ja",
+		"items": []map[string]any{
+			{"term": "猫", "meaning_en": "cat", "meaning_ru": "кошка", "example_en": "The cat is sleeping.", "example_ru": "Кошка спит."},
+			{"term": "犬", "meaning_en": "dog", "example_en": "The dog barks."},
+		},
+	})
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import/json", string(body), resp.Token, http.StatusCreated)
+	created := testutils.ParseResponse[handler.CreateDeckFromFileResponse](t, rec)
+
+	cards, err := testutils.GetDBStorage().GetCardsByDeckID(created.ID, resp.User.ID)
+	if err != nil {
+		t.Fatalf("Failed to load cards: %v", err)
+	}
+
+	getCards := func() map[string]contract.CardResponse {
+		byTerm := make(map[string]contract.CardResponse, len(cards))
+		for _, card := range cards {
+			rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/"+card.ID, "", resp.Token, http.StatusOK)
+			response := testutils.ParseResponse[contract.CardResponse](t, rec)
+			byTerm[response.Fields.Term] = response
+		}
+		return byTerm
+	}
+
+	// The test user's Telegram language is Russian
+	byTerm := getCards()
+	if cat := byTerm["猫"]; cat.Meaning != "кошка" || cat.ExampleTranslation != "Кошка спит." {
+		t.Errorf("Expected Russian translations by default, got %q / %q", cat.Meaning, cat.ExampleTranslation)
+	}
+	if dog := byTerm["犬"]; dog.Meaning != "dog" || dog.ExampleTranslation != "The dog barks." {
+		t.Errorf("Expected the English translations as fallback, got %q / %q", dog.Meaning, dog.ExampleTranslation)
+	}
+
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", `{"settings":{"display_language":"en"}}`, resp.Token, http.StatusOK)
+
+	byTerm = getCards()
+	if cat := byTerm["猫"]; cat.Meaning != "cat" || cat.ExampleTranslation != "The cat is sleeping." {
+		t.Errorf("Expected English translations after switching, got %q / %q", cat.Meaning, cat.ExampleTranslation)
+	}
+
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", `{"settings":{"display_language":"de"}}`, resp.Token, http.StatusBadRequest)
+}
+
+func TestGetDeck_Source(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+22, "supported", "Supported")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]any{"name": "N5", "file_name": "japanese_n5.json", "force": true})
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import", string(body), resp.Token, http.StatusCreated)
+	imported := testutils.ParseResponse[db.Deck](t, rec)
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+imported.ID, "", resp.Token, http.StatusOK)
+	deck := testutils.ParseResponse[db.Deck](t, rec)
+
+	if deck.Source == nil {
+		t.Fatal("Expected the imported deck to have a source")
+	}
+	if deck.Source.Type != db.DeckSourceBundled || deck.Source.FileName != "japanese_n5.json" || deck.Source.LanguageCode != "jp" {
+		t.Errorf("Unexpected deck source: %+v", deck.Source)
+	}
+	if deck.Source.ImportedAt == nil {
+		t.Error("Expected the import time to be recorded")
+	}
+
+	other, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+23, "stranger", "Stranger")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+	testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+imported.ID, "", other.Token, http.StatusForbidden)
+}
+
+func TestErrorResponse_Codes(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/nonexistent", "", resp.Token, http.StatusNotFound)
+	errorResp := testutils.ParseResponse[contract.ErrorResponse](t, rec)
+	if errorResp.Code != contract.ErrorCodeDeckNotFound {
+		t.Errorf("Expected code %q for a missing deck, got %q", contract.ErrorCodeDeckNotFound, errorResp.Code)
+	}
+	if errorResp.Error == "" {
+		t.Error("Expected the human message alongside the code")
+	}
+
+	body := `{"name":"No Items","language_code":"ja","items":[]}`
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import/json", body, resp.Token, http.StatusBadRequest)
+	errorResp = testutils.ParseResponse[contract.ErrorResponse](t, rec)
+	if errorResp.Code != contract.ErrorCodeValidation {
+		t.Errorf("Expected code %q for a validation failure, got %q", contract.ErrorCodeValidation, errorResp.Code)
+	}
+}
+
+func TestGetCard_MediaFlags(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+26, "listener", "Listener")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	storage := testutils.GetDBStorage()
+	deck, err := storage.CreateDeck(resp.User.ID, db.CreateDeckParams{Name: "Media Deck", Level: "mixed", LanguageCode: "jp", TranscriptionType: "furigana"})
+	if err != nil {
+		t.Fatalf("Failed to create deck: %v", err)
+	}
+
+	withAudio, err := storage.AddCard(resp.User.ID, deck.ID, `{"term":"猫","meaning_en":"cat","audio_word":"https://cdn.example.com/neko.mp3"}`)
+	if err != nil {
+		t.Fatalf("Failed to add card: %v", err)
+	}
+	bare, err := storage.AddCard(resp.User.ID, deck.ID, `{"term":"犬","meaning_en":"dog"}`)
+	if err != nil {
+		t.Fatalf("Failed to add card: %v", err)
+	}
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/"+withAudio.ID, "", resp.Token, http.StatusOK)
+	card := testutils.ParseResponse[contract.CardResponse](t, rec)
+	if !card.HasAudio || card.HasImage {
+		t.Errorf("Expected has_audio without has_image, got has_audio=%v has_image=%v", card.HasAudio, card.HasImage)
+	}
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/"+bare.ID, "", resp.Token, http.StatusOK)
+	card = testutils.ParseResponse[contract.CardResponse](t, rec)
+	if card.HasAudio || card.HasImage {
+		t.Errorf("Expected no media flags for a bare card, got has_audio=%v has_image=%v", card.HasAudio, card.HasImage)
+	}
+}
+
+func TestExportDeckTSV(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+27, "exporter", "Exporter")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	items := []map[string]any{
+		{"term": "猫", "meaning_en": "cat", "example_native": "猫が寝ている。", "frequency": 120},
+		{"term": "犬", "meaning_en": "dog\tpuppy", "example_en": "The dog barks.\nLoudly."},
+		{"term": "鳥", "meaning_en": `"bird"`},
+	}
+	body, _ := json.Marshal(map[string]any{"name": "Export Me", "language_code": "ja", "items": items})
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/import/json", string(body), resp.Token, http.StatusCreated)
+	created := testutils.ParseResponse[handler.CreateDeckFromFileResponse](t, rec)
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+created.ID+"/export.tsv", "", resp.Token, http.StatusOK)
+	// The .tsv route must serve what its extension promises, both in the content type and the file name
+	if contentType := rec.Header().Get("Content-Type"); contentType != "text/tab-separated-values; charset=utf-8" {
+		t.Errorf("Expected the .tsv export to be served as TSV, got %q", contentType)
+	}
+	if disposition := rec.Header().Get("Content-Disposition"); !strings.HasSuffix(disposition, `.tsv"`) {
+		t.Errorf("Expected a .tsv file name, got %q", disposition)
+	}
+	testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+created.ID+"/export.csv", "", resp.Token, http.StatusNotFound)
+	// Reading the export back is covered by TestExportDeckTSV_ImportRoundTrip, through the file import's parser
+	if !strings.HasPrefix(rec.Body.String(), "#separator:tab\n#columns:term\t") {
+		t.Errorf("Expected the export to start with its metadata lines, got %q", rec.Body.String())
+	}
+
+	other, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+1, "importer", "Importer")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+	testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+created.ID+"/export.tsv", "", other.Token, http.StatusForbidden)
+}
+
+func TestGetRecentCards(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+28, "collector", "Collector")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	storage := testutils.GetDBStorage()
+	first, err := storage.CreateDeck(resp.User.ID, db.CreateDeckParams{Name: "Numbers", Level: "mixed", LanguageCode: "jp", TranscriptionType: "furigana"})
+	if err != nil {
+		t.Fatalf("Failed to create deck: %v", err)
+	}
+	second, err := storage.CreateDeck(resp.User.ID, db.CreateDeckParams{Name: "Animals", Level: "mixed", LanguageCode: "jp", TranscriptionType: "furigana"})
+	if err != nil {
+		t.Fatalf("Failed to create deck: %v", err)
+	}
+
+	for _, card := range []struct {
+		deckID string
+		term   string
+	}{
+		{first.ID, "一"},
+		{second.ID, "猫"},
+		{first.ID, "二"},
+	} {
+		if _, err := storage.AddCard(resp.User.ID, card.deckID, fmt.Sprintf(`{"term":%q}`, card.term)); err != nil {
+			t.Fatalf("Failed to add card: %v", err)
+		}
+	}
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/recent", "", resp.Token, http.StatusOK)
+	recent := testutils.ParseResponse[[]contract.RecentCardResponse](t, rec)
+
+	expected := []struct{ term, deck string }{
+		{"二", "Numbers"},
+		{"猫", "Animals"},
+		{"一", "Numbers"},
+	}
+	if len(recent) != len(expected) {
+		t.Fatalf("Expected %d recent cards, got %d", len(expected), len(recent))
+	}
+	for i, want := range expected {
+		if recent[i].Fields.Term != want.term || recent[i].DeckName != want.deck {
+			t.Errorf("Position %d: expected %s from %s, got %s from %s", i, want.term, want.deck, recent[i].Fields.Term, recent[i].DeckName)
+		}
+	}
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/recent?limit=1", "", resp.Token, http.StatusOK)
+	if limited := testutils.ParseResponse[[]contract.RecentCardResponse](t, rec); len(limited) != 1 || limited[0].Fields.Term != "二" {
+		t.Errorf("Expected only the newest card with limit=1, got %d cards", len(limited))
+	}
+}
@@ -4,13 +4,16 @@ import (
 	"atamagaii/internal/ai"
 	"atamagaii/internal/contract"
 	"atamagaii/internal/db"
+	"atamagaii/internal/job"
 	"atamagaii/internal/middleware"
 	"atamagaii/internal/storage"
+	"errors"
 	telegram "github.com/go-telegram/bot"
 	"github.com/golang-jwt/jwt/v5"
 	echojwt "github.com/labstack/echo-jwt/v4"
 	"github.com/labstack/echo/v4"
 	"net/http"
+	"time"
 )
 
 type Handler struct {
@@ -21,25 +24,100 @@ type Handler struct {
 	webAppURL       string
 	storageProvider storage.Provider
 	aiClient        ai.AIClient
+	moderator       ai.Moderator
+	aiTimeout       time.Duration
+	taskGenerator   *job.TaskGenerator
+
+	maxGenerationRetries int
+	botAutoRetries       int           // Automatic retries of a failed card generation from Telegram
+	botRetryDelay        time.Duration // Wait before each automatic retry
+	botGenerations       chan struct{} // Slots for card generations started from Telegram messages
+	logGenerations       bool          // Store each card generation's prompt and response for admins
+	adminTelegramIDs     []int64
+	webhookSecret        string
+	ttsPreviews          *ttsPreviews
+	imports              *importJobs
+	deckAudio            *deckAudioJobs
 }
 
-func New(
-	bot *telegram.Bot,
-	db *db.Storage,
-	jwtSecret string,
-	botToken string,
-	webAppURL string,
-	storageProvider storage.Provider,
-	aiClient ai.AIClient,
-) *Handler {
+// DefaultMaxGenerationRetries is used when no retry limit for failed card generation is configured
+const DefaultMaxGenerationRetries = 3
+
+// DefaultMaxBotGenerations bounds concurrent card generations from Telegram messages when no limit is configured
+const DefaultMaxBotGenerations = 4
+
+// DefaultBotAutoRetries is how many times a failed card generation from Telegram is retried before the user is told
+const DefaultBotAutoRetries = 1
+
+// DefaultBotRetryDelay is how long a failed card generation from Telegram waits before an automatic retry
+const DefaultBotRetryDelay = 5 * time.Second
+
+// Config holds the dependencies and limits of a Handler
+type Config struct {
+	Bot             *telegram.Bot
+	DB              *db.Storage
+	JWTSecret       string
+	BotToken        string
+	WebAppURL       string
+	StorageProvider storage.Provider
+	AIClient        ai.AIClient
+	// Moderator screens generated content, nil disables the safety filter
+	Moderator     ai.Moderator
+	AITimeout     time.Duration
+	TaskGenerator *job.TaskGenerator
+
+	// MaxGenerationRetries defaults to DefaultMaxGenerationRetries when not positive
+	MaxGenerationRetries int
+	// MaxBotGenerations defaults to DefaultMaxBotGenerations when not positive
+	MaxBotGenerations int
+	// BotAutoRetries defaults to DefaultBotAutoRetries when zero, a negative value turns automatic retries off
+	BotAutoRetries int
+	// BotRetryDelay defaults to DefaultBotRetryDelay when not positive
+	BotRetryDelay    time.Duration
+	LogGenerations   bool
+	AdminTelegramIDs []int64
+	WebhookSecret    string
+}
+
+func New(cfg Config) *Handler {
+	if cfg.MaxGenerationRetries <= 0 {
+		cfg.MaxGenerationRetries = DefaultMaxGenerationRetries
+	}
+
+	if cfg.MaxBotGenerations <= 0 {
+		cfg.MaxBotGenerations = DefaultMaxBotGenerations
+	}
+
+	if cfg.BotAutoRetries == 0 {
+		cfg.BotAutoRetries = DefaultBotAutoRetries
+	}
+
+	if cfg.BotRetryDelay <= 0 {
+		cfg.BotRetryDelay = DefaultBotRetryDelay
+	}
+
 	return &Handler{
-		bot:             bot,
-		db:              db,
-		jwtSecret:       jwtSecret,
-		botToken:        botToken,
-		webAppURL:       webAppURL,
-		storageProvider: storageProvider,
-		aiClient:        aiClient,
+		bot:             cfg.Bot,
+		db:              cfg.DB,
+		jwtSecret:       cfg.JWTSecret,
+		botToken:        cfg.BotToken,
+		webAppURL:       cfg.WebAppURL,
+		storageProvider: cfg.StorageProvider,
+		aiClient:        cfg.AIClient,
+		moderator:       cfg.Moderator,
+		aiTimeout:       cfg.AITimeout,
+		taskGenerator:   cfg.TaskGenerator,
+
+		maxGenerationRetries: cfg.MaxGenerationRetries,
+		botAutoRetries:       cfg.BotAutoRetries,
+		botRetryDelay:        cfg.BotRetryDelay,
+		botGenerations:       make(chan struct{}, cfg.MaxBotGenerations),
+		logGenerations:       cfg.LogGenerations,
+		adminTelegramIDs:     cfg.AdminTelegramIDs,
+		webhookSecret:        cfg.WebhookSecret,
+		ttsPreviews:          newTTSPreviews(),
+		imports:              newImportJobs(),
+		deckAudio:            newDeckAudioJobs(),
 	}
 }
 
@@ -57,10 +135,33 @@ func (h *Handler) RegisterRoutes(e *echo.Echo) {
 	// Task routes
 	v1.GET("/tasks", h.GetTasks)
 	v1.GET("/tasks/by-deck", h.GetTasksPerDeck)
-	v1.POST("/tasks/submit", h.SubmitTaskResponse)
+	v1.GET("/tasks/count", h.GetTaskCount)
+	v1.GET("/cards/:id/tasks", h.GetCardTasks)
+	v1.POST("/cards/:id/requeue-task", h.RequeueCardTask)
+	v1.POST("/decks/:id/generate-tasks", h.GenerateDeckTasks, middleware.AIDeadline(h.aiTimeout))
+	v1.POST("/tasks/submit", h.SubmitTaskResponse, middleware.AIDeadline(h.aiTimeout))
+
+	// Audio routes
+	v1.POST("/tts/preview", h.PreviewTTS, middleware.AIDeadline(h.aiTimeout))
+
+	// Import routes
+	v1.GET("/imports", h.GetImports)
+	v1.POST("/imports/:id/cancel", h.CancelImport)
 
 	// User routes
 	v1.PUT("/user", h.UpdateUserHandler)
+	v1.GET("/user/settings", h.GetUserSettings)
+
+	// Admin routes
+	admin := v1.Group("/admin", middleware.RequireAdmin())
+	admin.GET("/users/:id", h.GetUserAsAdmin)
+	admin.POST("/users/:id/reset-daily", h.ResetUserDailyNewCards)
+	admin.GET("/jobs/task-generator", h.GetTaskGeneratorStatus)
+	admin.POST("/jobs/task-generator/pause", h.PauseTaskGenerator)
+	admin.POST("/jobs/task-generator/resume", h.ResumeTaskGenerator)
+	admin.GET("/jobs/task-generator/failures", h.GetTaskGenFailures)
+	admin.GET("/cards/:id/generations", h.GetCardGenerationLogs)
+	admin.POST("/decks/:id/recompute-stats", h.RecomputeDeckStats)
 }
 
 func GetUserIDFromToken(c echo.Context) (string, error) {
@@ -76,3 +177,33 @@ func GetUserIDFromToken(c echo.Context) (string, error) {
 
 	return claims.UID, nil
 }
+
+// requestUser loads the user a request is served for. Handlers load it once and pass its settings down.
+// A user without a row is served with default settings.
+func (h *Handler) requestUser(userID string) (*db.User, error) {
+	user, err := h.db.GetUserByID(userID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return &db.User{ID: userID, Settings: db.DefaultUserSettings()}, nil
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch user settings").WithInternal(err)
+	}
+
+	return user, nil
+}
+
+// isAdminToken reports whether the request's JWT was issued to an admin
+func isAdminToken(c echo.Context) bool {
+	user, ok := c.Get("user").(*jwt.Token)
+	if !ok || user == nil {
+		return false
+	}
+
+	claims, ok := user.Claims.(*contract.JWTClaims)
+	return ok && claims != nil && claims.IsAdmin
+}
+
+// newCodedError is echo.NewHTTPError for errors that carry a more specific code than their status implies
+func newCodedError(status int, code contract.ErrorCode, message string) *echo.HTTPError {
+	return echo.NewHTTPError(status, contract.ErrorResponse{Error: message, Code: code})
+}
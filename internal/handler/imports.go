@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"atamagaii/internal/contract"
+	"atamagaii/internal/db"
+	"context"
+	"fmt"
+	telegram "github.com/go-telegram/bot"
+	"github.com/labstack/echo/v4"
+	nanoid "github.com/matoous/go-nanoid/v2"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// importJob is a running file import that its owner may cancel
+type importJob struct {
+	userID    string
+	fileName  string
+	startedAt time.Time
+	cancel    context.CancelFunc
+}
+
+// importJobs tracks running file imports so they can be listed and canceled
+type importJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*importJob
+}
+
+func newImportJobs() *importJobs {
+	return &importJobs{jobs: make(map[string]*importJob)}
+}
+
+// start registers an import and returns its ID with a context that is canceled when the import is
+func (j *importJobs) start(userID, fileName string) (string, context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	id := nanoid.Must()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.jobs[id] = &importJob{userID: userID, fileName: fileName, startedAt: time.Now(), cancel: cancel}
+	return id, ctx
+}
+
+// finish forgets a completed import and releases its context
+func (j *importJobs) finish(id string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if job, ok := j.jobs[id]; ok {
+		job.cancel()
+		delete(j.jobs, id)
+	}
+}
+
+// cancel stops the user's import with the given ID, it reports false if the user has no such import
+func (j *importJobs) cancel(id, userID string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok || job.userID != userID {
+		return false
+	}
+
+	job.cancel()
+	delete(j.jobs, id)
+	return true
+}
+
+// running returns the user's imports, oldest first
+func (j *importJobs) running(userID string) []contract.ImportJobResponse {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	imports := make([]contract.ImportJobResponse, 0)
+	for id, job := range j.jobs {
+		if job.userID == userID {
+			imports = append(imports, contract.ImportJobResponse{ID: id, FileName: job.fileName, StartedAt: job.startedAt})
+		}
+	}
+
+	sort.Slice(imports, func(a, b int) bool {
+		return imports[a].StartedAt.Before(imports[b].StartedAt)
+	})
+
+	return imports
+}
+
+// GetImports lists the user's running file imports
+func (h *Handler) GetImports(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, h.imports.running(userID))
+}
+
+// CancelImport stops a running file import. Cards of a language whose insert hasn't committed yet
+// are rolled back, decks that were already filled keep their cards.
+func (h *Handler) CancelImport(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	if !h.imports.cancel(c.Param("id"), userID) {
+		return newCodedError(http.StatusNotFound, contract.ErrorCodeImportNotFound, "Import not found")
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// interruptedImportMessage tells the user how far an import got before the server stopped
+func interruptedImportMessage(job db.ImportJob) string {
+	if job.Total == 0 {
+		return fmt.Sprintf("Импорт файла %s прервался перезапуском сервера до добавления карточек. Отправь файл ещё раз.", job.FileName)
+	}
+
+	return fmt.Sprintf("Импорт файла %s прервался перезапуском сервера. Добавлено карточек: %d из %d.",
+		job.FileName, job.Processed, job.Total)
+}
+
+// ReportInterruptedImports marks imports left running by a previous process as interrupted and tells
+// their users how many cards were added. Call it on startup, before the bot takes new imports.
+func (h *Handler) ReportInterruptedImports() {
+	jobs, err := h.db.InterruptRunningImportJobs()
+	if err != nil {
+		log.Printf("Failed to check interrupted imports: %v", err)
+		return
+	}
+
+	for _, job := range jobs {
+		log.Printf("Import %s of user %s was interrupted after %d of %d items", job.ID, job.UserID, job.Processed, job.Total)
+		h.sendFileImportError(job.TelegramChatID, telegram.EscapeMarkdown(interruptedImportMessage(job)), job.MessageID)
+	}
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"atamagaii/internal/contract"
+	"atamagaii/internal/db"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func importRequestContext(e *echo.Echo, method, importID, userID string) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(method, "/", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(importID)
+	c.Set("user", &jwt.Token{Claims: &contract.JWTClaims{UID: userID}})
+	return c, rec
+}
+
+func TestCancelImport(t *testing.T) {
+	h := &Handler{imports: newImportJobs()}
+	e := echo.New()
+
+	importID, ctx := h.imports.start("owner", "words.csv")
+
+	c, rec := importRequestContext(e, http.MethodGet, "", "owner")
+	require.NoError(t, h.GetImports(c))
+	var running []contract.ImportJobResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &running))
+	require.Len(t, running, 1)
+	require.Equal(t, importID, running[0].ID)
+	require.Equal(t, "words.csv", running[0].FileName)
+
+	c, _ = importRequestContext(e, http.MethodPost, importID, "stranger")
+	var httpErr *echo.HTTPError
+	require.True(t, errors.As(h.CancelImport(c), &httpErr))
+	require.Equal(t, http.StatusNotFound, httpErr.Code, "Other users must not cancel the import")
+	require.NoError(t, ctx.Err())
+
+	c, rec = importRequestContext(e, http.MethodPost, importID, "owner")
+	require.NoError(t, h.CancelImport(c))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.ErrorIs(t, ctx.Err(), context.Canceled)
+
+	c, rec = importRequestContext(e, http.MethodGet, "", "owner")
+	require.NoError(t, h.GetImports(c))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &running))
+	require.Empty(t, running, "A canceled import should no longer be listed")
+}
+
+func TestImportVocabItems_Canceled(t *testing.T) {
+	storage, err := db.ConnectDB(filepath.Join(t.TempDir(), "cancel.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = storage.Close() })
+
+	user := &db.User{ID: "cancel-user", TelegramID: 43, LanguageCode: "ru"}
+	require.NoError(t, storage.SaveUser(user))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	h := &Handler{db: storage}
+	result := h.importVocabItems(ctx, user.ID, "words.csv", []VocabImportItem{
+		{Term: "แมว", MeaningEn: "cat"},
+		{Term: "კატა", MeaningEn: "cat"},
+	}, nil)
+
+	require.Equal(t, 0, result.Imported)
+	require.Equal(t, 2, result.Canceled)
+	require.Equal(t, result.Parsed, result.Skipped+result.Imported+result.Failed+result.Canceled)
+
+	decks, err := storage.GetDecks(user.ID, user.Settings)
+	require.NoError(t, err)
+	require.Empty(t, decks, "A canceled import should not create decks")
+}
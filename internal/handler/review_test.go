@@ -3,6 +3,7 @@ package handler_test
 import (
 	"atamagaii/internal/contract"
 	"atamagaii/internal/db"
+	"atamagaii/internal/handler"
 	"atamagaii/internal/testutils"
 	"encoding/json"
 	"fmt"
@@ -66,10 +67,11 @@ func TestReviewCard_Sequential(t *testing.T) {
 	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
 	require.NoError(t, err, "Failed to authenticate")
 
-	reqBody := map[string]string{
+	reqBody := map[string]any{
 		"name":        "Test Review Deck 2-Button",
 		"description": "Deck for testing 2-button review functionality",
-		"file_name":   "vocab_n5.json",
+		"file_name":   "japanese_n5.json",
+		"force":       true,
 	}
 	body, _ := json.Marshal(reqBody)
 
@@ -85,8 +87,8 @@ func TestReviewCard_Sequential(t *testing.T) {
 	require.NotEmpty(t, cards, "Expected at least one due card from imported deck")
 
 	// Scenario 1: New Card
-	// 1.1. New card, rated Good (or Again, outcome is same: moves to Learning Step 1)
-	//      - Expected: State -> Learning, LearningStep -> 1, Interval -> LearningStep1Duration
+	// 1.1. New card, rated Good (Again would stop at Learning Step 1)
+	//      - Expected: State -> Learning, LearningStep -> 2, Interval -> LearningStep2Duration
 	firstCard := cards[0]
 	require.Equal(t, string(db.StateNew), firstCard.State, "Card should be in 'new' state initially")
 	require.Equal(t, 0, firstCard.LearningStep, "New card should have LearningStep 0")
@@ -95,12 +97,12 @@ func TestReviewCard_Sequential(t *testing.T) {
 	learningCard := reviewCardAndVerify(
 		t, e, firstCard, deck.ID, resp.Token,
 		db.RatingGood,
-		string(db.StateLearning), 1, db.LearningStep1Duration,
+		string(db.StateLearning), 2, db.LearningStep2Duration,
 		nil,
 	)
 
 	// Scenario 2: Learning Card (Step 1)
-	// 2.1. Learning card (Step 1), rated Again
+	// 2.1. Learning card (Step 2 after Good), rated Again
 	//      - Expected: State -> Learning, LearningStep -> 1 (reset), Interval -> LearningStep1Duration
 	learningCardAgain := reviewCardAndVerify(
 		t, e, learningCard, deck.ID, resp.Token,
@@ -162,14 +164,14 @@ func TestReviewCard_Sequential(t *testing.T) {
 
 	// Scenario 4: Review Card
 	// 4.1. Review card, rated Again (Lapse)
-	//      - Expected: State -> Relearning, LearningStep -> 1, Interval -> LearningStep1Duration, Ease decreases, LapsCount++
+	//      - Expected: State -> Relearning, LearningStep -> 2, Interval -> LearningStep2Duration, Ease decreases, LapsCount++
 	originalEase := reviewCard.Ease
 	originalLapsCount := reviewCard.LapsCount
 
 	relearningCard := reviewCardAndVerify(
 		t, e, reviewCard, deck.ID, resp.Token,
 		db.RatingAgain,
-		string(db.StateRelearning), 1, db.LearningStep1Duration,
+		string(db.StateRelearning), 2, db.LearningStep2Duration,
 		func(t *testing.T, card contract.CardResponse) {
 			require.Equal(t, 7, card.ReviewCount, "Review count should be incremented")
 			require.Equal(t, originalLapsCount+1, card.LapsCount, "Lapse count should be incremented")
@@ -185,10 +187,10 @@ func TestReviewCard_Sequential(t *testing.T) {
 	//      - Expected: State -> Review, Interval capped at MaxReviewIntervalDays, Ease increases.
 
 	// Scenario 5: Relearning Card (Step 1)
-	// 5.1. Relearning card (Step 1), rated Again
+	// 5.1. Relearning card (Step 2 after the lapse), rated Again
 	//      - Expected: State -> Relearning, LearningStep -> 1 (reset), Interval -> LearningStep1Duration
 
-	// Test the "Again" rating on a relearning card (step 1)
+	// Test the "Again" rating on a relearning card
 	relearningCardAgain := reviewCardAndVerify(
 		t, e, relearningCard, deck.ID, resp.Token,
 		db.RatingAgain,
@@ -256,3 +258,343 @@ func TestReviewCard_Sequential(t *testing.T) {
 	// Total: 1 (New) + 2 (LearnS1) + 2 (LearnS2) + 3 (Review) + 2 (RelearnS1) + 2 (RelearnS2) = 12 core cases.
 	// Plus a few for specific ease/fuzz conditions, bringing it to ~14-15 distinct scenarios to verify.
 }
+
+func TestPauseNewCards(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Paused Deck")
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+
+	reviewJSON, _ := json.Marshal(map[string]int{"rating": db.RatingAgain, "time_spent_ms": 3000})
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+card.ID+"/review", string(reviewJSON), resp.Token, http.StatusOK)
+
+	setPaused := func(paused bool) {
+		body, _ := json.Marshal(map[string]interface{}{
+			"settings": map[string]bool{"new_cards_paused": paused},
+		})
+		rec := testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", string(body), resp.Token, http.StatusOK)
+		user := testutils.ParseResponse[db.User](t, rec)
+		require.NotNil(t, user.Settings)
+		require.Equal(t, paused, user.Settings.NewCardsPaused)
+	}
+
+	setPaused(true)
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/due?deck_id="+deck.ID+"&limit=10", "", resp.Token, http.StatusOK)
+	cards := testutils.ParseResponse[[]contract.CardResponse](t, rec)
+	require.Len(t, cards, 1, "Only the card in learning should be due while new cards are paused")
+	require.Equal(t, card.ID, cards[0].ID)
+	require.Equal(t, string(db.StateLearning), cards[0].State)
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+deck.ID, "", resp.Token, http.StatusOK)
+	pausedDeck := testutils.ParseResponse[db.Deck](t, rec)
+	require.NotNil(t, pausedDeck.Stats)
+	require.Equal(t, 0, pausedDeck.Stats.NewCards)
+
+	setPaused(false)
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/due?deck_id="+deck.ID+"&limit=10", "", resp.Token, http.StatusOK)
+	cards = testutils.ParseResponse[[]contract.CardResponse](t, rec)
+	require.Greater(t, len(cards), 1, "New cards should be back once the pause is lifted")
+}
+
+func TestGetDueCards_SessionNewLimit(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Session Limit Deck")
+	require.Greater(t, deck.NewCardsPerDay, 2, "Daily budget must allow more than the session limit")
+
+	countNew := func(cards []contract.CardResponse) int {
+		count := 0
+		for _, card := range cards {
+			if card.State == string(db.StateNew) {
+				count++
+			}
+		}
+		return count
+	}
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/due?deck_id="+deck.ID+"&limit=10", "", resp.Token, http.StatusOK)
+	cards := testutils.ParseResponse[[]contract.CardResponse](t, rec)
+	require.Greater(t, countNew(cards), 2, "Without a session limit the daily budget applies")
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/due?deck_id="+deck.ID+"&limit=10&session_new_limit=2", "", resp.Token, http.StatusOK)
+	cards = testutils.ParseResponse[[]contract.CardResponse](t, rec)
+	require.LessOrEqual(t, countNew(cards), 2, "Session limit should cap new cards in one fetch")
+	require.Len(t, cards, 2)
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/due?deck_id="+deck.ID+"&limit=10&session_new_limit=0", "", resp.Token, http.StatusOK)
+	cards = testutils.ParseResponse[[]contract.CardResponse](t, rec)
+	require.Empty(t, cards, "A session limit of zero should hold back all new cards")
+}
+
+func TestGetDueCards_StudyAgain(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+31, "again", "Again")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Study Again Deck")
+
+	// With one new card a day, the queue is empty once that card is failed: the tail of the session
+	settings, _ := json.Marshal(map[string]interface{}{"name": deck.Name, "new_cards_per_day": 1})
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(settings), resp.Token, http.StatusOK)
+
+	sessionStart := time.Now().UTC().Add(-time.Minute).Format(time.RFC3339)
+
+	dueWithStudyAgain := func() []contract.CardResponse {
+		path := fmt.Sprintf("/v1/cards/due?deck_id=%s&limit=5&study_again_since=%s", deck.ID, sessionStart)
+		rec := testutils.PerformRequest(t, e, http.MethodGet, path, "", resp.Token, http.StatusOK)
+		return testutils.ParseResponse[[]contract.CardResponse](t, rec)
+	}
+
+	findCard := func(cards []contract.CardResponse, id string) *contract.CardResponse {
+		for i := range cards {
+			if cards[i].ID == id {
+				return &cards[i]
+			}
+		}
+		return nil
+	}
+
+	failed := firstDueCard(t, e, resp.Token, deck.ID)
+	for _, card := range dueWithStudyAgain() {
+		require.False(t, card.StudyAgain, "Nothing was failed yet")
+	}
+
+	review := func(rating int) {
+		body, _ := json.Marshal(map[string]int{"rating": rating, "time_spent_ms": 3000})
+		testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+failed.ID+"/review", string(body), resp.Token, http.StatusOK)
+	}
+
+	review(db.RatingAgain)
+
+	again := findCard(dueWithStudyAgain(), failed.ID)
+	require.NotNil(t, again, "The failed card should come back within the session")
+	require.True(t, again.StudyAgain)
+
+	// Once answered correctly the lapse is resolved
+	review(db.RatingGood)
+	if card := findCard(dueWithStudyAgain(), failed.ID); card != nil {
+		require.False(t, card.StudyAgain)
+	}
+
+	path := fmt.Sprintf("/v1/cards/due?deck_id=%s&study_again_since=yesterday", deck.ID)
+	testutils.PerformRequest(t, e, http.MethodGet, path, "", resp.Token, http.StatusBadRequest)
+}
+
+func TestGetNextCard(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+37, "nextcard", "Next Card")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Next Card Deck")
+
+	settings, _ := json.Marshal(map[string]interface{}{"name": deck.Name, "new_cards_per_day": 1})
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(settings), resp.Token, http.StatusOK)
+
+	nextCardPath := "/v1/decks/" + deck.ID + "/next-card"
+
+	// Study the day's only new card until it graduates, the next card always being the head of the queue
+	for i := 0; i < 10; i++ {
+		rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/due?deck_id="+deck.ID, "", resp.Token, http.StatusOK)
+		due := testutils.ParseResponse[[]contract.CardResponse](t, rec)
+		if len(due) == 0 {
+			break
+		}
+
+		rec = testutils.PerformRequest(t, e, http.MethodGet, nextCardPath, "", resp.Token, http.StatusOK)
+		next := testutils.ParseResponse[contract.CardResponse](t, rec)
+		require.Equal(t, due[0].ID, next.ID, "The next card should be the first due card")
+		require.Equal(t, due[0].NextIntervals, next.NextIntervals, "The next card should carry the preview intervals")
+
+		body, _ := json.Marshal(map[string]int{"rating": db.RatingGood, "time_spent_ms": 3000})
+		testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+next.ID+"/review", string(body), resp.Token, http.StatusOK)
+	}
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, nextCardPath, "", resp.Token, http.StatusNoContent)
+	require.Empty(t, rec.Body.String(), "An exhausted deck has no next card")
+
+	other, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+38, "stranger", "Stranger")
+	require.NoError(t, err)
+	testutils.PerformRequest(t, e, http.MethodGet, nextCardPath, "", other.Token, http.StatusForbidden)
+}
+
+func TestGetDueCards_ExampleOnBack(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+39, "exampleback", "Example Back")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Example On Back Deck")
+
+	front := firstDueCard(t, e, resp.Token, deck.ID)
+	require.NotEmpty(t, front.Fields.ExampleNative, "The imported card should have an example")
+	require.Nil(t, front.Back, "Examples stay on the front by default")
+
+	settings, _ := json.Marshal(map[string]interface{}{"name": deck.Name, "new_cards_per_day": deck.NewCardsPerDay, "example_on_back": true})
+	rec := testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(settings), resp.Token, http.StatusOK)
+	require.True(t, testutils.ParseResponse[db.Deck](t, rec).ExampleOnBack)
+
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+	require.Equal(t, front.ID, card.ID)
+	require.NotNil(t, card.Back, "The example should be in the back section")
+	require.Equal(t, front.Fields.ExampleNative, card.Back.ExampleNative)
+	require.Equal(t, front.Fields.ExampleWithTranscription, card.Back.ExampleWithTranscription)
+	require.Equal(t, front.ExampleTranslation, card.Back.ExampleTranslation)
+	require.Equal(t, front.Fields.AudioExample, card.Back.AudioExample)
+
+	require.Empty(t, card.Fields.ExampleNative, "The front should not show the example")
+	require.Empty(t, card.Fields.ExampleWithTranscription)
+	require.Empty(t, card.Fields.AudioExample)
+	require.Empty(t, card.ExampleTranslation)
+	require.Equal(t, front.Fields.Term, card.Fields.Term, "The term stays on the front")
+}
+
+func TestReviewCard_FourRatingButtons(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+42, "fourbuttons", "Four Buttons")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Four Buttons Deck")
+	require.Equal(t, db.DefaultRatingButtons, deck.RatingButtons)
+
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+	require.Empty(t, card.NextIntervals.Hard, "Two-button decks only preview Again and Good")
+	require.Empty(t, card.NextIntervals.Easy)
+
+	easy, _ := json.Marshal(map[string]int{"rating": db.RatingEasy, "time_spent_ms": 3000})
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+card.ID+"/review", string(easy), resp.Token, http.StatusBadRequest)
+
+	settings, _ := json.Marshal(map[string]interface{}{"name": deck.Name, "new_cards_per_day": deck.NewCardsPerDay, "rating_buttons": 3})
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(settings), resp.Token, http.StatusBadRequest)
+
+	settings, _ = json.Marshal(map[string]interface{}{"name": deck.Name, "new_cards_per_day": deck.NewCardsPerDay, "rating_buttons": db.FourRatingButtons})
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/decks/"+deck.ID+"/settings", string(settings), resp.Token, http.StatusOK)
+
+	card = firstDueCard(t, e, resp.Token, deck.ID)
+	require.NotEmpty(t, card.NextIntervals.Hard, "Four-button decks preview every rating")
+	require.Equal(t, "4d", card.NextIntervals.Easy, "An Easy new card graduates straight to review")
+
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+card.ID+"/review", string(easy), resp.Token, http.StatusOK)
+	reviewed := testutils.ParseResponse[contract.ReviewCardResponse](t, rec)
+	require.NotNil(t, reviewed.Stats)
+
+	after, err := testutils.GetDBStorage().GetCard(card.ID, resp.User.ID)
+	require.NoError(t, err)
+	require.Equal(t, string(db.StateReview), after.State)
+	require.Equal(t, time.Duration(db.EasyGraduateIntervalDays*24*float64(time.Hour)), after.Interval)
+}
+
+func TestSuspendCard(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+43, "suspender", "Suspender")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Suspend Deck")
+
+	dueIDs := func() map[string]bool {
+		rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/due?deck_id="+deck.ID+"&limit=50", "", resp.Token, http.StatusOK)
+		ids := map[string]bool{}
+		for _, card := range testutils.ParseResponse[[]contract.CardResponse](t, rec) {
+			ids[card.ID] = true
+		}
+		return ids
+	}
+
+	learningCount := func() int {
+		rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+deck.ID, "", resp.Token, http.StatusOK)
+		return testutils.ParseResponse[db.Deck](t, rec).Stats.LearningCards
+	}
+
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+	body, _ := json.Marshal(map[string]int{"rating": db.RatingGood, "time_spent_ms": 3000})
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+card.ID+"/review", string(body), resp.Token, http.StatusOK)
+	require.Equal(t, 1, learningCount())
+
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+card.ID+"/suspend", "", resp.Token, http.StatusOK)
+	suspended := testutils.ParseResponse[contract.CardResponse](t, rec)
+	require.True(t, suspended.Suspended)
+	require.Equal(t, string(db.StateLearning), suspended.State, "Suspending keeps the scheduling state")
+
+	require.False(t, dueIDs()[card.ID], "A suspended card should not be studied")
+	require.Equal(t, 0, learningCount(), "A suspended card should not be counted as due")
+
+	listPage := func(limit, offset int) []contract.CardResponse {
+		url := fmt.Sprintf("/v1/decks/%s/cards?limit=%d&offset=%d", deck.ID, limit, offset)
+		rec := testutils.PerformRequest(t, e, http.MethodGet, url, "", resp.Token, http.StatusOK)
+		return testutils.ParseResponse[[]contract.CardResponse](t, rec)
+	}
+
+	var listed *contract.CardResponse
+	seen := map[string]bool{}
+	for offset := 0; ; offset += handler.MaxDeckCards {
+		page := listPage(handler.MaxDeckCards+1, offset)
+		require.LessOrEqual(t, len(page), handler.MaxDeckCards, "The page size should be capped")
+		for _, c := range page {
+			require.False(t, seen[c.ID], "Pages should not overlap")
+			seen[c.ID] = true
+			if c.ID == card.ID {
+				listed = &c
+			}
+		}
+		if len(page) < handler.MaxDeckCards {
+			break
+		}
+	}
+	require.NotNil(t, listed, "Suspended cards stay in the deck's card list")
+	require.True(t, listed.Suspended)
+	require.Len(t, listPage(0, 0), 50, "The default page size applies")
+
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+card.ID+"/suspend", `{"suspended": false}`, resp.Token, http.StatusOK)
+	require.False(t, testutils.ParseResponse[contract.CardResponse](t, rec).Suspended)
+	require.True(t, dueIDs()[card.ID], "An unsuspended card comes back")
+
+	other, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+38, "stranger", "Stranger")
+	require.NoError(t, err)
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+card.ID+"/suspend", "", other.Token, http.StatusNotFound)
+	testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+deck.ID+"/cards", "", other.Token, http.StatusForbidden)
+}
+
+func TestUndoReview(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+44, "undoer", "Undoer")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Undo Deck")
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+card.ID+"/undo", "", resp.Token, http.StatusConflict)
+
+	body, _ := json.Marshal(map[string]int{"rating": db.RatingGood, "time_spent_ms": 3000})
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+card.ID+"/review", string(body), resp.Token, http.StatusOK)
+
+	reviewed, err := testutils.GetDBStorage().GetCard(card.ID, resp.User.ID)
+	require.NoError(t, err)
+	require.Equal(t, string(db.StateLearning), reviewed.State)
+
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+card.ID+"/undo", "", resp.Token, http.StatusOK)
+	undone := testutils.ParseResponse[contract.CardResponse](t, rec)
+	require.Equal(t, card.ID, undone.ID)
+	require.Equal(t, string(db.StateNew), undone.State)
+
+	after, err := testutils.GetDBStorage().GetCard(card.ID, resp.User.ID)
+	require.NoError(t, err)
+	require.Equal(t, string(db.StateNew), after.State)
+	require.Equal(t, 0, after.ReviewCount)
+	require.Nil(t, after.FirstReviewedAt, "An undone first review should leave the card unseen")
+	require.Nil(t, after.LastReviewedAt)
+
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+card.ID+"/undo", "", resp.Token, http.StatusConflict)
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/missing/undo", "", resp.Token, http.StatusNotFound)
+}
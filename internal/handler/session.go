@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"atamagaii/internal/contract"
+	"atamagaii/internal/db"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+const (
+	SessionItemCard = "card"
+	SessionItemTask = "task"
+
+	// DefaultSessionCardsPerTask is how many cards are reviewed between two tasks in a study session
+	DefaultSessionCardsPerTask = 3
+)
+
+// GetStudySession returns due and new cards of a deck interleaved with its pending tasks,
+// so the client can run a whole study session from a single request
+func (h *Handler) GetStudySession(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	deckID := c.Param("id")
+	if deckID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Deck ID is required")
+	}
+
+	deck, err := h.db.GetDeck(deckID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck").WithInternal(err)
+	}
+
+	if deck.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+
+	limit := parseIntQuery(c, "limit", 10)
+	taskLimit := parseIntQuery(c, "task_limit", 5)
+	sessionNewLimit := parseIntQuery(c, "session_new_limit", db.NoSessionNewLimit)
+
+	cardsPerTask := parseIntQuery(c, "cards_per_task", DefaultSessionCardsPerTask)
+	if cardsPerTask == 0 {
+		cardsPerTask = DefaultSessionCardsPerTask
+	}
+
+	user, err := h.requestUser(userID)
+	if err != nil {
+		return err
+	}
+
+	cards, err := h.db.GetCardsForReview(userID, user.Settings, deck, limit, sessionNewLimit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch due cards").WithInternal(err)
+	}
+
+	var tasks []contract.TaskResponse
+	if taskLimit > 0 {
+		dueTasks, err := h.db.GetTasksDueForUser(userID, taskLimit, deckID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch due tasks").WithInternal(err)
+		}
+
+		tasks = make([]contract.TaskResponse, 0, len(dueTasks))
+		for _, task := range dueTasks {
+			taskResponse, err := formatTaskResponse(task)
+			if err != nil {
+				return err
+			}
+			tasks = append(tasks, taskResponse)
+		}
+	}
+
+	displayLanguage := db.ResolveDisplayLanguage(user.Settings, user.LanguageCode)
+
+	return c.JSON(http.StatusOK, contract.StudySessionResponse{
+		DeckID: deckID,
+		Items:  interleaveSession(formatReviewCardResponses(cards, deck, displayLanguage), tasks, cardsPerTask),
+	})
+}
+
+// interleaveSession places one task after every cardsPerTask cards; tasks left over once
+// the cards run out are appended at the end
+func interleaveSession(cards []contract.CardResponse, tasks []contract.TaskResponse, cardsPerTask int) []contract.SessionItem {
+	items := make([]contract.SessionItem, 0, len(cards)+len(tasks))
+
+	taskIdx := 0
+	for i := range cards {
+		items = append(items, contract.SessionItem{Type: SessionItemCard, Card: &cards[i]})
+
+		if (i+1)%cardsPerTask == 0 && taskIdx < len(tasks) {
+			items = append(items, contract.SessionItem{Type: SessionItemTask, Task: &tasks[taskIdx]})
+			taskIdx++
+		}
+	}
+
+	for ; taskIdx < len(tasks); taskIdx++ {
+		items = append(items, contract.SessionItem{Type: SessionItemTask, Task: &tasks[taskIdx]})
+	}
+
+	return items
+}
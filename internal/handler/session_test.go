@@ -0,0 +1,76 @@
+package handler_test
+
+import (
+	"atamagaii/internal/contract"
+	"atamagaii/internal/db"
+	"atamagaii/internal/handler"
+	"atamagaii/internal/testutils"
+	"context"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGetStudySession(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Session Deck")
+	first := firstDueCard(t, e, resp.Token, deck.ID)
+
+	storage := testutils.GetDBStorage()
+
+	// Graduate one card so the deck has a task that is due
+	card, err := storage.GetCard(first.ID, resp.User.ID)
+	require.NoError(t, err)
+	dbDeck, err := storage.GetDeck(deck.ID)
+	require.NoError(t, err)
+
+	card.State = string(db.StateReview)
+	card.Interval = 3 * 24 * time.Hour
+	card.Ease = 2.5
+	require.NoError(t, storage.ReviewCard(card, dbDeck, db.RatingGood, 3000))
+
+	task, err := storage.AddTask(context.Background(), &db.Task{
+		Type:    db.TaskTypeSentenceTranslation,
+		Content: `{"sentence_ru":"Это тестовое предложение."}`,
+		Answer:  "これはテストの文です。",
+		CardID:  &card.ID,
+		UserID:  resp.User.ID,
+	})
+	require.NoError(t, err)
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+deck.ID+"/session?limit=4&cards_per_task=2", "", resp.Token, http.StatusOK)
+	session := testutils.ParseResponse[contract.StudySessionResponse](t, rec)
+
+	require.Equal(t, deck.ID, session.DeckID)
+	require.Len(t, session.Items, 5)
+
+	var cards, tasks int
+	for _, item := range session.Items {
+		switch item.Type {
+		case handler.SessionItemCard:
+			require.NotNil(t, item.Card)
+			require.Equal(t, deck.ID, item.Card.DeckID)
+			require.NotEqual(t, card.ID, item.Card.ID, "Graduated card is not due yet")
+			cards++
+		case handler.SessionItemTask:
+			require.NotNil(t, item.Task)
+			require.Equal(t, task.ID, item.Task.ID)
+			tasks++
+		default:
+			t.Fatalf("Unexpected session item type %q", item.Type)
+		}
+	}
+
+	require.Equal(t, 4, cards)
+	require.Equal(t, 1, tasks)
+	require.Equal(t, handler.SessionItemTask, session.Items[2].Type, "Task should follow every two cards")
+
+	other, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+1, "importer", "Importer")
+	require.NoError(t, err)
+	testutils.PerformRequest(t, e, http.MethodGet, "/v1/decks/"+deck.ID+"/session", "", other.Token, http.StatusForbidden)
+}
@@ -1,8 +1,13 @@
 package handler
 
 import (
+	"atamagaii/internal/ai"
 	"atamagaii/internal/contract"
 	"atamagaii/internal/db"
+	"atamagaii/internal/job"
+	"atamagaii/internal/utils"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"net/http"
@@ -29,37 +34,165 @@ func (h *Handler) GetTasks(c echo.Context) error {
 
 	taskResponses := make([]contract.TaskResponse, 0, len(tasks))
 	for _, task := range tasks {
-		var content contract.TaskContent
+		taskResponse, err := formatTaskResponse(task)
+		if err != nil {
+			return err
+		}
+		taskResponses = append(taskResponses, taskResponse)
+	}
 
-		switch task.Type {
-		case db.TaskTypeVocabRecall:
-			content, err = db.UnmarshalTaskContent[db.TaskVocabRecallContent](&task)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Error parsing vocab recall task content: %v", err))
-			}
-		case db.TaskTypeSentenceTranslation:
-			content, err = db.UnmarshalTaskContent[db.TaskSentenceTranslationContent](&task)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Error parsing sentence translation task content: %v", err))
-			}
-		case db.TaskTypeAudio:
-			content, err = db.UnmarshalTaskContent[db.TaskAudioContent](&task)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Error parsing audio task content: %v", err))
-			}
-		default:
-			return echo.NewHTTPError(http.StatusNotImplemented, "Task type not implemented")
+	return c.JSON(http.StatusOK, taskResponses)
+}
+
+const (
+	// DefaultGeneratedTasks is how many tasks GenerateDeckTasks creates when count is not given
+	DefaultGeneratedTasks = 5
+	// MaxGeneratedTasks caps how many tasks a single GenerateDeckTasks request may create
+	MaxGeneratedTasks = 20
+)
+
+// GenerateDeckTasks generates tasks for the deck's review cards right away instead of waiting for the background job
+func (h *Handler) GenerateDeckTasks(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	if h.taskGenerator == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Task generator is not configured")
+	}
+
+	deckID := c.Param("id")
+	if deckID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Deck ID is required")
+	}
+
+	deck, err := h.db.GetDeck(deckID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeDeckNotFound, "Deck not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch deck").WithInternal(err)
+	}
+
+	if deck.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+
+	count := parseIntQuery(c, "count", DefaultGeneratedTasks)
+	if count == 0 {
+		count = DefaultGeneratedTasks
+	}
+	count = min(count, MaxGeneratedTasks)
+
+	tasks, err := h.taskGenerator.GenerateDeckTasks(c.Request().Context(), userID, deckID, count)
+	if err != nil {
+		switch {
+		case errors.Is(err, job.ErrDailyTaskLimitReached):
+			return newCodedError(http.StatusTooManyRequests, contract.ErrorCodeDailyLimit, "Daily task limit reached")
+		case errors.Is(err, ai.ErrQuotaExceeded):
+			return newCodedError(http.StatusServiceUnavailable, contract.ErrorCodeAIUnavailable, "AI provider is busy, try again later").WithInternal(err)
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to generate tasks").WithInternal(err)
+	}
+
+	taskResponses := make([]contract.TaskResponse, 0, len(tasks))
+	for _, task := range tasks {
+		task.LanguageCode = deck.LanguageCode
+		taskResponse, err := formatTaskResponse(task)
+		if err != nil {
+			return err
+		}
+		taskResponses = append(taskResponses, taskResponse)
+	}
+
+	return c.JSON(http.StatusCreated, taskResponses)
+}
+
+func formatTaskResponse(task db.Task) (contract.TaskResponse, error) {
+	var content contract.TaskContent
+	var err error
+
+	switch task.Type {
+	case db.TaskTypeVocabRecall:
+		content, err = db.UnmarshalTaskContent[db.TaskVocabRecallContent](&task)
+		if err != nil {
+			return contract.TaskResponse{}, echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Error parsing vocab recall task content: %v", err))
+		}
+	case db.TaskTypeSentenceTranslation:
+		content, err = db.UnmarshalTaskContent[db.TaskSentenceTranslationContent](&task)
+		if err != nil {
+			return contract.TaskResponse{}, echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Error parsing sentence translation task content: %v", err))
+		}
+	case db.TaskTypeAudio:
+		content, err = db.UnmarshalTaskContent[db.TaskAudioContent](&task)
+		if err != nil {
+			return contract.TaskResponse{}, echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Error parsing audio task content: %v", err))
+		}
+	default:
+		return contract.TaskResponse{}, echo.NewHTTPError(http.StatusNotImplemented, "Task type not implemented")
+	}
+
+	return contract.TaskResponse{
+		ID:           task.ID,
+		Type:         string(task.Type),
+		Content:      content,
+		CompletedAt:  task.CompletedAt,
+		UserResponse: task.UserResponse,
+		IsCorrect:    task.IsCorrect,
+		TimeSpentMs:  task.TimeSpentMs,
+		CreatedAt:    task.CreatedAt,
+		LanguageCode: task.LanguageCode,
+	}, nil
+}
+
+// GetCardTasks returns all tasks generated from a card; answers are only revealed for completed tasks
+func (h *Handler) GetCardTasks(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	cardID := c.Param("id")
+	if cardID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Card ID is required")
+	}
+
+	card, err := h.db.GetCard(cardID, userID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeCardNotFound, "Card not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch card").WithInternal(err)
+	}
+
+	deck, err := h.db.GetDeck(card.DeckID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to verify card ownership")
+	}
+
+	if deck.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+
+	tasks, err := h.db.GetTasksByCard(cardID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch card tasks").WithInternal(err)
+	}
+
+	taskResponses := make([]contract.TaskResponse, 0, len(tasks))
+	for _, task := range tasks {
+		task.LanguageCode = deck.LanguageCode
+		taskResponse, err := formatTaskResponse(task)
+		if err != nil {
+			return err
 		}
 
-		taskResponse := contract.TaskResponse{
-			ID:           task.ID,
-			Type:         string(task.Type),
-			Content:      content,
-			CompletedAt:  task.CompletedAt,
-			UserResponse: task.UserResponse,
-			IsCorrect:    task.IsCorrect,
-			CreatedAt:    task.CreatedAt,
+		if task.CompletedAt != nil {
+			answer := task.Answer
+			taskResponse.Answer = &answer
 		}
+
 		taskResponses = append(taskResponses, taskResponse)
 	}
 
@@ -78,6 +211,21 @@ func (h *Handler) GetTasksPerDeck(c echo.Context) error {
 	return c.JSON(http.StatusOK, tasksPerDeck)
 }
 
+// GetTaskCount returns how many tasks are waiting for the user, for badging the tasks tab
+func (h *Handler) GetTaskCount(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	count, err := h.db.CountTasksDueForUser(userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to count tasks").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, contract.TaskCountResponse{Count: count})
+}
+
 // SubmitTaskResponse handles the POST /api/tasks/submit endpoint to submit a task response
 func (h *Handler) SubmitTaskResponse(c echo.Context) error {
 	userID, _ := GetUserIDFromToken(c)
@@ -106,9 +254,13 @@ func (h *Handler) SubmitTaskResponse(c echo.Context) error {
 
 	isCorrect := false
 	var feedback *string
+	var score *int
 
 	if task.Type == db.TaskTypeVocabRecall {
-		isCorrect = req.Response == task.Answer
+		isCorrect, err = h.gradeVocabRecall(task, req.Response)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to grade vocab recall task").WithInternal(err)
+		}
 	} else if task.Type == db.TaskTypeSentenceTranslation {
 		translationContent, err := db.UnmarshalTaskContent[db.TaskSentenceTranslationContent](task)
 		if err != nil {
@@ -128,8 +280,15 @@ func (h *Handler) SubmitTaskResponse(c echo.Context) error {
 			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Error checking translation: %v", err))
 		}
 
-		// Update the is_correct field based on the AI check (score >= 80 is considered correct)
-		isCorrect = checkResult.Score >= 80
+		user, err := h.requestUser(userID)
+		if err != nil {
+			return err
+		}
+		passScore := db.ResolveTranslationPassScore(user.Settings)
+
+		// Update the is_correct field based on the AI check and the user's pass score
+		isCorrect = checkResult.Score >= passScore
+		score = &checkResult.Score
 		if checkResult.Feedback != nil && !isCorrect {
 			feedback = checkResult.Feedback
 		}
@@ -154,6 +313,7 @@ func (h *Handler) SubmitTaskResponse(c echo.Context) error {
 
 		// Update the is_correct field based on the AI check (score >= 80 is considered correct)
 		isCorrect = checkResult.Score >= 80
+		score = &checkResult.Score
 		if checkResult.Comment != nil && !isCorrect {
 			feedback = checkResult.Comment
 		}
@@ -162,14 +322,94 @@ func (h *Handler) SubmitTaskResponse(c echo.Context) error {
 
 	}
 
-	if err := h.db.SubmitTaskResponse(req.TaskID, userID, req.Response, isCorrect); err != nil {
+	if err := h.db.SubmitTaskResponse(req.TaskID, userID, req.Response, isCorrect, req.TimeSpentMs); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Error submitting task response: %v", err))
 	}
 
 	response := contract.SubmitTaskResponse{
 		IsCorrect: isCorrect,
 		FeedBack:  feedback,
+		Score:     score,
 	}
 
 	return c.JSON(http.StatusOK, response)
 }
+
+// RequeueCardTask clears a card's failed task generations so the next pass tries it again right away
+func (h *Handler) RequeueCardTask(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	cardID := c.Param("id")
+	if cardID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Card ID is required")
+	}
+
+	if _, err := h.db.GetCard(cardID, userID); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return newCodedError(http.StatusNotFound, contract.ErrorCodeCardNotFound, "Card not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch card").WithInternal(err)
+	}
+
+	if err := h.db.ClearTaskGenFailures(cardID, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to requeue task generation").WithInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// gradeVocabRecall checks a vocab recall answer. Multiple choice answers must be the correct option; typed
+// answers are compared to the term after normalization, and for Japanese the term's kana reading is accepted too.
+func (h *Handler) gradeVocabRecall(task *db.Task, response string) (bool, error) {
+	content, err := db.UnmarshalTaskContent[db.TaskVocabRecallContent](task)
+	if err != nil {
+		return false, err
+	}
+
+	if !content.FreeText {
+		return response == task.Answer, nil
+	}
+
+	accepted := []string{task.Answer}
+	languageCode := ""
+	if task.CardID != nil {
+		card, err := h.db.GetCardByID(*task.CardID)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return false, err
+		}
+
+		if card != nil {
+			// only file imports record the language on the card, the deck always has it
+			deck, err := h.db.GetDeck(card.DeckID)
+			if err != nil && !errors.Is(err, db.ErrNotFound) {
+				return false, err
+			}
+			if deck != nil {
+				languageCode = deck.LanguageCode
+			}
+
+			var item db.VocabularyItem
+			if err := json.Unmarshal([]byte(card.Fields), &item); err == nil {
+				if utils.NormalizeLanguageCode(languageCode) == "jp" && item.Transcription != "" {
+					accepted = append(accepted, item.Transcription)
+				}
+			}
+		}
+	}
+
+	answer := utils.NormalizeTermForDedup(response, languageCode)
+	if answer == "" {
+		return false, nil
+	}
+
+	for _, term := range accepted {
+		if answer == utils.NormalizeTermForDedup(term, languageCode) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,515 @@
+package handler_test
+
+import (
+	"atamagaii/internal/ai"
+	"atamagaii/internal/contract"
+	"atamagaii/internal/db"
+	"atamagaii/internal/job"
+	"atamagaii/internal/testutils"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+func TestGetCardTasks(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Card Tasks Deck")
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+
+	storage := testutils.GetDBStorage()
+
+	recall, err := storage.AddTask(context.Background(), &db.Task{
+		Type:    db.TaskTypeVocabRecall,
+		Content: `{"question":"What does this word mean?","options":{"a":"one","b":"two","c":"three","d":"four"}}`,
+		Answer:  "a",
+		CardID:  &card.ID,
+		UserID:  resp.User.ID,
+	})
+	require.NoError(t, err)
+
+	translation, err := storage.AddTask(context.Background(), &db.Task{
+		Type:    db.TaskTypeSentenceTranslation,
+		Content: `{"sentence_ru":"Это тестовое предложение."}`,
+		Answer:  "これはテストの文です。",
+		CardID:  &card.ID,
+		UserID:  resp.User.ID,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, storage.SubmitTaskResponse(recall.ID, resp.User.ID, "a", true, nil))
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/"+card.ID+"/tasks", "", resp.Token, http.StatusOK)
+	tasks := testutils.ParseResponse[[]contract.TaskResponse](t, rec)
+	require.Len(t, tasks, 2)
+
+	byID := make(map[string]contract.TaskResponse, len(tasks))
+	for _, task := range tasks {
+		byID[task.ID] = task
+	}
+
+	completed := byID[recall.ID]
+	require.Equal(t, string(db.TaskTypeVocabRecall), completed.Type)
+	require.NotNil(t, completed.CompletedAt)
+	require.NotNil(t, completed.Answer, "Answer should be revealed for completed tasks")
+	require.Equal(t, "a", *completed.Answer)
+
+	pending := byID[translation.ID]
+	require.Equal(t, string(db.TaskTypeSentenceTranslation), pending.Type)
+	require.Nil(t, pending.CompletedAt)
+	require.Nil(t, pending.Answer, "Answer must stay hidden until the task is completed")
+}
+
+func TestGetCardTasks_CardNotFound(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	require.NoError(t, err)
+
+	testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/missing-card/tasks", "", resp.Token, http.StatusNotFound)
+}
+
+func TestGetKnownWordsFromDeck_DedupesAndCaps(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID, "mkkksim", "Maksim")
+	require.NoError(t, err)
+
+	storage := testutils.GetDBStorage()
+
+	deck, err := storage.CreateDeck(resp.User.ID, db.CreateDeckParams{Name: "Known Words Deck", Level: "mixed", LanguageCode: "jp", TranscriptionType: "furigana"})
+	require.NoError(t, err)
+
+	terms := []string{"猫", "犬", "猫", "鳥", "犬", "魚", "猫"}
+	fields := make([]string, len(terms))
+	for i, term := range terms {
+		fields[i] = fmt.Sprintf(`{"term":%q}`, term)
+	}
+	require.NoError(t, storage.AddCardsInBatch(resp.User.ID, deck.ID, fields, db.DefaultCardBatchSize))
+
+	cards, err := storage.GetCardsByDeckID(deck.ID, resp.User.ID)
+	require.NoError(t, err)
+	for i := range cards {
+		require.NoError(t, storage.ReviewCard(&cards[i], deck, db.RatingGood, 3000))
+	}
+
+	words, err := storage.GetKnownWordsFromDeck(resp.User.ID, deck.ID, 10, false)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"猫", "犬", "鳥", "魚"}, words, "Known words should be deduplicated")
+
+	capped, err := storage.GetKnownWordsFromDeck(resp.User.ID, deck.ID, 2, true)
+	require.NoError(t, err)
+	require.Len(t, capped, 2)
+	require.NotEqual(t, capped[0], capped[1])
+}
+
+func TestSubmitTaskResponse_RecordsTimeSpent(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+6, "timer", "Timer")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Task Timing Deck")
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+
+	storage := testutils.GetDBStorage()
+	newRecallTask := func() *db.Task {
+		task, err := storage.AddTask(context.Background(), &db.Task{
+			Type:    db.TaskTypeVocabRecall,
+			Content: `{"question":"What does this word mean?","options":{"a":"one","b":"two","c":"three","d":"four"}}`,
+			Answer:  "a",
+			CardID:  &card.ID,
+			UserID:  resp.User.ID,
+		})
+		require.NoError(t, err)
+		return task
+	}
+
+	invalid := newRecallTask()
+	body := fmt.Sprintf(`{"task_id":%q,"response":"a","time_spent_ms":-1}`, invalid.ID)
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/tasks/submit", body, resp.Token, http.StatusBadRequest)
+
+	for _, submission := range []struct {
+		response    string
+		timeSpentMs int
+	}{
+		{response: "a", timeSpentMs: 3000},
+		{response: "b", timeSpentMs: 5000},
+	} {
+		task := newRecallTask()
+		body := fmt.Sprintf(`{"task_id":%q,"response":%q,"time_spent_ms":%d}`, task.ID, submission.response, submission.timeSpentMs)
+		testutils.PerformRequest(t, e, http.MethodPost, "/v1/tasks/submit", body, resp.Token, http.StatusOK)
+	}
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/"+card.ID+"/tasks", "", resp.Token, http.StatusOK)
+	tasks := testutils.ParseResponse[[]contract.TaskResponse](t, rec)
+
+	var recorded []int
+	for _, task := range tasks {
+		if task.CompletedAt != nil {
+			require.NotNil(t, task.TimeSpentMs)
+			recorded = append(recorded, *task.TimeSpentMs)
+		}
+	}
+	require.ElementsMatch(t, []int{3000, 5000}, recorded)
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/stats", "", resp.Token, http.StatusOK)
+	stats := testutils.ParseResponse[struct {
+		TaskStats []db.TaskTypeStats `json:"task_stats"`
+	}](t, rec)
+	require.Len(t, stats.TaskStats, 1)
+
+	recall := stats.TaskStats[0]
+	require.Equal(t, db.TaskTypeVocabRecall, recall.Type)
+	require.Equal(t, 2, recall.Completed)
+	require.Equal(t, 1, recall.Correct)
+	require.InDelta(t, 0.5, recall.Accuracy, 0.001)
+	require.Equal(t, 4000, recall.AvgTimeSpentMs)
+}
+
+func TestSubmitTaskResponse_TranslationPassScore(t *testing.T) {
+	mockAI := &testutils.MockAIClient{
+		CheckTranslationFunc: func(ctx context.Context, sentenceRu, correctAnswer, userAnswer string, languageCode string) (*ai.TranslationCheckResult, error) {
+			return &ai.TranslationCheckResult{Score: 75}, nil
+		},
+	}
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{AIClient: mockAI})
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+18, "grader", "Grader")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Pass Score Deck")
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+
+	storage := testutils.GetDBStorage()
+	submitTranslation := func() contract.SubmitTaskResponse {
+		task, err := storage.AddTask(context.Background(), &db.Task{
+			Type:    db.TaskTypeSentenceTranslation,
+			Content: `{"sentence_ru":"Это тестовое предложение."}`,
+			Answer:  "これはテストの文です。",
+			CardID:  &card.ID,
+			UserID:  resp.User.ID,
+		})
+		require.NoError(t, err)
+
+		body := fmt.Sprintf(`{"task_id":%q,"response":"これはテストです。"}`, task.ID)
+		rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/tasks/submit", body, resp.Token, http.StatusOK)
+		return testutils.ParseResponse[contract.SubmitTaskResponse](t, rec)
+	}
+
+	result := submitTranslation()
+	require.False(t, result.IsCorrect, "A score of 75 should fail the default pass score")
+	require.NotNil(t, result.Score)
+	require.Equal(t, 75, *result.Score)
+
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", `{"settings":{"translation_pass_score":40}}`, resp.Token, http.StatusBadRequest)
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", `{"settings":{"translation_pass_score":70}}`, resp.Token, http.StatusOK)
+
+	result = submitTranslation()
+	require.True(t, result.IsCorrect, "A score of 75 should pass a lowered pass score")
+	require.Equal(t, 75, *result.Score)
+}
+
+func TestGenerateDeckTasks(t *testing.T) {
+	mockAI := &testutils.MockAIClient{
+		GenerateTaskFunc: func(_ context.Context, _, knownWords string, taskType db.TaskType) (*string, error) {
+			require.Equal(t, db.TaskTypeVocabRecall, taskType, "Only enabled task types should be generated")
+			content := `{"question":"What does this word mean?","options":{"a":"one","b":"two","c":"three","d":"four"},"correct_answer":"b"}`
+			return &content, nil
+		},
+	}
+	storage := testutils.GetDBStorage()
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{
+		AIClient:      mockAI,
+		TaskGenerator: job.NewTaskGenerator(storage, mockAI, nil, nil, job.TaskGeneratorConfig{}),
+	})
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+13, "practicer", "Practicer")
+	require.NoError(t, err)
+
+	settings := `{"settings":{"task_types":["vocab_recall"],"max_tasks_per_day":3}}`
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", settings, resp.Token, http.StatusOK)
+
+	deck := importTestDeck(t, e, resp.Token, "On Demand Tasks Deck")
+
+	cards, err := storage.GetCardsByDeckID(deck.ID, resp.User.ID)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(cards), 5)
+
+	// new cards are not eligible, only the ones graduated to review
+	reviewed := make(map[string]bool)
+	for i := range cards[:4] {
+		for attempt := 0; attempt < 10 && cards[i].State != string(db.StateReview); attempt++ {
+			require.NoError(t, storage.ReviewCard(&cards[i], &deck, db.RatingGood, 3000))
+		}
+		require.Equal(t, string(db.StateReview), cards[i].State)
+		reviewed[cards[i].ID] = true
+	}
+
+	path := "/v1/decks/" + deck.ID + "/generate-tasks"
+
+	rec := testutils.PerformRequest(t, e, http.MethodPost, path+"?count=2", "", resp.Token, http.StatusCreated)
+	tasks := testutils.ParseResponse[[]contract.TaskResponse](t, rec)
+	require.Len(t, tasks, 2)
+	for _, task := range tasks {
+		require.Equal(t, string(db.TaskTypeVocabRecall), task.Type)
+		require.Nil(t, task.Answer, "Answer must stay hidden until the task is completed")
+	}
+
+	// the daily limit of 3 leaves room for one more task
+	rec = testutils.PerformRequest(t, e, http.MethodPost, path+"?count=5", "", resp.Token, http.StatusCreated)
+	tasks = testutils.ParseResponse[[]contract.TaskResponse](t, rec)
+	require.Len(t, tasks, 1)
+
+	testutils.PerformRequest(t, e, http.MethodPost, path, "", resp.Token, http.StatusTooManyRequests)
+
+	withTasks := 0
+	for _, card := range cards {
+		cardTasks, err := storage.GetTasksByCard(card.ID, resp.User.ID)
+		require.NoError(t, err)
+		if len(cardTasks) > 0 {
+			require.True(t, reviewed[card.ID], "Tasks should only be generated for review cards")
+			require.Len(t, cardTasks, 1, "A card should get at most one task per day")
+			withTasks++
+		}
+	}
+	require.Equal(t, 3, withTasks)
+
+	other, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+1, "importer", "Importer")
+	require.NoError(t, err)
+	testutils.PerformRequest(t, e, http.MethodPost, path, "", other.Token, http.StatusForbidden)
+}
+
+func TestGetTasks_LanguageCode(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+24, "thaistudent", "Thai Student")
+	require.NoError(t, err)
+
+	storage := testutils.GetDBStorage()
+
+	deck, err := storage.CreateDeck(resp.User.ID, db.CreateDeckParams{Name: "Thai Words", Level: "mixed", LanguageCode: "th", TranscriptionType: "thai_romanization"})
+	require.NoError(t, err)
+
+	card, err := storage.AddCard(resp.User.ID, deck.ID, `{"term":"แมว","meaning_en":"cat"}`)
+	require.NoError(t, err)
+	for attempt := 0; attempt < 10 && card.State != string(db.StateReview); attempt++ {
+		require.NoError(t, storage.ReviewCard(card, deck, db.RatingGood, 3000))
+	}
+	require.Equal(t, string(db.StateReview), card.State)
+
+	_, err = storage.AddTask(context.Background(), &db.Task{
+		Type:    db.TaskTypeVocabRecall,
+		Content: `{"question":"What does แมว mean?","options":{"a":"cat","b":"dog","c":"bird","d":"fish"}}`,
+		Answer:  "a",
+		CardID:  &card.ID,
+		UserID:  resp.User.ID,
+	})
+	require.NoError(t, err)
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/tasks", "", resp.Token, http.StatusOK)
+	tasks := testutils.ParseResponse[[]contract.TaskResponse](t, rec)
+	require.Len(t, tasks, 1)
+	require.Equal(t, "th", tasks[0].LanguageCode)
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/cards/"+card.ID+"/tasks", "", resp.Token, http.StatusOK)
+	cardTasks := testutils.ParseResponse[[]contract.TaskResponse](t, rec)
+	require.Len(t, cardTasks, 1)
+	require.Equal(t, "th", cardTasks[0].LanguageCode)
+}
+
+func TestRequeueCardTask(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+25, "requeuer", "Requeuer")
+	require.NoError(t, err)
+
+	deck := importTestDeck(t, e, resp.Token, "Requeue Deck")
+	card := firstDueCard(t, e, resp.Token, deck.ID)
+
+	storage := testutils.GetDBStorage()
+	for i := 0; i < db.MaxTaskGenFailures; i++ {
+		require.NoError(t, storage.RecordTaskGenFailure(db.Card{ID: card.ID, UserID: resp.User.ID}, "AI provider error"))
+	}
+
+	other, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+1, "importer", "Importer")
+	require.NoError(t, err)
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+card.ID+"/requeue-task", "", other.Token, http.StatusNotFound)
+
+	failure, err := storage.GetTaskGenFailure(card.ID, resp.User.ID)
+	require.NoError(t, err)
+	require.True(t, failure.Exhausted)
+
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/cards/"+card.ID+"/requeue-task", "", resp.Token, http.StatusOK)
+
+	_, err = storage.GetTaskGenFailure(card.ID, resp.User.ID)
+	require.ErrorIs(t, err, db.ErrNotFound)
+}
+
+func TestGetTaskCount(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+32, "badger", "Badger")
+	require.NoError(t, err)
+
+	storage := testutils.GetDBStorage()
+
+	deck, err := storage.CreateDeck(resp.User.ID, db.CreateDeckParams{Name: "Badge Deck", Level: "mixed", LanguageCode: "jp", TranscriptionType: "furigana"})
+	require.NoError(t, err)
+
+	reviewCard, err := storage.AddCard(resp.User.ID, deck.ID, `{"term":"猫","meaning_en":"cat"}`)
+	require.NoError(t, err)
+	for attempt := 0; attempt < 10 && reviewCard.State != string(db.StateReview); attempt++ {
+		require.NoError(t, storage.ReviewCard(reviewCard, deck, db.RatingGood, 3000))
+	}
+	require.Equal(t, string(db.StateReview), reviewCard.State)
+
+	newCard, err := storage.AddCard(resp.User.ID, deck.ID, `{"term":"犬","meaning_en":"dog"}`)
+	require.NoError(t, err)
+
+	addTask := func(card *db.Card) *db.Task {
+		task, err := storage.AddTask(context.Background(), &db.Task{
+			Type:    db.TaskTypeVocabRecall,
+			Content: `{"question":"What does this word mean?","options":{"a":"one","b":"two","c":"three","d":"four"}}`,
+			Answer:  "a",
+			CardID:  &card.ID,
+			UserID:  resp.User.ID,
+		})
+		require.NoError(t, err)
+		return task
+	}
+
+	completed := addTask(reviewCard)
+	addTask(reviewCard)
+	addTask(reviewCard)
+	addTask(newCard) // Not shown until its card reaches the review state
+	require.NoError(t, storage.SubmitTaskResponse(completed.ID, resp.User.ID, "a", true, nil))
+
+	rec := testutils.PerformRequest(t, e, http.MethodGet, "/v1/tasks/count", "", resp.Token, http.StatusOK)
+	count := testutils.ParseResponse[contract.TaskCountResponse](t, rec)
+	require.Equal(t, 2, count.Count)
+
+	rec = testutils.PerformRequest(t, e, http.MethodGet, "/v1/tasks", "", resp.Token, http.StatusOK)
+	tasks := testutils.ParseResponse[[]contract.TaskResponse](t, rec)
+	require.Len(t, tasks, count.Count, "The badge should match the task list")
+}
+
+func TestSubmitTaskResponse_FreeTextVocabRecall(t *testing.T) {
+	mockAI := &testutils.MockAIClient{
+		GenerateTaskFunc: func(_ context.Context, _, _ string, _ db.TaskType) (*string, error) {
+			t.Error("Free-text vocab recall tasks need no generated options")
+			return nil, errors.New("unexpected task generation")
+		},
+	}
+	storage := testutils.GetDBStorage()
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{
+		AIClient:      mockAI,
+		TaskGenerator: job.NewTaskGenerator(storage, mockAI, nil, nil, job.TaskGeneratorConfig{}),
+	})
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+36, "typist", "Typist")
+	require.NoError(t, err)
+
+	settings := `{"settings":{"task_types":["vocab_recall"],"max_tasks_per_day":5,"free_text_vocab_recall":true}}`
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", settings, resp.Token, http.StatusOK)
+
+	deck := importTestDeck(t, e, resp.Token, "Typed Recall Deck")
+
+	cards, err := storage.GetCardsByDeckID(deck.ID, resp.User.ID)
+	require.NoError(t, err)
+
+	// Cards written in kanji, so typing the kana reading differs from typing the term
+	items := make(map[string]db.VocabularyItem)
+	for i := range cards {
+		var item db.VocabularyItem
+		require.NoError(t, json.Unmarshal([]byte(cards[i].Fields), &item))
+		if item.Transcription == "" || item.Transcription == item.Term || item.MeaningEn == "" {
+			continue
+		}
+
+		for attempt := 0; attempt < 10 && cards[i].State != string(db.StateReview); attempt++ {
+			require.NoError(t, storage.ReviewCard(&cards[i], &deck, db.RatingGood, 3000))
+		}
+		items[cards[i].ID] = item
+		if len(items) == 3 {
+			break
+		}
+	}
+	require.Len(t, items, 3)
+
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/"+deck.ID+"/generate-tasks?count=3", "", resp.Token, http.StatusCreated)
+	tasks := testutils.ParseResponse[[]contract.TaskResponse](t, rec)
+	require.Len(t, tasks, 3)
+
+	responses := []func(item db.VocabularyItem) (string, bool){
+		func(item db.VocabularyItem) (string, bool) { return " " + item.Term + "。", true },
+		func(item db.VocabularyItem) (string, bool) { return "\u3000「" + item.Transcription, true },
+		func(item db.VocabularyItem) (string, bool) { return item.Term + "じゃない", false },
+	}
+
+	for i, task := range tasks {
+		require.Equal(t, string(db.TaskTypeVocabRecall), task.Type)
+
+		dbTask, err := storage.GetTask(task.ID)
+		require.NoError(t, err)
+		require.NotNil(t, dbTask.CardID)
+		item := items[*dbTask.CardID]
+
+		content, err := db.UnmarshalTaskContent[db.TaskVocabRecallContent](dbTask)
+		require.NoError(t, err)
+		require.True(t, content.FreeText)
+		require.Equal(t, item.MeaningEn, content.Question)
+		require.Empty(t, content.Options.A, "Free-text tasks have no options")
+
+		answer, correct := responses[i](item)
+		body, _ := json.Marshal(map[string]string{"task_id": task.ID, "response": answer})
+		rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/tasks/submit", string(body), resp.Token, http.StatusOK)
+		result := testutils.ParseResponse[contract.SubmitTaskResponse](t, rec)
+		require.Equal(t, correct, result.IsCorrect, "answer %q for term %s", answer, item.Term)
+	}
+}
+
+func TestSubmitTaskResponse_FreeTextVocabRecallUsesDeckLanguage(t *testing.T) {
+	mockAI := &testutils.MockAIClient{}
+	storage := testutils.GetDBStorage()
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{
+		AIClient:      mockAI,
+		TaskGenerator: job.NewTaskGenerator(storage, mockAI, nil, nil, job.TaskGeneratorConfig{}),
+	})
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+45, "reader", "Reader")
+	require.NoError(t, err)
+
+	settings := `{"settings":{"task_types":["vocab_recall"],"max_tasks_per_day":5,"free_text_vocab_recall":true}}`
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", settings, resp.Token, http.StatusOK)
+
+	deck, err := storage.CreateDeck(resp.User.ID, db.CreateDeckParams{Name: "Bare Fields Deck", Level: "N5", LanguageCode: "jp", TranscriptionType: "furigana"})
+	require.NoError(t, err)
+
+	// Cards added outside the file importer carry no language_code of their own
+	fields := `{"term":"猫","transcription":"ねこ","meaning_en":"cat"}`
+	require.NoError(t, storage.AddCardsInBatch(resp.User.ID, deck.ID, []string{fields}, db.DefaultCardBatchSize))
+
+	cards, err := storage.GetCardsByDeckID(deck.ID, resp.User.ID)
+	require.NoError(t, err)
+	require.Len(t, cards, 1)
+	for attempt := 0; attempt < 10 && cards[0].State != string(db.StateReview); attempt++ {
+		require.NoError(t, storage.ReviewCard(&cards[0], deck, db.RatingGood, 3000))
+	}
+
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/decks/"+deck.ID+"/generate-tasks?count=1", "", resp.Token, http.StatusCreated)
+	tasks := testutils.ParseResponse[[]contract.TaskResponse](t, rec)
+	require.Len(t, tasks, 1)
+
+	body, _ := json.Marshal(map[string]string{"task_id": tasks[0].ID, "response": "ねこ"})
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/tasks/submit", string(body), resp.Token, http.StatusOK)
+	result := testutils.ParseResponse[contract.SubmitTaskResponse](t, rec)
+	require.True(t, result.IsCorrect, "The kana reading should be accepted for a Japanese deck")
+}
@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"atamagaii/internal/ai"
+	"atamagaii/internal/contract"
+	"atamagaii/internal/db"
+	"atamagaii/internal/utils"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TTSPreviewsPerMinute is how many uncached previews a user may synthesize per minute
+	TTSPreviewsPerMinute = 10
+	// ttsPreviewPrefix is the storage prefix for preview audio. Objects under it are expired a day after
+	// upload, longer than ttsPreviewTTL, by the rule in deployment/tts-preview-lifecycle.json
+	// (make tts-preview-lifecycle).
+	ttsPreviewPrefix = "tts-preview/"
+	// ttsPreviewTTL is how long the URL of a synthesized preview is handed out again
+	ttsPreviewTTL = 6 * time.Hour
+	// maxTTSPreviews caps how many preview URLs are remembered, the ones expiring first make room
+	maxTTSPreviews = 1000
+)
+
+type TTSPreviewRequest struct {
+	Text     string `json:"text" validate:"required,max=500"`
+	Language string `json:"language" validate:"required"`
+}
+
+// ttsPreviews remembers synthesized previews by text, language and rate and limits how often each user
+// may synthesize a new one
+type ttsPreviews struct {
+	mu        sync.Mutex
+	urls      map[string]ttsPreview
+	requests  map[string][]time.Time
+	lastSweep time.Time // when users without requests in the last minute were last dropped from requests
+}
+
+// ttsPreview is a remembered preview URL, handed out until expiresAt
+type ttsPreview struct {
+	url       string
+	expiresAt time.Time
+}
+
+func newTTSPreviews() *ttsPreviews {
+	return &ttsPreviews{
+		urls:     make(map[string]ttsPreview),
+		requests: make(map[string][]time.Time),
+	}
+}
+
+func ttsPreviewKey(text, language string, rate float64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%.2f\x00%s", language, rate, text)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *ttsPreviews) cached(key string, now time.Time) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	preview, ok := p.urls[key]
+	if !ok || !now.Before(preview.expiresAt) {
+		delete(p.urls, key)
+		return "", false
+	}
+	return preview.url, true
+}
+
+// store remembers url for ttsPreviewTTL. Once maxTTSPreviews are remembered expired previews are dropped,
+// and if none are, the one expiring first.
+func (p *ttsPreviews) store(key, url string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.urls[key]; !ok && len(p.urls) >= maxTTSPreviews {
+		oldestKey := ""
+		for k, preview := range p.urls {
+			if !now.Before(preview.expiresAt) {
+				delete(p.urls, k)
+			} else if oldestKey == "" || preview.expiresAt.Before(p.urls[oldestKey].expiresAt) {
+				oldestKey = k
+			}
+		}
+		if len(p.urls) >= maxTTSPreviews {
+			delete(p.urls, oldestKey)
+		}
+	}
+
+	p.urls[key] = ttsPreview{url: url, expiresAt: now.Add(ttsPreviewTTL)}
+}
+
+// allow records a synthesis for the user unless they already used up the last minute's budget
+func (p *ttsPreviews) allow(userID string, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	windowStart := now.Add(-time.Minute)
+
+	// Users who stopped previewing would otherwise be remembered forever
+	if now.Sub(p.lastSweep) >= time.Minute {
+		for id, times := range p.requests {
+			if len(times) == 0 || !times[len(times)-1].After(windowStart) {
+				delete(p.requests, id)
+			}
+		}
+		p.lastSweep = now
+	}
+
+	recent := p.requests[userID][:0]
+	for _, at := range p.requests[userID] {
+		if at.After(windowStart) {
+			recent = append(recent, at)
+		}
+	}
+
+	if len(recent) >= TTSPreviewsPerMinute {
+		p.requests[userID] = recent
+		return false
+	}
+
+	p.requests[userID] = append(recent, now)
+	return true
+}
+
+// PreviewTTS synthesizes text so the card editor can play an edited sentence before saving it.
+// It is read at the user's TaskAudioRate, the speaking rate they chose to listen at. Identical text at the
+// same rate is served from cache and doesn't count against the user's rate limit.
+func (h *Handler) PreviewTTS(c echo.Context) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return err
+	}
+
+	req := new(TTSPreviewRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+
+	if err := c.Validate(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if !utils.IsKnownLanguageCode(req.Language) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unsupported language: %s", req.Language))
+	}
+
+	text := strings.TrimSpace(utils.RemoveFurigana(req.Text))
+	if text == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Text is required")
+	}
+
+	if h.storageProvider == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Audio storage is not configured")
+	}
+
+	settings, err := h.db.GetUserSettings(userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load user settings").WithInternal(err)
+	}
+	rate := db.ResolveTaskAudioRate(settings)
+
+	key := ttsPreviewKey(text, req.Language, rate)
+	if url, ok := h.ttsPreviews.cached(key, time.Now()); ok {
+		return c.JSON(http.StatusOK, contract.TTSPreviewResponse{URL: url, Cached: true})
+	}
+
+	if !h.ttsPreviews.allow(userID, time.Now()) {
+		return echo.NewHTTPError(http.StatusTooManyRequests, "Too many previews, try again in a minute")
+	}
+
+	ctx := c.Request().Context()
+
+	tempFilePath, err := h.aiClient.GenerateAudio(ctx, ai.WithSpeakingRate(text, rate), req.Language)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to synthesize audio").WithInternal(err)
+	}
+	defer os.Remove(tempFilePath)
+
+	tempFile, err := os.Open(tempFilePath)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to read synthesized audio").WithInternal(err)
+	}
+	defer tempFile.Close()
+
+	url, err := h.storageProvider.UploadFile(ctx, tempFile, ttsPreviewPrefix+key+".wav", "audio/wav")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to upload audio").WithInternal(err)
+	}
+
+	h.ttsPreviews.store(key, url, time.Now())
+
+	return c.JSON(http.StatusOK, contract.TTSPreviewResponse{URL: url})
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestTTSPreviews_Expiry(t *testing.T) {
+	previews := newTTSPreviews()
+	now := time.Now()
+
+	previews.store("key", "https://example.com/a.wav", now)
+
+	url, ok := previews.cached("key", now.Add(ttsPreviewTTL-time.Minute))
+	require.True(t, ok)
+	require.Equal(t, "https://example.com/a.wav", url)
+
+	_, ok = previews.cached("key", now.Add(ttsPreviewTTL))
+	require.False(t, ok, "An expired preview URL should not be handed out")
+	require.Empty(t, previews.urls)
+}
+
+func TestTTSPreviews_Capped(t *testing.T) {
+	previews := newTTSPreviews()
+	now := time.Now()
+
+	for i := 0; i < maxTTSPreviews; i++ {
+		previews.store(fmt.Sprintf("key-%d", i), "url", now.Add(time.Duration(i)*time.Second))
+	}
+	previews.store("newest", "url", now.Add(time.Hour))
+
+	require.Len(t, previews.urls, maxTTSPreviews)
+	_, ok := previews.cached("key-0", now.Add(time.Hour))
+	require.False(t, ok, "The preview expiring first should make room")
+	_, ok = previews.cached("newest", now.Add(time.Hour))
+	require.True(t, ok)
+}
+
+func TestTTSPreviews_DropsIdleUsers(t *testing.T) {
+	previews := newTTSPreviews()
+	now := time.Now()
+
+	require.True(t, previews.allow("idle", now))
+	require.True(t, previews.allow("active", now.Add(2*time.Minute)))
+
+	require.NotContains(t, previews.requests, "idle", "Users without recent previews should be forgotten")
+	require.Contains(t, previews.requests, "active")
+}
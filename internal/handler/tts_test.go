@@ -0,0 +1,83 @@
+package handler_test
+
+import (
+	"atamagaii/internal/ai"
+	"atamagaii/internal/contract"
+	"atamagaii/internal/db"
+	"atamagaii/internal/handler"
+	"atamagaii/internal/testutils"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPreviewTTS_CachesIdenticalText(t *testing.T) {
+	var synthesized []string
+	mockAI := &testutils.MockAIClient{
+		GenerateAudioFunc: func(_ context.Context, text string, _ string) (string, error) {
+			synthesized = append(synthesized, text)
+			f, err := os.CreateTemp("", "preview-*.wav")
+			if err != nil {
+				return "", err
+			}
+			defer f.Close()
+			return f.Name(), nil
+		},
+	}
+	storageProvider := &testutils.MockStorageProvider{}
+	e := testutils.SetupHandlerDependencies(t, testutils.HandlerOptions{AIClient: mockAI, StorageProvider: storageProvider})
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+16, "listener", "Listener")
+	require.NoError(t, err)
+
+	body := `{"text":"猫[ねこ]が寝[ね]ている。","language":"jp"}`
+
+	rec := testutils.PerformRequest(t, e, http.MethodPost, "/v1/tts/preview", body, resp.Token, http.StatusOK)
+	first := testutils.ParseResponse[contract.TTSPreviewResponse](t, rec)
+	require.NotEmpty(t, first.URL)
+	require.False(t, first.Cached)
+	require.Equal(t, []string{ai.WithSpeakingRate("猫が寝ている。", db.DefaultTaskAudioRate)}, synthesized, "Furigana should not be read out and the user's rate applies")
+
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/tts/preview", body, resp.Token, http.StatusOK)
+	second := testutils.ParseResponse[contract.TTSPreviewResponse](t, rec)
+	require.Equal(t, first.URL, second.URL)
+	require.True(t, second.Cached)
+	require.Len(t, synthesized, 1, "Repeated text should be served from cache")
+
+	uploads := storageProvider.Uploads()
+	require.Len(t, uploads, 1)
+	require.True(t, strings.HasPrefix(uploads[0], "tts-preview/"))
+
+	// A different rate is a different recording
+	testutils.PerformRequest(t, e, http.MethodPut, "/v1/user", `{"settings":{"task_audio_rate":0.6}}`, resp.Token, http.StatusOK)
+
+	rec = testutils.PerformRequest(t, e, http.MethodPost, "/v1/tts/preview", body, resp.Token, http.StatusOK)
+	slower := testutils.ParseResponse[contract.TTSPreviewResponse](t, rec)
+	require.False(t, slower.Cached)
+	require.NotEqual(t, first.URL, slower.URL)
+	require.Equal(t, ai.WithSpeakingRate("猫が寝ている。", 0.6), synthesized[len(synthesized)-1])
+
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/tts/preview", `{"text":"hello","language":"xx"}`, resp.Token, http.StatusBadRequest)
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/tts/preview", `{"language":"jp"}`, resp.Token, http.StatusBadRequest)
+}
+
+func TestPreviewTTS_RateLimited(t *testing.T) {
+	e := testutils.SetupHandlerDependencies(t)
+
+	resp, err := testutils.AuthHelper(t, e, testutils.TelegramTestUserID+16, "listener", "Listener")
+	require.NoError(t, err)
+
+	for i := 0; i < handler.TTSPreviewsPerMinute; i++ {
+		body := fmt.Sprintf(`{"text":"文 %d","language":"jp"}`, i)
+		testutils.PerformRequest(t, e, http.MethodPost, "/v1/tts/preview", body, resp.Token, http.StatusOK)
+	}
+
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/tts/preview", `{"text":"もう一つ","language":"jp"}`, resp.Token, http.StatusTooManyRequests)
+
+	// cached text stays available after the limit is hit
+	testutils.PerformRequest(t, e, http.MethodPost, "/v1/tts/preview", `{"text":"文 0","language":"jp"}`, resp.Token, http.StatusOK)
+}
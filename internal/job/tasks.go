@@ -7,9 +7,14 @@ import (
 	"atamagaii/internal/utils"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,40 +26,98 @@ const (
 	TaskAudioTemplate               = "task_audio.json"
 )
 
+// TaskGeneratorConfig controls how aggressively the task generator calls the AI provider
+type TaskGeneratorConfig struct {
+	// StartupDelay postpones the first pass so a restart after downtime doesn't hit the AI provider right away
+	StartupDelay time.Duration `yaml:"startup_delay"`
+	// StartupJitter adds a random extra delay in [0, StartupJitter) on top of StartupDelay
+	StartupJitter time.Duration `yaml:"startup_jitter"`
+	// MaxCardsPerPass caps how many cards are processed in a single pass, 0 means no limit
+	MaxCardsPerPass int `yaml:"max_cards_per_pass"`
+}
+
 // TaskGenerator is responsible for generating tasks for cards in review state
 type TaskGenerator struct {
 	storage         *db.Storage
 	aiClient        ai.AIClient
 	storageProvider storage.Provider
+	moderator       ai.Moderator // nil disables the safety filter
+	config          TaskGeneratorConfig
 	stopCh          chan struct{}
 	runningLock     chan struct{} // Used to ensure only one task generation job runs at a time
+	runPass         func()
+	paused          atomic.Bool
+
+	statusMu sync.Mutex
+	lastRun  TaskGeneratorRun
+}
+
+// TaskGeneratorRun summarizes a single task generation pass
+type TaskGeneratorRun struct {
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	DurationMs     int64      `json:"duration_ms"`
+	CardsProcessed int        `json:"cards_processed"`
+	TasksCreated   int        `json:"tasks_created"`
+	Errors         int        `json:"errors"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// TaskGeneratorStatus is a snapshot of the task generator for ops and debugging
+type TaskGeneratorStatus struct {
+	Paused  bool             `json:"paused"`
+	Running bool             `json:"running"`
+	LastRun TaskGeneratorRun `json:"last_run"`
 }
 
-// NewTaskGenerator creates a new TaskGenerator
-func NewTaskGenerator(storage *db.Storage, aiClient ai.AIClient, storageProvider storage.Provider) *TaskGenerator {
-	return &TaskGenerator{
+// NewTaskGenerator creates a new TaskGenerator, generated task content is screened by moderator unless it is nil
+func NewTaskGenerator(storage *db.Storage, aiClient ai.AIClient, storageProvider storage.Provider, moderator ai.Moderator, config TaskGeneratorConfig) *TaskGenerator {
+	tg := &TaskGenerator{
 		storage:         storage,
 		aiClient:        aiClient,
 		storageProvider: storageProvider,
+		moderator:       moderator,
+		config:          config,
 		stopCh:          make(chan struct{}),
 		runningLock:     make(chan struct{}, 1), // Buffer of 1 allows us to use it as a semaphore
 	}
+	tg.runPass = tg.generateTasks
+
+	return tg
+}
+
+// startupDelay returns how long to wait before the first pass
+func (tg *TaskGenerator) startupDelay() time.Duration {
+	delay := tg.config.StartupDelay
+	if tg.config.StartupJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(tg.config.StartupJitter)))
+	}
+	return delay
 }
 
 // Start begins the task generation job
 func (tg *TaskGenerator) Start() {
 	log.Println("Starting task generation job")
 
+	if delay := tg.startupDelay(); delay > 0 {
+		log.Printf("Delaying first task generation pass by %s", delay)
+		select {
+		case <-time.After(delay):
+		case <-tg.stopCh:
+			log.Println("Task generation job stopped")
+			return
+		}
+	}
+
 	ticker := time.NewTicker(TaskGenInterval)
 	defer ticker.Stop()
 
-	// Run once immediately
-	go tg.generateTasks()
+	// Run the first pass right away (after the optional startup delay)
+	go tg.tick()
 
 	for {
 		select {
 		case <-ticker.C:
-			go tg.generateTasks()
+			go tg.tick()
 		case <-tg.stopCh:
 			log.Println("Task generation job stopped")
 			return
@@ -67,57 +130,143 @@ func (tg *TaskGenerator) Stop() {
 	close(tg.stopCh)
 }
 
-// generateTasks finds cards in review state that need tasks and generates them
-func (tg *TaskGenerator) generateTasks() {
-	// Use non-blocking send to check if another job is already running
-	select {
-	case tg.runningLock <- struct{}{}: // Acquired the lock
-		defer func() { <-tg.runningLock }() // Release the lock when we're done
-	default:
-		// Another job is already running, exit without doing anything
-		log.Println("Task generation job already running, skipping this execution")
+// Pause skips scheduled passes until Resume is called; a pass already running is finished
+func (tg *TaskGenerator) Pause() {
+	tg.paused.Store(true)
+	log.Println("Task generation job paused")
+}
+
+// Resume lets scheduled passes run again after Pause
+func (tg *TaskGenerator) Resume() {
+	tg.paused.Store(false)
+	log.Println("Task generation job resumed")
+}
+
+// Status reports whether the generator is paused or running and what its last pass did
+func (tg *TaskGenerator) Status() TaskGeneratorStatus {
+	tg.statusMu.Lock()
+	defer tg.statusMu.Unlock()
+
+	return TaskGeneratorStatus{
+		Paused:  tg.paused.Load(),
+		Running: len(tg.runningLock) > 0,
+		LastRun: tg.lastRun,
+	}
+}
+
+// tick runs a pass on schedule unless the generator is paused
+func (tg *TaskGenerator) tick() {
+	if tg.paused.Load() {
+		log.Println("Task generation job paused, skipping this execution")
 		return
 	}
 
-	log.Println("Running task generation job")
+	tg.runPass()
+}
 
-	// Get cards that have moved to review state today and need tasks
-	cards, err := tg.storage.GetCardsForTaskGeneration()
+func (tg *TaskGenerator) recordRun(run TaskGeneratorRun) {
+	tg.statusMu.Lock()
+	tg.lastRun = run
+	tg.statusMu.Unlock()
+}
+
+// deckAudioEnabled reports whether audio may be generated for cards of the deck, caching lookups in cache
+func (tg *TaskGenerator) deckAudioEnabled(deckID string, cache map[string]bool) bool {
+	if enabled, ok := cache[deckID]; ok {
+		return enabled
+	}
+
+	enabled := true
+	deck, err := tg.storage.GetDeck(deckID)
 	if err != nil {
-		log.Printf("Error getting cards for task generation: %v", err)
-		return
+		log.Printf("Error getting deck %s for task generation: %v", deckID, err)
+	} else {
+		enabled = deck.GenerateAudio
 	}
 
-	log.Printf("Found %d cards that need tasks generated", len(cards))
+	cache[deckID] = enabled
+	return enabled
+}
 
-	ctx := context.Background()
+// taskTypeFor falls back from the preferred task type to one the card has the fields for.
+// Translation and listening tasks are built around an example sentence, a listening task also needs
+// the deck to allow audio; a card without a term supports no task at all.
+func taskTypeFor(preferred db.TaskType, item db.VocabularyItem, audioEnabled bool) (db.TaskType, bool) {
+	if strings.TrimSpace(item.Term) == "" {
+		return "", false
+	}
 
-	for _, card := range cards {
-		// Randomly choose between task types
-		// For now, we'll use a random distribution between task types
-		// This can be adjusted later based on user preferences or card type
-		taskType := db.TaskTypeVocabRecall
+	hasExample := strings.TrimSpace(item.ExampleNative) != ""
 
-		// Simple random selection - can be made more sophisticated later
-		rand := time.Now().Unix() % 3
-		if rand == 0 {
-			taskType = db.TaskTypeSentenceTranslation
-		} else if rand == 1 {
-			taskType = db.TaskTypeAudio
+	switch preferred {
+	case db.TaskTypeAudio:
+		if hasExample && audioEnabled {
+			return db.TaskTypeAudio, true
 		}
-
-		var vocabItem db.VocabularyItem
-		if err := json.Unmarshal([]byte(card.Fields), &vocabItem); err != nil {
-			log.Printf("error unmarshaling card fields: %v", err)
-			continue
+		if hasExample {
+			return db.TaskTypeSentenceTranslation, true
 		}
-
-		targetWord := vocabItem.Term
-		if vocabItem.MeaningEn != "" {
-			targetWord = fmt.Sprintf("%s (%s)", vocabItem.Term, vocabItem.MeaningEn)
+	case db.TaskTypeSentenceTranslation:
+		if hasExample {
+			return db.TaskTypeSentenceTranslation, true
 		}
+	}
 
-		// Generate task for this card
+	return db.TaskTypeVocabRecall, true
+}
+
+// freeTextMeaning is the meaning a free-text vocab recall task asks the term for, empty when the card has none
+func freeTextMeaning(item db.VocabularyItem) string {
+	if item.MeaningEn != "" {
+		return item.MeaningEn
+	}
+	return item.MeaningRu
+}
+
+// freeTextVocabRecall reports whether the user wants vocab recall tasks typed rather than picked
+func (tg *TaskGenerator) freeTextVocabRecall(userID string) bool {
+	settings, err := tg.storage.GetUserSettings(userID)
+	if err != nil {
+		log.Printf("Error getting vocab recall mode for user %s: %v", userID, err)
+		return false
+	}
+	return settings != nil && settings.FreeTextVocabRecall
+}
+
+// ErrCardUnsupported means no task can be generated from the card because it has no term
+var ErrCardUnsupported = errors.New("card supports no task type")
+
+// GenerateTaskForCard generates and stores a task for a review card. The AI output is sanitized so the
+// correct answer is only kept in the task's answer, never in the content shown to the user. taskType
+// falls back to one the card has the fields for.
+func (tg *TaskGenerator) GenerateTaskForCard(ctx context.Context, card db.Card, taskType db.TaskType) (*db.Task, error) {
+	return tg.generateTaskForCard(ctx, card, taskType, make(map[string]bool))
+}
+
+// generateTaskForCard is GenerateTaskForCard looking decks' audio settings up through audioEnabled,
+// a pass over many cards shares one cache so each deck is only loaded once
+func (tg *TaskGenerator) generateTaskForCard(ctx context.Context, card db.Card, taskType db.TaskType, audioEnabled map[string]bool) (*db.Task, error) {
+	var vocabItem db.VocabularyItem
+	if err := json.Unmarshal([]byte(card.Fields), &vocabItem); err != nil {
+		return nil, fmt.Errorf("error unmarshaling card fields: %w", err)
+	}
+
+	deckAudio := taskType == db.TaskTypeAudio && tg.deckAudioEnabled(card.DeckID, audioEnabled)
+	taskType, ok := taskTypeFor(taskType, vocabItem, deckAudio)
+	if !ok {
+		return nil, ErrCardUnsupported
+	}
+
+	targetWord := vocabItem.Term
+	if vocabItem.MeaningEn != "" {
+		targetWord = fmt.Sprintf("%s (%s)", vocabItem.Term, vocabItem.MeaningEn)
+	}
+
+	// Free-text recall asks for the term itself, so there are no distractors to generate
+	freeText := taskType == db.TaskTypeVocabRecall && freeTextMeaning(vocabItem) != "" && tg.freeTextVocabRecall(card.UserID)
+
+	var rawContentJSON []byte
+	if !freeText {
 		taskContent, err := tg.aiClient.GenerateTask(
 			ctx,
 			vocabItem.LanguageCode,
@@ -125,163 +274,340 @@ func (tg *TaskGenerator) generateTasks() {
 			taskType,
 		)
 		if err != nil {
-			log.Printf("Error generating task for card %s: %v", card.ID, err)
-			continue
+			return nil, fmt.Errorf("error generating task content: %w", err)
 		}
 
-		var rawContentJSON []byte
 		if taskContent != nil {
 			rawContentJSON = []byte(*taskContent)
 		}
 
-		correctAnswer := ""
-		var contentJSON []byte
+		// Sentences, stories and options are all written by the AI, so the whole content is screened
+		if tg.moderator != nil && taskContent != nil {
+			flagged, err := tg.moderator.IsFlagged(ctx, *taskContent)
+			if err != nil {
+				return nil, fmt.Errorf("error moderating task content: %w", err)
+			}
+			if flagged {
+				return nil, ai.ErrContentFlagged
+			}
+		}
+	}
 
-		// Handle different task types
-		if taskType == db.TaskTypeVocabRecall {
-			// For vocab recall tasks, extract and store just the answer letter
-			var vocabContent db.TaskVocabRecallContent
+	correctAnswer := ""
+	var contentJSON []byte
+	var err error
 
-			if err := json.Unmarshal(rawContentJSON, &vocabContent); err != nil {
-				log.Printf("Error parsing vocab content for card %s: %v", card.ID, err)
-				continue
-			}
+	// Handle different task types
+	if freeText {
+		// The answer is the term as written on the card, graded by normalized match in SubmitTaskResponse
+		correctAnswer = utils.RemoveFurigana(vocabItem.Term)
 
-			// Store just the answer letter (A, B, C, D)
-			correctAnswer = vocabContent.CorrectAnswer
-
-			// Create a content version without the correct answer field
-			sanitizedContent := struct {
-				Question string `json:"question"`
-				Options  struct {
-					A string `json:"a"`
-					B string `json:"b"`
-					C string `json:"c"`
-					D string `json:"d"`
-				} `json:"options"`
-			}{
-				Question: targetWord,
-				Options:  vocabContent.Options,
-			}
+		contentJSON, err = json.Marshal(db.TaskVocabRecallContent{
+			Question: freeTextMeaning(vocabItem),
+			FreeText: true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling free-text vocab content: %w", err)
+		}
+	} else if taskType == db.TaskTypeVocabRecall {
+		// For vocab recall tasks, extract and store just the answer letter
+		var vocabContent db.TaskVocabRecallContent
 
-			// Marshal again without the correct answer
-			contentJSON, err = json.Marshal(sanitizedContent)
-			if err != nil {
-				log.Printf("Error marshaling sanitized vocab content for card %s: %v", card.ID, err)
-				continue
-			}
+		if err := json.Unmarshal(rawContentJSON, &vocabContent); err != nil {
+			return nil, fmt.Errorf("error parsing vocab content: %w", err)
+		}
 
-		} else if taskType == db.TaskTypeSentenceTranslation {
-			// For sentence translation tasks, extract the native sentence as correct answer
-			var translationContent db.TaskSentenceTranslationContent
+		// Store just the answer letter (A, B, C, D)
+		correctAnswer = vocabContent.CorrectAnswer
+
+		// Create a content version without the correct answer field
+		sanitizedContent := struct {
+			Question string `json:"question"`
+			Options  struct {
+				A string `json:"a"`
+				B string `json:"b"`
+				C string `json:"c"`
+				D string `json:"d"`
+			} `json:"options"`
+		}{
+			Question: targetWord,
+			Options:  vocabContent.Options,
+		}
 
-			if err := json.Unmarshal(rawContentJSON, &translationContent); err != nil {
-				log.Printf("Error parsing translation content for card %s: %v", card.ID, err)
-				continue
-			}
+		// Marshal again without the correct answer
+		contentJSON, err = json.Marshal(sanitizedContent)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling sanitized vocab content: %w", err)
+		}
 
-			// Store the native sentence as the correct answer
-			correctAnswer = translationContent.SentenceNative
+	} else if taskType == db.TaskTypeSentenceTranslation {
+		// For sentence translation tasks, extract the native sentence as correct answer
+		var translationContent db.TaskSentenceTranslationContent
 
-			// Create sanitized content with only the Russian sentence
-			sanitizedContent := struct {
-				SentenceRu string `json:"sentence_ru"`
-			}{
-				SentenceRu: translationContent.SentenceRu,
-			}
+		if err := json.Unmarshal(rawContentJSON, &translationContent); err != nil {
+			return nil, fmt.Errorf("error parsing translation content: %w", err)
+		}
 
-			// Marshal again with only the Russian part
-			contentJSON, err = json.Marshal(sanitizedContent)
-			if err != nil {
-				log.Printf("Error marshaling sanitized translation content for card %s: %v", card.ID, err)
-				continue
-			}
-		} else if taskType == db.TaskTypeAudio {
-			// For audio listening tasks, extract and store the correct answer
-			var content db.TaskAudioContent
+		// Store the native sentence as the correct answer
+		correctAnswer = translationContent.SentenceNative
 
-			if err := json.Unmarshal(rawContentJSON, &content); err != nil {
-				log.Printf("Error parsing audio content for card %s: %v", card.ID, err)
-				continue
-			}
+		// Create sanitized content with only the Russian sentence
+		sanitizedContent := struct {
+			SentenceRu string `json:"sentence_ru"`
+		}{
+			SentenceRu: translationContent.SentenceRu,
+		}
 
-			// Store just the answer letter (a, b, c, d)
-			correctAnswer = content.CorrectAnswer
+		// Marshal again with only the Russian part
+		contentJSON, err = json.Marshal(sanitizedContent)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling sanitized translation content: %w", err)
+		}
+	} else if taskType == db.TaskTypeAudio {
+		// For audio listening tasks, extract and store the correct answer
+		var content db.TaskAudioContent
+
+		if err := json.Unmarshal(rawContentJSON, &content); err != nil {
+			return nil, fmt.Errorf("error parsing audio content: %w", err)
+		}
+
+		// Store just the answer letter (a, b, c, d)
+		correctAnswer = content.CorrectAnswer
+
+		// Strip furigana brackets from the story and generate audio at the user's listening pace
+		cleanStory := utils.RemoveFurigana(content.Story)
+		rate := db.DefaultTaskAudioRate
+		if settings, err := tg.storage.GetUserSettings(card.UserID); err != nil {
+			log.Printf("Error getting task audio rate for user %s: %v", card.UserID, err)
+		} else {
+			rate = db.ResolveTaskAudioRate(settings)
+		}
 
-			// Strip furigana brackets from the story and generate audio
-			cleanStory := utils.RemoveFurigana(content.Story)
-			tempFilePath, err := tg.aiClient.GenerateAudio(ctx, cleanStory, vocabItem.LanguageCode)
+		tempFilePath, err := tg.aiClient.GenerateAudio(ctx, ai.WithSpeakingRate(cleanStory, rate), vocabItem.LanguageCode)
+		if err != nil {
+			log.Printf("Error generating audio for task card %s: %v", card.ID, err)
+			// Continue without audio, we'll just have text
+		} else if tempFilePath != "" {
+			// Open the temp file
+			tempFile, err := os.Open(tempFilePath)
 			if err != nil {
-				log.Printf("Error generating audio for task card %s: %v", card.ID, err)
-				// Continue without audio, we'll just have text
-			} else if tempFilePath != "" {
-				// Open the temp file
-				tempFile, err := os.Open(tempFilePath)
+				log.Printf("Error opening temp audio file for task card %s: %v", card.ID, err)
+			} else {
+				defer tempFile.Close()
+				defer os.Remove(tempFilePath)
+
+				// Upload to S3
+				audioFileName := fmt.Sprintf("tasks/%s_audio.wav", card.ID)
+				audioURL, err := tg.storageProvider.UploadFile(
+					ctx,
+					tempFile,
+					audioFileName,
+					"audio/wav",
+				)
 				if err != nil {
-					log.Printf("Error opening temp audio file for task card %s: %v", card.ID, err)
+					log.Printf("Error uploading audio for task card %s: %v", card.ID, err)
 				} else {
-					defer tempFile.Close()
-					defer os.Remove(tempFilePath)
-
-					// Upload to S3
-					audioFileName := fmt.Sprintf("tasks/%s_audio.wav", card.ID)
-					audioURL, err := tg.storageProvider.UploadFile(
-						ctx,
-						tempFile,
-						audioFileName,
-						"audio/wav",
-					)
-					if err != nil {
-						log.Printf("Error uploading audio for task card %s: %v", card.ID, err)
-					} else {
-						content.AudioURL = audioURL
-					}
+					content.AudioURL = audioURL
 				}
 			}
+		}
 
-			sanitizedContent := struct {
-				Story    string `json:"story"`
-				Question string `json:"question"`
-				Options  struct {
-					A string `json:"a"`
-					B string `json:"b"`
-					C string `json:"c"`
-					D string `json:"d"`
-				} `json:"options"`
-				AudioURL string `json:"audio_url,omitempty"`
-			}{
-				Options:  content.Options,
-				Question: content.Question,
-				Story:    cleanStory, // Use the clean story without furigana
-				AudioURL: content.AudioURL,
-			}
+		sanitizedContent := struct {
+			Story    string `json:"story"`
+			Question string `json:"question"`
+			Options  struct {
+				A string `json:"a"`
+				B string `json:"b"`
+				C string `json:"c"`
+				D string `json:"d"`
+			} `json:"options"`
+			AudioURL string `json:"audio_url,omitempty"`
+		}{
+			Options:  content.Options,
+			Question: content.Question,
+			Story:    cleanStory, // Use the clean story without furigana
+			AudioURL: content.AudioURL,
+		}
 
-			// Marshal again without the correct answer
-			contentJSON, err = json.Marshal(sanitizedContent)
-			if err != nil {
-				log.Printf("Error marshaling sanitized audio content for card %s: %v", card.ID, err)
-				continue
-			}
-		} else {
-			// For any other task types
-			contentJSON = rawContentJSON
+		// Marshal again without the correct answer
+		contentJSON, err = json.Marshal(sanitizedContent)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling sanitized audio content: %w", err)
 		}
+	} else {
+		// For any other task types
+		contentJSON = rawContentJSON
+	}
+
+	// Add task to database
+	task := db.Task{
+		Type:    taskType,
+		Content: string(contentJSON),
+		Answer:  correctAnswer,
+		CardID:  &card.ID,
+		UserID:  card.UserID,
+	}
+	created, err := tg.storage.AddTask(ctx, &task)
+	if err != nil {
+		return nil, fmt.Errorf("error saving task: %w", err)
+	}
+
+	return created, nil
+}
+
+// ErrDailyTaskLimitReached means the user already got as many tasks today as their settings allow
+var ErrDailyTaskLimitReached = errors.New("daily task limit reached")
+
+// GenerateDeckTasks generates up to count tasks right away for review cards of a deck that got no task
+// today, picking task types the user enabled and stopping at the user's daily task limit
+func (tg *TaskGenerator) GenerateDeckTasks(ctx context.Context, userID, deckID string, count int) ([]db.Task, error) {
+	user, err := tg.storage.GetUserByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting user: %w", err)
+	}
 
-		// Add task to database
-		task := db.Task{
-			Type:    taskType,
-			Content: string(contentJSON),
-			Answer:  correctAnswer,
-			CardID:  &card.ID,
-			UserID:  card.UserID,
+	settings := user.Settings
+	if settings == nil {
+		settings = db.DefaultUserSettings()
+	}
+
+	maxPerDay := settings.MaxTasksPerDay
+	if maxPerDay <= 0 {
+		maxPerDay = db.DefaultUserSettings().MaxTasksPerDay
+	}
+
+	taskTypes := settings.TaskTypes
+	if len(taskTypes) == 0 {
+		taskTypes = db.DefaultUserSettings().TaskTypes
+	}
+
+	createdToday, err := tg.storage.CountTasksCreatedToday(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if createdToday >= maxPerDay {
+		return nil, ErrDailyTaskLimitReached
+	}
+	count = min(count, maxPerDay-createdToday)
+
+	cards, err := tg.storage.GetDeckCardsForTaskGeneration(userID, deckID, count)
+	if err != nil {
+		return nil, err
+	}
+
+	audioEnabled := make(map[string]bool)
+	tasks := make([]db.Task, 0, len(cards))
+	var lastErr error
+
+	for _, card := range cards {
+		taskType := taskTypes[rand.Intn(len(taskTypes))]
+
+		task, err := tg.generateTaskForCard(ctx, card, taskType, audioEnabled)
+		if errors.Is(err, ErrCardUnsupported) {
+			continue
 		}
-		_, err = tg.storage.AddTask(ctx, &task)
 		if err != nil {
-			log.Printf("Error saving task for card %s: %v", card.ID, err)
+			log.Printf("Error generating task for card %s: %v", card.ID, err)
+			lastErr = err
 			continue
 		}
 
-		log.Printf("Successfully generated %s task for card %s (user %s)", taskType, card.ID, card.UserID)
+		tasks = append(tasks, *task)
+	}
+
+	// a single bad card shouldn't fail the request, but an unreachable AI provider should
+	if len(tasks) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+
+	return tasks, nil
+}
+
+// generateTasks finds cards in review state that need tasks and generates them
+func (tg *TaskGenerator) generateTasks() {
+	// Use non-blocking send to check if another job is already running
+	select {
+	case tg.runningLock <- struct{}{}: // Acquired the lock
+		defer func() { <-tg.runningLock }() // Release the lock when we're done
+	default:
+		// Another job is already running, exit without doing anything
+		log.Println("Task generation job already running, skipping this execution")
+		return
+	}
+
+	log.Println("Running task generation job")
+
+	startedAt := time.Now()
+	run := TaskGeneratorRun{StartedAt: &startedAt}
+	defer func() {
+		run.DurationMs = time.Since(startedAt).Milliseconds()
+		tg.recordRun(run)
+	}()
+
+	// fail logs an error that cost a card its task and counts it in the run status
+	fail := func(format string, args ...interface{}) {
+		run.Errors++
+		run.LastError = fmt.Sprintf(format, args...)
+		log.Print(run.LastError)
+	}
+
+	// Get cards that have moved to review state today and need tasks
+	cards, err := tg.storage.GetCardsForTaskGeneration()
+	if err != nil {
+		fail("Error getting cards for task generation: %v", err)
+		return
+	}
+
+	log.Printf("Found %d cards that need tasks generated", len(cards))
+
+	// Remaining cards are picked up by the next pass since they still have no task for today
+	if tg.config.MaxCardsPerPass > 0 && len(cards) > tg.config.MaxCardsPerPass {
+		log.Printf("Limiting task generation pass to %d cards", tg.config.MaxCardsPerPass)
+		cards = cards[:tg.config.MaxCardsPerPass]
+	}
+
+	ctx := context.Background()
+	audioEnabled := make(map[string]bool)
+
+	for _, card := range cards {
+		run.CardsProcessed++
+
+		// Randomly choose between task types
+		// For now, we'll use a random distribution between task types
+		// This can be adjusted later based on user preferences or card type
+		taskType := db.TaskTypeVocabRecall
+
+		// Simple random selection - can be made more sophisticated later
+		rand := time.Now().Unix() % 3
+		if rand == 0 {
+			taskType = db.TaskTypeSentenceTranslation
+		} else if rand == 1 {
+			taskType = db.TaskTypeAudio
+		}
+
+		task, err := tg.generateTaskForCard(ctx, card, taskType, audioEnabled)
+		if errors.Is(err, ErrCardUnsupported) {
+			log.Printf("Skipping task generation for card %s, it has no term", card.ID)
+			if err := tg.storage.RecordTaskGenUnsupported(card, err.Error()); err != nil {
+				log.Printf("Error recording unsupported card %s: %v", card.ID, err)
+			}
+			continue
+		}
+		if err != nil {
+			fail("Error generating task for card %s: %v", card.ID, err)
+			if err := tg.storage.RecordTaskGenFailure(card, err.Error()); err != nil {
+				log.Printf("Error recording task generation failure for card %s: %v", card.ID, err)
+			}
+			continue
+		}
+
+		if err := tg.storage.ClearTaskGenFailures(card.ID, card.UserID); err != nil {
+			log.Printf("Error clearing task generation failures for card %s: %v", card.ID, err)
+		}
+
+		run.TasksCreated++
+		log.Printf("Successfully generated %s task for card %s (user %s)", task.Type, card.ID, card.UserID)
 	}
 
 	log.Println("Task generation job completed")
@@ -0,0 +1,374 @@
+package job
+
+import (
+	"atamagaii/internal/ai"
+	"atamagaii/internal/db"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaskGenerator_DefersFirstPass(t *testing.T) {
+	delay := 200 * time.Millisecond
+	tg := NewTaskGenerator(nil, nil, nil, nil, TaskGeneratorConfig{StartupDelay: delay})
+
+	ran := make(chan time.Time, 1)
+	tg.runPass = func() {
+		select {
+		case ran <- time.Now():
+		default:
+		}
+	}
+
+	started := time.Now()
+	go tg.Start()
+	defer tg.Stop()
+
+	select {
+	case <-ran:
+		t.Fatal("First pass should not run before the startup delay")
+	case <-time.After(delay / 2):
+	}
+
+	select {
+	case at := <-ran:
+		require.GreaterOrEqual(t, at.Sub(started), delay, "First pass ran before the configured delay")
+	case <-time.After(5 * delay):
+		t.Fatal("First pass did not run after the startup delay")
+	}
+}
+
+func TestTaskGenerator_StopDuringStartupDelay(t *testing.T) {
+	tg := NewTaskGenerator(nil, nil, nil, nil, TaskGeneratorConfig{StartupDelay: time.Hour})
+	tg.runPass = func() {
+		t.Error("First pass should not run once the generator is stopped")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		tg.Start()
+		close(done)
+	}()
+
+	tg.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return after Stop during the startup delay")
+	}
+}
+
+func TestTaskGenerator_StatusReflectsRun(t *testing.T) {
+	storage, err := db.ConnectDB(filepath.Join(t.TempDir(), "jobs.db"))
+	require.NoError(t, err)
+
+	tg := NewTaskGenerator(storage, nil, nil, nil, TaskGeneratorConfig{})
+	require.Nil(t, tg.Status().LastRun.StartedAt, "No run should be reported before the first pass")
+
+	tg.generateTasks()
+
+	status := tg.Status()
+	require.False(t, status.Running)
+	require.NotNil(t, status.LastRun.StartedAt)
+	require.Equal(t, 0, status.LastRun.CardsProcessed)
+	require.Equal(t, 0, status.LastRun.Errors)
+
+	// a broken database makes the pass fail before it gets to any card
+	require.NoError(t, storage.Close())
+	tg.generateTasks()
+
+	status = tg.Status()
+	require.Equal(t, 1, status.LastRun.Errors)
+	require.Contains(t, status.LastRun.LastError, "Error getting cards for task generation")
+}
+
+func TestTaskGenerator_PauseSkipsPasses(t *testing.T) {
+	tg := NewTaskGenerator(nil, nil, nil, nil, TaskGeneratorConfig{})
+
+	runs := 0
+	tg.runPass = func() { runs++ }
+
+	tg.tick()
+	require.Equal(t, 1, runs)
+
+	tg.Pause()
+	require.True(t, tg.Status().Paused)
+
+	tg.tick()
+	tg.tick()
+	require.Equal(t, 1, runs, "Paused generator should not run passes")
+
+	tg.Resume()
+	require.False(t, tg.Status().Paused)
+
+	tg.tick()
+	require.Equal(t, 2, runs)
+}
+
+func TestTaskTypeFor_FallsBackForBareCards(t *testing.T) {
+	bare := db.VocabularyItem{Term: "猫"}
+	full := db.VocabularyItem{Term: "猫", MeaningEn: "cat", ExampleNative: "猫がいる。"}
+
+	tests := []struct {
+		name         string
+		preferred    db.TaskType
+		item         db.VocabularyItem
+		audioEnabled bool
+		expected     db.TaskType
+		ok           bool
+	}{
+		{name: "bare card instead of translation", preferred: db.TaskTypeSentenceTranslation, item: bare, audioEnabled: true, expected: db.TaskTypeVocabRecall, ok: true},
+		{name: "bare card instead of audio", preferred: db.TaskTypeAudio, item: bare, audioEnabled: true, expected: db.TaskTypeVocabRecall, ok: true},
+		{name: "bare card vocab recall", preferred: db.TaskTypeVocabRecall, item: bare, audioEnabled: true, expected: db.TaskTypeVocabRecall, ok: true},
+		{name: "full card translation", preferred: db.TaskTypeSentenceTranslation, item: full, audioEnabled: true, expected: db.TaskTypeSentenceTranslation, ok: true},
+		{name: "full card audio", preferred: db.TaskTypeAudio, item: full, audioEnabled: true, expected: db.TaskTypeAudio, ok: true},
+		{name: "audio disabled", preferred: db.TaskTypeAudio, item: full, audioEnabled: false, expected: db.TaskTypeSentenceTranslation, ok: true},
+		{name: "no term", preferred: db.TaskTypeVocabRecall, item: db.VocabularyItem{MeaningEn: "cat"}, audioEnabled: true, ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taskType, ok := taskTypeFor(tt.preferred, tt.item, tt.audioEnabled)
+			require.Equal(t, tt.ok, ok)
+			if tt.ok {
+				require.Equal(t, tt.expected, taskType)
+			}
+		})
+	}
+}
+
+// fakeTaskAI returns canned task content per task type and writes a dummy audio file for stories
+type fakeTaskAI struct {
+	ai.AIClient
+	content map[db.TaskType]string
+	spoken  []string
+}
+
+func (f *fakeTaskAI) GenerateTask(_ context.Context, _, _ string, taskType db.TaskType) (*string, error) {
+	content := f.content[taskType]
+	return &content, nil
+}
+
+func (f *fakeTaskAI) GenerateAudio(_ context.Context, text string, _ string) (string, error) {
+	f.spoken = append(f.spoken, text)
+	file, err := os.CreateTemp("", "task-audio-*.wav")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString("RIFF")
+	return file.Name(), err
+}
+
+// fakeUploader pretends to upload files and returns their would-be URL
+type fakeUploader struct {
+	uploaded []string
+}
+
+func (f *fakeUploader) UploadFile(_ context.Context, data io.Reader, filename string, _ string) (string, error) {
+	if _, err := io.ReadAll(data); err != nil {
+		return "", err
+	}
+	f.uploaded = append(f.uploaded, filename)
+	return "https://cdn.example.com/" + filename, nil
+}
+
+func (f *fakeUploader) GetFileURL(filename string) (string, error) {
+	return "https://cdn.example.com/" + filename, nil
+}
+
+func TestGenerateTaskForCard_SanitizesAnswer(t *testing.T) {
+	storage, err := db.ConnectDB(filepath.Join(t.TempDir(), "tasks.db"))
+	require.NoError(t, err)
+	defer storage.Close()
+
+	user := &db.User{ID: "task-user", TelegramID: 1, LanguageCode: "en"}
+	require.NoError(t, storage.SaveUser(user))
+
+	deck, err := storage.CreateDeck(user.ID, db.CreateDeckParams{Name: "Task Deck", Level: "N5", LanguageCode: "jp", TranscriptionType: "furigana"})
+	require.NoError(t, err)
+
+	fields := `{"term":"猫","meaning_en":"cat","example_native":"猫が寝ている。","language_code":"jp"}`
+	require.NoError(t, storage.AddCardsInBatch(user.ID, deck.ID, []string{fields}, db.DefaultCardBatchSize))
+
+	cards, err := storage.GetCardsByDeckID(deck.ID, user.ID)
+	require.NoError(t, err)
+	require.Len(t, cards, 1)
+	card := cards[0]
+
+	aiClient := &fakeTaskAI{content: map[db.TaskType]string{
+		db.TaskTypeVocabRecall:         `{"question":"?","options":{"a":"dog","b":"bird","c":"cat","d":"fish"},"correct_answer":"c"}`,
+		db.TaskTypeSentenceTranslation: `{"sentence_ru":"Кошка спит.","sentence_native":"猫が寝ている。"}`,
+		db.TaskTypeAudio:               `{"story":"猫[ねこ]が寝[ね]ている。","question":"Who is sleeping?","options":{"a":"a cat","b":"a dog","c":"a bird","d":"nobody"},"correct_answer":"a"}`,
+	}}
+	uploader := &fakeUploader{}
+	tg := NewTaskGenerator(storage, aiClient, uploader, nil, TaskGeneratorConfig{})
+
+	tests := []struct {
+		taskType db.TaskType
+		answer   string
+		hidden   string
+		check    func(t *testing.T, content map[string]any)
+	}{
+		{
+			taskType: db.TaskTypeVocabRecall,
+			answer:   "c",
+			hidden:   "correct_answer",
+			check: func(t *testing.T, content map[string]any) {
+				require.Equal(t, "猫 (cat)", content["question"], "Question should be the card's term")
+				require.Contains(t, content, "options")
+			},
+		},
+		{
+			taskType: db.TaskTypeSentenceTranslation,
+			answer:   "猫が寝ている。",
+			hidden:   "sentence_native",
+			check: func(t *testing.T, content map[string]any) {
+				require.Equal(t, "Кошка спит.", content["sentence_ru"])
+			},
+		},
+		{
+			taskType: db.TaskTypeAudio,
+			answer:   "a",
+			hidden:   "correct_answer",
+			check: func(t *testing.T, content map[string]any) {
+				require.Equal(t, "猫が寝ている。", content["story"], "Furigana should be stripped from the story")
+				require.Equal(t, "https://cdn.example.com/tasks/"+card.ID+"_audio.wav", content["audio_url"])
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.taskType), func(t *testing.T) {
+			task, err := tg.GenerateTaskForCard(context.Background(), card, tt.taskType)
+			require.NoError(t, err)
+			require.Equal(t, tt.taskType, task.Type)
+			require.Equal(t, tt.answer, task.Answer)
+			require.NotContains(t, task.Content, tt.hidden, "Correct answer must not leak into the content")
+
+			stored, err := storage.GetTask(task.ID)
+			require.NoError(t, err)
+			require.Equal(t, tt.answer, stored.Answer)
+
+			var content map[string]any
+			require.NoError(t, json.Unmarshal([]byte(stored.Content), &content))
+			tt.check(t, content)
+		})
+	}
+
+	require.Len(t, uploader.uploaded, 1, "Only the listening task should upload audio")
+}
+
+func TestGenerateTaskForCard_TaskAudioRate(t *testing.T) {
+	storage, err := db.ConnectDB(filepath.Join(t.TempDir(), "tasks.db"))
+	require.NoError(t, err)
+	defer storage.Close()
+
+	user := &db.User{ID: "listener", TelegramID: 1, LanguageCode: "en"}
+	require.NoError(t, storage.SaveUser(user))
+
+	deck, err := storage.CreateDeck(user.ID, db.CreateDeckParams{Name: "Listening Deck", Level: "N5", LanguageCode: "jp", TranscriptionType: "furigana"})
+	require.NoError(t, err)
+
+	fields := `{"term":"猫","meaning_en":"cat","example_native":"猫が寝ている。","language_code":"jp"}`
+	require.NoError(t, storage.AddCardsInBatch(user.ID, deck.ID, []string{fields}, db.DefaultCardBatchSize))
+
+	cards, err := storage.GetCardsByDeckID(deck.ID, user.ID)
+	require.NoError(t, err)
+	require.Len(t, cards, 1)
+
+	aiClient := &fakeTaskAI{content: map[db.TaskType]string{
+		db.TaskTypeAudio: `{"story":"猫[ねこ]が寝[ね]ている。","question":"Who is sleeping?","options":{"a":"a cat","b":"a dog","c":"a bird","d":"nobody"},"correct_answer":"a"}`,
+	}}
+	tg := NewTaskGenerator(storage, aiClient, &fakeUploader{}, nil, TaskGeneratorConfig{})
+
+	_, err = tg.GenerateTaskForCard(context.Background(), cards[0], db.TaskTypeAudio)
+	require.NoError(t, err)
+
+	stored, err := storage.GetUserByID(user.ID)
+	require.NoError(t, err)
+	stored.Settings.TaskAudioRate = 0.6
+	require.NoError(t, storage.UpdateUser(stored))
+
+	_, err = tg.GenerateTaskForCard(context.Background(), cards[0], db.TaskTypeAudio)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{
+		`<prosody rate="80%">猫が寝ている。</prosody>`,
+		`<prosody rate="60%">猫が寝ている。</prosody>`,
+	}, aiClient.spoken, "Task audio should be slowed down to the user's task rate")
+
+	require.Equal(t, "猫が寝ている。", ai.WithSpeakingRate("猫が寝ている。", 1), "Card audio rate should leave the text untouched")
+}
+
+func TestDeckAudioEnabled_CachesPerPass(t *testing.T) {
+	storage, err := db.ConnectDB(filepath.Join(t.TempDir(), "tasks.db"))
+	require.NoError(t, err)
+	defer storage.Close()
+
+	user := &db.User{ID: "listener", TelegramID: 1, LanguageCode: "en"}
+	require.NoError(t, storage.SaveUser(user))
+
+	deck, err := storage.CreateDeck(user.ID, db.CreateDeckParams{Name: "Listening Deck", Level: "N5", LanguageCode: "jp", TranscriptionType: "furigana"})
+	require.NoError(t, err)
+
+	tg := NewTaskGenerator(storage, nil, nil, nil, TaskGeneratorConfig{})
+	cache := make(map[string]bool)
+	require.True(t, tg.deckAudioEnabled(deck.ID, cache))
+
+	deck.GenerateAudio = false
+	require.NoError(t, storage.UpdateDeckSettings(deck.ID, deck))
+
+	require.True(t, tg.deckAudioEnabled(deck.ID, cache), "A pass should reuse the deck's cached audio setting")
+	require.False(t, tg.deckAudioEnabled(deck.ID, make(map[string]bool)), "The next pass should see the new setting")
+}
+
+// flagWordModerator flags any text that contains word
+type flagWordModerator struct {
+	word string
+}
+
+func (m flagWordModerator) IsFlagged(_ context.Context, text string) (bool, error) {
+	return strings.Contains(text, m.word), nil
+}
+
+func TestGenerateTaskForCard_ModeratesContent(t *testing.T) {
+	storage, err := db.ConnectDB(filepath.Join(t.TempDir(), "tasks.db"))
+	require.NoError(t, err)
+	defer storage.Close()
+
+	user := &db.User{ID: "task-user", TelegramID: 1, LanguageCode: "en"}
+	require.NoError(t, storage.SaveUser(user))
+
+	deck, err := storage.CreateDeck(user.ID, db.CreateDeckParams{Name: "Task Deck", Level: "N5", LanguageCode: "jp", TranscriptionType: "furigana"})
+	require.NoError(t, err)
+
+	fields := `{"term":"猫","meaning_en":"cat","example_native":"猫が寝ている。","language_code":"jp"}`
+	require.NoError(t, storage.AddCardsInBatch(user.ID, deck.ID, []string{fields}, db.DefaultCardBatchSize))
+
+	cards, err := storage.GetCardsByDeckID(deck.ID, user.ID)
+	require.NoError(t, err)
+	require.Len(t, cards, 1)
+
+	aiClient := &fakeTaskAI{content: map[db.TaskType]string{
+		db.TaskTypeSentenceTranslation: `{"sentence_ru":"Кошка спит.","sentence_native":"猫が寝ている。"}`,
+		db.TaskTypeAudio:               `{"story":"猫が酒を飲んでいる。","question":"What is the cat doing?","options":{"a":"drinking","b":"sleeping","c":"eating","d":"running"},"correct_answer":"a"}`,
+	}}
+	tg := NewTaskGenerator(storage, aiClient, &fakeUploader{}, flagWordModerator{word: "酒"}, TaskGeneratorConfig{})
+
+	_, err = tg.GenerateTaskForCard(context.Background(), cards[0], db.TaskTypeAudio)
+	require.ErrorIs(t, err, ai.ErrContentFlagged)
+	require.Empty(t, aiClient.spoken, "Flagged content should not be voiced")
+
+	task, err := tg.GenerateTaskForCard(context.Background(), cards[0], db.TaskTypeSentenceTranslation)
+	require.NoError(t, err, "Clean content should pass the moderator")
+	require.Equal(t, db.TaskTypeSentenceTranslation, task.Type)
+}
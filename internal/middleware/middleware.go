@@ -42,9 +42,16 @@ func CustomHTTPErrorHandler(logger *slog.Logger) echo.HTTPErrorHandler {
 			slog.String("method", c.Request().Method),
 		}
 
-		if msgStr, ok := message.(string); ok {
-			logAttrs = append(logAttrs, slog.String("message", msgStr))
-			message = map[string]interface{}{"error": msgStr}
+		switch msg := message.(type) {
+		case string:
+			logAttrs = append(logAttrs, slog.String("message", msg))
+			message = contract.ErrorResponse{Error: msg, Code: contract.ErrorCodeForStatus(statusCode)}
+		case contract.ErrorResponse:
+			logAttrs = append(logAttrs, slog.String("message", msg.Error))
+			if msg.Code == "" {
+				msg.Code = contract.ErrorCodeForStatus(statusCode)
+			}
+			message = msg
 		}
 
 		if internalErr != nil {
@@ -66,6 +73,56 @@ func CustomHTTPErrorHandler(logger *slog.Logger) echo.HTTPErrorHandler {
 	}
 }
 
+// DefaultAIRequestTimeout is used by AIDeadline when no timeout is configured
+const DefaultAIRequestTimeout = 60 * time.Second
+
+// AIDeadline bounds how long a handler may wait on the AI provider. The request context gets a deadline,
+// and once it expires the handler's error is replaced with 504 regardless of how it was wrapped.
+func AIDeadline(timeout time.Duration) echo.MiddlewareFunc {
+	if timeout <= 0 {
+		timeout = DefaultAIRequestTimeout
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+			defer cancel()
+
+			c.SetRequest(c.Request().WithContext(ctx))
+
+			err := next(c)
+			if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return echo.NewHTTPError(http.StatusGatewayTimeout, contract.ErrorResponse{Error: "AI provider did not respond in time", Code: contract.ErrorCodeAITimeout}).WithInternal(err)
+			}
+
+			return err
+		}
+	}
+}
+
+// RequireAdmin rejects requests whose JWT wasn't issued to an admin. It must run after the JWT middleware.
+func RequireAdmin() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token, ok := c.Get("user").(*jwt.Token)
+			if !ok || token == nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid token")
+			}
+
+			claims, ok := token.Claims.(*contract.JWTClaims)
+			if !ok || claims == nil || claims.UID == "" {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid token")
+			}
+
+			if !claims.IsAdmin {
+				return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+			}
+
+			return next(c)
+		}
+	}
+}
+
 func GetUserAuthConfig(secret string) echojwt.Config {
 	return echojwt.Config{
 		NewClaimsFunc: func(_ echo.Context) jwt.Claims {
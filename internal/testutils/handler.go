@@ -5,6 +5,7 @@ import (
 	"atamagaii/internal/contract"
 	"atamagaii/internal/db"
 	"atamagaii/internal/handler"
+	"atamagaii/internal/job"
 	"atamagaii/internal/middleware"
 	"context"
 	"encoding/json"
@@ -19,6 +20,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -27,21 +29,138 @@ var (
 	dbStorage *db.Storage
 )
 
-// MockStorageProvider implements storage.Provider for testing
-type MockStorageProvider struct{}
+// MockStorageProvider implements storage.Provider for testing and records uploaded file names
+type MockStorageProvider struct {
+	mu      sync.Mutex
+	uploads []string
+}
 
 // UploadFile implements storage.Provider.UploadFile
 func (m *MockStorageProvider) UploadFile(ctx context.Context, data io.Reader, filename string, contentType string) (string, error) {
+	m.mu.Lock()
+	m.uploads = append(m.uploads, filename)
+	m.mu.Unlock()
+
 	// Return a mock URL for testing
 	return fmt.Sprintf("https://test-storage.example.com/%s", filename), nil
 }
 
+// Uploads returns the names of all files uploaded so far
+func (m *MockStorageProvider) Uploads() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.uploads...)
+}
+
 // GetFileURL implements storage.Provider.GetFileURL
 func (m *MockStorageProvider) GetFileURL(filename string) (string, error) {
 	// Return a mock URL for testing
 	return fmt.Sprintf("https://test-storage.example.com/%s", filename), nil
 }
 
+// MockAIClient implements ai.AIClient for testing; set the func fields to override the defaults
+type MockAIClient struct {
+	GenerateCardContentFunc   func(ctx context.Context, term string, language string, opts ai.CardGenerationOptions) (*contract.CardFields, error)
+	GenerateTaskFunc          func(ctx context.Context, language, knownWords string, taskType db.TaskType) (*string, error)
+	GenerateAudioFunc         func(ctx context.Context, text string, language string) (string, error)
+	GenerateTranscriptionFunc func(ctx context.Context, term, example, transcriptionType string) (*ai.TranscriptionResult, error)
+	CheckTranslationFunc      func(ctx context.Context, sentenceRu, correctAnswer, userAnswer string, languageCode string) (*ai.TranslationCheckResult, error)
+}
+
+func (m *MockAIClient) GenerateCardContent(ctx context.Context, term string, language string, opts ai.CardGenerationOptions) (*contract.CardFields, error) {
+	if m.GenerateCardContentFunc != nil {
+		return m.GenerateCardContentFunc(ctx, term, language, opts)
+	}
+	fields := &contract.CardFields{
+		Term:          term,
+		MeaningEn:     "meaning",
+		MeaningRu:     "значение",
+		ExampleNative: term + "です。",
+		ExampleEn:     "This is an example.",
+		ExampleRu:     "Это пример.",
+	}
+	if opts.ExampleCount > 1 {
+		fields.Examples = append(fields.Examples, contract.CardExample{Native: fields.ExampleNative, En: fields.ExampleEn, Ru: fields.ExampleRu})
+		for i := 1; i < opts.ExampleCount; i++ {
+			fields.Examples = append(fields.Examples, contract.CardExample{Native: fmt.Sprintf("%s%d。", term, i+1), En: "Another example.", Ru: "Ещё пример."})
+		}
+	}
+	return fields, nil
+}
+
+func (m *MockAIClient) GenerateTask(ctx context.Context, language, knownWords string, taskType db.TaskType) (*string, error) {
+	if m.GenerateTaskFunc != nil {
+		return m.GenerateTaskFunc(ctx, language, knownWords, taskType)
+	}
+	content := `{}`
+	return &content, nil
+}
+
+func (m *MockAIClient) GenerateAudio(ctx context.Context, text string, language string) (string, error) {
+	if m.GenerateAudioFunc != nil {
+		return m.GenerateAudioFunc(ctx, text, language)
+	}
+	f, err := os.CreateTemp("", "audio-*.wav")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return f.Name(), nil
+}
+
+func (m *MockAIClient) CheckSentenceTranslation(ctx context.Context, sentenceRu, correctAnswer, userAnswer string, languageCode string) (*ai.TranslationCheckResult, error) {
+	if m.CheckTranslationFunc != nil {
+		return m.CheckTranslationFunc(ctx, sentenceRu, correctAnswer, userAnswer, languageCode)
+	}
+	return &ai.TranslationCheckResult{Score: 100}, nil
+}
+
+func (m *MockAIClient) ParseCSVFields(ctx context.Context, line string) (ai.CSVToJSONFields, error) {
+	return ai.CSVToJSONFields{}, nil
+}
+
+func (m *MockAIClient) CheckQuestionAnswer(ctx context.Context, question, answer, languageCode string) (*ai.QuestionCheckResult, error) {
+	return &ai.QuestionCheckResult{Score: 100}, nil
+}
+
+func (m *MockAIClient) GenerateTranscription(ctx context.Context, term, example, transcriptionType string) (*ai.TranscriptionResult, error) {
+	if m.GenerateTranscriptionFunc != nil {
+		return m.GenerateTranscriptionFunc(ctx, term, example, transcriptionType)
+	}
+	result := &ai.TranscriptionResult{TermWithTranscription: term + "[reading]"}
+	if example != "" {
+		result.ExampleWithTranscription = example + "[reading]"
+	}
+	return result, nil
+}
+
+func (m *MockAIClient) CheckStoryQuestionAnswer(ctx context.Context, story, question, userAnswer string, languageCode string) (*ai.StoryQuestionCheckResult, error) {
+	return &ai.StoryQuestionCheckResult{Score: 100}, nil
+}
+
+// MockModerator implements ai.Moderator, flagging any text that contains FlagWord
+type MockModerator struct {
+	FlagWord string
+	Calls    int
+}
+
+func (m *MockModerator) IsFlagged(_ context.Context, text string) (bool, error) {
+	m.Calls++
+	return m.FlagWord != "" && strings.Contains(text, m.FlagWord), nil
+}
+
+// HandlerOptions overrides the default dependencies used by SetupHandlerDependencies
+type HandlerOptions struct {
+	AIClient         ai.AIClient
+	Moderator        ai.Moderator
+	AITimeout        time.Duration
+	StorageProvider  *MockStorageProvider
+	AdminTelegramIDs []int64
+	TaskGenerator    *job.TaskGenerator
+	WebhookSecret    string
+	LogGenerations   bool
+}
+
 type CustomValidator struct {
 	validator *validator.Validate
 }
@@ -96,7 +215,7 @@ func setupTestDB(ctx context.Context) (*db.Storage, func(), error) {
 	return storage, cleanup, nil
 }
 
-func SetupHandlerDependencies(t *testing.T) *echo.Echo {
+func SetupHandlerDependencies(t *testing.T, opts ...HandlerOptions) *echo.Echo {
 	var bot *telegram.Bot
 
 	// Initialize DB for tests
@@ -114,10 +233,36 @@ func SetupHandlerDependencies(t *testing.T) *echo.Echo {
 		}
 	}
 
+	var options HandlerOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+
 	// Create a mock storage provider for testing
-	mockStorage := &MockStorageProvider{}
+	mockStorage := options.StorageProvider
+	if mockStorage == nil {
+		mockStorage = &MockStorageProvider{}
+	}
+
+	if options.AIClient == nil {
+		options.AIClient = &MockAIClient{}
+	}
 
-	h := handler.New(bot, dbStorage, "hello-world", TestBotToken, mockStorage)
+	h := handler.New(handler.Config{
+		Bot:              bot,
+		DB:               dbStorage,
+		JWTSecret:        "hello-world",
+		BotToken:         TestBotToken,
+		WebAppURL:        "https://webapp.example.com",
+		StorageProvider:  mockStorage,
+		AIClient:         options.AIClient,
+		Moderator:        options.Moderator,
+		AITimeout:        options.AITimeout,
+		TaskGenerator:    options.TaskGenerator,
+		LogGenerations:   options.LogGenerations,
+		AdminTelegramIDs: options.AdminTelegramIDs,
+		WebhookSecret:    options.WebhookSecret,
+	})
 
 	e := echo.New()
 
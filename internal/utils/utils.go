@@ -2,9 +2,13 @@ package utils
 
 import (
 	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"html"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"unicode"
 )
 
 func FindDirUp(dirName string, maxDepth int) (string, error) {
@@ -24,37 +28,73 @@ func FindDirUp(dirName string, maxDepth int) (string, error) {
 	return "", fmt.Errorf("directory %q not found within %d levels up", dirName, maxDepth)
 }
 
-func GetLanguageNameFromCode(code string) string {
-	languages := map[string]string{
-		"jp": "Japanese",
-		"en": "English",
-		"es": "Spanish",
-		"ru": "Russian",
-		"ko": "Korean",
-		"fr": "French",
-		"de": "German",
-		"it": "Italian",
-		"pt": "Portuguese",
-		"ar": "Arabic",
-		"tr": "Turkish",
-		"th": "Thai",
-		"hi": "Hindi",
-		"ge": "Georgian",
-		"vi": "Vietnamese",
+var languageNames = map[string]string{
+	"jp": "Japanese",
+	"en": "English",
+	"es": "Spanish",
+	"ru": "Russian",
+	"ko": "Korean",
+	"zh": "Chinese",
+	"fr": "French",
+	"de": "German",
+	"it": "Italian",
+	"pt": "Portuguese",
+	"ar": "Arabic",
+	"tr": "Turkish",
+	"th": "Thai",
+	"hi": "Hindi",
+	"ge": "Georgian",
+	"vi": "Vietnamese",
+}
+
+// languageCodeAliases maps standard ISO codes to the codes used throughout the app
+var languageCodeAliases = map[string]string{
+	"ja": "jp",
+	"ka": "ge",
+}
+
+// NormalizeLanguageCode lowercases a language code and maps ISO codes like "ja" to the app's own ("jp")
+func NormalizeLanguageCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if alias, ok := languageCodeAliases[code]; ok {
+		return alias
 	}
+	return code
+}
 
-	if name, ok := languages[code]; ok {
+// LanguageCodeVariants returns the app's code for a language followed by the ISO codes normalizing to it,
+// so data stored under either code can be found, e.g. "jp" and "ja"
+func LanguageCodeVariants(code string) []string {
+	code = NormalizeLanguageCode(code)
+	variants := []string{code}
+	for iso, alias := range languageCodeAliases {
+		if alias == code {
+			variants = append(variants, iso)
+		}
+	}
+	return variants
+}
+
+func GetLanguageNameFromCode(code string) string {
+	if name, ok := languageNames[code]; ok {
 		return name
 	}
 	return "Unknown"
 }
 
+// IsKnownLanguageCode reports whether the language code is one we can name and generate content for
+func IsKnownLanguageCode(code string) bool {
+	_, ok := languageNames[code]
+	return ok
+}
+
 // GetDefaultTranscriptionType returns the default transcription type for the given language code
 func GetDefaultTranscriptionType(languageCode string) string {
 	switch languageCode {
 	case "jp":
 		return "furigana"
-
+	case "zh":
+		return "pinyin"
 	case "th":
 		return "thai_romanization"
 	case "ge":
@@ -64,6 +104,35 @@ func GetDefaultTranscriptionType(languageCode string) string {
 	}
 }
 
+// IsKnownTranscriptionType reports whether the transcription type is one of the supported ones
+func IsKnownTranscriptionType(transcriptionType string) bool {
+	switch transcriptionType {
+	case "furigana", "pinyin", "thai_romanization", "mkhedruli", "none":
+		return true
+	default:
+		return false
+	}
+}
+
+var (
+	htmlBreakPattern  = regexp.MustCompile(`(?i)</?(br|div|p|li|tr)\b[^>]*>`)
+	htmlTagPattern    = regexp.MustCompile(`</?[a-zA-Z][^>]*>`)
+	soundTagPattern   = regexp.MustCompile(`\[sound:[^\]]*\]`)
+	whitespacePattern = regexp.MustCompile(`\s+`)
+)
+
+// StripHTML turns a field exported with HTML, as Anki does, into plain text: line breaks and blocks become
+// spaces, other tags and [sound:...] references are removed, entities are decoded and whitespace collapsed.
+// For example: "猫<br>&nbsp;<b>ねこ</b>" -> "猫 ねこ"
+func StripHTML(text string) string {
+	text = soundTagPattern.ReplaceAllString(text, " ")
+	text = htmlBreakPattern.ReplaceAllString(text, " ")
+	text = htmlTagPattern.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	text = strings.ReplaceAll(text, "\u00a0", " ")
+	return strings.TrimSpace(whitespacePattern.ReplaceAllString(text, " "))
+}
+
 // RemoveFurigana removes furigana notation (text inside square brackets) from a string
 // For example: "今日[きょう]は良い[いい]天気[てんき]です" -> "今日は良い天気です"
 // Also handles nested brackets: "複雑[ふく[ざつ]]な例" -> "複雑な例"
@@ -80,3 +149,42 @@ func RemoveFurigana(text string) string {
 
 	return newText
 }
+
+// NormalizeTermForDedup returns the key two spellings of the same term share, so duplicates can be found
+// regardless of how a source wrote them: NFKC folds full-width and half-width forms together, case and
+// surrounding whitespace and punctuation are dropped, and Japanese terms also lose furigana and the spaces
+// Anki puts before it. NFKC runs first so furigana in full-width brackets is removed as well.
+func NormalizeTermForDedup(term, language string) string {
+	term = norm.NFKC.String(StripHTML(term))
+	if NormalizeLanguageCode(language) == "jp" {
+		term = strings.Join(strings.Fields(RemoveFurigana(term)), "")
+	}
+
+	term = strings.ToLower(strings.TrimSpace(term))
+	return strings.TrimFunc(term, func(r rune) bool {
+		return unicode.IsPunct(r) || unicode.IsSpace(r)
+	})
+}
+
+// DetectTranslationLanguage tells whether a translation is written in Russian ("ru") or English ("en")
+// by counting Cyrillic and Latin letters; it returns "" when the text has neither
+func DetectTranslationLanguage(text string) string {
+	cyrillic, latin := 0, 0
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
+	}
+
+	switch {
+	case cyrillic == 0 && latin == 0:
+		return ""
+	case cyrillic >= latin:
+		return "ru"
+	default:
+		return "en"
+	}
+}
@@ -44,3 +44,78 @@ func TestRemoveFurigana(t *testing.T) {
 		})
 	}
 }
+
+func TestDetectTranslationLanguage(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{input: "The cat is sleeping.", expected: "en"},
+		{input: "Кошка спит.", expected: "ru"},
+		{input: "Это NHK.", expected: "ru"},
+		{input: "猫が寝ている。", expected: ""},
+		{input: "", expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got := DetectTranslationLanguage(tt.input); got != tt.expected {
+				t.Errorf("DetectTranslationLanguage(%q) = %q, expected %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestStripHTML(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{input: "猫", expected: "猫"},
+		{input: "猫[ねこ]が寝[ね]ている", expected: "猫[ねこ]が寝[ね]ている"},
+		{input: "<div>猫が<b>寝ている</b>。</div>", expected: "猫が寝ている。"},
+		{input: "cat<br>kitty<br/>puss", expected: "cat kitty puss"},
+		{input: "&nbsp;Tom &amp; Jerry&nbsp;", expected: "Tom & Jerry"},
+		{input: `<span style="color: red">赤い</span>[sound:akai.mp3]`, expected: "赤い"},
+		{input: `<img src="cat.jpg">猫`, expected: "猫"},
+		{input: "1 < 2", expected: "1 < 2"},
+	}
+
+	for _, tt := range tests {
+		if result := StripHTML(tt.input); result != tt.expected {
+			t.Errorf("StripHTML(%q) = %q, want %q", tt.input, result, tt.expected)
+		}
+	}
+}
+
+func TestNormalizeTermForDedup(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     string
+		language string
+		same     bool
+	}{
+		{name: "Furigana embedded", a: "食べる", b: "食[た]べる", language: "jp", same: true},
+		{name: "Anki furigana spacing", a: "食べ物", b: " 食[た]べ 物[もの]", language: "jp", same: true},
+		{name: "Full-width latin", a: "ＣＤ", b: "cd", language: "jp", same: true},
+		{name: "Half-width katakana", a: "ｶﾀｶﾅ", b: "カタカナ", language: "jp", same: true},
+		{name: "Trailing punctuation", a: "ありがとう！", b: "ありがとう", language: "jp", same: true},
+		{name: "ISO language code", a: "食べる", b: "食[た]べる", language: "ja", same: true},
+		{name: "Case", a: "Hello", b: "hello.", language: "en", same: true},
+		{name: "Brackets kept outside Japanese", a: "run [verb]", b: "run", language: "en", same: false},
+		{name: "Different terms", a: "食べる", b: "飲む", language: "jp", same: false},
+		{name: "Leading whitespace", a: " word", b: "word", language: "en", same: true},
+		{name: "Leading full-width space", a: "\u3000word", b: "word", language: "en", same: true},
+		{name: "Leading punctuation", a: "¡hola!", b: "hola", language: "es", same: true},
+		{name: "Full-width furigana brackets", a: "食［た］べる", b: "食べる", language: "jp", same: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := NormalizeTermForDedup(tt.a, tt.language), NormalizeTermForDedup(tt.b, tt.language)
+			if (a == b) != tt.same {
+				t.Errorf("NormalizeTermForDedup(%q) = %q, NormalizeTermForDedup(%q) = %q, want same=%v", tt.a, a, tt.b, b, tt.same)
+			}
+		})
+	}
+}